@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const enableVirtualTerminalProcessing = 0x4
+
+// enableANSI turns on escape codes for the console f, which older windows
+// consoles need. it reports whether they work
+func enableANSI(f *os.File) bool {
+	console := syscall.Handle(f.Fd())
+	var mode uint32
+	if err := syscall.GetConsoleMode(console, &mode); err != nil {
+		return false
+	}
+	if mode&enableVirtualTerminalProcessing != 0 {
+		return true
+	}
+	ok, _, _ := setConsoleMode.Call(uintptr(console), uintptr(mode|enableVirtualTerminalProcessing))
+	return ok != 0
+}
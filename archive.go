@@ -0,0 +1,320 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// the formats archives can be written in. an archive's name ends in "." + its format,
+// which is how readers tell them apart
+var archiveFormats = []string{"tar.zstd", "tar.gz", "tar", "zip"}
+
+const defaultArchiveFormat = "tar.zstd"
+
+// formatOf returns the format of the archive at path
+func formatOf(path string) string {
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(path, "."+format) {
+			return format
+		}
+	}
+	return defaultArchiveFormat
+}
+
+func isArchiveFormat(format string) bool {
+	for _, f := range archiveFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter wraps w in the compression of a tar based format. dict is a
+// zstd dictionary to compress with, nil for none
+func compressWriter(w io.Writer, format string, dict []byte) (io.WriteCloser, error) {
+	switch format {
+	case "tar.zstd":
+		if dict != nil {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderDict(dict))
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	case "tar.gz":
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case "tar":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("%s archives can't be written as a stream", format)
+}
+
+// openArchive returns the decompressed contents of an archive: the data of stream
+// backups, or the tar stream of file backups. zip archives are read with readEntries
+func openArchive(path string) (io.ReadCloser, error) {
+	format := formatOf(path)
+	if format == "zip" {
+		return nil, errors.New("zip archives can't be read as a stream")
+	}
+
+	f, err := openArchiveData(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(f, copyBufferSize)
+
+	switch format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &decompressedFile{Reader: gz, file: f}, nil
+	case "tar":
+		return &decompressedFile{Reader: r, file: f}, nil
+	}
+
+	dec, err := getDecoder(r)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &decompressedFile{Reader: dec, file: f, dec: dec}, nil
+}
+
+type decompressedFile struct {
+	io.Reader
+	file archiveData
+	// returned to the pool on close
+	dec *zstd.Decoder
+}
+
+func (d *decompressedFile) Close() error {
+	if d.dec != nil {
+		putDecoder(d.dec)
+	}
+	return d.file.Close()
+}
+
+// readEntries calls fn with every entry of the archive at path in order. zip entries
+// are described with tar headers too. r holds the contents of regular files
+func readEntries(path string, fn func(header *tar.Header, r io.Reader) error) error {
+	if formatOf(path) == "zip" {
+		return readZipEntries(path, fn)
+	}
+
+	r, err := openArchive(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func readZipEntries(path string, fn func(header *tar.Header, r io.Reader) error) error {
+	f, err := openArchiveData(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := zip.NewReader(f, f.Size())
+	if err != nil {
+		return err
+	}
+
+	for _, file := range zr.File {
+		rc, err := file.Open()
+		if err != nil {
+			return err
+		}
+
+		// symlinks store their target as their contents
+		var link string
+		if file.Mode()&os.ModeSymlink != 0 {
+			target, err := io.ReadAll(rc)
+			if err != nil {
+				rc.Close()
+				return err
+			}
+			link = string(target)
+		}
+
+		header, err := tar.FileInfoHeader(file.FileInfo(), link)
+		if err == nil {
+			header.Name = strings.TrimSuffix(file.Name, "/")
+			err = fn(header, rc)
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveWriter writes the entries of a new archive
+type archiveWriter interface {
+	// WriteHeader writes an entry without contents, eg. a directory or symlink
+	WriteHeader(header *tar.Header) error
+	// WriteFile writes a regular file, passing its contents through hasher
+	WriteFile(header *tar.Header, file *os.File, info os.FileInfo, hasher hash.Hash) error
+	// WriteReader writes a regular file of header.Size bytes read from r, passing them through hasher
+	WriteReader(header *tar.Header, r io.Reader, hasher hash.Hash) error
+	// WriteData writes a regular file whose contents were already read
+	WriteData(header *tar.Header, data []byte) error
+	Close() error
+}
+
+func newArchiveWriter(w io.Writer, format string, dict []byte) (archiveWriter, error) {
+	if format == "zip" {
+		return &zipArchiveWriter{zw: zip.NewWriter(w)}, nil
+	}
+
+	comp, err := compressWriter(w, format, dict)
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchiveWriter{comp: comp, tw: tar.NewWriter(comp)}, nil
+}
+
+type tarArchiveWriter struct {
+	comp io.WriteCloser
+	tw   *tar.Writer
+}
+
+func (a *tarArchiveWriter) WriteHeader(header *tar.Header) error {
+	return a.tw.WriteHeader(header)
+}
+
+func (a *tarArchiveWriter) WriteFile(header *tar.Header, file *os.File, info os.FileInfo, hasher hash.Hash) error {
+	// files with holes only store the parts with data
+	regions, err := dataRegions(file, info)
+	if err != nil {
+		return err
+	}
+	if regions != nil && len(regions) <= maxSparseRegions {
+		return writeSparse(a.comp, a.tw, header, file, regions, hasher)
+	}
+
+	return a.WriteReader(header, file, hasher)
+}
+
+func (a *tarArchiveWriter) WriteReader(header *tar.Header, r io.Reader, hasher hash.Hash) error {
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	// a file that grew or shrank since the header was made still has to fill
+	// exactly header.Size, the missing part is stored as zeros
+	w := io.MultiWriter(a.tw, hasher)
+	n, err := copyBuffered(w, io.LimitReader(r, header.Size))
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffered(w, io.LimitReader(zeroReader{}, header.Size-n))
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func (a *tarArchiveWriter) WriteData(header *tar.Header, data []byte) error {
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := a.tw.Write(data)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		a.comp.Close()
+		return err
+	}
+	return a.comp.Close()
+}
+
+// zipArchiveWriter writes zip archives, which can't hold xattrs or sparse files
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) create(header *tar.Header) (io.Writer, error) {
+	zipHeader, err := zip.FileInfoHeader(header.FileInfo())
+	if err != nil {
+		return nil, err
+	}
+	zipHeader.Name = header.Name
+	if header.Typeflag == tar.TypeDir {
+		zipHeader.Name += "/"
+	} else {
+		zipHeader.Method = zip.Deflate
+	}
+	return a.zw.CreateHeader(zipHeader)
+}
+
+func (a *zipArchiveWriter) WriteHeader(header *tar.Header) error {
+	w, err := a.create(header)
+	if err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		_, err = io.WriteString(w, header.Linkname)
+	}
+	return err
+}
+
+func (a *zipArchiveWriter) WriteFile(header *tar.Header, file *os.File, info os.FileInfo, hasher hash.Hash) error {
+	return a.WriteReader(header, file, hasher)
+}
+
+func (a *zipArchiveWriter) WriteReader(header *tar.Header, r io.Reader, hasher hash.Hash) error {
+	w, err := a.create(header)
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffered(io.MultiWriter(w, hasher), r)
+	return err
+}
+
+func (a *zipArchiveWriter) WriteData(header *tar.Header, data []byte) error {
+	w, err := a.create(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
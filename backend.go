@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// integrations that aren't built in are executables named backman-backend-<kind>
+// on the PATH. a remote "<kind>:<arg>" or a backup target "<kind>:<arg>" runs
+// backman-backend-<kind> once per operation, as
+//
+//	backman-backend-<kind> <op> <arg> [name]
+//
+// with BACKMAN_PROTOCOL=1 in its environment. it exits with 0 on success, or
+// prints why it failed to stderr and exits with anything else. the operations:
+//
+//	ops            print the operations below that are supported, one per line
+//	put <name>     store stdin as name
+//	get <name>     write name to stdout
+//	list           print the name of every stored file, one per line
+//	delete <name>  delete name, succeeding if it doesn't exist
+//	dump           write what <arg> is as a tar stream to stdout, to back it up
+//
+// put, get, list and delete make it a storage backend for push, pull and sync,
+// dump a source that can be backed up
+
+const (
+	backendPrefix   = "backman-backend-"
+	backendProtocol = "1"
+)
+
+// backends are named like remotes, which leaves out windows drive letters
+var backendKind = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]+$`)
+
+// execBackend is an external backend found on the PATH, set up for one arg
+type execBackend struct {
+	Kind string
+	Path string
+	Arg  string
+	// the operations it supports
+	Ops []string
+}
+
+// findBackend looks up backman-backend-<kind> and asks which operations it supports
+func findBackend(kind, arg string) (*execBackend, error) {
+	if !backendKind.MatchString(kind) {
+		return nil, fmt.Errorf("%q isn't a backend name", kind)
+	}
+	path, err := exec.LookPath(backendPrefix + kind)
+	if err != nil {
+		return nil, err
+	}
+	b := &execBackend{Kind: kind, Path: path, Arg: arg}
+	var out bytes.Buffer
+	if err := b.run(nil, &out, "ops"); err != nil {
+		return nil, err
+	}
+	b.Ops = strings.Fields(out.String())
+	return b, nil
+}
+
+func (b *execBackend) Supports(op string) bool {
+	return slices.Contains(b.Ops, op)
+}
+
+func (b *execBackend) command(op string, args ...string) *exec.Cmd {
+	cmd := exec.Command(b.Path, append([]string{op, b.Arg}, args...)...)
+	cmd.Env = append(os.Environ(), "BACKMAN_PROTOCOL="+backendProtocol)
+	return cmd
+}
+
+// run runs op with stdin and stdout, the error has what the backend printed to stderr
+func (b *execBackend) run(stdin io.Reader, stdout io.Writer, op string, args ...string) error {
+	cmd := b.command(op, args...)
+	var stderr bytes.Buffer
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w\n%s", filepath.Base(b.Path), op, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (b *execBackend) Put(name, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return b.run(f, nil, "put", name)
+}
+
+func (b *execBackend) Get(name, localPath string) error {
+	f, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	err = b.run(nil, f, "get", name)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(localPath)
+	}
+	return err
+}
+
+func (b *execBackend) List() ([]string, error) {
+	var out bytes.Buffer
+	if err := b.run(nil, &out, "list"); err != nil {
+		return nil, err
+	}
+	return strings.Fields(out.String()), nil
+}
+
+func (b *execBackend) Delete(name string) error {
+	return b.run(nil, nil, "delete", name)
+}
+
+// openBackendRemote opens an external backend as a remote
+func openBackendRemote(kind, arg string) (remote, error) {
+	b, err := findBackend(kind, arg)
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, fmt.Errorf("unknown remote type %q, and there's no %s%s on the PATH", kind, backendPrefix, kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"put", "get", "list", "delete"} {
+		if !b.Supports(op) {
+			return nil, fmt.Errorf("%s%s can't be used as a remote, it doesn't support %s", backendPrefix, kind, op)
+		}
+	}
+	return b, nil
+}
+
+// isBackendTarget reports whether target is "<kind>:<arg>" for an external backend,
+// rather than a path that happens to have a colon
+func isBackendTarget(target string) bool {
+	kind, _, ok := strings.Cut(target, ":")
+	if !ok || !backendKind.MatchString(kind) {
+		return false
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return false
+	}
+	_, err := exec.LookPath(backendPrefix + kind)
+	return err == nil
+}
+
+func backupBackend(target string, opts compressOptions) {
+	kind, arg, _ := strings.Cut(target, ":")
+	b, err := findBackend(kind, arg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error starting backend: ", err)
+		os.Exit(exitFatal)
+	}
+	if !b.Supports("dump") {
+		fmt.Fprintf(os.Stderr, "%s%s can't be backed up from, it doesn't support dump\n", backendPrefix, kind)
+		os.Exit(exitUsage)
+	}
+	if opts.Snapshot != "" {
+		fmt.Fprintln(os.Stderr, "WARNING: Snapshots can't be taken of backends, ignoring --snapshot")
+	}
+
+	sidecar := SidecarData{BackupOf: target}
+	if opts.Incremental {
+		parent, manifest, ok := findParent(sidecar)
+		if ok {
+			fmt.Printf("Storing changes since backup %d...\n", parent.ID)
+			sidecar.ParentID = &parent.ID
+			opts.Parent = manifest
+		} else {
+			fmt.Printf("No earlier backup of '%s' to build on, making a full backup\n", sidecar.BackupOf)
+		}
+	}
+
+	useDict(&sidecar, &opts)
+	writeBackup(sidecar, opts.Format, func(backupName string) (*Manifest, error) {
+		fmt.Printf("Reading '%s' from %s...\n", arg, filepath.Base(b.Path))
+		return compressCommand(b.command("dump"), backupName, opts)
+	})
+}
+
+// listBackends prints the external backends on the PATH and what they support
+func listBackends() {
+	seen := make(map[string]bool)
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			kind, ok := strings.CutPrefix(entry.Name(), backendPrefix)
+			// windows executables end in .exe
+			kind = strings.TrimSuffix(kind, filepath.Ext(kind))
+			if !ok || seen[kind] || !backendKind.MatchString(kind) {
+				continue
+			}
+			// the first one on the PATH is the one that runs
+			seen[kind] = true
+
+			b, err := findBackend(kind, "")
+			if err != nil {
+				fmt.Printf("%s: %v\n", kind, err)
+				continue
+			}
+			fmt.Printf("%s (%s): %s\n", kind, b.Path, strings.Join(b.Ops, ", "))
+		}
+	}
+	if len(seen) == 0 {
+		fmt.Printf("No %s* executables on the PATH\n", backendPrefix)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// bench backs up and restores a tree of generated files (or a given directory)
+// in a temporary directory and prints how fast it went and how much memory the
+// GC had to deal with. it's left out of the usage, it's for measuring changes to
+// the archive code and for bug reports about slow backups
+
+// benchStats is what a benchmarked step cost
+type benchStats struct {
+	elapsed time.Duration
+	allocs  uint64
+	alloced uint64
+	gcs     uint32
+	pause   time.Duration
+}
+
+// measure runs fn and records its time and the allocations made meanwhile
+func measure(fn func() error) (benchStats, error) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	return benchStats{
+		elapsed: elapsed,
+		allocs:  after.Mallocs - before.Mallocs,
+		alloced: after.TotalAlloc - before.TotalAlloc,
+		gcs:     after.NumGC - before.NumGC,
+		pause:   time.Duration(after.PauseTotalNs - before.PauseTotalNs),
+	}, err
+}
+
+func (s benchStats) print(name string, files int, size int64) {
+	seconds := s.elapsed.Seconds()
+	fmt.Printf("%s: %s, %.0f files/s, %s/s\n", name, s.elapsed.Round(time.Millisecond), float64(files)/seconds, humanize.IBytes(uint64(float64(size)/seconds)))
+	fmt.Printf("\t%d allocations (%.1f per file), %s allocated, %d GCs pausing %s\n",
+		s.allocs, float64(s.allocs)/float64(max(files, 1)), humanize.IBytes(s.alloced), s.gcs, s.pause.Round(time.Microsecond))
+}
+
+// generateTree writes count files of about size bytes into dir, 1000 per directory.
+// the contents are half random and half repeated, so they compress somewhat
+func generateTree(dir string, count int, size int64) error {
+	rng := rand.New(rand.NewPCG(1, 2))
+	data := make([]byte, size)
+	for i := range count {
+		sub := filepath.Join(dir, fmt.Sprintf("d%04d", i/1000))
+		if i%1000 == 0 {
+			if err := os.MkdirAll(sub, 0755); err != nil {
+				return err
+			}
+		}
+		for j := range data {
+			if j%2 == 0 {
+				data[j] = byte(rng.UintN(256))
+			} else {
+				data[j] = 'a' + byte(j%26)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(sub, fmt.Sprintf("f%07d", i)), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func benchCommand(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	count := fs.Int("files", 100000, "how many files to generate")
+	sizeArg := fs.String("size", "1KiB", "size of the generated files")
+	format := fs.String("format", config.ArchiveFormat, "archive format to benchmark")
+	args = parseFlags(fs, args)
+
+	size, err := humanize.ParseBytes(*sizeArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid size %q: %v\n", *sizeArg, err)
+		os.Exit(exitUsage)
+	}
+
+	tmp, err := os.MkdirTemp("", "backman-bench-*")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error creating temporary directory: ", err)
+		os.Exit(exitFatal)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "src")
+	if len(args) > 0 {
+		if src, err = filepath.Abs(args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, "error getting absolute path of directory: ", err)
+			os.Exit(exitFatal)
+		}
+	} else {
+		fmt.Printf("Generating %d files of %s...\n", *count, humanize.IBytes(size))
+		if err := generateTree(src, *count, int64(size)); err != nil {
+			fmt.Fprintln(os.Stderr, "error generating files: ", err)
+			os.RemoveAll(tmp)
+			os.Exit(exitFatal)
+		}
+	}
+
+	archive := filepath.Join(tmp, "bench."+*format)
+	var manifest *Manifest
+	backup, err := measure(func() error {
+		var err error
+		manifest, err = compressDir([]archiveRoot{{Path: src}}, archive, compressOptions{Format: *format})
+		return err
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error compressing directory: ", err)
+		os.RemoveAll(tmp)
+		os.Exit(exitFatal)
+	}
+
+	var total int64
+	for _, entry := range manifest.Files {
+		total += entry.Size
+	}
+	files := len(manifest.Files)
+	fmt.Printf("%d files, %s, archived into %s (%s)\n", files, humanize.IBytes(uint64(total)), humanize.IBytes(uint64(fileSize(archive))), *format)
+	backup.print("Backup", files, total)
+
+	restored, err := measure(func() error {
+		mismatched, err := decompressDir(archive, filepath.Join(tmp, "restored"), restoreOptions{Manifest: manifest})
+		if err == nil && len(mismatched) > 0 {
+			err = fmt.Errorf("%d files failed verification", len(mismatched))
+		}
+		return err
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error decompressing directory: ", err)
+		os.RemoveAll(tmp)
+		os.Exit(exitFatal)
+	}
+	restored.print("Restore", files, total)
+}
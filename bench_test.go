@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchmarkTree generates count files of size bytes once per benchmark
+func benchmarkTree(b *testing.B, count int, size int64) string {
+	b.Helper()
+	src := b.TempDir()
+	if err := generateTree(src, count, size); err != nil {
+		b.Fatal(err)
+	}
+	return src
+}
+
+// many tiny files, where the allocations per file matter more than the bytes
+func BenchmarkBackupSmallFiles(b *testing.B) {
+	const count, size = 5000, 512
+	src := benchmarkTree(b, count, size)
+	archive := filepath.Join(b.TempDir(), "backup.tar.zstd")
+
+	b.ReportAllocs()
+	b.SetBytes(count * size)
+	for b.Loop() {
+		if _, err := compressDir([]archiveRoot{{Path: src}}, archive, compressOptions{Format: "tar.zstd"}); err != nil {
+			b.Fatal(err)
+		}
+		os.Remove(archive)
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*count), "ns/file")
+}
+
+func benchmarkRestore(b *testing.B, format string, count int, size int64) {
+	src := benchmarkTree(b, count, size)
+	dir := b.TempDir()
+	archive := filepath.Join(dir, "backup."+format)
+	manifest, err := compressDir([]archiveRoot{{Path: src}}, archive, compressOptions{Format: format})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(count) * size)
+	for b.Loop() {
+		dst := filepath.Join(dir, "restored")
+		mismatched, err := decompressDir(archive, dst, restoreOptions{Manifest: manifest})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(mismatched) > 0 {
+			b.Fatalf("restored files don't match: %q", mismatched)
+		}
+		os.RemoveAll(dst)
+	}
+}
+
+// restore throughput of a few big files, see decompressDir
+func BenchmarkRestoreLargeFiles(b *testing.B) {
+	benchmarkRestore(b, "tar.zstd", 8, 32<<20)
+}
+
+func BenchmarkRestoreSmallFiles(b *testing.B) {
+	benchmarkRestore(b, "tar.zstd", 5000, 512)
+}
+
+// the same without zstd, to compare against what plain tar costs
+func BenchmarkRestorePlainTar(b *testing.B) {
+	benchmarkRestore(b, "tar", 8, 32<<20)
+}
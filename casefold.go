@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// macOS and windows file systems usually don't tell names apart by case, so
+// restoring a backup of Readme.md and README.md made on linux would quietly write
+// both into one file. restore finds such files up front and handles all but the
+// first (in sorted order) with case_collisions
+
+// values of the case_collisions config key
+var caseModes = []string{"rename", "skip", "overwrite"}
+
+// caseRenames maps the archive paths of colliding files to the path they're
+// restored as, "" if they're skipped
+type caseRenames map[string]string
+
+// Apply returns the archive path name is restored as, false if it's skipped
+func (r caseRenames) Apply(name string) (string, bool) {
+	renamed, ok := r[name]
+	if !ok {
+		return name, true
+	}
+	return renamed, renamed != ""
+}
+
+// caseInsensitive reports whether dir, or its closest parent that exists, is on a
+// file system that ignores case. it's probed by creating a file and looking it
+// up in upper case
+func caseInsensitive(dir string) bool {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	probe, err := os.CreateTemp(dir, ".backman-case-")
+	if err != nil {
+		// can't tell without writing, go by what the system usually uses
+		return runtime.GOOS == "darwin" || runtime.GOOS == "windows"
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	_, err = os.Lstat(filepath.Join(dir, strings.ToUpper(filepath.Base(probe.Name()))))
+	return err == nil
+}
+
+// planCaseCollisions finds the paths that differ from another only in case and
+// decides what happens to them with mode. renamed files get ".case-N" before their
+// extension, eg. "Readme.md" is restored as "Readme.case-2.md"
+func planCaseCollisions(paths []string, mode string) caseRenames {
+	renames := make(caseRenames)
+	taken := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		taken[strings.ToLower(p)] = true
+	}
+
+	first := make(map[string]bool)
+	for _, p := range slices.Sorted(slices.Values(paths)) {
+		folded := strings.ToLower(p)
+		if !first[folded] {
+			first[folded] = true
+			continue
+		}
+		switch mode {
+		case "skip":
+			renames[p] = ""
+		case "overwrite":
+			// written over the first one, noted so it can be listed
+			renames[p] = p
+		default:
+			ext := path.Ext(p)
+			for n := 2; ; n++ {
+				candidate := fmt.Sprintf("%s.case-%d%s", strings.TrimSuffix(p, ext), n, ext)
+				if !taken[strings.ToLower(candidate)] {
+					taken[strings.ToLower(candidate)] = true
+					renames[p] = candidate
+					break
+				}
+			}
+		}
+	}
+	return renames
+}
+
+// printCaseCollisions warns about what happens to the colliding files in dst
+func printCaseCollisions(dst string, renames caseRenames) {
+	if len(renames) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: '%s' doesn't tell names apart by case, %d files differ from another only in case:\n", dst, len(renames))
+	for i, p := range slices.Sorted(maps.Keys(renames)) {
+		if i == previewLimit {
+			fmt.Fprintf(os.Stderr, "\t...and %d more\n", len(renames)-i)
+			break
+		}
+		switch renamed := renames[p]; renamed {
+		case "":
+			fmt.Fprintf(os.Stderr, "\t%s (skipped)\n", escapeName(p))
+		case p:
+			fmt.Fprintf(os.Stderr, "\t%s (overwrites the other)\n", escapeName(p))
+		default:
+			fmt.Fprintf(os.Stderr, "\t%s -> %s\n", escapeName(p), escapeName(renamed))
+		}
+	}
+}
+
+// foldsOnto reports whether name differs only in case from one of paths
+func foldsOnto(name string, paths map[string]ManifestEntry) bool {
+	folded := strings.ToLower(name)
+	for p := range paths {
+		if p != name && strings.ToLower(p) == folded {
+			return true
+		}
+	}
+	return false
+}
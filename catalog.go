@@ -0,0 +1,378 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// the config, the sidecars, the master key and the dictionaries are small but
+// without them the archives are hard to use. after every command that may change
+// them they're bundled into ArchiveDir/.catalog/catalog-<time>-<hash>.tar.zstd,
+// unless they're the same as in the newest bundle. catalog_versions are kept
+
+// catalogCommands are the commands after which the catalog is snapshotted
+var catalogCommands = map[string]bool{
+	"backup": true, "delete": true, "purge": true, "undelete": true, "trash": true,
+	"annotate": true, "import": true, "import-archive": true, "import-restic": true,
+	"import-borg": true, "pull": true, "migrate": true, "rebind": true, "rekey": true,
+	"fsck": true, "quarantine": true, "dict": true, "config": true, "run": true,
+}
+
+func catalogDir() string {
+	return filepath.Join(config.ArchiveDir, ".catalog")
+}
+
+// catalogFile is a file in a catalog bundle, Name is its path in the bundle
+type catalogFile struct {
+	Name string
+	Data []byte
+}
+
+// catalogFiles reads what goes into a bundle: backman.json, sidecars/, backman.key and dicts/
+func catalogFiles() ([]catalogFile, error) {
+	var files []catalogFile
+	add := func(name, p string) error {
+		data, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err == nil {
+			files = append(files, catalogFile{Name: name, Data: data})
+		}
+		return err
+	}
+
+	if err := add(appName+".json", getConfigPath()); err != nil {
+		return nil, err
+	}
+	if err := add(keyFileName, keyFilePath()); err != nil {
+		return nil, err
+	}
+	for _, dir := range []struct{ name, path string }{{"sidecars", config.ArchiveDir}, {"dicts", dictDir()}} {
+		entries, err := os.ReadDir(dir.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || dir.name == "sidecars" && (filepath.Ext(entry.Name()) != ".json" || !isBackupFile(entry.Name())) {
+				continue
+			}
+			if err := add(path.Join(dir.name, entry.Name()), filepath.Join(dir.path, entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// catalogHash identifies the contents of a bundle, so unchanged catalogs aren't bundled again
+func catalogHash(files []catalogFile) string {
+	h := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(h, "%s\x00%d\x00", f.Name, len(f.Data))
+		h.Write(f.Data)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// catalogBundles returns the paths of the bundles, oldest first
+func catalogBundles() ([]string, error) {
+	entries, err := os.ReadDir(catalogDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bundles []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "catalog-") && strings.HasSuffix(entry.Name(), ".tar.zstd") {
+			bundles = append(bundles, filepath.Join(catalogDir(), entry.Name()))
+		}
+	}
+	// the time in the name sorts them
+	slices.Sort(bundles)
+	return bundles, nil
+}
+
+// saveCatalog bundles the catalog if it changed since the newest bundle, and
+// removes the bundles beyond catalog_versions. returns the new bundle, empty if
+// nothing changed
+func saveCatalog() (string, error) {
+	files, err := catalogFiles()
+	if err != nil {
+		return "", err
+	}
+	bundles, err := catalogBundles()
+	if err != nil {
+		return "", err
+	}
+	hash := catalogHash(files)
+	if len(bundles) > 0 && strings.HasSuffix(bundles[len(bundles)-1], "-"+hash+".tar.zstd") {
+		return "", nil
+	}
+
+	now := time.Now()
+	name := filepath.Join(catalogDir(), fmt.Sprintf("catalog-%s-%s.tar.zstd", now.UTC().Format("20060102-150405.000"), hash))
+	if err := writeBundle(name, files, now); err != nil {
+		return "", err
+	}
+
+	bundles = append(bundles, name)
+	for len(bundles) > config.CatalogVersions {
+		if err := os.Remove(bundles[0]); err != nil {
+			return name, err
+		}
+		bundles = bundles[1:]
+	}
+	return name, nil
+}
+
+// writeBundle writes files into the bundle name
+func writeBundle(name string, files []catalogFile, modTime time.Time) error {
+	var buf bytes.Buffer
+	zw, err := compressWriter(&buf, "tar.zstd", nil)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	for _, f := range files {
+		header := &tar.Header{Name: f.Name, Mode: 0600, Size: int64(len(f.Data)), ModTime: modTime, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(catalogDir(), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(name, buf.Bytes(), 0600)
+}
+
+// replaceCatalogKeys puts the current backman.key into every bundle that has an
+// older one, so after rekey none of them opens with what unlocked it before.
+// returns how many bundles were rewritten
+func replaceCatalogKeys() (int, error) {
+	key, err := os.ReadFile(keyFilePath())
+	if err != nil {
+		return 0, err
+	}
+	bundles, err := catalogBundles()
+	if err != nil {
+		return 0, err
+	}
+
+	var replaced int
+	for _, bundle := range bundles {
+		var files []catalogFile
+		var modTime time.Time
+		stale := false
+		err := readEntries(bundle, func(header *tar.Header, r io.Reader) error {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if header.Name == keyFileName && !bytes.Equal(data, key) {
+				data, stale = key, true
+			}
+			files = append(files, catalogFile{Name: header.Name, Data: data})
+			modTime = header.ModTime
+			return nil
+		})
+		if err != nil {
+			return replaced, fmt.Errorf("error reading '%s': %w", filepath.Base(bundle), err)
+		}
+		if !stale {
+			continue
+		}
+
+		// the name ends in the hash of the files, the time in it stays
+		stamp := strings.TrimSuffix(filepath.Base(bundle), ".tar.zstd")
+		stamp = stamp[:strings.LastIndex(stamp, "-")]
+		name := filepath.Join(catalogDir(), fmt.Sprintf("%s-%s.tar.zstd", stamp, catalogHash(files)))
+		if err := writeBundle(name, files, modTime); err != nil {
+			return replaced, err
+		}
+		if name != bundle {
+			if err := os.Remove(bundle); err != nil {
+				return replaced, err
+			}
+		}
+		replaced++
+	}
+	return replaced, nil
+}
+
+// snapshotCatalog saves the catalog after a command, see catalogCommands
+func snapshotCatalog() {
+	if os.Args[1] == "config" && !reloadConfig() {
+		// the config commands don't load it, and a broken one has nothing to keep
+		return
+	}
+	if config.CatalogVersions <= 0 {
+		return
+	}
+	if _, err := os.Stat(config.ArchiveDir); err != nil {
+		return
+	}
+	if _, err := saveCatalog(); err != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: Could not back up the catalog: ", err)
+	}
+}
+
+func listCatalog() {
+	bundles, err := catalogBundles()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading catalog bundles: ", err)
+		os.Exit(exitFatal)
+	}
+	if len(bundles) == 0 {
+		fmt.Println("No catalog bundles yet!")
+		return
+	}
+	for _, bundle := range bundles {
+		var sidecars int
+		err := readEntries(bundle, func(header *tar.Header, r io.Reader) error {
+			if strings.HasPrefix(header.Name, "sidecars/") {
+				sidecars++
+			}
+			return nil
+		})
+		var size int64
+		if info, statErr := os.Stat(bundle); statErr == nil {
+			size = info.Size()
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", filepath.Base(bundle), err)
+			continue
+		}
+		fmt.Printf("%s: %d sidecars, %s\n", filepath.Base(bundle), sidecars, humanize.IBytes(uint64(size)))
+	}
+}
+
+// restoreCatalog writes the files of a bundle that are missing back, or every one
+// with overwrite. sidecars whose archive is gone are left out
+func restoreCatalog(bundle string, overwrite bool) {
+	var restored, kept, gone int
+	err := readEntries(bundle, func(header *tar.Header, r io.Reader) error {
+		var dst string
+		dir, name := path.Split(header.Name)
+		switch {
+		case header.Name == appName+".json":
+			dst = getConfigPath()
+		case header.Name == keyFileName:
+			dst = keyFilePath()
+		case dir == "sidecars/":
+			dst = filepath.Join(config.ArchiveDir, name)
+			if len(archiveVolumes(strings.TrimSuffix(dst, ".json"))) == 0 {
+				gone++
+				return nil
+			}
+		case dir == "dicts/":
+			dst = filepath.Join(dictDir(), name)
+		default:
+			return nil
+		}
+
+		if _, err := os.Stat(dst); err == nil && !overwrite {
+			kept++
+			return nil
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(dst, data, 0600); err != nil {
+			return err
+		}
+		fmt.Printf("Restored '%s'\n", dst)
+		restored++
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error restoring the catalog: ", err)
+		os.Exit(exitFatal)
+	}
+
+	fmt.Printf("Restored %d files from '%s'", restored, filepath.Base(bundle))
+	if kept > 0 {
+		fmt.Printf(", kept %d that exist, use --force to overwrite them", kept)
+	}
+	fmt.Println()
+	if gone > 0 {
+		fmt.Printf("Left out %d sidecars whose archive is gone\n", gone)
+	}
+}
+
+func catalogCommand(args []string) {
+	if len(args) == 0 {
+		usageError("catalog")
+	}
+
+	switch args[0] {
+	case "list":
+		listCatalog()
+	case "save":
+		name, err := saveCatalog()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error backing up the catalog: ", err)
+			os.Exit(exitFatal)
+		}
+		if name == "" {
+			fmt.Println("The catalog didn't change since the newest bundle")
+			return
+		}
+		fmt.Printf("Saved '%s'\n", name)
+	case "restore":
+		fs := flag.NewFlagSet("catalog restore", flag.ContinueOnError)
+		force := fs.Bool("force", false, "overwrite files that exist")
+		rest := parseFlags(fs, args[1:])
+
+		bundles, err := catalogBundles()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading catalog bundles: ", err)
+			os.Exit(exitFatal)
+		}
+		if len(bundles) == 0 {
+			fmt.Fprintln(os.Stderr, "No catalog bundles to restore from")
+			os.Exit(exitFatal)
+		}
+		bundle := bundles[len(bundles)-1]
+		if len(rest) > 0 {
+			bundle = filepath.Join(catalogDir(), filepath.Base(rest[0]))
+			if !slices.Contains(bundles, bundle) {
+				fmt.Fprintf(os.Stderr, "No catalog bundle '%s', see catalog list\n", rest[0])
+				os.Exit(exitFatal)
+			}
+		}
+		restoreCatalog(bundle, *force)
+	default:
+		usageError("catalog")
+	}
+}
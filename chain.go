@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+)
+
+// findParent returns the newest backup of the same paths (or stream) as sidecar,
+// other than sidecar itself. false if there is none with a manifest
+func findParent(sidecar SidecarData) (SidecarData, *Manifest, bool) {
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+
+	var parent *SidecarData
+	for i, other := range sidecars {
+		if other.ParentPath == sidecar.ParentPath || other.Stream != sidecar.Stream ||
+			other.Of() != sidecar.Of() || !slices.Equal(other.OfSources(), sidecar.OfSources()) {
+			continue
+		}
+		if parent == nil || other.Time.After(parent.Time) {
+			parent = &sidecars[i]
+		}
+	}
+	if parent == nil {
+		return SidecarData{}, nil, false
+	}
+
+	manifest, err := readManifest(parent.ManifestPath())
+	if err != nil || manifest == nil {
+		return SidecarData{}, nil, false
+	}
+	return *parent, manifest, true
+}
+
+// backupChain returns the backups needed to restore sidecar, oldest first
+func backupChain(sidecar SidecarData) ([]SidecarData, error) {
+	sidecars, err := readSidecars()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[uint16]SidecarData)
+	for _, other := range sidecars {
+		byID[other.ID] = other
+	}
+
+	chain := []SidecarData{sidecar}
+	for current := sidecar; current.ParentID != nil; {
+		parent, ok := byID[*current.ParentID]
+		if !ok {
+			return nil, fmt.Errorf("backup %d depends on backup %d, which is missing", current.ID, *current.ParentID)
+		}
+		if len(chain) > len(sidecars) {
+			return nil, fmt.Errorf("backup %d is part of a cycle", current.ID)
+		}
+		chain = append(chain, parent)
+		current = parent
+	}
+
+	slices.Reverse(chain)
+	return chain, nil
+}
+
+// dependents returns the backups in sidecars that depend on the backup with id,
+// directly or through other incremental backups
+func dependents(sidecars []SidecarData, id uint16) []SidecarData {
+	var found []SidecarData
+	for _, other := range sidecars {
+		if other.ParentID != nil && *other.ParentID == id && other.ID != id {
+			found = append(found, other)
+			found = append(found, dependents(sidecars, other.ID)...)
+		}
+	}
+	return found
+}
+
+// chainFiles returns the archive paths the backups of chain write. that's more
+// than the last one has, files deleted later are still written by earlier ones
+func chainFiles(chain []SidecarData) ([]string, error) {
+	paths := make(map[string]bool)
+	for _, sidecar := range chain {
+		manifest, err := readManifest(sidecar.ManifestPath())
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest of backup %d: %w", sidecar.ID, err)
+		}
+		if manifest == nil {
+			return nil, fmt.Errorf("backup %d has no manifest, which incremental restores need", sidecar.ID)
+		}
+		for path := range manifest.Files {
+			paths[path] = true
+		}
+	}
+	return slices.Sorted(maps.Keys(paths)), nil
+}
+
+// restoreChain extracts every archive of chain into dst in order, then removes
+// the files that were deleted between the backups. returns the mismatched files
+func restoreChain(chain []SidecarData, dst string, opts restoreOptions) ([]string, error) {
+	var mismatched []string
+	var previous *Manifest
+
+	for _, sidecar := range chain {
+		checkSignature(sidecar.ParentPath)
+
+		manifest, err := readManifest(sidecar.ManifestPath())
+		if err != nil {
+			return mismatched, fmt.Errorf("error reading manifest of backup %d: %w", sidecar.ID, err)
+		}
+		if manifest == nil {
+			return mismatched, fmt.Errorf("backup %d has no manifest, which incremental restores need", sidecar.ID)
+		}
+
+		if len(chain) > 1 {
+			fmt.Printf("Restoring backup %d...\n", sidecar.ID)
+		}
+		opts.Manifest = manifest
+		layerMismatched, err := decompressDir(sidecar.ParentPath, dst, opts)
+		mismatched = append(mismatched, layerMismatched...)
+		if err != nil {
+			return mismatched, err
+		}
+
+		if previous != nil {
+			for path := range previous.Files {
+				if _, ok := manifest.Files[path]; ok || !opts.Filter.Keep(path) {
+					continue
+				}
+				if opts.Delta != nil && !opts.Delta[path] {
+					// was never written, what's there isn't ours to remove
+					continue
+				}
+				if opts.CaseInsensitive && foldsOnto(path, manifest.Files) {
+					// the file restored under the other case is the same one
+					continue
+				}
+				name, ok := opts.CaseRenames.Apply(path)
+				if !ok {
+					continue
+				}
+				restored, ok := restoredPath(dst, name)
+				if ok && opts.Conflicts != nil {
+					restored, ok = opts.Conflicts.Removable(path, restored)
+				}
+				if ok {
+					os.Remove(restored)
+				}
+			}
+		}
+		previous = manifest
+	}
+
+	return mismatched, nil
+}
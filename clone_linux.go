@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// _IOW(0x94, 9, int) from linux/fs.h, not in package syscall
+const ficlone = 0x40049409
+
+// cloneFile makes out share in's data blocks (a reflink) instead of copying them,
+// which is instant and takes no space on btrfs, XFS and the like. fails if the
+// filesystem can't, or they're on different ones
+func cloneFile(out, in *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
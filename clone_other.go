@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile shares in's data blocks with out instead of copying them. only done on linux
+func cloneFile(out, in *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// list and status color what they print by role, eg. stale paths red. colors are
+// left out when the output isn't a terminal, so logs and pipes get plain text, and
+// with no_color (--no-color) or the NO_COLOR environment variable (no-color.org)
+
+// the colors of each role, as ANSI SGR parameters. the colors config key overrides them
+var defaultTheme = map[string]string{
+	"ok":      "32", // green
+	"warning": "33", // yellow
+	"stale":   "31", // red
+	"match":   "1",  // bold
+	"other":   "90", // grey
+}
+
+// colorRoles returns the roles the colors config key can set
+func colorRoles() []string {
+	return slices.Sorted(maps.Keys(defaultTheme))
+}
+
+// validColor reports whether code is made of SGR parameters, eg. "1;31"
+func validColor(code string) bool {
+	for _, param := range strings.Split(code, ";") {
+		if n, err := strconv.Atoi(param); err != nil || n < 0 || n > 255 {
+			return false
+		}
+	}
+	return true
+}
+
+// colorEnabled reports whether text written to f should be colored
+func colorEnabled(f *os.File) bool {
+	if config.NoColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	return enableANSI(f)
+}
+
+// paint colors text for writing to f in the color of role, or returns it as is
+func paint(f *os.File, role, text string) string {
+	code, ok := config.Colors[role]
+	if !ok {
+		code = defaultTheme[role]
+	}
+	if code == "" || text == "" || !colorEnabled(f) {
+		return text
+	}
+	return "\033[" + code + "m" + text + "\033[0m"
+}
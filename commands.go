@@ -0,0 +1,75 @@
+package main
+
+import "strings"
+
+// command is a subcommand of backman. Run gets the arguments after its name,
+// flags included, and parses them with parseFlags. the help menu of each is in
+// usageLines
+type command struct {
+	// how many arguments it needs at least, fewer is a usage error
+	MinArgs int
+	Run     func(args []string)
+}
+
+// commands maps the names of the subcommands to them
+var commands = map[string]command{
+	"help":    {Run: helpCommand},
+	"info":    {Run: infoCommand},
+	"backup":  {Run: backupCommand},
+	"restore": {Run: restoreCommand},
+	"verify":  {MinArgs: 1, Run: func(args []string) { verifyBackup(findSidecar(args[0])) }},
+	"scrub":   {Run: scrubCommand},
+	"repair":  {MinArgs: 1, Run: func(args []string) { repairBackup(findSidecar(args[0])) }},
+	"annotate": {MinArgs: 1, Run: func(args []string) {
+		annotateBackup(findSidecar(args[0]), strings.Join(args[1:], " "))
+	}},
+	"list":             {Run: listCommand},
+	"search":           {Run: searchCommand},
+	"history":          {Run: historyCommand},
+	"cat":              {Run: catCommand},
+	"delete":           {Run: deleteCommand},
+	"purge":            {Run: purgeCommand},
+	"status":           {Run: func([]string) { statusCommand() }},
+	"stats":            {Run: func([]string) { printStats() }},
+	"export":           {MinArgs: 2, Run: func(args []string) { exportBackup(args[0], args[1]) }},
+	"import-archive":   {Run: importArchiveCommand},
+	"import-restic":    {Run: func(args []string) { importForeignCommand(resticTool, args) }},
+	"import-borg":      {Run: func(args []string) { importForeignCommand(borgTool, args) }},
+	"import":           {MinArgs: 1, Run: func(args []string) { importBackups(args[0]) }},
+	"push":             {MinArgs: 1, Run: func(args []string) { pushCommand(args[0]) }},
+	"pull":             {MinArgs: 1, Run: func(args []string) { pullBackup(args[0]) }},
+	"remote":           {Run: remoteCommand},
+	"sync":             {Run: func([]string) { syncCommand() }},
+	"backends":         {Run: func([]string) { listBackends() }},
+	"run":              {Run: runCommand},
+	"flush":            {Run: func([]string) { flushCommand() }},
+	"undelete":         {MinArgs: 1, Run: func(args []string) { undeleteBackup(args[0]) }},
+	"trash":            {Run: trashCommand},
+	"migrate":          {Run: migrateCommand},
+	"rebind":           {Run: rebindCommand},
+	"catalog":          {Run: catalogCommand},
+	"rekey":            {Run: rekeyCommand},
+	"keychain":         {Run: keychainCommand},
+	"report":           {Run: reportCommand},
+	"fsck":             {Run: fsckCommand},
+	"quarantine":       {Run: quarantineCommand},
+	"dict":             {Run: dictCommand},
+	"install-schedule": {Run: installScheduleCommand},
+	"config":           {Run: configCommand},
+	"completion":       {MinArgs: 1, Run: func(args []string) { printCompletion(args[0]) }},
+	"serve": {Run: func(args []string) {
+		addr := "127.0.0.1:8080"
+		if len(args) > 0 {
+			addr = args[0]
+		}
+		serve(addr)
+	}},
+	// left out of the usage, see bench.go
+	"bench": {Run: benchCommand},
+	// used by the completion scripts
+	"__complete": {Run: func(args []string) {
+		if len(args) > 0 && args[0] == "ids" {
+			completeIDs()
+		}
+	}},
+}
@@ -2,75 +2,233 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
 )
 
 type SidecarData struct {
+	// format version, see sidecarVersion. missing in version 1
+	Version int `json:"version,omitempty"`
 	// the absolute path of the directory that the parent file of this sidecar is backing up
 	BackupOf string `json:"of"`
 	// when the backup was created
 	Time time.Time `json:"time"`
 	// unique id
 	ID uint16 `json:"id"`
+	// every path stored in a combined backup, each under its own top-level directory.
+	// empty for single path backups
+	Sources []string `json:"sources,omitempty"`
+	// set for backups of piped data (backup --stdin), the archive is then a plain
+	// zstd stream of the data instead of a tar, and this is the name it was given
+	Stream string `json:"stream,omitempty"`
+	// the tool and its version that dumped the database of a database backup, see database.go
+	Dumper string `json:"dumper,omitempty"`
+	// set for incremental backups, the ID of the backup they only store the changes to
+	ParentID *uint16 `json:"parent_id,omitempty"`
+	// the last time a backup found nothing changed since this one, and was dropped
+	LastSeen time.Time `json:"last_seen,omitzero"`
+	// the last time verify or scrub found the backup intact
+	Verified time.Time `json:"verified,omitzero"`
+	// the machine and user that made the backup, so machines sharing an archive dir can tell theirs apart
+	Host string `json:"host,omitempty"`
+	User string `json:"user,omitempty"`
+	// free-form note set with annotate, eg. why the backup was made
+	Note string `json:"note,omitempty"`
+	// the size and number of the files stored in the archive, before compression.
+	// unchanged files of incremental backups aren't counted. zero for older backups, see Original
+	OriginalSize int64 `json:"original_size,omitempty"`
+	Files        int   `json:"files,omitempty"`
+	// files that couldn't be read and aren't in the backup, with why
+	Skipped map[string]string `json:"skipped,omitempty"`
+	// when the backup was deleted, set while it's in the trash
+	TrashedAt time.Time `json:"trashed_at,omitzero"`
+	// ID of the zstd dictionary the archive was compressed with, see dict.go
+	Dict uint32 `json:"dict,omitempty"`
+	// set while the backup is being written, cleared once the archive is synced to disk.
+	// left set by a crash, readSidecars skips these and fsck reports them
+	Partial bool `json:"partial,omitempty"`
+	// set if the archive is named by archive_name_template instead of its UUID
+	ArchiveUUID string `json:"uuid,omitempty"`
+	// set if the archive and manifest are encrypted, see crypt.go
+	Encrypted bool `json:"encrypted,omitempty"`
 
 	// populated by readSidecars
-	ParentSize int64
-	ParentPath string
+	ParentSize int64  `json:"-"`
+	ParentPath string `json:"-"`
+	// the version the sidecar was upgraded from when it was read, 0 if it's current
+	migratedFrom int
 }
 
 func (s *SidecarData) FormatHay() string {
 	return strings.ToLower(fmt.Sprintf(
-		"%v %s %s",
-		s.ID, s.BackupOf,
-		s.Time.Local().Format(config.TimeFormat),
+		"%v %s %s %s %s %s %s %s",
+		s.ID, s.UUID(), s.BackupOf, strings.Join(s.Sources, " "),
+		formatTime(s.Time), s.Host, s.User, s.Note,
 	))
 }
+
+// Save writes the sidecar next to its archive
+func (s *SidecarData) Save() error {
+	if s.Version > sidecarVersion {
+		return errNewerSidecar
+	}
+	s.Version = sidecarVersion
+	s.toUTC()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.ParentPath+".json", data, 0600)
+}
+
+// UUID returns the random part of the archive's name, which unlike the ID stays
+// the same when the backup is exported and imported elsewhere
+func (s *SidecarData) UUID() string {
+	if s.ArchiveUUID != "" {
+		return s.ArchiveUUID
+	}
+	return strings.TrimSuffix(filepath.Base(s.ParentPath), "."+formatOf(s.ParentPath))
+}
+
+// Original returns OriginalSize and Files, read from the manifest for backups made
+// before they were recorded. false if neither knows
+func (s *SidecarData) Original() (int64, int, bool) {
+	if s.OriginalSize > 0 || s.Files > 0 {
+		return s.OriginalSize, s.Files, true
+	}
+	manifest, err := readManifest(s.ManifestPath())
+	if err != nil || manifest == nil {
+		return 0, 0, false
+	}
+	size, files := manifest.Stored()
+	return size, files, true
+}
+
+// Ratio returns how many times smaller the archive is than its files, as eg. "2.50x"
+func (s *SidecarData) Ratio() string {
+	original, _, ok := s.Original()
+	if !ok || s.ParentSize <= 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%.2fx", float64(original)/float64(s.ParentSize))
+}
+
+func (s *SidecarData) ManifestPath() string {
+	return s.ParentPath + ".manifest"
+}
+func (s *SidecarData) IndexPath() string {
+	return s.ParentPath + ".index"
+}
+func (s *SidecarData) SignaturePath() string {
+	return s.ParentPath + ".sig"
+}
+func (s *SidecarData) ParityPath() string {
+	return s.ParentPath + ".par"
+}
 func (s *SidecarData) DeleteAll() {
 	if s.ParentPath != "" {
-		os.Remove(s.ParentPath)
+		removeArchive(s.ParentPath)
 		os.Remove(s.ParentPath + ".json")
+		os.Remove(s.ManifestPath())
+		os.Remove(s.IndexPath())
+		os.Remove(s.SignaturePath())
+		os.Remove(s.ParityPath())
 	}
 }
 
-// important: name and backupOf should be absolute paths
-func generateSidecar(name, backupOf string) (func(), error) {
+// generateSidecar fills in the time, ID and path of sidecarData and writes it to name.
+// the time, host and user are kept if they're set, eg. by imports.
+// important: name, BackupOf and Sources should be absolute paths
+func generateSidecar(name string, sidecarData SidecarData) (SidecarData, func(), error) {
 	// read other sidecars to check which ID's have already been used
 	var usedIDs []uint16
 	others, err := readSidecars()
 	if err != nil {
-		return nil, fmt.Errorf("error reading other sidecars: %w", err)
+		return sidecarData, nil, fmt.Errorf("error reading other sidecars: %w", err)
 	}
 	for _, sidecar := range others {
 		usedIDs = append(usedIDs, sidecar.ID)
 	}
-
-	sidecarData := SidecarData{
-		BackupOf: backupOf,
-		Time:     time.Now().Local(),
-		ID:       closestMissing(usedIDs),
+	trashed, err := trashedIDs()
+	if err != nil {
+		return sidecarData, nil, fmt.Errorf("error reading the trash: %w", err)
 	}
+	usedIDs = append(usedIDs, trashed...)
 
-	data, err := json.Marshal(sidecarData)
+	if sidecarData.Time.IsZero() {
+		sidecarData.Time = time.Now().UTC()
+	}
+	if sidecarData.Host == "" {
+		sidecarData.Host = hostname()
+		sidecarData.User = username()
+	}
+	sidecarData.ID, err = allocateID(usedIDs)
 	if err != nil {
-		return nil, err
+		return sidecarData, nil, fmt.Errorf("error allocating ID: %w", err)
 	}
+	sidecarData.ParentPath = strings.TrimSuffix(name, ".json")
+	sidecarData.Partial = true
 
-	return func() {
+	return sidecarData, func() {
 		os.Remove(name)
-	}, os.WriteFile(name, data, 0600)
+	}, sidecarData.Save()
+}
+
+// new IDs count up from the one stored in this file in the archive dir, so an ID
+// isn't given to another backup after its own was deleted
+const nextIDFile = ".next_id"
+
+// allocateID returns the next ID after every ID in used and any ID handed out before
+func allocateID(used []uint16) (uint16, error) {
+	path := filepath.Join(config.ArchiveDir, nextIDFile)
+
+	next := 0
+	data, err := os.ReadFile(path)
+	if err == nil {
+		next, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	for _, id := range used {
+		next = max(next, int(id)+1)
+	}
+
+	id := uint16(next)
+	if next > math.MaxUint16 {
+		// every ID was handed out once, fill the gaps instead
+		id = closestMissing(used)
+	}
+	return id, writeFileAtomic(path, []byte(strconv.Itoa(int(id)+1)), 0600)
 }
 
 func readSidecars() ([]SidecarData, error) {
-	appDir := getAppDir()
+	return scanSidecars(true)
+}
+
+// peekSidecars is readSidecars without touching the archive dir, broken and
+// orphaned sidecars are skipped instead of quarantined or deleted
+func peekSidecars() ([]SidecarData, error) {
+	return scanSidecars(false)
+}
+
+// scanSidecars reads the sidecars in the archive dir. with cleanup, sidecars that
+// can't be parsed have their backup quarantined and ones without an archive are deleted
+func scanSidecars(cleanup bool) ([]SidecarData, error) {
+	appDir := config.ArchiveDir
 
 	if _, err := os.Stat(appDir); errors.Is(err, os.ErrNotExist) {
 		// return empty list if the directory wasnt found
@@ -89,36 +247,43 @@ func readSidecars() ([]SidecarData, error) {
 			continue
 		}
 
-		var sidecarData SidecarData
 		entryAbs := filepath.Join(appDir, entry.Name())
 		parentAbs := strings.TrimSuffix(entryAbs, ".json")
 
-		_, err := os.Stat(parentAbs)
-		if errors.Is(err, os.ErrNotExist) {
+		data, err := os.ReadFile(entryAbs)
+		if err != nil {
+			return nil, err
+		}
+		sidecarData, err := parseSidecar(data, parentAbs)
+
+		// a backup being written has no archive at first
+		if err == nil && sidecarData.Partial {
+			continue
+		}
+		if len(archiveVolumes(parentAbs)) == 0 {
+			if !cleanup {
+				continue
+			}
 			fmt.Fprintln(os.Stderr, "WARNING: Sidecar without parent found. Deleting...")
 			os.Remove(entryAbs)
 			continue
 		}
 
-		data, err := os.ReadFile(entryAbs)
-		if err != nil {
-			return nil, err
+		if err != nil && !cleanup {
+			continue
 		}
-
-		err = json.Unmarshal(data, &sidecarData)
 		if err != nil {
-			fmt.Printf("WARNING: Error parsing sidecar file. (%s)\n", entry.Name())
-			if askYesNo("Delete?") {
-				// remove sidecar
-				os.Remove(entryAbs)
-				// remove backup file aswell
-				os.Remove(strings.TrimSuffix(entryAbs, ".json"))
+			// the archive may well be fine, keep it out of the way instead of deleting it
+			fmt.Fprintf(os.Stderr, "WARNING: Error parsing sidecar file, moving its backup into the quarantine. (%s: %v)\n", entry.Name(), err)
+			if qerr := quarantineBackup(parentAbs, err); qerr != nil {
+				fmt.Fprintln(os.Stderr, "WARNING: Could not quarantine the backup: ", qerr)
+			} else {
+				fmt.Fprintln(os.Stderr, "See `quarantine list` for what was wrong")
 			}
 			continue
 		}
 
-		sidecarData.ParentSize = fileSize(parentAbs)
-		sidecarData.ParentPath = parentAbs
+		sidecarData.ParentSize = archiveSize(parentAbs)
 
 		dataEntries = append(dataEntries, sidecarData)
 	}
@@ -126,83 +291,660 @@ func readSidecars() ([]SidecarData, error) {
 	return dataEntries, nil
 }
 
-func compressDir(src, dst string) error {
-	f, err := os.Create(dst)
+type compressOptions struct {
+	// store the contents of symlinked files and directories instead of the links
+	FollowSymlinks bool
+	// store extended attributes and ACLs
+	Xattrs bool
+	// back up from a snapshot of this type, see takeSnapshot. used by makeBackup
+	Snapshot string
+	// one of archiveFormats
+	Format string
+	// only store the changes since the last backup of the same paths. used by makeBackup
+	Incremental bool
+	// files left out of the backup
+	Filter fileFilter
+	// abort on the first unreadable file instead of skipping it
+	Strict bool
+	// how often a file that changes while it's read is read again
+	Retries int
+	// the archive dir, which is left out if it's inside a target. set by makeBackup
+	ArchiveDir os.FileInfo
+	// manifest of the backup an incremental backup is based on, files that still
+	// match it are left out of the archive
+	Parent *Manifest
+	// zstd dictionary tar.zstd archives are compressed with, see useDict
+	Dict []byte
+	// size of the volumes the archive is split into, 0 to write a single file. see volumes.go
+	SplitSize int64
+	// index the words of text files, see index.go
+	Index bool
+	// pause the containers using a docker volume while it's backed up, see docker.go
+	Pause bool
+	// maps the entries of a tar stream to where they're stored, false leaves them out.
+	// set by the restic and borg imports
+	Rename func(name string) (string, bool)
+}
+
+// archiveRoot is a path stored in an archive under Name.
+// an empty Name stores the contents of a directory at the top of the archive
+type archiveRoot struct {
+	Path string
+	Name string
+}
+
+// archiveRoots lays out absolute target paths inside an archive.
+// a single directory is stored as is, anything else gets a top-level entry per target
+func archiveRoots(targets []string) []archiveRoot {
+	if len(targets) == 1 {
+		info, err := os.Stat(targets[0])
+		if err == nil && info.IsDir() {
+			return []archiveRoot{{Path: targets[0]}}
+		}
+	}
+
+	var roots []archiveRoot
+	used := make(map[string]bool)
+	for _, target := range targets {
+		name := filepath.Base(target)
+		// two targets can share a base name, eg. a/src and b/src
+		for i := 1; used[name]; i++ {
+			name = fmt.Sprintf("%s-%d", filepath.Base(target), i)
+		}
+		used[name] = true
+
+		roots = append(roots, archiveRoot{Path: target, Name: name})
+	}
+	return roots
+}
+
+// files up to this size are read and hashed by a pool of workers ahead of the
+// archive writer, bigger ones are hashed while they're copied into the archive
+const prefetchSize = 1 << 20
+
+// archiveItem is an entry on its way from walking the tree to the archive writer
+type archiveItem struct {
+	path    string
+	relPath string
+	header  *tar.Header
+	info    os.FileInfo
+	// set for files that didn't change since the parent backup, they're only recorded in the manifest
+	unchanged *ManifestEntry
+	// contents and hash of small files, set by a hashing worker before done is closed.
+	// data is in buf, which goes back to prefetchBuffers once it's written
+	data []byte
+	buf  *[]byte
+	sum  string
+	// set if the file kept changing while it was read
+	changed bool
+	done    chan struct{}
+	err     error
+}
+
+// prefetchBuffers holds the buffers small files are read into
+var prefetchBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// compressDir archives roots into dst, returning a manifest of the stored files
+func compressDir(roots []archiveRoot, dst string, opts compressOptions) (*Manifest, error) {
+	f, err := createArchive(dst, opts.SplitSize)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 
-	enc, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	aw, err := newArchiveWriter(f, opts.Format, opts.Dict)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer enc.Close()
 
-	tarWriter := tar.NewWriter(enc)
-	defer tarWriter.Close()
+	// the walk runs ahead of the writer by at most this many entries,
+	// which bounds the memory held by prefetched files
+	workers := runtime.GOMAXPROCS(0)
+	items := make(chan *archiveItem, workers*4)
+	prefetch := make(chan *archiveItem, workers*4)
+	quit := make(chan struct{})
+	defer close(quit)
 
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+	go walkItems(roots, opts, items, prefetch, quit)
+	for range workers {
+		go hashItems(prefetch, quit, opts.Retries)
+	}
+
+	manifest := newManifest()
+	if opts.Index {
+		manifest.Index = newContentIndex()
+	}
+	for item := range items {
+		if item.done != nil {
+			<-item.done
+		}
+		err = writeItem(aw, item, manifest)
+		// only files up to prefetchSize are indexed, they're in memory already
+		if err == nil && manifest.Index != nil && item.data != nil {
+			manifest.Index.Add(item.relPath, item.data)
+		}
+		if item.buf != nil {
+			prefetchBuffers.Put(item.buf)
+		}
+		var unreadable *unreadableError
+		if errors.As(err, &unreadable) && !opts.Strict {
+			manifest.skipFile(item.relPath, unreadable.err)
+			err = nil
+		}
 		if err != nil {
-			return err
+			break
 		}
-		if path == src {
+	}
+	if err != nil {
+		aw.Close()
+		return nil, err
+	}
+
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// unreadableError is a file that couldn't be read before anything of it was
+// written, so the backup can go on without it
+type unreadableError struct {
+	err error
+}
+
+func (e *unreadableError) Error() string { return e.err.Error() }
+func (e *unreadableError) Unwrap() error { return e.err }
+
+// walkItems walks the roots in archive order, sending every entry to items and
+// small files to prefetch too. entries that can't be read are sent with their
+// error set. closes both when done or when quit is closed
+func walkItems(roots []archiveRoot, opts compressOptions, items, prefetch chan<- *archiveItem, quit <-chan struct{}) {
+	defer close(items)
+	defer close(prefetch)
+
+	send := func(ch chan<- *archiveItem, item *archiveItem) error {
+		select {
+		case ch <- item:
 			return nil
+		case <-quit:
+			return errors.New("stopped")
+		}
+	}
+
+	for _, root := range roots {
+		err := walkTree(root.Path, opts.FollowSymlinks, func(path string, info os.FileInfo, err error) error {
+			if err != nil && path == root.Path {
+				// nothing to back up
+				return err
+			}
+			relPath, relErr := filepath.Rel(root.Path, path)
+			if relErr != nil {
+				return relErr
+			}
+			relPath = filepath.ToSlash(filepath.Join(root.Name, relPath))
+			if err != nil {
+				// eg. a directory that can't be listed or a file that vanished
+				return send(items, &archiveItem{path: path, relPath: relPath, err: err})
+			}
+			if path == root.Path && root.Name == "" {
+				return nil
+			}
+			if opts.Filter.Skip(info) {
+				return nil
+			}
+			if info.IsDir() && opts.ArchiveDir != nil && os.SameFile(info, opts.ArchiveDir) {
+				// it would hold every earlier backup, and the one being written
+				fmt.Fprintf(os.Stderr, "WARNING: Leaving out '%s', it's the archive dir\n", path)
+				return filepath.SkipDir
+			}
+			item := &archiveItem{path: path, relPath: relPath, info: info}
+			fail := func(err error) error {
+				item.err = err
+				return send(items, item)
+			}
+
+			// files that didn't change since the parent backup are only recorded in the manifest
+			if opts.Parent != nil && info.Mode().IsRegular() {
+				entry, ok := opts.Parent.Files[relPath]
+				if ok && !entry.Changed && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+					entry.Unchanged = true
+					item.unchanged = &entry
+					return send(items, item)
+				}
+			}
+
+			var link string
+			if info.Mode()&os.ModeSymlink != 0 {
+				if opts.FollowSymlinks {
+					// walkTree only leaves broken and cyclic links unresolved
+					fmt.Fprintf(os.Stderr, "WARNING: Cannot follow symlink '%s', storing the link only\n", path)
+				}
+				link, err = os.Readlink(path)
+				if err != nil {
+					return fail(err)
+				}
+			}
+
+			item.header, err = entryHeader(info, link, relPath)
+			if err != nil {
+				return fail(err)
+			}
+
+			if opts.Xattrs && info.Mode()&os.ModeSymlink == 0 {
+				xattrs, err := readXattrs(path)
+				if err != nil {
+					return fail(fmt.Errorf("error reading extended attributes: %w", err))
+				}
+				for name, value := range xattrs {
+					if item.header.PAXRecords == nil {
+						item.header.PAXRecords = make(map[string]string)
+					}
+					item.header.PAXRecords[paxXattrPrefix+name] = value
+				}
+			}
+
+			if info.Mode().IsRegular() && info.Size() <= prefetchSize {
+				item.done = make(chan struct{})
+				if err := send(prefetch, item); err != nil {
+					return err
+				}
+			}
+			return send(items, item)
+		})
+		if err != nil {
+			// the writer has stopped if quit is closed, and the item is dropped then
+			send(items, &archiveItem{err: err})
+			return
+		}
+	}
+}
+
+// hashItems reads and hashes the files sent to prefetch
+func hashItems(prefetch <-chan *archiveItem, quit <-chan struct{}, retries int) {
+	hasher := newFileHash()
+	for item := range prefetch {
+		select {
+		case <-quit:
+		default:
+			item.err = prefetchItem(item, retries)
+			if item.err == nil {
+				hasher.Reset()
+				hasher.Write(item.data)
+				item.sum = hashString(hasher)
+			}
 		}
+		close(item.done)
+	}
+}
+
+// prefetchItem reads a small file into a pooled buffer. a file that changes while
+// it's read is read again up to retries times, then stored as last read and flagged
+func prefetchItem(item *archiveItem, retries int) error {
+	file, err := os.Open(item.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
-		relPath, err := filepath.Rel(src, path)
+	item.buf = prefetchBuffers.Get().(*[]byte)
+	before := item.info
+	for attempt := 0; ; attempt++ {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		// one byte more than expected, so a file that didn't grow is read in one go
+		*item.buf = slices.Grow((*item.buf)[:0], int(before.Size())+1)
+		item.data, err = readAll(file, item.buf)
+		if err != nil {
+			return err
+		}
+		after, err := file.Stat()
 		if err != nil {
 			return err
 		}
 
-		header, err := tar.FileInfoHeader(info, relPath)
+		// the header is written after this, so it can describe what was read
+		item.info = after
+		item.header.Size = int64(len(item.data))
+		item.header.ModTime = after.ModTime()
+		if !changedWhileRead(before, after, len(item.data)) {
+			return nil
+		}
+		if attempt == retries {
+			item.changed = true
+			return nil
+		}
+		before = after
+	}
+}
+
+// readAll reads r into buf until EOF, growing it if needed
+func readAll(r io.Reader, buf *[]byte) ([]byte, error) {
+	b := (*buf)[:0]
+	for {
+		if len(b) == cap(b) {
+			b = slices.Grow(b, max(cap(b), 512))
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			err = nil
+		}
+		if err != nil || n == 0 {
+			*buf = b
+			return b, err
+		}
+	}
+}
+
+// changedWhileRead reports whether a file stat'ed as before, then read (read bytes),
+// then stat'ed as after was modified in the meantime
+func changedWhileRead(before, after os.FileInfo, read int) bool {
+	return int64(read) != after.Size() || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime())
+}
+
+// entryHeader returns the header of the file described by info, stored as name
+func entryHeader(info os.FileInfo, link, name string) (*tar.Header, error) {
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	// ustar and the gnu fallbacks truncate or reject long paths, huge files and non-ascii names
+	header.Format = tar.FormatPAX
+	return header, nil
+}
+
+// writeItem adds an entry to the archive and its file to the manifest
+func writeItem(aw archiveWriter, item *archiveItem, manifest *Manifest) error {
+	if item.err != nil && item.relPath != "" {
+		return &unreadableError{item.err}
+	}
+	if item.err != nil {
+		return item.err
+	}
+	if item.unchanged != nil {
+		manifest.Files[item.relPath] = *item.unchanged
+		return nil
+	}
+	if !item.info.Mode().IsRegular() {
+		manifest.Dirs++
+		return aw.WriteHeader(item.header)
+	}
+
+	sum := item.sum
+	if item.done != nil {
+		if err := aw.WriteData(item.header, item.data); err != nil {
+			return err
+		}
+	} else {
+		file, err := os.Open(item.path)
 		if err != nil {
+			return &unreadableError{err}
+		}
+		defer file.Close()
+
+		// hash while copying so big files are only read once
+		hasher := newFileHash()
+		if err := aw.WriteFile(item.header, file, item.info, hasher); err != nil {
 			return err
 		}
-		header.Name = relPath
+		sum = hashString(hasher)
 
-		if err := tarWriter.WriteHeader(header); err != nil {
+		// it's in the archive already, so a big file that changed can't be read again
+		after, err := file.Stat()
+		if err != nil {
 			return err
 		}
-		if !info.Mode().IsRegular() {
+		item.changed = changedWhileRead(item.info, after, int(item.info.Size()))
+	}
+
+	manifest.Files[item.relPath] = ManifestEntry{
+		Size:    item.header.Size,
+		ModTime: item.info.ModTime(),
+		SHA256:  sum,
+		Changed: item.changed,
+	}
+	return nil
+}
+
+// checkArchive reads the archive src and compares its files against manifest without
+// extracting anything, returning the paths of files that don't match
+func checkArchive(src string, manifest *Manifest) ([]string, error) {
+	var mismatched []string
+	seen := make(map[string]bool)
+
+	err := readEntries(src, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag != tar.TypeReg {
 			return nil
 		}
 
-		file, err := os.Open(path)
-		if err != nil {
+		hasher := newFileHash()
+		if _, err := copyBuffered(hasher, r); err != nil {
 			return err
 		}
-		defer file.Close()
 
-		_, err = io.Copy(tarWriter, file)
-		return err
+		seen[header.Name] = true
+		entry, ok := manifest.Files[header.Name]
+		if !ok || entry.SHA256 != hashString(hasher) {
+			mismatched = append(mismatched, header.Name)
+		}
+		return nil
 	})
+	if err != nil {
+		return mismatched, err
+	}
+
+	for _, path := range manifest.Paths() {
+		if !seen[path] && !manifest.Files[path].Unchanged {
+			mismatched = append(mismatched, path)
+		}
+	}
+
+	return mismatched, nil
 }
-func decompressDir(src, dst string) error {
-	f, err := os.Open(src)
+
+// walkTree works like filepath.Walk, but with follow set it also descends into
+// symlinked directories and reports symlinked files as the files themselves.
+// links that lead back into one of their own parent directories are reported as links
+func walkTree(root string, follow bool, fn filepath.WalkFunc) error {
+	if !follow {
+		return filepath.Walk(root, fn)
+	}
+
+	info, err := os.Lstat(root)
 	if err != nil {
-		return err
+		err = fn(root, nil, err)
+	} else {
+		err = walkFollow(root, info, nil, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+func walkFollow(path string, info os.FileInfo, parents []string, fn filepath.WalkFunc) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		// broken links stay links
+		if target, err := os.Stat(path); err == nil {
+			if !target.IsDir() || !isCycle(path, parents) {
+				info = target
+			}
+		}
 	}
-	defer f.Close()
 
-	dec, err := zstd.NewReader(f)
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	err := fn(path, info, nil)
+	if err == filepath.SkipDir {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	defer dec.Close()
 
-	tr := tar.NewReader(dec)
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	parents = append(parents, real)
 
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+
+		childInfo, err := os.Lstat(child)
+		if err != nil {
+			err = fn(child, childInfo, err)
+		} else {
+			err = walkFollow(child, childInfo, parents, fn)
+		}
+
+		if err == filepath.SkipDir {
+			// returned for a file, skip the rest of this directory
+			return nil
 		}
 		if err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+// isCycle reports whether the directory link at path resolves to one of parents
+func isCycle(path string, parents []string) bool {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return true
+	}
+	for _, parent := range parents {
+		if real == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// size of the buffers used when reading archives and writing restored files
+const copyBufferSize = 1 << 20
+
+// io.Copy allocates a buffer per call unless one side can do without, which
+// adds up over millions of small files, so the buffers are pooled
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, copyBufferSize)
+	return &buf
+}}
+
+// copyBuffered is io.Copy with a pooled buffer
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// decoders with concurrency enabled are expensive to set up, so they're reused
+var decoderPool sync.Pool
+
+func getDecoder(r io.Reader) (*zstd.Decoder, error) {
+	if dec, ok := decoderPool.Get().(*zstd.Decoder); ok {
+		if err := dec.Reset(r); err == nil {
+			return dec, nil
+		}
+		dec.Close()
+	}
+
+	return zstd.NewReader(r,
+		// decode blocks on every core instead of at most 4
+		zstd.WithDecoderConcurrency(0),
+		zstd.WithDecoderLowmem(false),
+		// accept archives written with windows larger than the default limit
+		zstd.WithDecoderMaxWindow(1<<31),
+		// archives name the dictionary they need, if any
+		zstd.WithDecoderDicts(loadDicts()...),
+	)
+}
+func putDecoder(dec *zstd.Decoder) {
+	// drop the reference to the previous input
+	dec.Reset(nil)
+	decoderPool.Put(dec)
+}
 
-		targetPath := filepath.Join(dst, header.Name)
+type restoreOptions struct {
+	// if set, restored files are checked against it
+	Manifest *Manifest
+	// reapply extended attributes and ACLs stored in the archive
+	Xattrs bool
+	// write the backup to stdout instead of extracting it, used by restoreFrom
+	Stdout bool
+	// only print what would be restored, used by restoreFrom
+	DryRun bool
+	// skip the free space check, used by restoreFrom
+	Force bool
+	// an ssh:// destination to restore onto instead of a local directory, used by restoreFrom
+	Remote string
+	// decides about files that already exist in the destination, nil if it didn't exist
+	Conflicts *conflictResolver
+	// which entries are restored
+	Filter pathFilter
+	// with --delta, the directory brought up to date, used by restoreFrom
+	DeltaDir string
+	// with --delta, the only files written. the others are already right
+	Delta map[string]bool
+	// compare the backup to the destination and ask before restoring, used by restoreFrom
+	ShowDiff bool
+	// give restored files the owners stored in the archive, nil to leave them to whoever restores
+	Owners *ownerMap
+	// the database a dump is replayed into instead of the one it's of, see database.go
+	Database string
+	// set when the destination ignores case, with what happens to files whose
+	// names differ only in case, see casefold.go
+	CaseInsensitive bool
+	CaseRenames     caseRenames
+}
+
+// decompressDir extracts the archive src into dst. returns the paths of files
+// that don't match the manifest or are missing from the archive
+func decompressDir(src, dst string, opts restoreOptions) ([]string, error) {
+	manifest := opts.Manifest
+	var mismatched []string
+	seen := make(map[string]bool)
+	xattrWarned, ownerWarned := false, false
+	// reused for every file
+	hasher := newFileHash()
+	buffered := bufio.NewWriterSize(nil, copyBufferSize)
+
+	err := readEntries(src, func(header *tar.Header, r io.Reader) error {
+		if !opts.Filter.Keep(header.Name) {
+			// directories of kept files are created along with them
+			seen[header.Name] = true
+			return nil
+		}
+		name, ok := opts.CaseRenames.Apply(header.Name)
+		if !ok {
+			seen[header.Name] = true
+			return nil
+		}
+		targetPath, ok := restoredPath(dst, name)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "WARNING: Skipping '%s', it would be restored outside of '%s'\n", escapeName(header.Name), dst)
+			seen[header.Name] = true
+			exitCode = exitPartial
+			return nil
+		}
+		// an earlier entry may have put a link where a directory of this one goes
+		if link, ok := linkedParent(dst, targetPath); ok {
+			fmt.Fprintf(os.Stderr, "WARNING: Skipping '%s', '%s' is a symlink and would lead outside of '%s'\n", escapeName(header.Name), link, dst)
+			seen[header.Name] = true
+			exitCode = exitPartial
+			return nil
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -211,32 +953,119 @@ func decompressDir(src, dst string) error {
 			}
 
 		case tar.TypeReg:
+			if opts.Delta != nil && !opts.Delta[header.Name] {
+				seen[header.Name] = true
+				return nil
+			}
+			if opts.Conflicts != nil {
+				var ok bool
+				if targetPath, ok = opts.Conflicts.Resolve(header, targetPath); !ok {
+					// kept the existing file, there's nothing of ours to verify
+					seen[header.Name] = true
+					return nil
+				}
+			}
 			if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
 				return err
 			}
-			outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			// don't write through a link that's in the way
+			if info, err := os.Lstat(targetPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				os.Remove(targetPath)
+			}
+			outFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
 			if err != nil {
 				return err
 			}
 
-			if _, err := io.Copy(outFile, tr); err != nil {
-				outFile.Close()
-				return err
+			hasher.Reset()
+			if isSparse(header) {
+				// recreate the holes instead of writing zeros
+				sparse := &sparseWriter{file: outFile}
+				_, err = copyBuffered(io.MultiWriter(sparse, hasher), r)
+				if err == nil {
+					err = sparse.Finish()
+				}
+			} else if err = preallocate(outFile, header.Size); err == nil {
+				buffered.Reset(outFile)
+				_, err = copyBuffered(io.MultiWriter(buffered, hasher), r)
+				if err == nil {
+					err = buffered.Flush()
+				}
 			}
 			outFile.Close()
+			if err != nil {
+				return err
+			}
+
+			if manifest != nil {
+				seen[header.Name] = true
+				entry, ok := manifest.Files[header.Name]
+				if !ok || entry.SHA256 != hashString(hasher) {
+					mismatched = append(mismatched, header.Name)
+				}
+			}
 
 		case tar.TypeSymlink:
 			if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
 				return err
 			}
+			// every archive of a chain stores the links again
+			if info, err := os.Lstat(targetPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				os.Remove(targetPath)
+			}
 			if err := os.Symlink(header.Linkname, targetPath); err != nil {
 				return err
 			}
 
 		default:
-			continue
+			return nil
+		}
+
+		if opts.Owners != nil {
+			if err := opts.Owners.Chown(targetPath, header); err != nil && !ownerWarned {
+				// only root can give files away
+				fmt.Fprintln(os.Stderr, "WARNING: Could not restore the owners of some files: ", err)
+				ownerWarned = true
+			}
+		}
+		if opts.Xattrs && header.Typeflag != tar.TypeSymlink {
+			if err := applyXattrs(targetPath, header); err != nil && !xattrWarned {
+				// eg. security.* needs privileges, keep going with the rest
+				fmt.Fprintln(os.Stderr, "WARNING: Could not restore some extended attributes: ", err)
+				xattrWarned = true
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return mismatched, err
 	}
 
-	return nil
+	if manifest != nil {
+		for _, path := range manifest.Paths() {
+			if !seen[path] && !manifest.Files[path].Unchanged && opts.Filter.Keep(path) {
+				mismatched = append(mismatched, path)
+			}
+		}
+	}
+
+	return mismatched, nil
+}
+
+// xattrs are stored the same way GNU tar and bsdtar store them
+const paxXattrPrefix = "SCHILY.xattr."
+
+// applyXattrs writes the extended attributes stored in header to path
+func applyXattrs(path string, header *tar.Header) error {
+	var firstErr error
+	for key, value := range header.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		if err := writeXattr(path, name, value); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s on '%s': %w", name, path, err)
+		}
+	}
+	return firstErr
 }
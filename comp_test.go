@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/tar"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTar writes a plain tar with the given entries, in order, into dir
+func writeTar(t *testing.T, dir string, entries []*tar.Header, contents map[string]string) string {
+	t.Helper()
+	archive := filepath.Join(dir, "foreign.tar")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, header := range entries {
+		header.Size = int64(len(contents[header.Name]))
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[header.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+// a link to a directory outside followed by a file under it must not write there
+func TestRestoreThroughSymlink(t *testing.T) {
+	dir := t.TempDir()
+	outside := filepath.Join(dir, "outside")
+	if err := os.Mkdir(outside, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	archive := writeTar(t, dir, []*tar.Header{
+		{Name: "d", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0o777},
+		{Name: "d/x.txt", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{"d/x.txt": "escaped"})
+
+	if _, err := foreignManifest(archive); err == nil || !strings.Contains(err.Error(), "symlink") {
+		t.Errorf("foreignManifest accepted an entry under a symlink, err: %v", err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	defer func(code int) { exitCode = code }(exitCode)
+	if _, err := decompressDir(archive, dst, restoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "x.txt")); err == nil {
+		t.Error("restore wrote through the symlink outside of the destination")
+	}
+	if exitCode != exitPartial {
+		t.Errorf("exitCode = %d, want %d for the skipped file", exitCode, exitPartial)
+	}
+}
+
+func TestThroughLink(t *testing.T) {
+	links := map[string]bool{"a/link": true}
+	for name, want := range map[string]bool{
+		"a/link/x":   true,
+		"a/link/b/x": true,
+		"a/link":     false,
+		"a/linked/x": false,
+		"b/x":        false,
+	} {
+		if _, got := throughLink(name, links); got != want {
+			t.Errorf("throughLink(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// fakeInfo describes a file that doesn't exist, eg. one too big to write in a test
+type fakeInfo struct {
+	name string
+	size int64
+}
+
+func (f fakeInfo) Name() string       { return f.name }
+func (f fakeInfo) Size() int64        { return f.size }
+func (f fakeInfo) Mode() os.FileMode  { return 0o644 }
+func (f fakeInfo) ModTime() time.Time { return time.Unix(1700000000, 0) }
+func (f fakeInfo) IsDir() bool        { return false }
+func (f fakeInfo) Sys() any           { return nil }
+
+// ustar stores sizes in 11 octal digits, so files of 8 GiB and more need PAX
+func TestHugeFileHeader(t *testing.T) {
+	const size = 8<<30 + 1
+	header, err := entryHeader(fakeInfo{name: "huge.img", size: size}, "", "disk/huge.img")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the contents come from zeroReader and go nowhere, only the header and the
+	// amount that's read back matter
+	r, w := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		aw, err := newArchiveWriter(w, "tar", nil)
+		if err == nil {
+			err = aw.WriteReader(header, zeroReader{}, crc32.NewIEEE())
+		}
+		if err == nil {
+			err = aw.Close()
+		}
+		w.CloseWithError(err)
+		done <- err
+	}()
+
+	tr := tar.NewReader(r)
+	read, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Name != "disk/huge.img" || read.Size != size {
+		t.Errorf("read back %q of %d bytes, want %q of %d", read.Name, read.Size, "disk/huge.img", int64(size))
+	}
+	if testing.Short() {
+		r.Close()
+		<-done
+		return
+	}
+	n, err := io.Copy(io.Discard, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size {
+		t.Errorf("read %d bytes of contents, want %d", n, int64(size))
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("want the end of the archive after the file, got %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// roundTrip backs up the files, name to contents, in every archive format,
+// restores them and checks they came back as they were
+func roundTrip(t *testing.T, files map[string]string) {
+	t.Helper()
+	src := t.TempDir()
+	for name, contents := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, format := range archiveFormats {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			archive := filepath.Join(dir, "backup."+format)
+			manifest, err := compressDir([]archiveRoot{{Path: src}}, archive, compressOptions{Format: format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name := range files {
+				if _, ok := manifest.Files[name]; !ok {
+					t.Errorf("%s isn't in the manifest", escapeName(name))
+				}
+			}
+
+			dst := filepath.Join(dir, "restored")
+			mismatched, err := decompressDir(archive, dst, restoreOptions{Manifest: manifest})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(mismatched) > 0 {
+				t.Errorf("files don't match the manifest: %q", mismatched)
+			}
+			for name, contents := range files {
+				restored, err := os.ReadFile(filepath.Join(dst, localName(name)))
+				if err != nil {
+					t.Errorf("%s wasn't restored: %v", escapeName(name), err)
+				} else if string(restored) != contents {
+					t.Errorf("%s came back as %q, want %q", escapeName(name), restored, contents)
+				}
+			}
+		})
+	}
+}
+
+func TestLongPaths(t *testing.T) {
+	// ustar only holds 100 bytes of name and 155 of prefix
+	var elems []string
+	for i := range 6 {
+		elems = append(elems, strings.Repeat(string(rune('a'+i)), 120))
+	}
+	long := strings.Join(elems, "/") + "/" + strings.Repeat("n", 200) + ".txt"
+	roundTrip(t, map[string]string{long: "deep", "short.txt": "flat"})
+}
+
+func TestNonASCIINames(t *testing.T) {
+	roundTrip(t, map[string]string{
+		"grüße/übung.txt": "umlauts",
+		"日本語/ファイル.txt":    "cjk",
+		"emoji-🎉.md":      "emoji",
+		"ελληνικά/αρχείο": "greek",
+	})
+}
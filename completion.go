@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// completion scripts call `backman __complete ids` to complete backup IDs,
+// which prints one "<id>\t<backed up path>" line per backup
+
+type completionCommand struct {
+	Name string
+	Desc string
+	// complete a backup ID as the first argument
+	TakesID bool
+	// complete paths as arguments
+	TakesPaths bool
+	Flags      []string
+}
+
+var completionCommands = []completionCommand{
+	{Name: "help", Desc: "Show usage"},
+	{Name: "info", Desc: "Print details of a backup, or the config", TakesID: true},
+	{Name: "backup", Desc: "Backup directories or files", TakesPaths: true, Flags: []string{"--follow-symlinks", "--separate", "--xattrs", "--snapshot", "--stdin", "--name", "--incremental", "--pause", "--format", "--max-file-size", "--newer-than", "--strict", "--retries", "--split-size"}},
+	{Name: "restore", Desc: "Restore from a backup", TakesID: true, Flags: []string{"--latest", "--xattrs", "--stdout", "--on-conflict", "--dry-run", "--force", "--show-diff", "--delta", "--include", "--exclude", "--owners", "--map-user", "--map-group"}},
+	{Name: "verify", Desc: "Check a backup's signature and contents", TakesID: true},
+	{Name: "scrub", Desc: "Verify the backups checked longest ago", Flags: []string{"--percent"}},
+	{Name: "repair", Desc: "Rebuild a damaged archive from its parity", TakesID: true},
+	{Name: "annotate", Desc: "Attach a note to a backup", TakesID: true},
+	{Name: "list", Desc: "List backups", Flags: []string{"--host", "--sort", "--reverse", "--columns", "--table", "--filter", "--since", "--until", "--group", "--all", "--utc"}},
+	{Name: "search", Desc: "Find backups containing matching files", Flags: []string{"--regex", "--content", "--of", "--since", "--until"}},
+	{Name: "history", Desc: "List the backups that have a file", TakesPaths: true, Flags: []string{"--of"}},
+	{Name: "cat", Desc: "Print a file of a backup", TakesID: true, Flags: []string{"--raw"}},
+	{Name: "delete", Desc: "Delete a backup", TakesID: true, Flags: []string{"--cascade", "--of", "--all", "--force", "--yes", "--i-know"}},
+	{Name: "purge", Desc: "Delete backups older than a date or duration", Flags: []string{"--between", "--of", "--force", "--yes", "--i-know"}},
+	{Name: "undelete", Desc: "Bring a deleted backup back"},
+	{Name: "trash", Desc: "List or empty deleted backups"},
+	{Name: "fsck", Desc: "Find and rebuild archives without a sidecar", Flags: []string{"--rebuild", "--of", "--remove-partial", "--i-know"}},
+	{Name: "quarantine", Desc: "Manage backups with unparsable sidecars", Flags: []string{"--force", "--yes", "--i-know"}},
+	{Name: "dict", Desc: "Train and manage zstd dictionaries"},
+	{Name: "run", Desc: "Run a profile: backup, verify, prune, mirror and hooks", Flags: []string{"--profile"}},
+	{Name: "install-schedule", Desc: "Schedule daily backups with the OS scheduler", TakesPaths: true, Flags: []string{"--daily", "--name", "--incremental", "--profile", "--scrub", "--dry-run", "--remove"}},
+	{Name: "status", Desc: "Show when each path was last backed up"},
+	{Name: "stats", Desc: "Summarize the backup catalog"},
+	{Name: "rebind", Desc: "Make backups ones of a moved path", TakesID: true, Flags: []string{"--of"}},
+	{Name: "catalog", Desc: "List, save or restore bundles of the catalog", Flags: []string{"--force"}},
+	{Name: "migrate", Desc: "Rewrite old sidecars in the current format", Flags: []string{"--dry-run"}},
+	{Name: "keychain", Desc: "Remember or forget the passphrase in the OS keychain"},
+	{Name: "rekey", Desc: "Change the passphrase of encrypted backups", Flags: []string{"--new-key-file", "--new-key-command", "--new-fido2", "--rotate"}},
+	{Name: "report", Desc: "Report backup sizes and durations over time", Flags: []string{"--of", "--since", "--until", "--csv"}},
+	{Name: "export", Desc: "Copy a backup into another directory", TakesID: true},
+	{Name: "import", Desc: "Add exported backups", TakesPaths: true},
+	{Name: "import-archive", Desc: "Add an archive made by another tool as a backup", TakesPaths: true, Flags: []string{"--of", "--move"}},
+	{Name: "import-restic", Desc: "Import the snapshots of a restic repository", TakesPaths: true, Flags: []string{"--incremental", "--path"}},
+	{Name: "import-borg", Desc: "Import the archives of a borg repository", TakesPaths: true, Flags: []string{"--incremental", "--path"}},
+	{Name: "push", Desc: "Upload a backup to the remote", TakesID: true},
+	{Name: "flush", Desc: "Upload the backups queued while offline"},
+	{Name: "pull", Desc: "Download a backup from the remote"},
+	{Name: "remote", Desc: "List backups on the remote or log in"},
+	{Name: "sync", Desc: "Sync the mirror with the archive dir"},
+	{Name: "backends", Desc: "List external backends on the PATH"},
+	{Name: "config", Desc: "Manage the config file"},
+	{Name: "completion", Desc: "Print a shell completion script"},
+	{Name: "serve", Desc: "Run the web UI"},
+}
+
+func printCompletion(shell string) {
+	switch shell {
+	case "bash":
+		fmt.Print(bashCompletion())
+	case "zsh":
+		fmt.Print(zshCompletion())
+	case "fish":
+		fmt.Print(fishCompletion())
+	default:
+		fmt.Fprintf(os.Stderr, "unsupported shell %q, use bash, zsh or fish\n", shell)
+		os.Exit(exitUsage)
+	}
+}
+
+func bashCompletion() string {
+	var b strings.Builder
+	var names []string
+	for _, cmd := range completionCommands {
+		names = append(names, cmd.Name)
+	}
+
+	b.WriteString("_backman() {\n")
+	b.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	b.WriteString("\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+	fmt.Fprintf(&b, "\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	b.WriteString("\t\treturn\n\tfi\n\n")
+
+	b.WriteString("\tcase \"${COMP_WORDS[1]}\" in\n")
+	for _, cmd := range completionCommands {
+		if !cmd.TakesID && len(cmd.Flags) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\t%s)\n", cmd.Name)
+		if len(cmd.Flags) > 0 {
+			b.WriteString("\t\tif [[ \"$cur\" == -* ]]; then\n")
+			fmt.Fprintf(&b, "\t\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(cmd.Flags, " "))
+			b.WriteString("\t\t\treturn\n\t\tfi\n")
+		}
+		if cmd.TakesID {
+			b.WriteString("\t\tif [ \"$COMP_CWORD\" -eq 2 ]; then\n")
+			b.WriteString("\t\t\tCOMPREPLY=($(compgen -W \"$(backman __complete ids </dev/null 2>/dev/null | cut -f1)\" -- \"$cur\"))\n")
+			b.WriteString("\t\tfi\n")
+		}
+		b.WriteString("\t\t;;\n")
+	}
+	b.WriteString("\tcompletion)\n\t\tCOMPREPLY=($(compgen -W \"bash zsh fish\" -- \"$cur\"))\n\t\t;;\n")
+	b.WriteString("\tconfig)\n\t\tCOMPREPLY=($(compgen -W \"init validate set edit\" -- \"$cur\"))\n\t\t;;\n")
+	b.WriteString("\tesac\n}\n")
+
+	// -o default falls back to file completion when nothing matched
+	b.WriteString("complete -o default -F _backman backman\n")
+	return b.String()
+}
+
+func zshCompletion() string {
+	var b strings.Builder
+
+	b.WriteString("#compdef backman\n\n_backman() {\n")
+	b.WriteString("\tlocal -a commands ids\n\tcommands=(\n")
+	for _, cmd := range completionCommands {
+		fmt.Fprintf(&b, "\t\t'%s:%s'\n", cmd.Name, strings.ReplaceAll(cmd.Desc, "'", "'\\''"))
+	}
+	b.WriteString("\t)\n\n")
+	b.WriteString("\tif (( CURRENT == 2 )); then\n\t\t_describe 'command' commands\n\t\treturn\n\tfi\n\n")
+
+	b.WriteString("\tcase \"$words[2]\" in\n")
+	for _, cmd := range completionCommands {
+		if !cmd.TakesID && !cmd.TakesPaths && len(cmd.Flags) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\t%s)\n", cmd.Name)
+		if cmd.TakesID {
+			b.WriteString("\t\tif (( CURRENT == 3 )); then\n")
+			b.WriteString("\t\t\tids=(${(f)\"$(backman __complete ids </dev/null 2>/dev/null)\"})\n")
+			b.WriteString("\t\t\tids=(${ids//$'\\t'/:})\n")
+			b.WriteString("\t\t\t_describe 'backup' ids\n")
+			b.WriteString("\t\tfi\n")
+		}
+		if len(cmd.Flags) > 0 || cmd.TakesPaths {
+			b.WriteString("\t\t_arguments")
+			for _, flag := range cmd.Flags {
+				fmt.Fprintf(&b, " '%s'", flag)
+			}
+			if cmd.TakesPaths {
+				b.WriteString(" '*:path:_files'")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\t\t;;\n")
+	}
+	b.WriteString("\tcompletion)\n\t\t_values 'shell' bash zsh fish\n\t\t;;\n")
+	b.WriteString("\tconfig)\n\t\t_values 'action' init validate set edit\n\t\t;;\n")
+	b.WriteString("\tesac\n}\n\ncompdef _backman backman\n")
+	return b.String()
+}
+
+func fishCompletion() string {
+	var b strings.Builder
+
+	b.WriteString("complete -c backman -f\n")
+	for _, cmd := range completionCommands {
+		fmt.Fprintf(&b, "complete -c backman -n __fish_use_subcommand -a %s -d '%s'\n", cmd.Name, strings.ReplaceAll(cmd.Desc, "'", "\\'"))
+	}
+	b.WriteString("\n")
+
+	for _, cmd := range completionCommands {
+		cond := fmt.Sprintf("'__fish_seen_subcommand_from %s'", cmd.Name)
+		if cmd.TakesID {
+			fmt.Fprintf(&b, "complete -c backman -n %s -a '(backman __complete ids </dev/null 2>/dev/null)'\n", cond)
+		}
+		if cmd.TakesPaths {
+			fmt.Fprintf(&b, "complete -c backman -n %s -F\n", cond)
+		}
+		for _, flag := range cmd.Flags {
+			fmt.Fprintf(&b, "complete -c backman -n %s -l %s\n", cond, strings.TrimPrefix(flag, "--"))
+		}
+	}
+	b.WriteString("complete -c backman -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'\n")
+	b.WriteString("complete -c backman -n '__fish_seen_subcommand_from config' -a 'init validate set edit'\n")
+	return b.String()
+}
+
+// completeIDs prints every backup ID along with what it's a backup of
+func completeIDs() {
+	// readSidecars can print warnings and prompts, which must not end up as completions
+	stdout := os.Stdout
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err == nil {
+		os.Stdout = devNull
+		defer devNull.Close()
+	}
+
+	sidecars, err := readSidecars()
+	os.Stdout = stdout
+	if err != nil {
+		os.Exit(exitFatal)
+	}
+
+	sort.Slice(sidecars, func(i, j int) bool {
+		return sidecars[i].ID < sidecars[j].ID
+	})
+	for _, sidecar := range sidecars {
+		fmt.Printf("%d\t%s\n", sidecar.ID, sidecar.BackupOf)
+	}
+}
@@ -1,21 +1,101 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 
 	"github.com/mcuadros/go-defaults"
 )
 
 var config Config
 
+// the doc tags are written as comments by `config init`
 type Config struct {
-	ArchiveDir string `json:"archive_dir"`
-	TimeFormat string `json:"time_format" default:"02.01.2006 15:04:05"`
+	ArchiveDir     string `json:"archive_dir" doc:"where backups and their sidecar files are stored"`
+	TimeFormat     string `json:"time_format" default:"02.01.2006 15:04:05" doc:"go time layout used when printing times"`
+	Language       string `json:"language" doc:"language messages are shown in, eg. \"de\". empty to go by LC_ALL, LC_MESSAGES or LANG"`
+	TimeZone       string `json:"time_zone" doc:"zone times are printed in and dates like 2024-05-01 are read in, eg. \"UTC\" or \"Europe/Berlin\". empty for the system's. times are stored in UTC either way"`
+	ListFilter     bool   `json:"list_filter" doc:"list only shows backups matching the query, instead of greying out the rest"`
+	ArchiveFormat  string `json:"archive_format" default:"tar.zstd" doc:"format of new archives: \"tar.zstd\", \"tar.gz\", \"tar\" (no compression, for already compressed media) or \"zip\" (for windows)"`
+	FollowSymlinks bool   `json:"follow_symlinks" doc:"archive what symlinks point to instead of the links"`
+	Xattrs         bool   `json:"xattrs" doc:"store and restore extended attributes and ACLs (linux only)"`
+	Snapshot       string `json:"snapshot" doc:"back up from a \"btrfs\", \"zfs\" or \"lvm\" snapshot of the target, empty to disable"`
+	SnapshotSize   string `json:"snapshot_size" default:"1G" doc:"space reserved for changes made while an lvm snapshot exists"`
+
+	NoColor bool              `json:"no_color" doc:"print list and status without colors. they're also left out when output isn't a terminal or NO_COLOR is set"`
+	Colors  map[string]string `json:"colors" doc:"colors of list and status by role, as ANSI codes, eg. {\"stale\": \"1;31\"}. roles are ok, warning, stale, match and other, \"\" turns one off"`
+
+	DockerPause bool   `json:"docker_pause" doc:"pause the containers using a docker volume while it's backed up, so databases and the like are captured consistently"`
+	DockerImage string `json:"docker_image" default:"busybox" doc:"image of the helper container that reads docker volumes this machine can't read directly, it needs tar"`
+
+	MaxFileSize string `json:"max_file_size" doc:"leave files bigger than this out of backups, eg. \"500M\". empty for no limit"`
+	NewerThan   string `json:"newer_than" doc:"only back up files modified within this long, eg. \"7d\" or \"2w\" for a work in progress snapshot, or since a date like \"2024-05-01\". empty for every file"`
+
+	ArchiveNameTemplate string `json:"archive_name_template" doc:"go template naming new archives, eg. \"{{.Host}}-{{.Target | base}}-{{.Time}}-{{.UUID}}\". has .Host, .User, .Target, .Time and .UUID, which it has to contain. empty names them by their UUID"`
+
+	Encrypt    bool   `json:"encrypt" doc:"encrypt new archives and manifests, each with a random key that's wrapped by the master key in backman.key in the archive dir. the master key is unlocked with a passphrase that's typed in or set in the BACKMAN_PASSPHRASE environment variable, key_file, key_command or a security key (see rekey). sidecars stay readable, so what was backed up when isn't secret"`
+	KeyFile    string `json:"key_file" doc:"file whose contents unlock the master key instead of a passphrase. keep it somewhere other than the archive dir"`
+	Keychain   bool   `json:"keychain" doc:"remember the passphrase in the OS keychain once it's typed in: the macOS keychain, the secret service through secret-tool on linux, or the windows credential manager"`
+	KeyCommand string `json:"key_command" doc:"command, split on spaces, printing what unlocks the master key instead of a passphrase. eg. \"age -d -i /home/me/yubikey-identity.txt /home/me/backman-secret.age\" for a PIV token with age-plugin-yubikey. FIDO2 security keys are set up with rekey --new-fido2 instead"`
+
+	SplitSize string `json:"split_size" doc:"split new archives into numbered volumes of this size, eg. \"4G\" for FAT32 drives or providers with an object size limit. empty for single files"`
+
+	AppendOnly bool `json:"append_only" doc:"refuse to delete, purge or expire backups and to empty the trash unless --i-know is passed, and keep backups deleted anyway on mirrors. guards against mistakes and scripts, not against someone who can edit this file"`
+
+	LowPriority bool `json:"low_priority" doc:"run at the lowest CPU and IO priority on fewer cores, so backups don't slow down everything else. scheduled backups always do"`
+
+	Strict  bool `json:"strict" doc:"abort a backup on the first file that can't be read, instead of leaving it out with a warning"`
+	Retries int  `json:"retries" default:"3" doc:"how often a file that changes while it's backed up is read again before it's stored as is and flagged. only files up to 1MiB can be read again"`
+
+	NonInteractive bool   `json:"non_interactive" doc:"never prompt, take default_answer instead. also the case when stdin isn't a terminal, eg. under cron"`
+	DefaultAnswer  string `json:"default_answer" default:"no" doc:"what yes/no prompts take without anyone to ask, \"yes\" or \"no\". conflicts on restore are skipped unless on_conflict says otherwise"`
+
+	VerifyAfterBackup bool   `json:"verify_after_backup" doc:"read every new archive back and check it against its manifest before declaring success"`
+	ScrubPercent      int    `json:"scrub_percent" default:"10" doc:"percentage of the backups scrub verifies per run, the ones checked longest ago first. 10 reads every archive back once every 10 runs"`
+	ContentIndex      bool   `json:"content_index" doc:"index the words in text files up to 1MiB while backing up, so search --content can find files by what's in them. the index is stored next to the archive and takes some space"`
+	StaleAfter        string `json:"stale_after" default:"7d" doc:"how long a path can go without a backup before status and list flag it, eg. 36h, 2w or 1mo. empty to never flag them"`
+	Dedupe            string `json:"dedupe" default:"ask" doc:"when a backup is identical to the previous one of the same paths: \"ask\" whether to drop it, \"auto\" drops it, \"off\" keeps it"`
+
+	OnConflict     string `json:"on_conflict" default:"ask" doc:"what restore does with files that already exist: \"ask\", \"overwrite\", \"skip\", \"rename\" (restore next to them) or \"newer\" (keep whichever is newer)"`
+	CaseCollisions string `json:"case_collisions" default:"rename" doc:"what restore does on file systems that ignore case (usually macOS and windows) with files whose names differ only in case, eg. Readme.md and README.md: \"rename\" restores the later ones as Readme.case-2.md, \"skip\" leaves them out, \"overwrite\" lets the last one win"`
+
+	SignWith         string `json:"sign_with" doc:"sign new archives with \"gpg\" or \"ssh\", empty to disable"`
+	SigningKey       string `json:"signing_key" doc:"gpg key id, or path of the ssh private key (its .pub is used to verify)"`
+	RequireSignature bool   `json:"require_signature" doc:"refuse to restore archives with a missing or invalid signature instead of warning"`
+
+	SpaceCheckRatio float64 `json:"space_check_ratio" default:"1" doc:"expected archive size as a fraction of the backed up data, used to check for free space before a backup. eg. 0.5 for mostly text, 0 disables the check"`
+
+	CatalogVersions int `json:"catalog_versions" default:"10" doc:"how many bundles of the config, sidecars, master key and dictionaries are kept in .catalog in the archive dir, see catalog restore. a new one is saved whenever they change, 0 disables them"`
+
+	TrashDays int `json:"trash_days" default:"30" doc:"days deleted backups are kept in the trash (.trash in the archive dir) before they're gone for good, 0 deletes them right away"`
+
+	ParityPercent int `json:"parity_percent" doc:"store Reed-Solomon parity of this percentage of each new archive, so the repair command can fix that much damage. 0 to disable"`
+
+	Remote        string `json:"remote" doc:"offsite storage for push/pull, eg. \"dropbox:/backman\", \"rclone:myremote:backman\", \"s3:mybucket/backman\" (with the aws cli), a local directory or \"<kind>:...\" for a backman-backend-<kind> on the PATH"`
+	AutoPush      bool   `json:"auto_push" doc:"upload every new backup to the remote. backups that can't be uploaded, eg. while offline, are queued (.queue in the archive dir) for flush and the next backup"`
+	FlushInterval string `json:"flush_interval" default:"15m" doc:"how often serve uploads the backups auto_push queued, empty to leave them to flush and the next backup"`
+	Mirror        string `json:"mirror" doc:"second location kept in sync with the archive dir after every backup and by sync, a directory or remote like above"`
+	DropboxAppKey string `json:"dropbox_app_key" doc:"app key of your dropbox app, see https://www.dropbox.com/developers/apps"`
+	UploadRetries int    `json:"upload_retries" default:"5" doc:"how often an upload to dropbox is retried after a network error, waiting twice as long each time up to a minute. interrupted uploads of big files resume on the next push or sync. rclone and the aws cli retry on their own"`
+
+	ObjectLock     string `json:"object_lock" doc:"lock backups uploaded to an s3 remote or mirror for this long after they were made, eg. \"90d\" or \"1y\", so not even someone with the credentials can delete them before. the bucket needs object lock enabled. empty to disable"`
+	ObjectLockMode string `json:"object_lock_mode" default:"governance" doc:"\"governance\" lets users with the s3:BypassGovernanceRetention permission remove locks early, \"compliance\" lets no one, not even the root account"`
+
+	PathAliases map[string]string `json:"path_aliases" doc:"directories that were moved or mounted elsewhere, old path to new path, eg. {\"/mnt/old-disk\": \"/mnt/data\"}. backups of paths in the old one count as backups of the new one. see rebind to change the backups themselves"`
+
+	Profiles map[string]profile `json:"profiles" doc:"named pipelines for run --profile, eg. {\"home\": {\"paths\": [\"/home/me\"], \"incremental\": true, \"before\": \"systemctl stop app\", \"after\": \"systemctl start app\", \"verify\": true, \"prune\": \"90d\", \"mirror\": true, \"notify\": \"/usr/local/bin/mail-me\"}}. hooks and notify are split on spaces, notify gets the summary on stdin"`
+
+	MetricsFile string `json:"metrics_file" doc:"write prometheus metrics here after every backup, eg. for node_exporter's textfile collector. empty to disable"`
+
+	ServePassword string `json:"serve_password" doc:"password the web UI asks for (http basic auth, any user name), required for serve to listen on anything but localhost. it's sent unencrypted, put serve behind a TLS proxy on networks you don't trust"`
 }
 
 func (c *Config) SetDefaultDir() {
@@ -34,11 +114,281 @@ func loadConfig() {
 		return
 	}
 
-	err = json.Unmarshal(contents, &config)
+	unknown, err := parseConfig(contents, &config)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error parsing config: ", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "error parsing config '%s': %v\n", path, err)
+		fmt.Fprintln(os.Stderr, "run `backman config validate` for details")
+		os.Exit(exitUsage)
+	}
+	for _, key := range unknown {
+		fmt.Fprintf(os.Stderr, "WARNING: Unknown config key %q in '%s'\n", key, path)
+	}
+}
+
+// reloadConfig loads the config as it's now, for after the config commands
+// changed it. returns false instead of exiting if it's broken
+func reloadConfig() bool {
+	config = Config{}
+	defaults.SetDefaults(&config)
+	config.SetDefaultDir()
+	contents, err := os.ReadFile(getConfigPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false
 	}
+	if err == nil {
+		if _, err := parseConfig(contents, &config); err != nil {
+			return false
+		}
+	}
+	applyOverrides(os.Args[:1])
+	return true
+}
+
+// takeConfigFlag removes --config [path] from args and has BACKMAN_CONFIG point
+// at the file, so getConfigPath and the backman commands run by this one use it.
+// it can appear anywhere before a "--"
+func takeConfigFlag(args []string) []string {
+	rest := []string{args[0]}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				fmt.Fprintln(os.Stderr, "--config needs the path of a config file")
+				os.Exit(exitUsage)
+			}
+			i++
+			value = args[i]
+		}
+		path, err := filepath.Abs(value)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error getting absolute path of config: ", err)
+			os.Exit(exitUsage)
+		}
+		os.Setenv("BACKMAN_CONFIG", path)
+	}
+	return rest
+}
+
+// applyOverrides layers BACKMAN_* environment variables and then --key=value
+// flags on top of the loaded config. the flags can appear anywhere in args and
+// are removed from the returned args
+func applyOverrides(args []string) []string {
+	fields := configFields()
+
+	for _, field := range fields {
+		env := "BACKMAN_" + strings.ToUpper(field.Key)
+		if value, ok := os.LookupEnv(env); ok {
+			if err := setField(field.Value, value); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid value for %s: %v\n", env, err)
+				os.Exit(exitUsage)
+			}
+		}
+	}
+
+	rest := []string{args[0]}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		key := strings.ReplaceAll(name, "-", "_")
+
+		var field *configField
+		if strings.HasPrefix(arg, "-") {
+			for _, f := range fields {
+				if f.Key == key {
+					field = &f
+					break
+				}
+			}
+		}
+		if field == nil {
+			rest = append(rest, arg)
+			continue
+		}
+
+		if !hasValue {
+			if field.Value.Kind() == reflect.Bool {
+				// like the flag package, bools only take a value with =
+				value = "true"
+			} else if i+1 < len(args) {
+				i++
+				value = args[i]
+			} else {
+				fmt.Fprintf(os.Stderr, "flag needs an argument: %s\n", arg)
+				os.Exit(exitUsage)
+			}
+		}
+
+		if err := setField(field.Value, value); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid value for %s: %v\n", arg, err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	return rest
+}
+
+// parseConfig reads a config file into cfg, allowing // comments.
+// returns the keys that don't belong to any config field
+func parseConfig(contents []byte, cfg *Config) ([]string, error) {
+	contents = stripComments(contents)
+
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &keys); err != nil {
+		return nil, describeJSONError(contents, err)
+	}
+	if err := json.Unmarshal(contents, cfg); err != nil {
+		return nil, describeJSONError(contents, err)
+	}
+
+	known := make(map[string]bool)
+	for _, field := range configFields() {
+		known[field.Key] = true
+	}
+
+	var unknown []string
+	for key := range keys {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// stripComments blanks out // comments outside of strings, keeping line numbers intact
+func stripComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inString, escaped, inComment := false, false, false
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inComment:
+			if c == '\n' {
+				inComment = false
+				out = append(out, c)
+			}
+		case inString:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			out = append(out, c)
+		case c == '"':
+			inString = true
+			out = append(out, c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			inComment = true
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// describeJSONError adds the line number to syntax and type errors
+func describeJSONError(data []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+
+	line := 1 + bytes.Count(data[:min(offset, int64(len(data)))], []byte("\n"))
+	return fmt.Errorf("line %d: %w", line, err)
+}
+
+type configField struct {
+	Key   string
+	Doc   string
+	Value reflect.Value
+}
+
+// configFields returns every field of the global config
+func configFields() []configField {
+	return fieldsOf(&config)
+}
+func fieldsOf(cfg *Config) []configField {
+	var fields []configField
+
+	v := reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+
+		fields = append(fields, configField{
+			Key:   key,
+			Doc:   t.Field(i).Tag.Get("doc"),
+			Value: v.Field(i),
+		})
+	}
+	return fields
+}
+
+// defaultConfig returns the config used when there is no config file
+func defaultConfig() Config {
+	var cfg Config
+	defaults.SetDefaults(&cfg)
+	cfg.SetDefaultDir()
+	return cfg
+}
+
+// writeConfig writes cfg as json with every key preceded by its doc comment
+func writeConfig(path string, cfg *Config) error {
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+
+	fields := fieldsOf(cfg)
+	for i, field := range fields {
+		value, err := json.Marshal(field.Value.Interface())
+		if err != nil {
+			return err
+		}
+		if field.Value.Kind() == reflect.Map && field.Value.IsNil() {
+			value = []byte("{}")
+		}
+
+		if field.Doc != "" {
+			fmt.Fprintf(&buf, "\t// %s\n", field.Doc)
+		}
+		fmt.Fprintf(&buf, "\t%q: %s", field.Key, value)
+		if i < len(fields)-1 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString("}\n")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
 }
 
 const appName = "backman"
@@ -71,6 +421,9 @@ func getAppDir() string {
 }
 
 func getConfigPath() string {
+	if path := os.Getenv("BACKMAN_CONFIG"); path != "" {
+		return path
+	}
 	// XDG_CONFIG_HOME, fallback to Windows/AppData/<appName> or ~/.config/<appName>/<appName>.json
 	dir := resolveDir("XDG_CONFIG_HOME", appName, filepath.Join(".config", appName))
 	return filepath.Join(dir, appName+".json")
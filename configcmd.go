@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+func configCommand(args []string) {
+	if len(args) == 0 {
+		usageError("config")
+	}
+
+	switch args[0] {
+	case "init":
+		force := len(args) > 1 && args[1] == "--force"
+		configInit(force)
+	case "validate":
+		if !configValidate() {
+			os.Exit(exitUsage)
+		}
+	case "set":
+		if len(args) < 3 {
+			usageError("config")
+		}
+		configSet(args[1], args[2])
+	case "edit":
+		configEdit()
+	default:
+		usageError("config")
+	}
+}
+
+func configInit(force bool) {
+	path := getConfigPath()
+	if _, err := os.Stat(path); err == nil && !force {
+		fmt.Fprintf(os.Stderr, "'%s' already exists, use --force to overwrite it\n", path)
+		os.Exit(exitUsage)
+	}
+
+	cfg := defaultConfig()
+	if err := writeConfig(path, &cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "error writing config: ", err)
+		os.Exit(exitFatal)
+	}
+	fmt.Printf("Wrote default config to '%s'\n", path)
+}
+
+// configValidate prints every problem found in the config file, returns false if there were any
+func configValidate() bool {
+	path := getConfigPath()
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No config file at '%s', using defaults\n", path)
+		return true
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading config: ", err)
+		return false
+	}
+
+	var problems []string
+
+	cfg := defaultConfig()
+	unknown, err := parseConfig(contents, &cfg)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, key := range unknown {
+		problems = append(problems, fmt.Sprintf("unknown key %q", key))
+	}
+
+	if err == nil {
+		problems = append(problems, checkConfig(&cfg)...)
+	}
+
+	if len(problems) == 0 {
+		fmt.Printf("'%s' is valid\n", path)
+		return true
+	}
+
+	fmt.Printf("Found %d problems in '%s':\n", len(problems), path)
+	for _, problem := range problems {
+		fmt.Printf("\t%s\n", problem)
+	}
+	return false
+}
+
+// checkConfig checks the values of a parsed config
+func checkConfig(cfg *Config) []string {
+	var problems []string
+
+	if strings.HasPrefix(cfg.ArchiveDir, "rclone:") {
+		// every command reads sidecars and archives as local files, see rcloneRemote
+		problems = append(problems, "archive_dir has to be local, backups are read from it all the time. set remote to the rclone path instead and enable auto_push")
+	} else if !filepath.IsAbs(cfg.ArchiveDir) {
+		problems = append(problems, fmt.Sprintf("archive_dir '%s' is not an absolute path", cfg.ArchiveDir))
+	}
+	if cfg.Remote != "" {
+		problems = append(problems, checkRemoteSpec("remote", cfg.Remote, cfg)...)
+	}
+	if cfg.Mirror != "" {
+		problems = append(problems, checkRemoteSpec("mirror", cfg.Mirror, cfg)...)
+		if filepath.Clean(cfg.Mirror) == filepath.Clean(cfg.ArchiveDir) {
+			problems = append(problems, "mirror can't be the archive_dir itself")
+		}
+	}
+	if info, err := os.Stat(cfg.ArchiveDir); err == nil {
+		if !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("archive_dir '%s' is not a directory", cfg.ArchiveDir))
+		} else if err := checkWritable(cfg.ArchiveDir); err != nil {
+			problems = append(problems, fmt.Sprintf("archive_dir '%s' is not writable: %v", cfg.ArchiveDir, err))
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		problems = append(problems, fmt.Sprintf("archive_dir: %v", err))
+	}
+
+	for _, role := range slices.Sorted(maps.Keys(cfg.Colors)) {
+		if !slices.Contains(colorRoles(), role) {
+			problems = append(problems, fmt.Sprintf("colors: unknown role %q, use one of %s", role, strings.Join(colorRoles(), ", ")))
+		} else if code := cfg.Colors[role]; code != "" && !validColor(code) {
+			problems = append(problems, fmt.Sprintf("colors: %q isn't an ANSI code like \"31\" or \"1;33\"", code))
+		}
+	}
+	for _, old := range slices.Sorted(maps.Keys(cfg.PathAliases)) {
+		if !filepath.IsAbs(old) || !filepath.IsAbs(cfg.PathAliases[old]) {
+			problems = append(problems, fmt.Sprintf("path_aliases: '%s' => '%s' needs two absolute paths", old, cfg.PathAliases[old]))
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(cfg.Profiles)) {
+		prof := cfg.Profiles[name]
+		if len(prof.Paths) == 0 {
+			problems = append(problems, fmt.Sprintf("profiles: '%s' has no paths to back up", name))
+		}
+		if prof.Prune != "" {
+			if _, err := parseTimeRange("", prof.Prune); err != nil {
+				problems = append(problems, fmt.Sprintf("profiles: prune %q of '%s' isn't a date or duration: %v", prof.Prune, name, err))
+			}
+		}
+		if prof.Mirror && cfg.Mirror == "" {
+			problems = append(problems, fmt.Sprintf("profiles: '%s' syncs the mirror, but mirror isn't set", name))
+		}
+		for _, hook := range []struct{ key, command string }{{"before", prof.Before}, {"after", prof.After}, {"notify", prof.Notify}} {
+			if hook.command == "" {
+				continue
+			}
+			fields := strings.Fields(hook.command)
+			if len(fields) == 0 {
+				problems = append(problems, fmt.Sprintf("profiles: %s of '%s' is only whitespace", hook.key, name))
+			} else if _, err := exec.LookPath(fields[0]); err != nil {
+				problems = append(problems, fmt.Sprintf("profiles: %s of '%s': %v", hook.key, name, err))
+			}
+		}
+	}
+
+	// a layout without any time fields formats every time the same
+	a := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	b := time.Date(2007, 2, 3, 4, 5, 6, 0, time.UTC)
+	if a.Format(cfg.TimeFormat) == b.Format(cfg.TimeFormat) {
+		problems = append(problems, fmt.Sprintf("time_format %q doesn't contain any date or time fields", cfg.TimeFormat))
+	}
+
+	if !isArchiveFormat(cfg.ArchiveFormat) {
+		problems = append(problems, fmt.Sprintf("archive_format %q must be one of: %s", cfg.ArchiveFormat, strings.Join(archiveFormats, ", ")))
+	}
+	if cfg.ArchiveNameTemplate != "" {
+		if _, err := parseArchiveNameTemplate(cfg.ArchiveNameTemplate); err != nil {
+			problems = append(problems, fmt.Sprintf("archive_name_template: %v", err))
+		}
+	}
+
+	switch cfg.Dedupe {
+	case "ask", "auto", "off":
+	default:
+		problems = append(problems, fmt.Sprintf("dedupe %q must be \"ask\", \"auto\" or \"off\"", cfg.Dedupe))
+	}
+
+	if !slices.Contains(conflictModes, cfg.OnConflict) {
+		problems = append(problems, fmt.Sprintf("on_conflict %q must be one of: %s", cfg.OnConflict, strings.Join(conflictModes, ", ")))
+	}
+	if cfg.Language != "" && !slices.Contains(locales(), cfg.Language) {
+		problems = append(problems, fmt.Sprintf("language %q has no translation, use one of %s", cfg.Language, strings.Join(locales(), ", ")))
+	}
+	if cfg.TimeZone != "" {
+		if _, err := time.LoadLocation(cfg.TimeZone); err != nil {
+			problems = append(problems, fmt.Sprintf("time_zone %q isn't a zone, use eg. \"UTC\" or \"Europe/Berlin\": %v", cfg.TimeZone, err))
+		}
+	}
+	if cfg.StaleAfter != "" {
+		if _, err := timeAgo(cfg.StaleAfter, time.Now()); err != nil {
+			problems = append(problems, fmt.Sprintf("stale_after: %v", err))
+		}
+	}
+	if cfg.ScrubPercent < 1 || cfg.ScrubPercent > 100 {
+		problems = append(problems, fmt.Sprintf("scrub_percent %d must be between 1 and 100", cfg.ScrubPercent))
+	}
+	if !slices.Contains(caseModes, cfg.CaseCollisions) {
+		problems = append(problems, fmt.Sprintf("case_collisions %q must be one of: %s", cfg.CaseCollisions, strings.Join(caseModes, ", ")))
+	}
+
+	switch cfg.Snapshot {
+	case "", "btrfs", "zfs", "lvm":
+	default:
+		problems = append(problems, fmt.Sprintf("snapshot %q must be \"btrfs\", \"zfs\", \"lvm\" or empty", cfg.Snapshot))
+	}
+
+	switch cfg.SignWith {
+	case "", "gpg":
+	case "ssh":
+		if _, err := os.Stat(cfg.SigningKey + ".pub"); err != nil {
+			problems = append(problems, fmt.Sprintf("signing_key: ssh signing needs a key with a .pub next to it: %v", err))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("sign_with %q must be \"gpg\", \"ssh\" or empty", cfg.SignWith))
+	}
+
+	if _, err := parseFileFilter(cfg.MaxFileSize, cfg.NewerThan); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, err := parseSplitSize(cfg.SplitSize); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if cfg.DefaultAnswer != "yes" && cfg.DefaultAnswer != "no" {
+		problems = append(problems, fmt.Sprintf("default_answer %q must be \"yes\" or \"no\"", cfg.DefaultAnswer))
+	}
+	if cfg.Retries < 0 {
+		problems = append(problems, fmt.Sprintf("retries %d can't be negative", cfg.Retries))
+	}
+	if cfg.UploadRetries < 0 {
+		problems = append(problems, fmt.Sprintf("upload_retries %d can't be negative", cfg.UploadRetries))
+	}
+	if cfg.SpaceCheckRatio < 0 {
+		problems = append(problems, fmt.Sprintf("space_check_ratio %v can't be negative", cfg.SpaceCheckRatio))
+	}
+	if cfg.FlushInterval != "" {
+		if d, err := time.ParseDuration(cfg.FlushInterval); err != nil || d <= 0 {
+			problems = append(problems, fmt.Sprintf("flush_interval %q isn't a duration like 15m or 1h", cfg.FlushInterval))
+		}
+	}
+	if cfg.TrashDays < 0 {
+		problems = append(problems, fmt.Sprintf("trash_days %d can't be negative", cfg.TrashDays))
+	}
+	if cfg.ParityPercent < 0 || cfg.ParityPercent > 100 {
+		problems = append(problems, fmt.Sprintf("parity_percent %d must be between 0 and 100", cfg.ParityPercent))
+	}
+	if cfg.ObjectLock != "" {
+		if _, err := timeAgo(cfg.ObjectLock, time.Now()); err != nil {
+			problems = append(problems, "object_lock: "+err.Error())
+		}
+		if !strings.HasPrefix(cfg.Remote, "s3:") && !strings.HasPrefix(cfg.Mirror, "s3:") {
+			problems = append(problems, "object_lock only works with an s3 remote or mirror")
+		}
+	}
+	if cfg.ObjectLockMode != "governance" && cfg.ObjectLockMode != "compliance" {
+		problems = append(problems, fmt.Sprintf("object_lock_mode %q must be \"governance\" or \"compliance\"", cfg.ObjectLockMode))
+	}
+
+	if cfg.KeyFile != "" && cfg.KeyCommand != "" {
+		problems = append(problems, "set only one of key_file and key_command")
+	}
+	if fields := strings.Fields(cfg.KeyCommand); len(fields) > 0 {
+		if _, err := exec.LookPath(fields[0]); err != nil {
+			problems = append(problems, fmt.Sprintf("key_command: %v", err))
+		}
+	}
+	if cfg.KeyFile != "" {
+		if !filepath.IsAbs(cfg.KeyFile) {
+			problems = append(problems, fmt.Sprintf("key_file '%s' is not an absolute path", cfg.KeyFile))
+		} else if _, err := os.Stat(cfg.KeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("key_file: %v", err))
+		}
+	}
+
+	if cfg.MetricsFile != "" {
+		if !strings.HasSuffix(cfg.MetricsFile, ".prom") {
+			problems = append(problems, fmt.Sprintf("metrics_file '%s' should end in .prom, the textfile collector ignores other files", cfg.MetricsFile))
+		}
+		if info, err := os.Stat(filepath.Dir(cfg.MetricsFile)); err != nil || !info.IsDir() {
+			problems = append(problems, fmt.Sprintf("metrics_file: directory '%s' doesn't exist", filepath.Dir(cfg.MetricsFile)))
+		}
+	}
+
+	return problems
+}
+
+// checkRemoteSpec checks a remote spec, see openRemote
+func checkRemoteSpec(key, spec string, cfg *Config) []string {
+	if filepath.IsAbs(spec) {
+		return nil
+	}
+
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "dropbox":
+		if cfg.DropboxAppKey == "" {
+			return []string{key + ": dropbox needs dropbox_app_key to be set"}
+		}
+	case "rclone":
+		if !strings.Contains(arg, ":") {
+			return []string{fmt.Sprintf("%s %q is missing the rclone remote name, eg. rclone:gdrive:backups", key, spec)}
+		}
+	case "s3":
+		if strings.Trim(arg, "/") == "" {
+			return []string{fmt.Sprintf("%s %q is missing the bucket, eg. s3:mybucket/backups", key, spec)}
+		}
+	default:
+		// anything else is an external backend, see backend.go
+		if _, err := openBackendRemote(kind, arg); err != nil {
+			return []string{fmt.Sprintf("%s %q: %v", key, spec, err)}
+		}
+	}
+	return nil
+}
+
+// checkWritable tries creating a file in dir
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".backman-write-test-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func configSet(key, value string) {
+	path := getConfigPath()
+
+	cfg := defaultConfig()
+	contents, err := os.ReadFile(path)
+	if err == nil {
+		if _, err := parseConfig(contents, &cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "error parsing config '%s': %v\n", path, err)
+			os.Exit(exitUsage)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, "error reading config: ", err)
+		os.Exit(exitFatal)
+	}
+
+	var field *configField
+	for _, f := range fieldsOf(&cfg) {
+		if f.Key == key {
+			field = &f
+			break
+		}
+	}
+	if field == nil {
+		fmt.Fprintf(os.Stderr, "unknown config key %q\n", key)
+		os.Exit(exitUsage)
+	}
+
+	if err := setField(field.Value, value); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid value for %s: %v\n", key, err)
+		os.Exit(exitUsage)
+	}
+
+	if problems := checkConfig(&cfg); len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "WARNING: %s\n", problem)
+		}
+	}
+
+	if err := writeConfig(path, &cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "error writing config: ", err)
+		os.Exit(exitFatal)
+	}
+	fmt.Printf("Set %s in '%s'\n", key, path)
+}
+
+// setField parses value into a config field. strings are taken as is,
+// everything else has to be valid json for the field's type
+func setField(field reflect.Value, value string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+
+	ptr := reflect.New(field.Type())
+	if err := json.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+		return err
+	}
+	field.Set(ptr.Elem())
+	return nil
+}
+
+func configEdit() {
+	path := getConfigPath()
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		configInit(false)
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+
+	cmd := exec.Command(editor, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "error running editor: ", err)
+		os.Exit(exitFatal)
+	}
+
+	if !configValidate() {
+		os.Exit(exitUsage)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// values of the on_conflict config key
+var conflictModes = []string{"ask", "overwrite", "skip", "rename", "newer"}
+
+// restoreFiles returns the archive paths and sizes of the files a backup restores
+func restoreFiles(sidecar SidecarData) (map[string]int64, error) {
+	files := make(map[string]int64)
+	manifest, err := readManifest(sidecar.ManifestPath())
+	if sidecar.Stream != "" {
+		// streams are restored under their base name
+		var size int64
+		if manifest != nil {
+			size = manifest.Files[sidecar.Stream].Size
+		}
+		files[filepath.Base(sidecar.Stream)] = size
+		return files, nil
+	}
+	if err == nil && manifest != nil {
+		for path, entry := range manifest.Files {
+			files[path] = entry.Size
+		}
+		return files, nil
+	}
+
+	// older backups have no manifest, list the archive instead
+	err = readEntries(sidecar.ParentPath, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag == tar.TypeReg {
+			files[header.Name] = header.Size
+		}
+		return nil
+	})
+	return files, err
+}
+
+// conflictResolver decides what happens to files that already exist where a
+// backup is being restored. mode is "ask", "overwrite", "skip", "rename" or "newer"
+type conflictResolver struct {
+	mode string
+	// files that were in the destination before restoring, by archive path
+	existing map[string]os.FileInfo
+	// decisions made so far, so every layer of a chain gets the same answer
+	decided map[string]string
+	// where each conflicting file was written, if it was
+	written map[string]string
+	reader  *bufio.Reader
+}
+
+// newConflictResolver finds which of paths already exist in dst, where they're
+// restored as renames says
+func newConflictResolver(dst, mode string, paths []string, renames caseRenames) *conflictResolver {
+	c := &conflictResolver{
+		mode:     mode,
+		existing: make(map[string]os.FileInfo),
+		decided:  make(map[string]string),
+		written:  make(map[string]string),
+		reader:   bufio.NewReader(os.Stdin),
+	}
+	for _, path := range paths {
+		name, ok := renames.Apply(path)
+		if !ok {
+			continue
+		}
+		restored, ok := restoredPath(dst, name)
+		if !ok {
+			continue
+		}
+		info, err := os.Lstat(restored)
+		if err == nil && !info.IsDir() {
+			c.existing[path] = info
+		}
+	}
+	return c
+}
+
+// Preview lists the files that would be overwritten and, in ask mode, lets the
+// user pick what to do with all of them. returns false if the restore should be aborted
+func (c *conflictResolver) Preview(dst string) bool {
+	if len(c.existing) == 0 {
+		return true
+	}
+
+	if c.mode == "ask" && !interactive() {
+		c.mode = "skip"
+	}
+	if c.mode != "ask" {
+		fmt.Printf("%d files already exist in '%s', handling them with on_conflict=%s\n", len(c.existing), dst, c.mode)
+		return true
+	}
+
+	fmt.Printf("%d files already exist in '%s' and would be overwritten:\n", len(c.existing), dst)
+	paths := make([]string, 0, len(c.existing))
+	for path := range c.existing {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for i, path := range paths {
+		if i == previewLimit {
+			fmt.Printf("\t...and %d more\n", len(paths)-i)
+			break
+		}
+		fmt.Printf("\t%s\n", escapeName(path))
+	}
+
+	for {
+		fmt.Print("[o]verwrite all, [s]kip all, [r]ename all, keep [n]ewer, decide [p]er file or [a]bort: ")
+		input, err := c.reader.ReadString('\n')
+		if err != nil && input == "" {
+			return false
+		}
+
+		switch strings.TrimSpace(strings.ToLower(input)) {
+		case "o", "overwrite":
+			c.mode = "overwrite"
+		case "s", "skip":
+			c.mode = "skip"
+		case "r", "rename":
+			c.mode = "rename"
+		case "n", "newer":
+			c.mode = "newer"
+		case "p", "per file":
+			// stays "ask"
+		case "a", "abort":
+			return false
+		default:
+			continue
+		}
+		return true
+	}
+}
+
+// Resolve returns where the archive entry should be written, or false if it
+// should be left out
+func (c *conflictResolver) Resolve(header *tar.Header, path string) (string, bool) {
+	info, ok := c.existing[header.Name]
+	if !ok {
+		return path, true
+	}
+
+	action, ok := c.decided[header.Name]
+	if !ok {
+		action = c.mode
+		if action == "ask" {
+			action = c.ask(header, info)
+		}
+		c.decided[header.Name] = action
+	}
+
+	switch action {
+	case "overwrite":
+	case "rename":
+		if renamed, ok := c.written[header.Name]; ok {
+			path = renamed
+		} else {
+			path = freePath(path)
+		}
+	case "newer":
+		if !header.ModTime.After(info.ModTime()) {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+
+	c.written[header.Name] = path
+	return path, true
+}
+
+// Removable returns where name was restored to, for removing it again. false if
+// that would remove a file that was there before the restore, even if it was overwritten
+func (c *conflictResolver) Removable(name, path string) (string, bool) {
+	if _, ok := c.existing[name]; !ok {
+		return path, true
+	}
+	written, ok := c.written[name]
+	return written, ok && written != path
+}
+
+// ask prompts for a single file. a capital letter applies the answer to the remaining files too
+func (c *conflictResolver) ask(header *tar.Header, info os.FileInfo) string {
+	fmt.Printf("'%s' already exists (here: %s, %s | backup: %s, %s)\n",
+		escapeName(header.Name),
+		formatTime(info.ModTime()),
+		humanize.IBytes(uint64(info.Size())),
+		formatTime(header.ModTime),
+		humanize.IBytes(uint64(header.Size)),
+	)
+
+	for {
+		fmt.Print("[o]verwrite, [s]kip, [r]ename, keep [n]ewer (capital letter for all remaining): ")
+		input, err := c.reader.ReadString('\n')
+		if err != nil && input == "" {
+			// nobody to ask, leave the existing file alone
+			c.mode = "skip"
+			return "skip"
+		}
+
+		input = strings.TrimSpace(input)
+		var action string
+		switch strings.ToLower(input) {
+		case "o":
+			action = "overwrite"
+		case "s":
+			action = "skip"
+		case "r":
+			action = "rename"
+		case "n":
+			action = "newer"
+		default:
+			continue
+		}
+		if input != strings.ToLower(input) {
+			c.mode = action
+		}
+		return action
+	}
+}
+
+// freePath returns path with ".restored" added before the extension, numbered
+// if that exists too
+func freePath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	candidate := base + ".restored" + ext
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s.restored-%d%s", base, i, ext)
+	}
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// encrypted archives and manifests start with a header holding a random key of
+// their own, the data key, wrapped by the master key. the master key is kept in
+// backman.key in the archive dir, wrapped by a key derived from the passphrase or
+// key_file, so changing those only rewrites backman.key (see rekey) and the data
+// key of one archive doesn't open any other. plain rekey keeps the master key, any
+// copy of the old backman.key still opens every archive with what unlocked it.
+// rekey --rotate makes a new one and rewraps the data keys, see rotate.go.
+// after the header come AES-256-GCM sealed chunks, so archives can be read from
+// any offset and one that's cut short fails to decrypt instead of ending early.
+// sidecars stay readable, backups are listed without the passphrase
+
+const (
+	keyFileName  = "backman.key"
+	encryptMagic = "BKMNENC1"
+	keyIDSize    = 8
+	// magic, master key ID, then the wrapped data key: nonce, key and GCM tag
+	encryptHeaderSize = len(encryptMagic) + keyIDSize + 12 + 32 + 16
+	// plaintext sealed per chunk
+	encryptChunkSize = 64 << 10
+
+	pbkdf2Iterations = 600000
+)
+
+// keyFile is the contents of backman.key
+type keyFile struct {
+	// hex, stored in the header of every archive encrypted with the key
+	ID         string `json:"id"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	// the master key, sealed with the key derived from the passphrase
+	Key []byte `json:"key"`
+	// set if a security key computes the passphrase, see fido2.go
+	FIDO2 *fido2Credential `json:"fido2,omitempty"`
+	// the master key before rekey --rotate, sealed with the current one. only
+	// set until every archive was rewrapped
+	Retired *retiredKey `json:"retired,omitempty"`
+}
+
+type retiredKey struct {
+	ID  string `json:"id"`
+	Key []byte `json:"key"`
+}
+
+type masterKey struct {
+	id  []byte
+	key []byte
+	// the key that's being rotated out, archives can have either while it's set
+	retired *masterKey
+}
+
+// forID returns the key with id, m or the one it replaces. nil if it's neither
+func (m *masterKey) forID(id []byte) *masterKey {
+	switch {
+	case bytes.Equal(id, m.id):
+		return m
+	case m.retired != nil && bytes.Equal(id, m.retired.id):
+		return m.retired
+	}
+	return nil
+}
+
+// newMasterKey returns a random master key
+func newMasterKey() (*masterKey, error) {
+	master := &masterKey{id: make([]byte, keyIDSize), key: make([]byte, 32)}
+	if _, err := rand.Read(master.id); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(master.key); err != nil {
+		return nil, err
+	}
+	return master, nil
+}
+
+// unlocked once by loadMasterKey
+var currentMasterKey *masterKey
+
+func keyFilePath() string {
+	return filepath.Join(config.ArchiveDir, keyFileName)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data with key under a random nonce, which it's prefixed with
+func seal(key, data, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, aad), nil
+}
+
+func unseal(key, sealed, aad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+// readSecret returns what unlocks the master key: the contents of keyFile, the
+// output of command, or else the env environment variable
+func readSecret(keyFile, command, env string) ([]byte, error) {
+	if keyFile != "" {
+		secret, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key file: %w", err)
+		}
+		return secret, nil
+	}
+	if command != "" {
+		return runKeyCommand(command)
+	}
+	if passphrase := os.Getenv(env); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, fmt.Errorf("%w, set %s, key_file or key_command, or run in a terminal to type it in", errNoPassphrase, env)
+}
+
+func (k *keyFile) derive(secret []byte) ([]byte, error) {
+	if k.KDF != "pbkdf2-sha256" {
+		return nil, fmt.Errorf("%s uses the unknown kdf %q", keyFileName, k.KDF)
+	}
+	return pbkdf2.Key(sha256.New, string(secret), k.Salt, k.Iterations, 32)
+}
+
+// wrap stores master in k, sealed with secret under a new salt
+func (k *keyFile) wrap(master *masterKey, secret []byte) error {
+	k.ID = hex.EncodeToString(master.id)
+	k.KDF = "pbkdf2-sha256"
+	k.Iterations = pbkdf2Iterations
+	k.Salt = make([]byte, 16)
+	if _, err := rand.Read(k.Salt); err != nil {
+		return err
+	}
+	derived, err := k.derive(secret)
+	if err != nil {
+		return err
+	}
+	if k.Key, err = seal(derived, master.key, master.id); err != nil {
+		return err
+	}
+
+	k.Retired = nil
+	if master.retired != nil {
+		sealed, err := seal(master.key, master.retired.key, master.retired.id)
+		if err != nil {
+			return err
+		}
+		k.Retired = &retiredKey{ID: hex.EncodeToString(master.retired.id), Key: sealed}
+	}
+	return nil
+}
+
+func (k *keyFile) unwrap(secret []byte) (*masterKey, error) {
+	id, err := hex.DecodeString(k.ID)
+	if err != nil || len(id) != keyIDSize {
+		return nil, fmt.Errorf("%s has an invalid key ID", keyFileName)
+	}
+	derived, err := k.derive(secret)
+	if err != nil {
+		return nil, err
+	}
+	key, err := unseal(derived, k.Key, id)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or key file")
+	}
+	master := &masterKey{id: id, key: key}
+
+	if k.Retired != nil {
+		retiredID, err := hex.DecodeString(k.Retired.ID)
+		if err != nil || len(retiredID) != keyIDSize {
+			return nil, fmt.Errorf("%s has an invalid retired key ID", keyFileName)
+		}
+		retired, err := unseal(key, k.Retired.Key, retiredID)
+		if err != nil {
+			return nil, fmt.Errorf("the retired master key in %s is damaged", keyFileName)
+		}
+		master.retired = &masterKey{id: retiredID, key: retired}
+	}
+	return master, nil
+}
+
+func (k *keyFile) save() error {
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(keyFilePath(), data, 0600)
+}
+
+// readKeyFile reads backman.key, nil if there is none
+func readKeyFile() (*keyFile, error) {
+	data, err := os.ReadFile(keyFilePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	var k keyFile
+	if err == nil {
+		err = json.Unmarshal(data, &k)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", keyFileName, err)
+	}
+	return &k, nil
+}
+
+// unlockMasterKey unwraps the master key in backman.key with secret
+func unlockMasterKey(secret []byte) (*masterKey, error) {
+	k, err := readKeyFile()
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, fmt.Errorf("no master key at '%s', copy it back from a remote or a backup of it", keyFilePath())
+	}
+	return k.unwrap(secret)
+}
+
+// loadMasterKey unlocks the master key in the archive dir. with create, one is
+// made if there's none yet
+func loadMasterKey(create bool) (*masterKey, error) {
+	if currentMasterKey != nil {
+		return currentMasterKey, nil
+	}
+	k, err := readKeyFile()
+	if err != nil {
+		return nil, err
+	}
+
+	if k == nil && create {
+		secret, source, err := masterSecret(true)
+		if err != nil {
+			return nil, err
+		}
+		master, err := newMasterKey()
+		if err != nil {
+			return nil, err
+		}
+		k = &keyFile{}
+		if err := k.wrap(master, secret); err != nil {
+			return nil, err
+		}
+		if err := k.save(); err != nil {
+			return nil, fmt.Errorf("error writing %s: %w", keyFileName, err)
+		}
+		fmt.Printf("Created the master key '%s'. Backups can't be restored without it and the passphrase, keep a copy of both\n", keyFilePath())
+		if source == "prompt" {
+			rememberPassphrase(secret)
+		}
+		currentMasterKey = master
+		return master, nil
+	}
+	if k == nil {
+		return nil, fmt.Errorf("no master key at '%s', copy it back from a remote or a backup of it", keyFilePath())
+	}
+
+	if k.FIDO2 != nil {
+		secret, err := fido2Secret(k.FIDO2)
+		if err != nil {
+			return nil, err
+		}
+		currentMasterKey, err = k.unwrap(secret)
+		return currentMasterKey, err
+	}
+
+	secret, source, err := masterSecret(false)
+	if err != nil {
+		return nil, err
+	}
+	master, err := k.unwrap(secret)
+	if err != nil && source == "keychain" {
+		return nil, fmt.Errorf("%w, the one in the keychain is outdated: run `keychain forget`", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if source == "prompt" {
+		rememberPassphrase(secret)
+	}
+	currentMasterKey = master
+	return master, nil
+}
+
+// chunkNonce is the nonce chunk i is sealed with. the last chunk is marked, so
+// cutting an archive at a chunk boundary is noticed too
+func chunkNonce(i uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], i)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter seals what's written to it into w
+type encryptWriter struct {
+	w      io.WriteCloser
+	aead   cipher.AEAD
+	buf    []byte
+	chunk  uint64
+	closed bool
+}
+
+func newEncryptWriter(w io.WriteCloser) (*encryptWriter, error) {
+	master, err := loadMasterKey(false)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptMagic), master.id...)
+	wrapped, err := seal(master.key, dataKey, header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(header, wrapped...)); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, encryptChunkSize)}, nil
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.chunk, last), e.buf, nil)
+	e.chunk++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		// a full chunk is only sealed once more follows, the last one is sealed by Close
+		if len(e.buf) == encryptChunkSize {
+			if err := e.flush(false); err != nil {
+				return total - len(p), err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// Close seals the last chunk and closes w, closing again does nothing
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	err := e.flush(true)
+	if closeErr := e.w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sealedData is where decryptReader reads from, an archiveFile or a bytes.Reader
+type sealedData interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// decryptReader reads the plaintext of encrypted data. it isn't safe for concurrent use
+type decryptReader struct {
+	sealed sealedData
+	aead   cipher.AEAD
+	size   int64
+	chunks int64
+	// the chunk in plain, -1 for none
+	index int64
+	plain []byte
+	// where Read continues
+	offset int64
+}
+
+func newDecryptReader(sealed sealedData) (*decryptReader, error) {
+	header := make([]byte, encryptHeaderSize)
+	if _, err := sealed.ReadAt(header, 0); err != nil {
+		return nil, errors.New("the encrypted data is truncated")
+	}
+	prefix := header[:len(encryptMagic)+keyIDSize]
+	id := prefix[len(encryptMagic):]
+
+	master, err := loadMasterKey(false)
+	if err != nil {
+		return nil, err
+	}
+	key := master.forID(id)
+	if key == nil {
+		return nil, fmt.Errorf("encrypted with the master key %x, but %s holds %x", id, keyFileName, master.id)
+	}
+	dataKey, err := unseal(key.key, header[len(prefix):], prefix)
+	if err != nil {
+		return nil, errors.New("the header of the encrypted data is damaged")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	body := sealed.Size() - int64(encryptHeaderSize)
+	sealedChunk := int64(encryptChunkSize + aead.Overhead())
+	chunks := (body + sealedChunk - 1) / sealedChunk
+	if chunks == 0 || body-(chunks-1)*sealedChunk < int64(aead.Overhead()) {
+		return nil, errors.New("the encrypted data is truncated")
+	}
+	return &decryptReader{
+		sealed: sealed,
+		aead:   aead,
+		size:   body - chunks*int64(aead.Overhead()),
+		chunks: chunks,
+		index:  -1,
+	}, nil
+}
+
+func (d *decryptReader) chunk(i int64) ([]byte, error) {
+	if i == d.index {
+		return d.plain, nil
+	}
+	sealedChunk := int64(encryptChunkSize + d.aead.Overhead())
+	offset := int64(encryptHeaderSize) + i*sealedChunk
+	buf := make([]byte, min(sealedChunk, d.sealed.Size()-offset))
+	if _, err := d.sealed.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	plain, err := d.aead.Open(buf[:0], chunkNonce(uint64(i), i == d.chunks-1), buf, nil)
+	if err != nil {
+		d.index = -1
+		return nil, fmt.Errorf("chunk %d of the encrypted data is damaged", i)
+	}
+	d.index, d.plain = i, plain
+	return plain, nil
+}
+
+func (d *decryptReader) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if off >= d.size {
+			return total, io.EOF
+		}
+		plain, err := d.chunk(off / encryptChunkSize)
+		if err != nil {
+			return total, err
+		}
+		n := copy(p, plain[off%encryptChunkSize:])
+		total += n
+		p, off = p[n:], off+int64(n)
+	}
+	return total, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+	n, err := d.ReadAt(p[:min(int64(len(p)), d.size-d.offset)], d.offset)
+	d.offset += int64(n)
+	return n, err
+}
+
+func (d *decryptReader) Size() int64 {
+	return d.size
+}
+
+func (d *decryptReader) Close() error {
+	if c, ok := d.sealed.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// isEncrypted tells whether r starts with the header of encrypted data
+func isEncrypted(r io.ReaderAt) bool {
+	magic := make([]byte, len(encryptMagic))
+	_, err := r.ReadAt(magic, 0)
+	return err == nil && string(magic) == encryptMagic
+}
+
+// archiveData is the contents of an archive's file or volumes, decrypted
+type archiveData interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// openArchiveData opens an archive for reading, decrypting it if it's encrypted
+func openArchiveData(path string) (archiveData, error) {
+	f, err := openArchiveFile(path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	if !isEncrypted(f) {
+		return f, nil
+	}
+	d, err := newDecryptReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error decrypting '%s': %w", filepath.Base(path), err)
+	}
+	return d, nil
+}
+
+// encryptBytes encrypts data like an archive, for manifests and content indexes
+func encryptBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := newEncryptWriter(nopWriteCloser{&buf})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decryptBytes decrypts data if it's encrypted, and returns it as is otherwise
+func decryptBytes(data []byte) ([]byte, error) {
+	r := bytes.NewReader(data)
+	if !isEncrypted(r) {
+		return data, nil
+	}
+	d, err := newDecryptReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(d)
+}
+
+// rekeyCommand wraps the master key with a new passphrase, key file or security
+// key. archives stay as they are, only backman.key is rewritten. with --rotate
+// the master key is replaced too, see rotate.go
+func rekeyCommand(args []string) {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	newKeyFile := fs.String("new-key-file", "", "unlock the master key with this file from now on, instead of the BACKMAN_NEW_PASSPHRASE passphrase")
+	newKeyCommand := fs.String("new-key-command", "", "unlock the master key with what this command prints from now on")
+	newFIDO2 := fs.Bool("new-fido2", false, "unlock the master key by touching the plugged in FIDO2 security key from now on")
+	rotate := fs.Bool("rotate", false, "replace the master key too and rewrap every archive, so old copies of backman.key open nothing")
+	parseFlags(fs, args)
+
+	master, err := loadMasterKey(false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error unlocking the master key: ", err)
+		os.Exit(exitFatal)
+	}
+
+	if master.retired != nil {
+		if !*rotate {
+			fmt.Fprintln(os.Stderr, "A rotation of the master key isn't finished, run `rekey --rotate` first")
+			os.Exit(exitUsage)
+		}
+		// the new key is saved already and opens with what unlocks it now
+		k, err := readKeyFile()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFatal)
+		}
+		fmt.Println("Continuing the rotation of the master key")
+		if rotateMasterKey(k, master) {
+			fmt.Println("Rotated the master key, the old one opens none of the backups anymore")
+		} else {
+			exitCode = exitPartial
+		}
+		publishKeyFile()
+		return
+	}
+
+	var k keyFile
+	var secret []byte
+	if *newFIDO2 {
+		k.FIDO2, err = enrollFIDO2()
+		if err == nil {
+			secret, err = fido2Secret(k.FIDO2)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error setting up the security key: ", err)
+			os.Exit(exitFatal)
+		}
+	} else {
+		secret, err = readSecret(*newKeyFile, *newKeyCommand, "BACKMAN_NEW_PASSPHRASE")
+		if errors.Is(err, errNoPassphrase) && interactive() {
+			secret, err = promptPassphrase("New passphrase", true)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	if *rotate {
+		next, err := newMasterKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error making a new master key: ", err)
+			os.Exit(exitFatal)
+		}
+		next.retired = master
+		master, currentMasterKey = next, next
+	}
+
+	if err := k.wrap(master, secret); err == nil {
+		err = k.save()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error writing %s: %v\n", keyFileName, err)
+		os.Exit(exitFatal)
+	}
+	if *rotate {
+		fmt.Println("Made a new master key")
+		if rotateMasterKey(&k, master) {
+			fmt.Println("Rotated the master key, the old one opens none of the backups anymore")
+		} else {
+			exitCode = exitPartial
+		}
+	} else {
+		fmt.Println("Changed what unlocks the master key, the archives didn't need to change")
+		fmt.Println("The master key itself is the same. Copies of the old backman.key elsewhere, eg. on old drives, still open the backups with the old passphrase, see --rotate")
+	}
+	if config.Keychain {
+		if *newFIDO2 || *newKeyFile != "" || *newKeyCommand != "" {
+			keychainDelete(keychainAccount())
+		} else {
+			rememberPassphrase(secret)
+		}
+	}
+	switch {
+	case *newFIDO2:
+		fmt.Println("The security key unlocks it now. Losing it loses the backups, unless you keep a copy of the old backman.key and what unlocked it")
+	case *newKeyFile != "":
+		fmt.Printf("Set key_file to '%s'\n", *newKeyFile)
+	case *newKeyCommand != "":
+		fmt.Printf("Set key_command to '%s'\n", *newKeyCommand)
+	case config.KeyFile != "" || config.KeyCommand != "":
+		fmt.Println("Unset key_file and key_command, the passphrase unlocks it now")
+	}
+	publishKeyFile()
+}
+
+// publishKeyFile puts backman.key into the catalog bundles, the remote and the
+// mirror, whose copies would still open with what unlocked it before
+func publishKeyFile() {
+	// the bundles are the only other copies here, the next one has the new key anyway
+	if replaced, err := replaceCatalogKeys(); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: error replacing %s in the catalog bundles, older ones still open with what unlocked it before: %v\n", keyFileName, err)
+	} else if replaced > 0 {
+		fmt.Printf("Replaced %s in %d catalog bundles\n", keyFileName, replaced)
+	}
+
+	for _, spec := range []string{config.Remote, config.Mirror} {
+		if spec == "" {
+			continue
+		}
+		r, err := openRemote(spec)
+		if err == nil {
+			err = r.Put(keyFileName, keyFilePath())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: error replacing %s on %s, that copy still opens with the old passphrase: %v\n", keyFileName, spec, err)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// backups of databases are written as pg://[user@][host[:port]/]dbname,
+// mysql://[user@][host[:port]/]dbname or sqlite:///path/to/file.db. the database's
+// own tool dumps it, the dump is stored like piped data, and restore replays it into
+// the database instead of writing it out. passwords come from wherever the tools
+// look for them, eg. ~/.pgpass, PGPASSWORD, ~/.my.cnf or MYSQL_PWD
+
+// dbTarget is a database, see parseDBTarget
+type dbTarget struct {
+	Scheme string
+	User   string
+	Host   string
+	Port   string
+	// the database's name, or the absolute path of a sqlite file
+	Name string
+}
+
+// dbPlugin knows how to dump and replay one kind of database
+type dbPlugin struct {
+	Scheme string
+	// the dump tool, its --version is kept in the sidecar
+	Tool string
+	// appended to the database's name to name the stored dump
+	Ext string
+	// the tools write and read dumps as files instead of stdout and stdin
+	files bool
+	// writes the database to stdout, or to file
+	dump func(t dbTarget, file string) *exec.Cmd
+	// reads a dump from stdin, or from file, into the database
+	replay func(t dbTarget, file string) *exec.Cmd
+}
+
+var dbPlugins = []dbPlugin{
+	{
+		Scheme: "pg",
+		Tool:   "pg_dump",
+		Ext:    ".sql",
+		dump: func(t dbTarget, _ string) *exec.Cmd {
+			// --clean drops what's there first, so replaying the dump restores it
+			args := append([]string{"--clean", "--if-exists"}, t.pgArgs()...)
+			return exec.Command("pg_dump", append(args, t.Name)...)
+		},
+		replay: func(t dbTarget, _ string) *exec.Cmd {
+			args := append([]string{"--quiet", "--set", "ON_ERROR_STOP=1", "--single-transaction"}, t.pgArgs()...)
+			return exec.Command("psql", append(args, "--dbname", t.Name)...)
+		},
+	},
+	{
+		Scheme: "mysql",
+		Tool:   "mysqldump",
+		Ext:    ".sql",
+		dump: func(t dbTarget, _ string) *exec.Cmd {
+			// a consistent dump of innodb tables without locking them
+			args := append([]string{"--single-transaction", "--routines", "--triggers"}, t.mysqlArgs()...)
+			return exec.Command("mysqldump", append(args, t.Name)...)
+		},
+		replay: func(t dbTarget, _ string) *exec.Cmd {
+			return exec.Command("mysql", append(t.mysqlArgs(), t.Name)...)
+		},
+	},
+	{
+		Scheme: "sqlite",
+		Tool:   "sqlite3",
+		files:  true,
+		dump: func(t dbTarget, file string) *exec.Cmd {
+			// .backup copies a consistent state even while the database is written to
+			return exec.Command("sqlite3", t.Name, ".backup "+sqliteQuote(file))
+		},
+		replay: func(t dbTarget, file string) *exec.Cmd {
+			return exec.Command("sqlite3", t.Name, ".restore "+sqliteQuote(file))
+		},
+	},
+}
+
+// sqliteQuote quotes s as an argument of a sqlite3 dot command
+func sqliteQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (t dbTarget) pgArgs() []string {
+	var args []string
+	if t.Host != "" {
+		args = append(args, "--host", t.Host)
+	}
+	if t.Port != "" {
+		args = append(args, "--port", t.Port)
+	}
+	if t.User != "" {
+		args = append(args, "--username", t.User)
+	}
+	return args
+}
+
+func (t dbTarget) mysqlArgs() []string {
+	var args []string
+	if t.Host != "" {
+		args = append(args, "--host", t.Host)
+	}
+	if t.Port != "" {
+		args = append(args, "--port", t.Port)
+	}
+	if t.User != "" {
+		args = append(args, "--user", t.User)
+	}
+	return args
+}
+
+// findDBPlugin returns the plugin for target's scheme, false if it isn't a database
+func findDBPlugin(target string) (dbPlugin, bool) {
+	scheme, _, ok := strings.Cut(target, "://")
+	if !ok {
+		return dbPlugin{}, false
+	}
+	for _, plugin := range dbPlugins {
+		if plugin.Scheme == scheme {
+			return plugin, true
+		}
+	}
+	return dbPlugin{}, false
+}
+
+func isDBTarget(target string) bool {
+	_, ok := findDBPlugin(target)
+	return ok
+}
+
+func parseDBTarget(target string) (dbPlugin, dbTarget, error) {
+	plugin, ok := findDBPlugin(target)
+	if !ok {
+		return dbPlugin{}, dbTarget{}, fmt.Errorf("%q isn't a pg://, mysql:// or sqlite:// database", target)
+	}
+	t := dbTarget{Scheme: plugin.Scheme}
+
+	if plugin.Scheme == "sqlite" {
+		name, err := filepath.Abs(strings.TrimPrefix(target, "sqlite://"))
+		if err != nil {
+			return plugin, t, err
+		}
+		t.Name = name
+		return plugin, t, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return plugin, t, err
+	}
+	if u.User != nil {
+		t.User = u.User.Username()
+	}
+	// pg://dbname connects locally, pg://host/dbname to host
+	t.Name = strings.Trim(u.Path, "/")
+	if t.Name == "" && u.Port() == "" {
+		t.Name = u.Hostname()
+	} else {
+		t.Host, t.Port = u.Hostname(), u.Port()
+	}
+	if t.Name == "" || strings.Contains(t.Name, "/") {
+		return plugin, t, fmt.Errorf("%q isn't a %s://[user@][host[:port]/]dbname url", target, plugin.Scheme)
+	}
+	return plugin, t, nil
+}
+
+// String returns the target in the canonical form used as BackupOf
+func (t dbTarget) String() string {
+	if t.Scheme == "sqlite" {
+		return "sqlite://" + t.Name
+	}
+	if t.Host == "" && t.User == "" {
+		return t.Scheme + "://" + t.Name
+	}
+	host := t.Host
+	if t.Port != "" {
+		host += ":" + t.Port
+	}
+	if t.User != "" {
+		host = t.User + "@" + host
+	}
+	return t.Scheme + "://" + host + "/" + t.Name
+}
+
+// dumpName is what the dump of t is stored as
+func (p dbPlugin) dumpName(t dbTarget) string {
+	return filepath.Base(t.Name) + p.Ext
+}
+
+// version returns the first line of the dump tool's --version
+func (p dbPlugin) version() (string, error) {
+	out, err := foreignOutput(exec.Command(p.Tool, "--version"))
+	if err != nil {
+		return "", err
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	// sqlite3 only prints the number
+	if !strings.HasPrefix(line, p.Tool) {
+		line = p.Tool + " " + line
+	}
+	return line, nil
+}
+
+func backupDatabase(target string, opts compressOptions) {
+	plugin, t, err := parseDBTarget(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading target: ", err)
+		os.Exit(exitUsage)
+	}
+	if opts.Format == "zip" {
+		fmt.Fprintln(os.Stderr, "zip archives can't hold database dumps, use another --format")
+		os.Exit(exitUsage)
+	}
+	if opts.Incremental {
+		fmt.Fprintln(os.Stderr, "WARNING: Database dumps are always stored whole, ignoring --incremental")
+	}
+	if opts.Snapshot != "" {
+		fmt.Fprintln(os.Stderr, "WARNING: The dump tool takes care of consistency, ignoring --snapshot")
+	}
+
+	// also finds out early if the tool is missing
+	dumper, err := plugin.version()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error running %s, is it installed? %v\n", plugin.Tool, err)
+		os.Exit(exitFatal)
+	}
+
+	sidecar := SidecarData{
+		BackupOf: t.String(),
+		Stream:   plugin.dumpName(t),
+		Dumper:   dumper,
+	}
+	writeBackup(sidecar, opts.Format, func(backupName string) (*Manifest, error) {
+		fmt.Printf("Dumping '%s' with %s...\n", t.Name, plugin.Tool)
+		return dumpDatabase(plugin, t, sidecar.Stream, backupName, opts)
+	})
+}
+
+// dumpDatabase compresses the dump of t into dst, as a stream named name
+func dumpDatabase(plugin dbPlugin, t dbTarget, name, dst string, opts compressOptions) (*Manifest, error) {
+	if plugin.files {
+		dir, err := os.MkdirTemp("", "backman-dump-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		file := filepath.Join(dir, name)
+		if _, err := foreignOutput(plugin.dump(t, file)); err != nil {
+			return nil, err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return compressStream(f, name, dst, opts.Format, opts.SplitSize)
+	}
+
+	cmd := plugin.dump(t, "")
+	var stderr bytes.Buffer
+	// the tools ask for passwords on the terminal
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	manifest, copyErr := compressStream(out, name, dst, opts.Format, opts.SplitSize)
+	if copyErr != nil {
+		cmd.Process.Kill()
+	}
+	// a dump cut short by a failing tool isn't a backup
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("%s: %w\n%s", cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return manifest, copyErr
+}
+
+// restoreDatabase replays the dump of a database backup into the database it's
+// of, or into opts.Database
+func restoreDatabase(sidecar SidecarData, opts restoreOptions) {
+	plugin, t, err := parseDBTarget(sidecar.BackupOf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the backup's database: ", err)
+		os.Exit(exitFatal)
+	}
+	if opts.Database != "" {
+		other, into, err := parseDBTarget(opts.Database)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitUsage)
+		}
+		if other.Scheme != plugin.Scheme {
+			fmt.Fprintf(os.Stderr, "A %s dump can't be replayed into %s\n", plugin.Scheme, opts.Database)
+			os.Exit(exitUsage)
+		}
+		t = into
+	}
+	if opts.DeltaDir != "" || opts.ShowDiff || opts.Owners != nil || !opts.Filter.Empty() {
+		fmt.Fprintln(os.Stderr, "--delta, --show-diff, --owners, --include and --exclude need a backup of files, this one is a database dump")
+		os.Exit(exitUsage)
+	}
+
+	if opts.DryRun {
+		fmt.Printf("Would replay '%s' into '%s'\n", sidecar.Stream, t)
+		return
+	}
+	if !askYesNo(fmt.Sprintf(tr("Replay '%s' into '%s'? What's in the database is replaced"), sidecar.Stream, t)) {
+		fmt.Println(tr("Restore aborted"))
+		os.Exit(exitFatal)
+	}
+
+	checkSignature(sidecar.ParentPath)
+	manifest, err := readManifest(sidecar.ManifestPath())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading manifest, restoring without verification: ", err)
+	}
+	r, err := openArchive(sidecar.ParentPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error opening archive: ", err)
+		os.Exit(exitFatal)
+	}
+	defer r.Close()
+
+	hasher := newFileHash()
+	dump := io.TeeReader(r, hasher)
+	verified := func() bool {
+		return manifest == nil || manifest.Files[sidecar.Stream].SHA256 == hashString(hasher)
+	}
+
+	var cmd *exec.Cmd
+	if plugin.files {
+		dir, err := os.MkdirTemp("", "backman-dump-")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error creating temporary directory: ", err)
+			os.Exit(exitFatal)
+		}
+		defer os.RemoveAll(dir)
+
+		file := filepath.Join(dir, filepath.Base(sidecar.Stream))
+		err = writeDump(file, dump)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error decompressing dump: ", err)
+			os.Exit(exitFatal)
+		}
+		// the whole file is there to check before anything is replaced
+		if !verified() {
+			fmt.Fprintf(os.Stderr, "WARNING: '%s' doesn't match the manifest, not replaying it\n", sidecar.Stream)
+			os.Exit(exitVerifyFailed)
+		}
+		cmd = plugin.replay(t, file)
+	} else {
+		cmd = plugin.replay(t, "")
+		cmd.Stdin = dump
+	}
+
+	fmt.Printf("Replaying '%s' into '%s'...\n", sidecar.Stream, t)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "error replaying the dump with %s: %v\n", cmd.Args[0], err)
+		os.Exit(exitFatal)
+	}
+	if !verified() {
+		fmt.Fprintf(os.Stderr, "WARNING: '%s' doesn't match the manifest, the database may be damaged\n", sidecar.Stream)
+		os.Exit(exitVerifyFailed)
+	}
+	fmt.Printf("Replayed backup %d into '%s'\n", sidecar.ID, t)
+}
+
+// writeDump writes r into a new file
+func writeDump(name string, r io.Reader) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
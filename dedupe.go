@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+)
+
+// unchangedSince returns the previous backup of the same paths if it holds exactly
+// the files in manifest
+func unchangedSince(sidecar SidecarData, manifest *Manifest) (SidecarData, bool) {
+	previous, previousManifest, ok := findParent(sidecar)
+	if !ok || !sameFiles(manifest, previousManifest) {
+		return SidecarData{}, false
+	}
+	return previous, true
+}
+
+// sameFiles reports whether two manifests have the same paths with the same contents
+func sameFiles(a, b *Manifest) bool {
+	if len(a.Files) != len(b.Files) {
+		return false
+	}
+	for path, entry := range a.Files {
+		other, ok := b.Files[path]
+		if !ok || other.Size != entry.Size || other.SHA256 != entry.SHA256 {
+			return false
+		}
+	}
+	return true
+}
+
+// shouldDedupe decides with the dedupe config whether to drop a new archive
+// identical to previous
+func shouldDedupe(previous SidecarData) bool {
+	switch config.Dedupe {
+	case "auto":
+		return true
+	case "ask":
+		return askYesNo(fmt.Sprintf(tr("Nothing changed since backup %d, drop the new archive?"), previous.ID))
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"hash"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// restore --delta brings a directory back to the state of a backup by only
+// extracting the files whose contents differ from the manifest. files that
+// aren't in the backup are left alone
+
+// deltaFiles returns which of files are missing from dir or differ from their manifest entry
+func deltaFiles(dir string, files map[string]int64, manifest *Manifest) map[string]bool {
+	delta := make(map[string]bool)
+	hasher := newFileHash()
+	for path := range files {
+		onDisk, ok := restoredPath(dir, path)
+		if !ok || !sameContents(onDisk, manifest.Files[path], hasher) {
+			delta[path] = true
+		}
+	}
+	return delta
+}
+
+// sameContents reports whether the file at path is a regular file with the contents of entry
+func sameContents(path string, entry ManifestEntry, hasher hash.Hash) bool {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != entry.Size {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	hasher.Reset()
+	if _, err := copyBuffered(hasher, f); err != nil {
+		return false
+	}
+	return hashString(hasher) == entry.SHA256
+}
+
+// restoreDiff is how a directory compares to a backup, by archive path
+type restoreDiff struct {
+	// in the backup but not in the directory, restoring creates them
+	OnlyInBackup []string
+	// in the directory but not in the backup, restoring leaves them alone
+	OnlyOnDisk []string
+	// in both with different contents, on_conflict decides what happens to them
+	Modified []string
+	// in both with the same contents
+	Same int
+}
+
+// diffRestore compares the regular files in dir against the ones the backup
+// restores. files are compared by hash, or by size and mtime for backups
+// without a manifest. keep leaves out files on disk the restore wouldn't touch
+func diffRestore(dir string, sidecar SidecarData, files map[string]int64, keep pathFilter) (restoreDiff, error) {
+	var diff restoreDiff
+	entries, err := archiveFiles(sidecar)
+	if err != nil {
+		return diff, err
+	}
+
+	hasher := newFileHash()
+	// where the files are restored to, their names may be encoded, see localName
+	restored := make(map[string]bool)
+	for _, path := range slices.Sorted(maps.Keys(files)) {
+		onDisk, ok := restoredPath(dir, path)
+		if !ok {
+			continue
+		}
+		restored[onDisk] = true
+		info, err := os.Lstat(onDisk)
+		switch {
+		case err != nil:
+			diff.OnlyInBackup = append(diff.OnlyInBackup, path)
+		case entries[path].SHA256 != "" && sameContents(onDisk, entries[path], hasher):
+			diff.Same++
+		case entries[path].SHA256 == "" && info.Mode().IsRegular() && info.Size() == entries[path].Size &&
+			info.ModTime().Truncate(time.Second).Equal(entries[path].ModTime.Truncate(time.Second)):
+			diff.Same++
+		default:
+			diff.Modified = append(diff.Modified, path)
+		}
+	}
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !restored[path] && keep.Keep(rel) {
+			diff.OnlyOnDisk = append(diff.OnlyOnDisk, rel)
+		}
+		return nil
+	})
+	return diff, err
+}
+
+// Print lists the differences, up to previewLimit files of each kind
+func (d restoreDiff) Print(dir string) {
+	fmt.Printf("Compared to '%s', the backup has:\n", dir)
+	section := func(title string, paths []string) {
+		fmt.Printf("  %d %s\n", len(paths), title)
+		for i, path := range paths {
+			if i == previewLimit {
+				fmt.Printf("\t...and %d more\n", len(paths)-i)
+				break
+			}
+			fmt.Printf("\t%s\n", escapeName(path))
+		}
+	}
+	section("files only in the backup, which are restored", d.OnlyInBackup)
+	section("files only on disk, which are left alone", d.OnlyOnDisk)
+	section("files that differ from the ones on disk", d.Modified)
+	fmt.Printf("  %d files that are the same\n", d.Same)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstd dictionaries are trained on the small files of a directory's backups and
+// stored in ArchiveDir/.dicts as <id>.dict, with a <id>.json describing them.
+// new tar.zstd backups of the directory are compressed with its newest one
+
+const (
+	// the dictionary size zstd itself defaults to
+	dictMaxSize = 112 << 10
+	// only files up to this size are sampled, bigger ones compress fine on their own
+	dictSampleMaxFile = 64 << 10
+	// how much is read from archives when training
+	dictSampleLimit = 32 << 20
+	// training needs a few samples to find anything common
+	dictMinSamples = 8
+	// how many of the newest backups are sampled
+	dictSampleBackups = 5
+)
+
+type dictInfo struct {
+	ID      uint32    `json:"id"`
+	Of      string    `json:"of"`
+	Trained time.Time `json:"trained"`
+	Samples int       `json:"samples"`
+	Size    int       `json:"size"`
+}
+
+func dictDir() string {
+	return filepath.Join(config.ArchiveDir, ".dicts")
+}
+
+func dictPath(id uint32) string {
+	return filepath.Join(dictDir(), fmt.Sprintf("%d.dict", id))
+}
+
+// readDicts returns the info of every stored dictionary
+func readDicts() ([]dictInfo, error) {
+	entries, err := os.ReadDir(dictDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var dicts []dictInfo
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dictDir(), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var info dictInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Error parsing dictionary info. (%s)\n", entry.Name())
+			continue
+		}
+		info.Of = aliasPath(info.Of)
+		dicts = append(dicts, info)
+	}
+	return dicts, nil
+}
+
+// loadDicts reads every stored dictionary once, for decoding archives written with them
+var loadDicts = sync.OnceValue(func() [][]byte {
+	dicts, err := readDicts()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: Could not read zstd dictionaries: ", err)
+	}
+	var loaded [][]byte
+	for _, info := range dicts {
+		data, err := os.ReadFile(dictPath(info.ID))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Could not read zstd dictionary %d: %v\n", info.ID, err)
+			continue
+		}
+		loaded = append(loaded, data)
+	}
+	return loaded
+})
+
+// useDict sets up a tar.zstd backup to be compressed with the newest dictionary
+// of its directory, if there is one
+func useDict(sidecar *SidecarData, opts *compressOptions) {
+	if opts.Format != "tar.zstd" {
+		return
+	}
+	dicts, err := readDicts()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: Could not read zstd dictionaries, compressing without one: ", err)
+		return
+	}
+
+	var newest *dictInfo
+	for i, info := range dicts {
+		if info.Of == sidecar.Of() && (newest == nil || info.Trained.After(newest.Trained)) {
+			newest = &dicts[i]
+		}
+	}
+	if newest == nil {
+		return
+	}
+
+	data, err := os.ReadFile(dictPath(newest.ID))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: Could not read zstd dictionary %d, compressing without it: %v\n", newest.ID, err)
+		return
+	}
+	sidecar.Dict = newest.ID
+	opts.Dict = data
+}
+
+// dictSamples reads the small files of the newest backups of target
+func dictSamples(target string) ([][]byte, error) {
+	sidecars, err := readSidecars()
+	if err != nil {
+		return nil, err
+	}
+	var backups []SidecarData
+	for _, sidecar := range sidecars {
+		if sidecar.matchesTarget(target) && sidecar.Stream == "" {
+			backups = append(backups, sidecar)
+		}
+	}
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no backups of '%s' to train on", target)
+	}
+	slices.SortFunc(backups, func(a, b SidecarData) int { return b.Time.Compare(a.Time) })
+	backups = backups[:min(len(backups), dictSampleBackups)]
+
+	var samples [][]byte
+	var total int
+	errFull := errors.New("enough samples")
+	for _, backup := range backups {
+		err := readEntries(backup.ParentPath, func(header *tar.Header, r io.Reader) error {
+			if header.Typeflag != tar.TypeReg || header.Size == 0 || header.Size > dictSampleMaxFile {
+				return nil
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, data)
+			total += len(data)
+			if total >= dictSampleLimit {
+				return errFull
+			}
+			return nil
+		})
+		if errors.Is(err, errFull) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading backup %d: %w", backup.ID, err)
+		}
+	}
+
+	if len(samples) < dictMinSamples {
+		return nil, fmt.Errorf("the backups of '%s' only have %d files under %s, too few to train on", target, len(samples), humanize.IBytes(dictSampleMaxFile))
+	}
+	return samples, nil
+}
+
+// trainDict builds a dictionary for the backups of dir and stores it
+func trainDict(dir string) {
+	target := targetPath(dir)
+	fmt.Printf("Sampling backups of '%s'...\n", target)
+	samples, err := dictSamples(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error sampling backups: ", err)
+		os.Exit(exitFatal)
+	}
+
+	fmt.Printf("Training on %d files...\n", len(samples))
+	data, err := dict.BuildZstdDict(samples, dict.Options{MaxDictSize: dictMaxSize, HashBytes: 6})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error training dictionary: ", err)
+		os.Exit(exitFatal)
+	}
+	inspected, err := zstd.InspectDictionary(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error training dictionary: ", err)
+		os.Exit(exitFatal)
+	}
+
+	info := dictInfo{
+		ID:      inspected.ID(),
+		Of:      target,
+		Trained: time.Now().UTC(),
+		Samples: len(samples),
+		Size:    len(data),
+	}
+	meta, err := json.Marshal(info)
+	if err == nil {
+		err = os.MkdirAll(dictDir(), 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(dictPath(info.ID), data, 0600)
+	}
+	if err == nil {
+		err = os.WriteFile(strings.TrimSuffix(dictPath(info.ID), ".dict")+".json", meta, 0600)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error saving dictionary: ", err)
+		os.Exit(exitFatal)
+	}
+
+	without, with := dictGain(samples, data)
+	fmt.Printf("Saved dictionary %d (%s)\n", info.ID, humanize.IBytes(uint64(info.Size)))
+	fmt.Printf("The sampled files compress to %s with it, %s without\n", humanize.IBytes(uint64(with)), humanize.IBytes(uint64(without)))
+	fmt.Println("New tar.zstd backups of the directory will use it")
+}
+
+// dictGain compresses every sample on its own with and without the dictionary,
+// as they'd be in small incremental backups
+func dictGain(samples [][]byte, data []byte) (without, with int) {
+	plain, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return 0, 0
+	}
+	defer plain.Close()
+	withDict, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderDict(data))
+	if err != nil {
+		return 0, 0
+	}
+	defer withDict.Close()
+
+	for _, sample := range samples {
+		without += len(plain.EncodeAll(sample, nil))
+		with += len(withDict.EncodeAll(sample, nil))
+	}
+	return without, with
+}
+
+func listDicts() {
+	dicts, err := readDicts()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading dictionaries: ", err)
+		os.Exit(exitFatal)
+	}
+	if len(dicts) == 0 {
+		fmt.Println("No dictionaries, train one with `dict train [dir]`")
+		return
+	}
+	slices.SortFunc(dicts, func(a, b dictInfo) int { return a.Trained.Compare(b.Trained) })
+	for _, info := range dicts {
+		fmt.Printf("%d:\n\t%s\n\t%s | %s, from %d files\n",
+			info.ID,
+			info.Of,
+			formatTime(info.Trained),
+			humanize.IBytes(uint64(info.Size)),
+			info.Samples,
+		)
+	}
+}
+
+// removeDict deletes a dictionary no backup was compressed with
+func removeDict(arg string) {
+	id, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid dictionary ID %q\n", arg)
+		os.Exit(exitUsage)
+	}
+	if _, err := os.Stat(dictPath(uint32(id))); err != nil {
+		fmt.Fprintln(os.Stderr, "error reading dictionary: ", err)
+		os.Exit(exitFatal)
+	}
+
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+	trashed, err := readTrash()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the trash: ", err)
+		os.Exit(exitFatal)
+	}
+	for _, sidecar := range append(sidecars, trashed...) {
+		if sidecar.Dict == uint32(id) {
+			fmt.Fprintf(os.Stderr, "Backup %d is compressed with this dictionary and can't be read without it\n", sidecar.ID)
+			os.Exit(exitFatal)
+		}
+	}
+
+	os.Remove(dictPath(uint32(id)))
+	os.Remove(strings.TrimSuffix(dictPath(uint32(id)), ".dict") + ".json")
+	fmt.Println(tr("Removed successfully!"))
+}
+
+func dictCommand(args []string) {
+	if len(args) == 0 {
+		usageError("dict")
+	}
+
+	switch args[0] {
+	case "train":
+		dir := "."
+		if len(args) > 1 {
+			dir = args[1]
+		}
+		trainDict(dir)
+	case "list":
+		listDicts()
+	case "remove":
+		if len(args) < 2 {
+			usageError("dict")
+		}
+		removeDict(args[1])
+	default:
+		usageError("dict")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// dirRemote keeps copies of backups in a local directory, eg. on a second disk
+type dirRemote struct {
+	dir string
+}
+
+func newDirRemote(dir string) (*dirRemote, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &dirRemote{dir: dir}, nil
+}
+
+func (r *dirRemote) Put(name, localPath string) error {
+	// copied under a temporary name first, so the file is never seen half written
+	tmp := filepath.Join(r.dir, "."+name+".tmp")
+	os.Remove(tmp)
+	if err := copyFile(localPath, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(r.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (r *dirRemote) Get(name, localPath string) error {
+	return copyFile(filepath.Join(r.dir, name), localPath)
+}
+
+func (r *dirRemote) List() ([]string, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && entry.Name()[0] != '.' {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (r *dirRemote) Delete(name string) error {
+	return os.Remove(filepath.Join(r.dir, name))
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// backups of docker volumes and containers are written as docker:<name>. a volume
+// whose mountpoint can be read here is archived from there, otherwise (eg. docker
+// desktop keeps volumes in a VM) a helper container with the volume mounted streams
+// it with tar, like backups over ssh. a container is backed up with all of its
+// volumes and bind mounts, through a helper container using --volumes-from
+
+func isDockerTarget(target string) bool {
+	return strings.HasPrefix(target, "docker:")
+}
+
+// isRemoteTarget reports whether target is ssh://, docker:, a database or an
+// external backend rather than a local path
+func isRemoteTarget(target string) bool {
+	return isSSHTarget(target) || isDockerTarget(target) || isDBTarget(target) || isBackendTarget(target)
+}
+
+// docker runs the docker cli and returns its trimmed output
+func docker(args ...string) (string, error) {
+	cmd := exec.Command("docker", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// dockerLines runs the docker cli and returns the non-empty lines of its output
+func dockerLines(args ...string) ([]string, error) {
+	out, err := docker(args...)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// pauseContainers pauses the running containers among ids, the returned function
+// unpauses them again and must always be called
+func pauseContainers(ids []string) (func(), error) {
+	var paused []string
+	unpause := func() {
+		if len(paused) == 0 {
+			return
+		}
+		if _, err := docker(append([]string{"unpause"}, paused...)...); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Could not unpause, run `docker unpause %s`: %v\n", strings.Join(paused, " "), err)
+		}
+	}
+	for _, id := range ids {
+		// stopped and already paused containers are left as they are
+		state, err := docker("container", "inspect", "--format", "{{.State.Status}}", id)
+		if err != nil {
+			unpause()
+			return nil, err
+		}
+		if state != "running" {
+			continue
+		}
+		if _, err := docker("pause", id); err != nil {
+			unpause()
+			return nil, err
+		}
+		paused = append(paused, id)
+	}
+	return unpause, nil
+}
+
+func backupDocker(target string, opts compressOptions) {
+	name := strings.TrimPrefix(target, "docker:")
+	if name == "" {
+		fmt.Fprintln(os.Stderr, "docker targets are written as docker:<volume or container>")
+		os.Exit(exitUsage)
+	}
+	if opts.Snapshot != "" {
+		fmt.Fprintln(os.Stderr, "WARNING: Snapshots can't be taken of docker volumes, ignoring --snapshot")
+	}
+
+	// volumes and containers have separate names, a volume is more likely meant
+	var users []string
+	var volume, mountpoint string
+	var mounts []string
+	if out, err := docker("volume", "inspect", "--format", "{{.Mountpoint}}", name); err == nil {
+		volume = name
+		if _, err := os.ReadDir(out); err == nil {
+			mountpoint = out
+		}
+		if users, err = dockerLines("ps", "--all", "--quiet", "--filter", "volume="+name); err != nil {
+			fmt.Fprintln(os.Stderr, "error finding the containers using the volume: ", err)
+			os.Exit(exitFatal)
+		}
+	} else if out, inspectErr := docker("container", "inspect", "--format", `{{range .Mounts}}{{.Destination}}{{"\n"}}{{end}}`, name); inspectErr == nil {
+		mounts = strings.Fields(out)
+		if len(mounts) == 0 {
+			fmt.Fprintf(os.Stderr, "Container '%s' has no volumes or bind mounts to back up\n", name)
+			os.Exit(exitFatal)
+		}
+		users = []string{name}
+	} else {
+		fmt.Fprintf(os.Stderr, "No docker volume or container named '%s': %v\n", name, err)
+		os.Exit(exitFatal)
+	}
+	if mountpoint == "" && opts.Xattrs {
+		fmt.Fprintln(os.Stderr, "WARNING: The helper container's tar can't read extended attributes, ignoring --xattrs")
+		opts.Xattrs = false
+	}
+
+	sidecar := SidecarData{BackupOf: "docker:" + name}
+	if opts.Incremental {
+		parent, manifest, ok := findParent(sidecar)
+		if ok {
+			fmt.Printf("Storing changes since backup %d...\n", parent.ID)
+			sidecar.ParentID = &parent.ID
+			opts.Parent = manifest
+		} else {
+			fmt.Printf("No earlier backup of '%s' to build on, making a full backup\n", sidecar.BackupOf)
+		}
+	}
+
+	useDict(&sidecar, &opts)
+	writeBackup(sidecar, opts.Format, func(backupName string) (*Manifest, error) {
+		// the data only has to hold still while it's read
+		if opts.Pause && len(users) > 0 {
+			fmt.Printf("Pausing %d containers...\n", len(users))
+			unpause, err := pauseContainers(users)
+			if err != nil {
+				return nil, fmt.Errorf("error pausing containers: %w", err)
+			}
+			defer unpause()
+		}
+
+		switch {
+		case mountpoint != "":
+			fmt.Printf("Compressing volume '%s'...\n", volume)
+			return compressDir([]archiveRoot{{Path: mountpoint}}, backupName, opts)
+		case volume != "":
+			fmt.Printf("Compressing volume '%s' through a helper container...\n", volume)
+			return compressCommand(dockerTar(opts, []string{"-v", volume + ":/data:ro"}, "/data", "."), backupName, opts)
+		default:
+			fmt.Printf("Compressing the volumes of container '%s'...\n", name)
+			paths := make([]string, len(mounts))
+			for i, mount := range mounts {
+				// "./" like the paths of the other streams, see skipTarErrors
+				paths[i] = "." + path.Clean("/"+mount)
+			}
+			return compressCommand(dockerTar(opts, []string{"--volumes-from", name + ":ro"}, "/", paths...), backupName, opts)
+		}
+	})
+}
+
+// dockerTar returns a command running tar over paths in dir of a helper container
+// made with the run flags mounts
+func dockerTar(opts compressOptions, mounts []string, dir string, paths ...string) *exec.Cmd {
+	args := append([]string{"run", "--rm", "--network", "none"}, mounts...)
+	args = append(args, config.DockerImage, "tar", "-cf", "-")
+	if opts.FollowSymlinks {
+		args = append(args, "-h")
+	}
+	args = append(args, "-C", dir)
+	return exec.Command("docker", append(args, paths...)...)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	dropboxAPI      = "https://api.dropboxapi.com/2/"
+	dropboxContent  = "https://content.dropboxapi.com/2/"
+	dropboxTokenURL = "https://api.dropboxapi.com/oauth2/token"
+	dropboxAuth     = "https://www.dropbox.com/oauth2/authorize"
+
+	// single request uploads are limited to 150MB, larger files go through upload sessions
+	dropboxChunkSize = 64 << 20
+	// upload sessions expire after a week
+	dropboxSessionAge = 6 * 24 * time.Hour
+)
+
+var (
+	// where the server says the session is after an append with a wrong offset
+	dropboxCorrectOffset = regexp.MustCompile(`"correct_offset":\s*(\d+)`)
+	dropboxSessionGone   = regexp.MustCompile(`"(not_found|closed|expired)"`)
+)
+
+type dropboxToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	Expiry       time.Time `json:"expiry"`
+}
+
+type dropboxRemote struct {
+	// folder inside the dropbox without a trailing slash, eg. /backman
+	dir   string
+	token dropboxToken
+}
+
+func newDropbox(dir string) (*dropboxRemote, error) {
+	if config.DropboxAppKey == "" {
+		return nil, errors.New("dropbox_app_key is not set, create an app at https://www.dropbox.com/developers/apps")
+	}
+	if dir == "" {
+		dir = "/" + appName
+	}
+
+	// the api calls the root folder ""
+	d := &dropboxRemote{dir: strings.TrimSuffix("/"+strings.Trim(dir, "/"), "/")}
+
+	data, err := os.ReadFile(dropboxTokenPath())
+	if err == nil {
+		err = json.Unmarshal(data, &d.token)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error reading dropbox token: %w", err)
+	}
+	return d, nil
+}
+
+// the oauth token is kept next to the config file
+func dropboxTokenPath() string {
+	return filepath.Join(filepath.Dir(getConfigPath()), "dropbox-token.json")
+}
+
+// Login runs the oauth flow (with PKCE, so no app secret is needed) and stores the token
+func (d *dropboxRemote) Login() error {
+	verifierBytes := make([]byte, 32)
+	if _, err := rand.Read(verifierBytes); err != nil {
+		return err
+	}
+	verifier := base64.RawURLEncoding.EncodeToString(verifierBytes)
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{
+		"client_id":             {config.DropboxAppKey},
+		"response_type":         {"code"},
+		"token_access_type":     {"offline"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if !interactive() {
+		return errors.New("logging in needs someone to paste a code, run `remote login` in a terminal")
+	}
+	fmt.Printf("Open this URL, allow access and paste the code below:\n%s?%s\n\nCode: ", dropboxAuth, query.Encode())
+
+	code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	return d.requestToken(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {strings.TrimSpace(code)},
+		"code_verifier": {verifier},
+		"client_id":     {config.DropboxAppKey},
+	})
+}
+
+func (d *dropboxRemote) requestToken(form url.Values) error {
+	resp, err := http.PostForm(dropboxTokenURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return dropboxError(resp)
+	}
+
+	var result struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+
+	d.token.AccessToken = result.AccessToken
+	// refreshing doesn't return a new refresh token
+	if result.RefreshToken != "" {
+		d.token.RefreshToken = result.RefreshToken
+	}
+	d.token.Expiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+
+	data, err := json.Marshal(d.token)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dropboxTokenPath()), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(dropboxTokenPath(), data, 0600)
+}
+
+// accessToken returns a valid access token, refreshing it if it's about to expire
+func (d *dropboxRemote) accessToken() (string, error) {
+	if d.token.RefreshToken == "" {
+		return "", errors.New("not logged in to dropbox, run `backman remote login`")
+	}
+	if time.Until(d.token.Expiry) < time.Minute {
+		err := d.requestToken(url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {d.token.RefreshToken},
+			"client_id":     {config.DropboxAppKey},
+		})
+		if err != nil {
+			return "", fmt.Errorf("error refreshing dropbox token: %w", err)
+		}
+	}
+	return d.token.AccessToken, nil
+}
+
+// call makes an rpc or content request. content endpoints take their arguments in
+// the Dropbox-API-Arg header and the body as content, rpc endpoints take json bodies
+func (d *dropboxRemote) call(endpoint string, arg any, body io.Reader, content bool) (*http.Response, error) {
+	token, err := d.accessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	argJSON, err := json.Marshal(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if content {
+		req, err = http.NewRequest(http.MethodPost, dropboxContent+endpoint, body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Dropbox-API-Arg", asciiJSON(argJSON))
+		req.Header.Set("Content-Type", "application/octet-stream")
+	} else {
+		req, err = http.NewRequest(http.MethodPost, dropboxAPI+endpoint, bytes.NewReader(argJSON))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, dropboxError(resp)
+	}
+	return resp, nil
+}
+
+// callJSON makes a request and decodes the json response into out, if it isn't nil
+func (d *dropboxRemote) callJSON(endpoint string, arg any, body io.Reader, content bool, out any) error {
+	resp, err := d.call(endpoint, arg, body, content)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (d *dropboxRemote) path(name string) string {
+	return d.dir + "/" + name
+}
+
+func (d *dropboxRemote) Put(name, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	commit := map[string]any{"path": d.path(name), "mode": "overwrite", "mute": true}
+
+	if info.Size() <= dropboxChunkSize {
+		return withRetry("uploading "+name, func() error {
+			return d.callJSON("files/upload", commit, io.NewSectionReader(f, 0, info.Size()), true, nil)
+		})
+	}
+
+	key := "dropbox:" + d.path(name)
+	state, ok := resumableUpload(key, info, dropboxSessionAge)
+	if ok {
+		fmt.Printf("Resuming upload of %s at %s\n", name, humanize.IBytes(uint64(state.Offset)))
+	} else {
+		var session struct {
+			SessionID string `json:"session_id"`
+		}
+		err := withRetry("starting the upload of "+name, func() error {
+			return d.callJSON("files/upload_session/start", map[string]any{}, nil, true, &session)
+		})
+		if err != nil {
+			return err
+		}
+		state = uploadState{SessionID: session.SessionID, Started: time.Now(), Size: info.Size(), ModTime: info.ModTime()}
+	}
+
+	for {
+		size := min(dropboxChunkSize, info.Size()-state.Offset)
+		// the last chunk is sent with the commit
+		last := state.Offset+size == info.Size()
+		err := withRetry("uploading "+name, func() error {
+			chunk := io.NewSectionReader(f, state.Offset, size)
+			cursor := map[string]any{"session_id": state.SessionID, "offset": state.Offset}
+			if last {
+				return d.callJSON("files/upload_session/finish", map[string]any{"cursor": cursor, "commit": commit}, chunk, true, nil)
+			}
+			return d.callJSON("files/upload_session/append_v2", map[string]any{"cursor": cursor}, chunk, true, nil)
+		})
+
+		var apiErr *dropboxAPIError
+		switch {
+		case err == nil:
+		case errors.As(err, &apiErr) && dropboxCorrectOffset.MatchString(apiErr.Body):
+			// a chunk arrived but its response got lost, or the state file is off
+			correct, _ := strconv.ParseInt(dropboxCorrectOffset.FindStringSubmatch(apiErr.Body)[1], 10, 64)
+			if correct != state.Offset && correct < info.Size() {
+				state.Offset = correct
+				continue
+			}
+			fallthrough
+		default:
+			if errors.As(err, &apiErr) && dropboxSessionGone.MatchString(apiErr.Body) {
+				saveUploadState(key, nil)
+				// a finished session is gone as well, maybe only the response was lost
+				if last && d.uploaded(name, f) {
+					return nil
+				}
+			}
+			return err
+		}
+
+		if last {
+			return saveUploadState(key, nil)
+		}
+		state.Offset += size
+		if err := saveUploadState(key, &state); err != nil {
+			fmt.Fprintln(os.Stderr, "WARNING: error saving upload state, an interrupted upload will start over: ", err)
+		}
+		fmt.Printf("\t%s: %s of %s\n", name, humanize.IBytes(uint64(state.Offset)), humanize.IBytes(uint64(info.Size())))
+	}
+}
+
+// uploaded tells whether name on the dropbox has the contents of f
+func (d *dropboxRemote) uploaded(name string, f *os.File) bool {
+	var meta struct {
+		ContentHash string `json:"content_hash"`
+	}
+	if err := d.callJSON("files/get_metadata", map[string]any{"path": d.path(name)}, nil, false, &meta); err != nil {
+		return false
+	}
+	hash, err := dropboxContentHash(f)
+	return err == nil && hash == meta.ContentHash
+}
+
+// dropboxContentHash hashes f the way dropbox does: sha256 over the sha256 of
+// each 4MiB block, see https://www.dropbox.com/developers/reference/content-hash
+func dropboxContentHash(f *os.File) (string, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	overall := sha256.New()
+	for offset := int64(0); offset < info.Size(); offset += 4 << 20 {
+		block := sha256.New()
+		if _, err := io.Copy(block, io.NewSectionReader(f, offset, 4<<20)); err != nil {
+			return "", err
+		}
+		overall.Write(block.Sum(nil))
+	}
+	return hex.EncodeToString(overall.Sum(nil)), nil
+}
+
+func (d *dropboxRemote) Get(name, localPath string) error {
+	resp, err := d.call("files/download", map[string]any{"path": d.path(name)}, nil, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := os.OpenFile(localPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		os.Remove(localPath)
+		return err
+	}
+	return out.Close()
+}
+
+func (d *dropboxRemote) List() ([]string, error) {
+	var names []string
+
+	var page struct {
+		Entries []struct {
+			Tag  string `json:".tag"`
+			Name string `json:"name"`
+		} `json:"entries"`
+		Cursor  string `json:"cursor"`
+		HasMore bool   `json:"has_more"`
+	}
+
+	err := d.callJSON("files/list_folder", map[string]any{"path": d.dir}, nil, false, &page)
+	if err != nil && strings.Contains(err.Error(), "not_found") {
+		// nothing was uploaded yet
+		return nil, nil
+	}
+
+	for err == nil {
+		for _, entry := range page.Entries {
+			if entry.Tag == "file" {
+				names = append(names, entry.Name)
+			}
+		}
+		if !page.HasMore {
+			return names, nil
+		}
+		cursor := page.Cursor
+		page.Entries = nil
+		err = d.callJSON("files/list_folder/continue", map[string]any{"cursor": cursor}, nil, false, &page)
+	}
+	return nil, err
+}
+
+func (d *dropboxRemote) Delete(name string) error {
+	return d.callJSON("files/delete_v2", map[string]any{"path": d.path(name)}, nil, false, nil)
+}
+
+// dropboxAPIError is an error response, Body is the json describing it
+type dropboxAPIError struct {
+	Status string
+	Body   string
+}
+
+func (e *dropboxAPIError) Error() string {
+	return fmt.Sprintf("dropbox: %s: %s", e.Status, e.Body)
+}
+
+func dropboxError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	err := &dropboxAPIError{Status: resp.Status, Body: strings.TrimSpace(string(body))}
+	// rate limits and server errors pass
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return temporaryError{err}
+	}
+	return err
+}
+
+// asciiJSON escapes non-ascii characters, http headers can't carry them
+func asciiJSON(data []byte) string {
+	var b strings.Builder
+	for _, r := range string(data) {
+		if r < 0x80 {
+			b.WriteRune(r)
+		} else if r > 0xffff {
+			// json needs surrogate pairs for these
+			r -= 0x10000
+			fmt.Fprintf(&b, `\u%04x\u%04x`, 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+		} else {
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,20 @@
+package main
+
+// exit codes, so scripts and monitoring can tell failures apart without parsing the output
+const (
+	exitOK = 0
+	// the command line or config is invalid
+	exitUsage = 1
+	// the command finished, but left something out, eg. files that couldn't be read
+	exitPartial = 2
+	// the command failed
+	exitFatal = 3
+	// a backup, archive or signature didn't check out
+	exitVerifyFailed = 4
+	// status found paths that weren't backed up within stale_after
+	exitStale = 5
+)
+
+// exitCode is what main exits with once the command is done, set by commands
+// that finish but with problems, eg. exitPartial
+var exitCode = exitOK
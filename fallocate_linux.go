@@ -0,0 +1,22 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// preallocate reserves size bytes for file before it's written, so big restored
+// files end up in few extents and a full disk shows before the copy instead of
+// halfway through it. filesystems that can't do it are left to allocate as usual
+func preallocate(file *os.File, size int64) error {
+	if size < copyBufferSize {
+		// a single write anyway
+		return nil
+	}
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if err == nil || errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return &os.PathError{Op: "fallocate", Path: file.Name(), Err: err}
+}
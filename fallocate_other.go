@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// preallocate reserves space for file before it's written. only done on linux
+func preallocate(file *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// a FIDO2 security key with the hmac-secret extension, eg. a YubiKey, can unlock
+// the master key instead of a passphrase: it computes a secret from a salt and a
+// credential it made, only while it's plugged in and touched. this runs the
+// fido2-token, fido2-cred and fido2-assert tools that come with libfido2.
+// the credential ID and salt are stored in backman.key, they're useless without
+// the security key itself
+
+const fido2RelyingParty = "backman"
+
+type fido2Credential struct {
+	ID   []byte `json:"id"`
+	Salt []byte `json:"salt"`
+}
+
+// fido2Device returns the first plugged in security key
+func fido2Device() (string, error) {
+	out, err := foreignOutput(exec.Command("fido2-token", "-L"))
+	if err != nil {
+		return "", err
+	}
+	// lines like "/dev/hidraw3: vendor=0x1050, product=0x0407 (Yubico YubiKey OTP+FIDO+CCID)"
+	for _, line := range strings.Split(string(out), "\n") {
+		if device, _, ok := strings.Cut(line, ": "); ok {
+			return device, nil
+		}
+	}
+	return "", errors.New("no FIDO2 security key found, plug one in")
+}
+
+// fido2Run runs one of the fido2 tools, which read their parameters as lines from
+// stdin and print their results the same way. PIN prompts go to the terminal
+func fido2Run(name string, input []string, args ...string) ([]string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(strings.Join(input, "\n") + "\n")
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return strings.Split(strings.TrimSpace(stdout.String()), "\n"), nil
+}
+
+func randomBase64(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// enrollFIDO2 makes a new credential with hmac-secret on the plugged in security key
+func enrollFIDO2() (*fido2Credential, error) {
+	device, err := fido2Device()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(os.Stderr, "Touch your security key to create a credential for backman...")
+	// client data hash, relying party, user name and user ID
+	out, err := fido2Run("fido2-cred", []string{randomBase64(32), fido2RelyingParty, appName, randomBase64(16)}, "-M", "-h", device)
+	if err != nil {
+		return nil, err
+	}
+	// client data hash, relying party, format, authenticator data, then the credential ID
+	if len(out) < 5 {
+		return nil, errors.New("fido2-cred didn't return a credential")
+	}
+	id, err := base64.StdEncoding.DecodeString(out[4])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the credential ID: %w", err)
+	}
+
+	cred := &fido2Credential{ID: id, Salt: make([]byte, 32)}
+	if _, err := rand.Read(cred.Salt); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+// fido2Secret has the security key compute the secret of cred
+func fido2Secret(cred *fido2Credential) ([]byte, error) {
+	device, err := fido2Device()
+	if err != nil {
+		return nil, err
+	}
+	// stderr, restore --stdout may be writing to stdout
+	fmt.Fprintln(os.Stderr, "Touch your security key to unlock the master key...")
+	input := []string{
+		randomBase64(32),
+		fido2RelyingParty,
+		base64.StdEncoding.EncodeToString(cred.ID),
+		base64.StdEncoding.EncodeToString(cred.Salt),
+	}
+	out, err := fido2Run("fido2-assert", input, "-G", "-h", device)
+	if err != nil {
+		return nil, err
+	}
+	// client data hash, relying party, authenticator data, signature, then the secret
+	if len(out) < 5 {
+		return nil, errors.New("fido2-assert didn't return a secret, does the security key support hmac-secret?")
+	}
+	secret, err := base64.StdEncoding.DecodeString(out[len(out)-1])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the secret: %w", err)
+	}
+	return secret, nil
+}
+
+// runKeyCommand runs key_command, split on spaces, and returns what it prints.
+// stdin and stderr are passed through for PIN and touch prompts
+func runKeyCommand(command string) ([]byte, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("key_command is empty")
+	}
+	var stdout bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("key_command: %w", err)
+	}
+	secret := bytes.TrimRight(stdout.Bytes(), "\r\n")
+	if len(secret) == 0 {
+		return nil, errors.New("key_command printed nothing")
+	}
+	return secret, nil
+}
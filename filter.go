@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// fileFilter leaves files out of a backup
+type fileFilter struct {
+	// files bigger than this are left out, 0 for no limit
+	MaxSize int64
+	// files last modified before this are left out, zero for no limit
+	ModifiedAfter time.Time
+}
+
+// parseFileFilter reads the max_file_size and newer_than config values, empty ones don't filter
+func parseFileFilter(maxSize, newerThan string) (fileFilter, error) {
+	var filter fileFilter
+	if maxSize != "" {
+		size, err := humanize.ParseBytes(maxSize)
+		if err != nil {
+			return filter, fmt.Errorf("invalid max_file_size %q: %w", maxSize, err)
+		}
+		filter.MaxSize = int64(size)
+	}
+	if newerThan != "" {
+		after, err := parseTimeArg(newerThan)
+		if err != nil {
+			return filter, fmt.Errorf("invalid newer_than: %w", err)
+		}
+		filter.ModifiedAfter = after
+	}
+	return filter, nil
+}
+
+// Skip reports whether the file is left out. directories and links are always kept
+func (f fileFilter) Skip(info os.FileInfo) bool {
+	if !info.Mode().IsRegular() {
+		return false
+	}
+	if f.MaxSize > 0 && info.Size() > f.MaxSize {
+		return true
+	}
+	return !f.ModifiedAfter.IsZero() && info.ModTime().Before(f.ModifiedAfter)
+}
+
+// pathFilter picks the archive entries a restore writes, by glob patterns on
+// their slash separated paths. patterns without a slash match any single path
+// element (*.sql, cache), the others the whole path, where ** matches any
+// number of directories (src/**/*.go). a directory matching a pattern matches
+// everything in it too
+type pathFilter struct {
+	// if any, only paths matching one of these are restored
+	Include []string
+	// paths matching any of these aren't restored
+	Exclude []string
+}
+
+func newPathFilter(include, exclude []string) (pathFilter, error) {
+	for _, pattern := range append(slices.Clone(include), exclude...) {
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return pathFilter{}, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return pathFilter{Include: include, Exclude: exclude}, nil
+}
+
+func (f pathFilter) Empty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+// Keep reports whether the entry at name is restored
+func (f pathFilter) Keep(name string) bool {
+	name = path.Clean(name)
+	if slices.ContainsFunc(f.Exclude, func(p string) bool { return globMatch(p, name) }) {
+		return false
+	}
+	return len(f.Include) == 0 || slices.ContainsFunc(f.Include, func(p string) bool { return globMatch(p, name) })
+}
+
+// globMatch reports whether pattern matches name or one of the directories it's in
+func globMatch(pattern, name string) bool {
+	elems := strings.Split(name, "/")
+	if !strings.Contains(pattern, "/") {
+		for _, elem := range elems {
+			if ok, _ := path.Match(pattern, elem); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	patternElems := strings.Split(strings.Trim(pattern, "/"), "/")
+	for i := range elems {
+		if matchElems(patternElems, elems[:i+1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchElems matches path elements against pattern elements, ** matching any number of them
+func matchElems(pattern, elems []string) bool {
+	if len(pattern) == 0 {
+		return len(elems) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			if matchElems(pattern[1:], elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+		return false
+	}
+	return matchElems(pattern[1:], elems[1:])
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// import-restic and import-borg turn the snapshots of a restic or borg repository
+// into backman backups, so switching doesn't mean losing the history. the tool
+// itself writes each snapshot as a tar stream, which is stored like an ssh backup
+
+// foreignSnapshot is a restic snapshot or borg archive
+type foreignSnapshot struct {
+	// restic's snapshot ID or borg's archive name
+	ID    string
+	Time  time.Time
+	Host  string
+	User  string
+	Paths []string
+}
+
+// foreignTool knows how to read the snapshots of a restic or borg repository
+type foreignTool struct {
+	Name string
+	// lists the snapshots of repo, the oldest first
+	snapshots func(repo string) ([]foreignSnapshot, error)
+	// writes a snapshot to stdout as tar, with paths relative to /
+	dump func(repo string, snapshot foreignSnapshot) *exec.Cmd
+}
+
+var resticTool = foreignTool{
+	Name: "restic",
+	snapshots: func(repo string) ([]foreignSnapshot, error) {
+		out, err := foreignOutput(exec.Command("restic", "-r", repo, "snapshots", "--json"))
+		if err != nil {
+			return nil, err
+		}
+		var listed []struct {
+			ID       string    `json:"id"`
+			Time     time.Time `json:"time"`
+			Hostname string    `json:"hostname"`
+			Username string    `json:"username"`
+			Paths    []string  `json:"paths"`
+		}
+		if err := json.Unmarshal(out, &listed); err != nil {
+			return nil, fmt.Errorf("error parsing restic's snapshot list: %w", err)
+		}
+		var snapshots []foreignSnapshot
+		for _, s := range listed {
+			snapshots = append(snapshots, foreignSnapshot{ID: s.ID, Time: s.Time, Host: s.Hostname, User: s.Username, Paths: s.Paths})
+		}
+		return snapshots, nil
+	},
+	dump: func(repo string, snapshot foreignSnapshot) *exec.Cmd {
+		return exec.Command("restic", "-r", repo, "dump", "--archive", "tar", snapshot.ID, "/")
+	},
+}
+
+// borg prints times without a zone, in local time
+const borgTimeLayout = "2006-01-02T15:04:05.999999"
+
+var borgTool = foreignTool{
+	Name: "borg",
+	snapshots: func(repo string) ([]foreignSnapshot, error) {
+		out, err := foreignOutput(exec.Command("borg", "list", "--json", repo))
+		if err != nil {
+			return nil, err
+		}
+		var listed struct {
+			Archives []struct {
+				Name string `json:"name"`
+			} `json:"archives"`
+		}
+		if err := json.Unmarshal(out, &listed); err != nil {
+			return nil, fmt.Errorf("error parsing borg's archive list: %w", err)
+		}
+
+		// only borg info knows who made an archive and of what
+		var snapshots []foreignSnapshot
+		for _, archive := range listed.Archives {
+			out, err := foreignOutput(exec.Command("borg", "info", "--json", repo+"::"+archive.Name))
+			if err != nil {
+				return nil, err
+			}
+			var info struct {
+				Archives []struct {
+					Start       string   `json:"start"`
+					Hostname    string   `json:"hostname"`
+					Username    string   `json:"username"`
+					CommandLine []string `json:"command_line"`
+				} `json:"archives"`
+			}
+			if err := json.Unmarshal(out, &info); err != nil || len(info.Archives) == 0 {
+				return nil, fmt.Errorf("error parsing borg's info on '%s': %v", archive.Name, err)
+			}
+			a := info.Archives[0]
+			start, err := time.ParseInLocation(borgTimeLayout, a.Start, time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing the time of '%s': %w", archive.Name, err)
+			}
+			snapshots = append(snapshots, foreignSnapshot{
+				ID:    archive.Name,
+				Time:  start,
+				Host:  a.Hostname,
+				User:  a.Username,
+				Paths: borgPaths(a.CommandLine),
+			})
+		}
+		return snapshots, nil
+	},
+	dump: func(repo string, snapshot foreignSnapshot) *exec.Cmd {
+		return exec.Command("borg", "export-tar", repo+"::"+snapshot.ID, "-")
+	},
+}
+
+// borgPaths guesses the backed up paths from the `borg create` command line: the
+// arguments after the repo::archive one that aren't options. options taking a
+// value, like --exclude, can make it guess wrong, --path corrects that
+func borgPaths(commandLine []string) []string {
+	var paths []string
+	found := false
+	for _, arg := range commandLine {
+		switch {
+		case strings.Contains(arg, "::"):
+			found = true
+		case found && !strings.HasPrefix(arg, "-"):
+			paths = append(paths, arg)
+		}
+	}
+	return paths
+}
+
+// foreignOutput runs cmd and returns its stdout. stdin is passed through for
+// password prompts, stderr is shown if it fails
+func foreignOutput(cmd *exec.Cmd) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w\n%s", cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// foreignNote is the note of a backup imported from snapshot, which is also how
+// snapshots that were already imported are recognized
+func foreignNote(tool foreignTool, snapshot foreignSnapshot) string {
+	return fmt.Sprintf("imported from %s snapshot %s", tool.Name, snapshot.ID)
+}
+
+// snapshotRename maps the paths of a snapshot's tar stream into the archive like
+// a backup of paths would store them: the contents of a single path at the top,
+// several paths each under their own name. everything else is left out
+func snapshotRename(paths []string) func(name string) (string, bool) {
+	prefixes := make(map[string]string)
+	if len(paths) == 1 {
+		prefixes[strings.Trim(paths[0], "/")] = ""
+	} else {
+		used := make(map[string]bool)
+		for _, p := range paths {
+			name := path.Base(p)
+			for i := 1; used[name]; i++ {
+				name = fmt.Sprintf("%s-%d", path.Base(p), i)
+			}
+			used[name] = true
+			prefixes[strings.Trim(p, "/")] = name
+		}
+	}
+
+	return func(name string) (string, bool) {
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		for prefix, root := range prefixes {
+			var rest string
+			switch {
+			case prefix == "":
+				rest = name
+			case name == prefix:
+				rest = ""
+			case strings.HasPrefix(name, prefix+"/"):
+				rest = name[len(prefix)+1:]
+			default:
+				continue
+			}
+			renamed := path.Join(root, rest)
+			return renamed, renamed != ""
+		}
+		return "", false
+	}
+}
+
+// importSnapshot makes a backup of a snapshot
+func importSnapshot(tool foreignTool, repo string, snapshot foreignSnapshot, opts compressOptions) {
+	sidecar := SidecarData{
+		BackupOf: snapshot.Paths[0],
+		Time:     snapshot.Time.UTC(),
+		Host:     snapshot.Host,
+		User:     snapshot.User,
+		Note:     foreignNote(tool, snapshot),
+	}
+	if len(snapshot.Paths) > 1 {
+		sidecar.BackupOf = commonParent(snapshot.Paths)
+		sidecar.Sources = snapshot.Paths
+	}
+	opts.Rename = snapshotRename(snapshot.Paths)
+
+	if opts.Incremental {
+		if parent, manifest, ok := findParent(sidecar); ok {
+			sidecar.ParentID = &parent.ID
+			opts.Parent = manifest
+		}
+	}
+
+	useDict(&sidecar, &opts)
+	writeBackup(sidecar, opts.Format, func(backupName string) (*Manifest, error) {
+		fmt.Printf("Importing %s snapshot %s of %s...\n", tool.Name, snapshot.ID, strings.Join(snapshot.Paths, ", "))
+		cmd := tool.dump(repo, snapshot)
+		var stderr bytes.Buffer
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = &stderr
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+
+		manifest, copyErr := copyTarStream(out, backupName, opts)
+		if copyErr != nil {
+			cmd.Process.Kill()
+		}
+		if err := cmd.Wait(); err != nil && (copyErr == nil || stderr.Len() > 0) {
+			return nil, fmt.Errorf("%s: %w\n%s", tool.Name, err, strings.TrimSpace(stderr.String()))
+		}
+		if copyErr == nil && len(manifest.Files) == 0 {
+			return nil, fmt.Errorf("no files of %s in the snapshot, pass the --path it backed up", strings.Join(snapshot.Paths, ", "))
+		}
+		return manifest, copyErr
+	})
+}
+
+func importForeignCommand(tool foreignTool, args []string) {
+	fs := flag.NewFlagSet("import-"+tool.Name, flag.ContinueOnError)
+	incremental := fs.Bool("incremental", false, "store each snapshot as the changes since the one before")
+	var paths stringList
+	fs.Var(&paths, "path", "the absolute path the snapshots backed up, can be repeated. read from the snapshots by default")
+	args = parseFlags(fs, args)
+	if len(args) == 0 {
+		usageError("import-" + tool.Name)
+	}
+	repo, wanted := args[0], args[1:]
+
+	split, err := parseSplitSize(config.SplitSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	opts := compressOptions{
+		Format:      config.ArchiveFormat,
+		Xattrs:      config.Xattrs,
+		Strict:      config.Strict,
+		Incremental: *incremental,
+		SplitSize:   split,
+	}
+
+	snapshots, err := tool.snapshots(repo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading the %s repository: %v\n", tool.Name, err)
+		os.Exit(exitFatal)
+	}
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+	slices.SortFunc(snapshots, func(a, b foreignSnapshot) int { return a.Time.Compare(b.Time) })
+
+	var imported, skipped int
+	for _, snapshot := range snapshots {
+		// restic's short IDs are prefixes of the full ones
+		if len(wanted) > 0 && !slices.ContainsFunc(wanted, func(w string) bool { return strings.HasPrefix(snapshot.ID, w) }) {
+			continue
+		}
+		if slices.ContainsFunc(sidecars, func(s SidecarData) bool { return s.Note == foreignNote(tool, snapshot) }) {
+			skipped++
+			continue
+		}
+		if len(paths) > 0 {
+			snapshot.Paths = paths
+		}
+		if len(snapshot.Paths) == 0 || slices.ContainsFunc(snapshot.Paths, func(p string) bool { return !path.IsAbs(p) }) {
+			fmt.Fprintf(os.Stderr, "Can't tell which absolute paths snapshot %s is of, pass them with --path\n", snapshot.ID)
+			os.Exit(exitUsage)
+		}
+		importSnapshot(tool, repo, snapshot, opts)
+		imported++
+	}
+
+	if skipped > 0 {
+		fmt.Printf("Skipped %d snapshots that were already imported\n", skipped)
+	}
+	fmt.Printf("Imported %d snapshots!\n", imported)
+}
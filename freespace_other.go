@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+const freeSpaceSupported = false
+
+func freeSpace(path string) (uint64, error) {
+	return 0, errors.New("checking free space is not supported on this platform")
+}
+
+func freeInodes(path string) (uint64, bool, error) {
+	return 0, false, nil
+}
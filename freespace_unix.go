@@ -0,0 +1,51 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const freeSpaceSupported = true
+
+// freeSpace returns the bytes available to unprivileged users on the filesystem
+// holding path. path doesn't have to exist yet, its closest existing parent is used
+func freeSpace(path string) (uint64, error) {
+	path = existingParent(path)
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// freeInodes returns the inodes available on the filesystem holding path, false
+// if it doesn't have a fixed number of them, eg. btrfs
+func freeInodes(path string) (uint64, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(existingParent(path), &stat); err != nil {
+		return 0, false, err
+	}
+	if stat.Files == 0 {
+		return 0, false, nil
+	}
+	return uint64(stat.Ffree), true, nil
+}
+
+// existingParent returns path or the closest of its parents that exists
+func existingParent(path string) string {
+	path, _ = filepath.Abs(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
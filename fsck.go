@@ -0,0 +1,381 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+)
+
+// fsck finds backups that were interrupted while they were written, and archives
+// in the archive dir that lost their sidecar. archives don't
+// store where their files came from, so `fsck --rebuild` guesses it by comparing
+// the paths inside an archive with the targets of the other backups, both on disk
+// and in their manifests, and writes a new sidecar
+
+// how many file paths of an orphan are compared against each candidate
+const fsckSamplePaths = 500
+
+// orphanArchives returns the archives in the archive dir without a sidecar
+func orphanArchives() ([]string, error) {
+	entries, err := os.ReadDir(config.ArchiveDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for _, entry := range entries {
+		// split archives are found by their first volume
+		name := strings.TrimSuffix(entry.Name(), ".001")
+		if entry.IsDir() || !slices.ContainsFunc(archiveFormats, func(f string) bool { return strings.HasSuffix(name, "."+f) }) {
+			continue
+		}
+		path := filepath.Join(config.ArchiveDir, name)
+		if _, err := os.Stat(path + ".json"); errors.Is(err, os.ErrNotExist) {
+			orphans = append(orphans, path)
+		}
+	}
+	return orphans, nil
+}
+
+// partialBackups returns the backups whose sidecar is still marked partial, see SidecarData.Partial
+func partialBackups() ([]SidecarData, error) {
+	entries, err := os.ReadDir(config.ArchiveDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var partial []SidecarData
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" || entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(config.ArchiveDir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var sidecar SidecarData
+		if json.Unmarshal(data, &sidecar) == nil && sidecar.Partial {
+			sidecar.ParentPath = strings.TrimSuffix(path, ".json")
+			partial = append(partial, sidecar)
+		}
+	}
+	return partial, nil
+}
+
+// orphanContents is what could be read out of an orphaned archive
+type orphanContents struct {
+	// paths of regular files inside the archive, at most fsckSamplePaths
+	Sample []string
+	Size   int64
+	Files  int
+	// set if the archive isn't a tar but a backup of piped data
+	Stream bool
+}
+
+// readOrphan reads the file paths and sizes stored in an archive
+func readOrphan(path string) (orphanContents, error) {
+	var contents orphanContents
+	err := readEntries(path, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		if len(contents.Sample) < fsckSamplePaths {
+			contents.Sample = append(contents.Sample, header.Name)
+		}
+		contents.Size += header.Size
+		contents.Files++
+		return nil
+	})
+	if err != nil && contents.Files == 0 && formatOf(path) != "zip" {
+		// stream backups are compressed data without a tar around it
+		if r, openErr := openArchive(path); openErr == nil {
+			size, copyErr := copyBuffered(io.Discard, r)
+			r.Close()
+			if copyErr == nil {
+				return orphanContents{Size: size, Files: 1, Stream: true}, nil
+			}
+		}
+	}
+	return contents, err
+}
+
+// archiveDict returns the ID of the zstd dictionary a tar.zstd archive was compressed with
+func archiveDict(path string) uint32 {
+	if formatOf(path) != "tar.zstd" {
+		return 0
+	}
+	f, err := openArchiveData(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	start := make([]byte, zstd.HeaderMaxSize)
+	n, _ := io.ReadFull(f, start)
+	var header zstd.Header
+	if header.Decode(start[:n]) != nil {
+		return 0
+	}
+	return header.DictionaryID
+}
+
+// fsckCandidate is a target an orphan might have been a backup of
+type fsckCandidate struct {
+	Targets []string
+	// the manifest of the newest backup of the targets, if any
+	Manifest *Manifest
+}
+
+// onDisk maps a path inside an archive of the candidate to where it is on disk
+func (c fsckCandidate) onDisk(name string) (string, bool) {
+	for _, root := range archiveRoots(c.Targets) {
+		if root.Name == "" {
+			return filepath.Join(root.Path, filepath.FromSlash(name)), true
+		}
+		if rest, ok := strings.CutPrefix(name, root.Name+"/"); ok {
+			return filepath.Join(root.Path, filepath.FromSlash(rest)), true
+		}
+		if name == root.Name {
+			return root.Path, true
+		}
+	}
+	return "", false
+}
+
+// score returns how many of the sampled paths the candidate has
+func (c fsckCandidate) score(sample []string) int {
+	found := 0
+	for _, name := range sample {
+		if c.Manifest != nil {
+			if _, ok := c.Manifest.Files[name]; ok {
+				found++
+				continue
+			}
+		}
+		if path, ok := c.onDisk(name); ok {
+			if _, err := os.Lstat(path); err == nil {
+				found++
+			}
+		}
+	}
+	return found
+}
+
+// fsckCandidates returns the targets of every known backup, with their newest manifest
+func fsckCandidates(sidecars []SidecarData) []fsckCandidate {
+	slices.SortFunc(sidecars, func(a, b SidecarData) int { return b.Time.Compare(a.Time) })
+
+	seen := make(map[string]bool)
+	var candidates []fsckCandidate
+	for _, sidecar := range sidecars {
+		if sidecar.Stream != "" {
+			continue
+		}
+		targets := sidecar.Sources
+		if len(targets) == 0 {
+			targets = []string{sidecar.BackupOf}
+		}
+		key := strings.Join(targets, "\x00")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		manifest, err := readManifest(sidecar.ManifestPath())
+		if err != nil {
+			manifest = nil
+		}
+		candidates = append(candidates, fsckCandidate{Targets: targets, Manifest: manifest})
+	}
+	return candidates
+}
+
+// rebuildSidecar guesses what an orphan is a backup of and writes a sidecar for it.
+// of overrides the guess
+func rebuildSidecar(path string, candidates []fsckCandidate, of string, usedIDs []uint16) (SidecarData, error) {
+	contents, err := readOrphan(path)
+	if err != nil {
+		return SidecarData{}, fmt.Errorf("error reading archive: %w", err)
+	}
+	manifest, err := readManifest(path + ".manifest")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: Ignoring the unreadable manifest of '%s': %v\n", filepath.Base(path), err)
+		manifest = nil
+	}
+
+	sidecar := SidecarData{
+		OriginalSize: contents.Size,
+		Files:        contents.Files,
+		Dict:         archiveDict(path),
+		ParentPath:   path,
+	}
+	// archives named by archive_name_template have their UUID somewhere in the name
+	if uuid := uuidPattern.FindString(filepath.Base(path)); uuid != "" && uuid != sidecar.UUID() {
+		sidecar.ArchiveUUID = uuid
+	}
+	if info, err := os.Stat(archiveVolumes(path)[0]); err == nil {
+		// the archive is finished writing right after the backup is made
+		sidecar.Time = info.ModTime().UTC()
+	}
+
+	switch {
+	case contents.Stream:
+		name := strings.TrimSuffix(filepath.Base(path), "."+formatOf(path))
+		if manifest != nil && len(manifest.Files) == 1 {
+			name = manifest.Paths()[0]
+		}
+		sidecar.Stream = name
+		sidecar.BackupOf = "stdin:" + name
+
+	case of != "":
+		if isRemoteTarget(of) {
+			sidecar.BackupOf = of
+		} else if sidecar.BackupOf, err = filepath.Abs(of); err != nil {
+			return SidecarData{}, err
+		}
+
+	default:
+		best, bestScore := fsckCandidate{}, 0
+		for _, candidate := range candidates {
+			if score := candidate.score(contents.Sample); score > bestScore {
+				best, bestScore = candidate, score
+			}
+		}
+		if bestScore == 0 {
+			return SidecarData{}, errors.New("couldn't guess what it's a backup of, pass --of")
+		}
+		fmt.Printf("\t%d of %d sampled files match '%s'\n", bestScore, len(contents.Sample), strings.Join(best.Targets, "', '"))
+		sidecar.BackupOf = best.Targets[0]
+		if len(best.Targets) > 1 {
+			sidecar.BackupOf = commonParent(best.Targets)
+			sidecar.Sources = best.Targets
+		}
+	}
+
+	if manifest != nil {
+		if size, files := manifest.Stored(); files < len(manifest.Files) {
+			sidecar.OriginalSize, sidecar.Files = size, files
+			fmt.Fprintf(os.Stderr, "WARNING: '%s' was an incremental backup, its parent is unknown so only the files it stored can be restored\n", filepath.Base(path))
+		}
+	}
+
+	sidecar.ID, err = allocateID(usedIDs)
+	if err != nil {
+		return SidecarData{}, fmt.Errorf("error allocating ID: %w", err)
+	}
+	return sidecar, sidecar.Save()
+}
+
+func fsckCommand(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	rebuild := fs.Bool("rebuild", false, "write sidecars for archives that lost theirs")
+	of := fs.String("of", "", "what the rebuilt archives are backups of, instead of guessing")
+	removePartial := fs.Bool("remove-partial", false, "delete backups that were interrupted while they were written")
+	iKnow := iKnowFlag(fs)
+	names := parseFlags(fs, args)
+	if *removePartial {
+		checkAppendOnly("remove interrupted backups", *iKnow)
+	}
+
+	partial, err := partialBackups()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+	if len(partial) > 0 {
+		fmt.Printf("%d backups were interrupted while they were written, or are still being written:\n", len(partial))
+		for _, sidecar := range partial {
+			fmt.Printf("\t%d: %s, started %s on %s\n", sidecar.ID, sidecar.BackupOf, formatTime(sidecar.Time), sidecar.Host)
+			if *removePartial {
+				sidecar.DeleteAll()
+			}
+		}
+		if *removePartial {
+			fmt.Printf("Removed %d interrupted backups\n", len(partial))
+		} else {
+			fmt.Println("Remove them with `fsck --remove-partial` once no backup is running")
+		}
+	}
+
+	orphans, err := orphanArchives()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading archive dir: ", err)
+		os.Exit(exitFatal)
+	}
+	if len(names) > 0 {
+		orphans = slices.DeleteFunc(orphans, func(path string) bool {
+			return !slices.ContainsFunc(names, func(name string) bool { return strings.HasPrefix(filepath.Base(path), name) })
+		})
+	}
+	if quarantined, err := readQuarantine(); err == nil && len(quarantined) > 0 {
+		fmt.Printf("%d backups are in the quarantine, see `quarantine list`\n", len(quarantined))
+	}
+	if len(orphans) == 0 {
+		fmt.Println("No archives without a sidecar")
+		return
+	}
+
+	if !*rebuild {
+		fmt.Printf("%d archives without a sidecar:\n", len(orphans))
+		for _, path := range orphans {
+			modified := "?"
+			if info, err := os.Stat(archiveVolumes(path)[0]); err == nil {
+				modified = formatTime(info.ModTime())
+			}
+			fmt.Printf("\t%s, %s | %s\n", filepath.Base(path), modified, humanize.IBytes(uint64(archiveSize(path))))
+		}
+		fmt.Println("Write sidecars for them with `fsck --rebuild`")
+		return
+	}
+
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+	trashed, err := readTrash()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the trash: ", err)
+		os.Exit(exitFatal)
+	}
+	var usedIDs []uint16
+	for _, sidecar := range append(slices.Clone(sidecars), trashed...) {
+		usedIDs = append(usedIDs, sidecar.ID)
+	}
+	candidates := fsckCandidates(append(sidecars, trashed...))
+
+	failed := 0
+	for _, path := range orphans {
+		fmt.Printf("Rebuilding the sidecar of '%s'...\n", filepath.Base(path))
+		sidecar, err := rebuildSidecar(path, candidates, *of, usedIDs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "\terror: ", err)
+			failed++
+			continue
+		}
+		usedIDs = append(usedIDs, sidecar.ID)
+		fmt.Printf("\tbackup %d of '%s'\n", sidecar.ID, sidecar.BackupOf)
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d archives were left without a sidecar\n", failed)
+		exitCode = exitPartial
+		return
+	}
+	fmt.Println("Rebuilt successfully! Check them with `verify [id]`")
+}
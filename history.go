@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// archivePaths returns the paths the file at name may be stored under in sidecar's
+// archive: name itself if it's relative, taken as an archive path, and where the
+// file name points at on disk is stored if it's inside what the backup is of
+func archivePaths(sidecar SidecarData, name string) []string {
+	var paths []string
+	if !filepath.IsAbs(name) {
+		paths = append(paths, path.Clean(filepath.ToSlash(name)))
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return paths
+	}
+
+	// a single directory is stored at the top of the archive and a single file
+	// under its name, the targets of combined backups under their own names
+	roots := []archiveRoot{{Path: sidecar.Of()}, {Path: sidecar.Of(), Name: filepath.Base(sidecar.Of())}}
+	if len(sidecar.Sources) > 0 {
+		roots = archiveRoots(sidecar.OfSources())
+	}
+	for _, root := range roots {
+		rel, err := filepath.Rel(root.Path, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if p := path.Join(root.Name, filepath.ToSlash(rel)); p != "." && !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// findArchivePath returns the path the file at name is stored under in files, false if it isn't
+func findArchivePath(sidecar SidecarData, files map[string]ManifestEntry, name string) (string, bool) {
+	for _, p := range archivePaths(sidecar, name) {
+		if _, ok := files[p]; ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// printHistory lists every backup that has the file at name, with its size, hash and mtime in each.
+// of limits it to the backups of a directory
+func printHistory(name, of string) {
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading sidecar files: %v\n", err)
+		os.Exit(exitFatal)
+	}
+	sort.Slice(sidecars, func(i, j int) bool {
+		return sidecars[i].Time.Before(sidecars[j].Time)
+	})
+
+	var hits []searchHit
+	for _, sidecar := range sidecars {
+		if of != "" && !sidecar.matchesTarget(of) {
+			continue
+		}
+		files, err := archiveFiles(sidecar)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Not searching backup %d: %v\n", sidecar.ID, err)
+			exitCode = exitPartial
+			continue
+		}
+		if p, ok := findArchivePath(sidecar, files, name); ok {
+			hits = append(hits, searchHit{Sidecar: sidecar, Entry: files[p]})
+		}
+	}
+
+	if len(hits) == 0 {
+		fmt.Printf("No backups contain '%s'\n", name)
+		return
+	}
+	printHits(name, hits)
+}
+
+// errFileFound stops reading an archive once catFile found the file
+var errFileFound = errors.New("found")
+
+// errBinary is returned by catTo for binary files when stdout is a terminal
+var errBinary = errors.New("looks like a binary file, pass --raw to print it anyway or redirect the output")
+
+// catTo copies r to out and hasher. unless raw is set, binary data isn't written
+// to a terminal: data with a NUL byte in its first 8KiB, like git and grep tell
+func catTo(out io.Writer, hasher io.Writer, r io.Reader, raw bool) error {
+	if !raw && stdoutIsTerminal() {
+		br := bufio.NewReaderSize(r, 8<<10)
+		head, _ := br.Peek(8 << 10)
+		if bytes.IndexByte(head, 0) >= 0 {
+			return errBinary
+		}
+		r = br
+	}
+	_, err := io.Copy(io.MultiWriter(out, hasher), r)
+	return err
+}
+
+// catFile writes the contents of the file at name in a backup to stdout. files
+// of incremental backups that didn't change are read from the backup storing them
+func catFile(sidecar SidecarData, name string, raw bool) {
+	out := bufio.NewWriterSize(os.Stdout, copyBufferSize)
+	hasher := newFileHash()
+	if sidecar.Stream != "" {
+		if name != sidecar.Stream && name != filepath.Base(sidecar.Stream) {
+			fmt.Fprintf(os.Stderr, "Backup %d is a single stream named '%s'\n", sidecar.ID, sidecar.Stream)
+			os.Exit(exitFatal)
+		}
+		checkSignature(sidecar.ParentPath)
+		r, err := openArchive(sidecar.ParentPath)
+		if err == nil {
+			err = catTo(out, hasher, r, raw)
+			r.Close()
+		}
+		if err != nil {
+			out.Flush()
+			fmt.Fprintf(os.Stderr, "error reading '%s': %v\n", sidecar.Stream, err)
+			os.Exit(exitFatal)
+		}
+		if err := out.Flush(); err != nil {
+			fmt.Fprintln(os.Stderr, "error writing to stdout: ", err)
+			os.Exit(exitFatal)
+		}
+		if manifest, err := readManifest(sidecar.ManifestPath()); err == nil && manifest != nil {
+			checkCatHash(sidecar.Stream, manifest.Files[sidecar.Stream], hasher)
+		}
+		return
+	}
+
+	files, err := archiveFiles(sidecar)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading backup: ", err)
+		os.Exit(exitFatal)
+	}
+	p, ok := findArchivePath(sidecar, files, name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "'%s' isn't in backup %d, see history\n", name, sidecar.ID)
+		os.Exit(exitFatal)
+	}
+	entry := files[p]
+
+	if entry.Unchanged {
+		chain, err := backupChain(sidecar)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error resolving backup chain: ", err)
+			os.Exit(exitFatal)
+		}
+		// the newest earlier backup that stored it
+		for i := len(chain) - 2; i >= 0; i-- {
+			manifest, err := readManifest(chain[i].ManifestPath())
+			if err != nil || manifest == nil {
+				continue
+			}
+			if layer, ok := manifest.Files[p]; ok && !layer.Unchanged {
+				sidecar = chain[i]
+				break
+			}
+		}
+	}
+	checkSignature(sidecar.ParentPath)
+
+	err = readEntries(sidecar.ParentPath, func(header *tar.Header, r io.Reader) error {
+		if header.Name != p || header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		if err := catTo(out, hasher, r, raw); err != nil {
+			return err
+		}
+		return errFileFound
+	})
+	if err == nil {
+		err = fmt.Errorf("'%s' is missing from the archive", p)
+	}
+	if err != errFileFound {
+		out.Flush()
+		fmt.Fprintf(os.Stderr, "error reading '%s': %v\n", p, err)
+		os.Exit(exitFatal)
+	}
+	if err := out.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, "error writing to stdout: ", err)
+		os.Exit(exitFatal)
+	}
+	checkCatHash(p, entry, hasher)
+}
+
+// checkCatHash exits if what catFile printed of name doesn't match its manifest entry
+func checkCatHash(name string, entry ManifestEntry, hasher hash.Hash) {
+	if entry.SHA256 != "" && hashString(hasher) != entry.SHA256 {
+		fmt.Fprintf(os.Stderr, "WARNING: '%s' doesn't match the manifest, the archive may be damaged\n", name)
+		os.Exit(exitVerifyFailed)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// messages are written in english and looked up in locales/<language>.json,
+// which maps the english format strings to translated ones, eg.
+//
+//	{"Restored backup into '%s'\n": "Backup nach '%s' wiederhergestellt\n"}
+//
+// anything without a translation is printed in english. a translation has to keep
+// the verbs of the original in the same order. the language is the language
+// config key, or comes from LC_ALL, LC_MESSAGES or LANG like with other tools
+
+//go:embed locales
+var localeFiles embed.FS
+
+// the catalog of the language in use, loaded on first use
+var (
+	catalogOnce sync.Once
+	catalog     map[string]string
+)
+
+// locales returns the languages there are translations for, and english
+func locales() []string {
+	languages := []string{"en"}
+	entries, _ := localeFiles.ReadDir("locales")
+	for _, entry := range entries {
+		languages = append(languages, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	return languages
+}
+
+// language returns the language messages are shown in, eg. "de" for LANG=de_DE.UTF-8
+func language() string {
+	if config.Language != "" {
+		return config.Language
+	}
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if value := os.Getenv(env); value != "" {
+			// language[_territory][.codeset][@modifier]
+			lang, _, _ := strings.Cut(value, "_")
+			lang, _, _ = strings.Cut(lang, ".")
+			lang, _, _ = strings.Cut(lang, "@")
+			if lang == "C" || lang == "POSIX" {
+				return "en"
+			}
+			return strings.ToLower(lang)
+		}
+	}
+	return "en"
+}
+
+// tr returns the translation of the english message msg, or msg if there's none
+func tr(msg string) string {
+	catalogOnce.Do(func() {
+		data, err := localeFiles.ReadFile(path.Join("locales", language()+".json"))
+		if err != nil {
+			return
+		}
+		// a broken catalog leaves messages in english rather than failing commands
+		json.Unmarshal(data, &catalog)
+	})
+	if translated, ok := catalog[msg]; ok && translated != "" {
+		return translated
+	}
+	return msg
+}
+
+// isYes reports whether answer means yes, in english or the language in use
+func isYes(answer string) bool {
+	answer = strings.TrimSpace(strings.ToLower(answer))
+	switch answer {
+	case "y", "yes", strings.ToLower(tr("y")), strings.ToLower(tr("yes")):
+		return true
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// contentIndex maps the words in a backup's text files to the files they're in,
+// so search --content doesn't have to decompress archives. it's written next to
+// the archive as <archive>.index when content_index is set
+type contentIndex struct {
+	// archive paths of the indexed files
+	Files []string `json:"files"`
+	// every word, lowercased, with the positions in Files of the files it's in
+	Terms map[string][]int `json:"terms"`
+}
+
+// words shorter or longer than these aren't indexed
+const (
+	minTermLength = 2
+	maxTermLength = 64
+)
+
+func newContentIndex() *contentIndex {
+	return &contentIndex{Terms: make(map[string][]int)}
+}
+
+// indexTerms splits text into lowercased words
+func indexTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := words[:0]
+	for _, word := range words {
+		if n := utf8.RuneCountInString(word); n >= minTermLength && n <= maxTermLength {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// isText guesses whether data is a text file: valid utf-8 without NUL bytes
+func isText(data []byte) bool {
+	return len(data) > 0 && !bytes.ContainsRune(data, 0) && utf8.Valid(data)
+}
+
+// Add indexes the contents of the file at path, if they're text
+func (x *contentIndex) Add(path string, data []byte) {
+	if !isText(data) {
+		return
+	}
+	file := len(x.Files)
+	x.Files = append(x.Files, path)
+	for _, term := range indexTerms(string(data)) {
+		files := x.Terms[term]
+		// a file's words are added together, so a repeated word ends the list
+		if len(files) == 0 || files[len(files)-1] != file {
+			x.Terms[term] = append(files, file)
+		}
+	}
+}
+
+// Find returns the paths of the files that contain every word of query
+func (x *contentIndex) Find(query string) []string {
+	terms := indexTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	matches := x.Terms[terms[0]]
+	for _, term := range terms[1:] {
+		matches = slices.DeleteFunc(slices.Clone(matches), func(file int) bool {
+			_, found := slices.BinarySearch(x.Terms[term], file)
+			return !found
+		})
+	}
+
+	paths := make([]string, len(matches))
+	for i, file := range matches {
+		paths[i] = x.Files[file]
+	}
+	return paths
+}
+
+// writeIndex writes x to name, encrypted if encrypt is set
+func writeIndex(name string, x *contentIndex) error {
+	data, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	if config.Encrypt {
+		if data, err = encryptBytes(data); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(name, data, 0600)
+}
+
+// readIndex returns nil without an error if the backup wasn't indexed
+func readIndex(name string) (*contentIndex, error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = decryptBytes(data); err != nil {
+		return nil, fmt.Errorf("error decrypting '%s': %w", filepath.Base(name), err)
+	}
+
+	x := newContentIndex()
+	if err := json.Unmarshal(data, x); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// printBackupInfo prints everything known about a single backup
+func printBackupInfo(sidecar SidecarData) {
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+
+	field := func(name string, value any) {
+		fmt.Printf("%-16s %v\n", name+":", value)
+	}
+
+	field("ID", sidecar.ID)
+	field("UUID", sidecar.UUID())
+	field("Of", sidecar.Of())
+	for _, source := range sidecar.OfSources() {
+		field("Source", source)
+	}
+	if sidecar.Stream != "" {
+		field("Stream", sidecar.Stream)
+	}
+	if sidecar.Dumper != "" {
+		field("Dumped with", sidecar.Dumper)
+	}
+	field("Created", fmt.Sprintf("%s (%s)", formatTime(sidecar.Time), humanize.Time(sidecar.Time)))
+	if !sidecar.Verified.IsZero() {
+		field("Verified", formatTime(sidecar.Verified))
+	}
+	if !sidecar.LastSeen.IsZero() {
+		field("Unchanged until", formatTime(sidecar.LastSeen))
+	}
+	if sidecar.Host != "" {
+		field("Made by", sidecar.User+"@"+sidecar.Host)
+	}
+	if sidecar.Note != "" {
+		field("Note", sidecar.Note)
+	}
+
+	fmt.Println()
+	field("Archive", sidecar.ParentPath)
+	field("Format", formatOf(sidecar.ParentPath))
+	if sidecar.Dict != 0 {
+		field("Dictionary", sidecar.Dict)
+	}
+	field("Compressed", humanize.IBytes(uint64(sidecar.ParentSize)))
+
+	if original, files, ok := sidecar.Original(); ok {
+		field("Original", humanize.IBytes(uint64(original)))
+		field("Ratio", sidecar.Ratio())
+		field("Files", files)
+	} else {
+		field("Original", "unknown, made by an older version")
+	}
+
+	manifest, err := readManifest(sidecar.ManifestPath())
+	switch {
+	case err != nil:
+		field("Manifest", "unreadable: "+err.Error())
+	case manifest == nil:
+		field("Manifest", "none")
+	default:
+		if manifest.Dirs > 0 {
+			field("Inodes", fmt.Sprintf("%d to restore (%d files, %d directories and links)", manifest.Inodes(), len(manifest.Files), manifest.Dirs))
+		} else {
+			field("Inodes", fmt.Sprintf("%d files to restore, and their directories", len(manifest.Files)))
+		}
+		_, stored := manifest.Stored()
+		if unchanged := len(manifest.Files) - stored; unchanged > 0 {
+			field("Unchanged", fmt.Sprintf("%d files stored in earlier backups", unchanged))
+		}
+		if changed := manifest.Changed(); len(changed) > 0 {
+			field("Changed", fmt.Sprintf("%d files changed while they were read", len(changed)))
+		}
+	}
+	if len(sidecar.Skipped) > 0 {
+		field("Skipped", fmt.Sprintf("%d unreadable files", len(sidecar.Skipped)))
+	}
+
+	hasher := newFileHash()
+	if f, err := openArchiveFile(sidecar.ParentPath, os.O_RDONLY); err == nil {
+		if f.Split() {
+			field("Volumes", len(f.files))
+		}
+		_, err = copyBuffered(hasher, f)
+		f.Close()
+		if err == nil {
+			field("SHA256", hashString(hasher))
+		}
+	}
+	if sidecar.Encrypted {
+		field("Encrypted", "yes")
+	}
+	field("Content index", presence(sidecar.IndexPath()))
+	field("Signature", presence(sidecar.SignaturePath()))
+	field("Parity", presence(sidecar.ParityPath()))
+
+	fmt.Println()
+	if sidecar.ParentID != nil {
+		chain, err := backupChain(sidecar)
+		if err != nil {
+			field("Chain", "broken: "+err.Error())
+		} else {
+			var ids []string
+			for _, link := range chain {
+				ids = append(ids, fmt.Sprint(link.ID))
+			}
+			field("Chain", strings.Join(ids, " -> "))
+		}
+	} else {
+		field("Chain", "full backup")
+	}
+	if deps := dependents(sidecars, sidecar.ID); len(deps) > 0 {
+		var ids []string
+		for _, dep := range deps {
+			ids = append(ids, fmt.Sprint(dep.ID))
+		}
+		field("Needed by", strings.Join(ids, ", "))
+	}
+}
+
+// presence describes whether an optional backup file exists
+func presence(path string) string {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "none"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return humanize.IBytes(uint64(info.Size()))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// the macOS keychain is used through the security tool
+
+func keychainGet(account string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("security", "find-generic-password", "-s", keychainService, "-a", account, "-w")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// 44 is errSecItemNotFound
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() == 44 {
+			return nil, nil
+		}
+		return nil, errors.New(strings.TrimSpace(stderr.String()))
+	}
+	return bytes.TrimRight(stdout.Bytes(), "\n"), nil
+}
+
+func keychainSet(account string, secret []byte) error {
+	// passed through security's interactive mode, arguments show up in ps
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	command := `add-generic-password -U -s "` + quote.Replace(keychainService) + `" -a "` + quote.Replace(account) + `" -w "` + quote.Replace(string(secret)) + "\"\n"
+	return runQuiet(strings.NewReader(command), "security", "-i")
+}
+
+func keychainDelete(account string) error {
+	return runQuiet(nil, "security", "delete-generic-password", "-s", keychainService, "-a", account)
+}
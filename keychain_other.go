@@ -0,0 +1,37 @@
+//go:build !darwin && !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// the secret service (gnome keyring, kwallet) is used through libsecret's secret-tool
+
+func keychainGet(account string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", "lookup", "service", keychainService, "account", account)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// a missing entry fails without saying anything
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && stderr.Len() == 0 {
+			return nil, nil
+		}
+		return nil, errors.New(strings.TrimSpace(stderr.String() + " " + err.Error()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func keychainSet(account string, secret []byte) error {
+	// read from stdin, arguments show up in ps
+	return runQuiet(bytes.NewReader(secret), "secret-tool", "store", "--label", "backman passphrase of "+account, "service", keychainService, "account", account)
+}
+
+func keychainDelete(account string) error {
+	return runQuiet(nil, "secret-tool", "clear", "service", keychainService, "account", account)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/lithammer/fuzzysearch/fuzzy"
+)
+
+type listOptions struct {
+	// matches are highlighted, see parseQuery. in column output only matches are printed
+	Query string
+	// leave out backups that don't match Query instead of greying them out
+	Filter bool
+	// only list backups made on this machine
+	Host string
+	// "id", "time", "size" or "name"
+	Sort    string
+	Reverse bool
+	// print these listColumns one backup per line instead of the default layout
+	Columns []string
+	// align the columns and add a header
+	Table bool
+	// only list backups made in this window
+	Range timeRange
+	// print one line per backed up path instead of every backup, see printGroups
+	Group bool
+	// with Group, list the backups of each path under it too
+	All bool
+}
+
+// listColumns are the columns list --columns can print
+var listColumns = map[string]func(s SidecarData) string{
+	"id":     func(s SidecarData) string { return strconv.Itoa(int(s.ID)) },
+	"uuid":   func(s SidecarData) string { return s.UUID() },
+	"of":     func(s SidecarData) string { return s.Of() },
+	"time":   func(s SidecarData) string { return formatTime(s.Time) },
+	"size":   func(s SidecarData) string { return humanize.IBytes(uint64(s.ParentSize)) },
+	"bytes":  func(s SidecarData) string { return strconv.FormatInt(s.ParentSize, 10) },
+	"format": func(s SidecarData) string { return formatOf(s.ParentPath) },
+	"parent": func(s SidecarData) string {
+		if s.ParentID == nil {
+			return "-"
+		}
+		return strconv.Itoa(int(*s.ParentID))
+	},
+	"original": func(s SidecarData) string {
+		if size, _, ok := s.Original(); ok {
+			return humanize.IBytes(uint64(size))
+		}
+		return "-"
+	},
+	"files": func(s SidecarData) string {
+		if _, files, ok := s.Original(); ok {
+			return strconv.Itoa(files)
+		}
+		return "-"
+	},
+	"ratio": func(s SidecarData) string { return s.Ratio() },
+	"host":  func(s SidecarData) string { return s.User + "@" + s.Host },
+	"note":  func(s SidecarData) string { return s.Note },
+}
+
+var defaultColumns = []string{"id", "of", "time", "size"}
+
+// queryFields are the fields a query can be scoped to with field:value
+var queryFields = map[string]func(s SidecarData) string{
+	"id":     listColumns["id"],
+	"uuid":   listColumns["uuid"],
+	"of":     func(s SidecarData) string { return s.Of() + " " + strings.Join(s.OfSources(), " ") },
+	"time":   func(s SidecarData) string { return inZone(s.Time).Format("2006-01-02 15:04:05") },
+	"host":   listColumns["host"],
+	"format": listColumns["format"],
+	"note":   listColumns["note"],
+}
+
+// backupQuery matches backups against a list query: space separated terms that
+// all have to match. field:value terms match a substring of that field, the
+// rest are fuzzy matched against FormatHay
+type backupQuery struct {
+	fuzzy  string
+	fields map[string]string
+}
+
+func parseQuery(query string) (backupQuery, error) {
+	q := backupQuery{fields: make(map[string]string)}
+	var fuzzyTerms []string
+	for _, term := range strings.Fields(strings.ToLower(query)) {
+		field, value, ok := strings.Cut(term, ":")
+		if !ok || value == "" {
+			fuzzyTerms = append(fuzzyTerms, term)
+			continue
+		}
+		if _, known := queryFields[field]; !known {
+			return q, fmt.Errorf("can't search by %q, use any of: %s", field, strings.Join(slices.Sorted(maps.Keys(queryFields)), ", "))
+		}
+		q.fields[field] = value
+	}
+	q.fuzzy = strings.Join(fuzzyTerms, " ")
+	return q, nil
+}
+
+func (q backupQuery) Empty() bool {
+	return q.fuzzy == "" && len(q.fields) == 0
+}
+
+func (q backupQuery) Match(s SidecarData) bool {
+	for field, value := range q.fields {
+		if !strings.Contains(strings.ToLower(queryFields[field](s)), value) {
+			return false
+		}
+	}
+	return q.fuzzy == "" || fuzzy.Match(q.fuzzy, s.FormatHay())
+}
+
+// sortSidecars sorts by one of the listOptions.Sort keys, oldest first for ties
+func sortSidecars(sidecars []SidecarData, by string, reverse bool) error {
+	var less func(a, b SidecarData) bool
+	switch by {
+	case "", "time":
+		less = func(a, b SidecarData) bool { return a.Time.Before(b.Time) }
+	case "id":
+		less = func(a, b SidecarData) bool { return a.ID < b.ID }
+	case "size":
+		less = func(a, b SidecarData) bool { return a.ParentSize < b.ParentSize }
+	case "name":
+		less = func(a, b SidecarData) bool { return a.Of() < b.Of() }
+	default:
+		return fmt.Errorf("can't sort by %q, use id, time, size or name", by)
+	}
+
+	sort.SliceStable(sidecars, func(i, j int) bool {
+		return sidecars[i].Time.Before(sidecars[j].Time)
+	})
+	sort.SliceStable(sidecars, func(i, j int) bool {
+		if reverse {
+			return less(sidecars[j], sidecars[i])
+		}
+		return less(sidecars[i], sidecars[j])
+	})
+	return nil
+}
+
+func listBackups(opts listOptions) {
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading sidecar files: %v\n", err)
+		os.Exit(exitFatal)
+	}
+
+	if err := sortSidecars(sidecars, opts.Sort, opts.Reverse); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	for _, column := range opts.Columns {
+		if _, ok := listColumns[column]; !ok {
+			names := slices.Sorted(maps.Keys(listColumns))
+			fmt.Fprintf(os.Stderr, "unknown column %q, use any of: %s\n", column, strings.Join(names, ", "))
+			os.Exit(exitUsage)
+		}
+	}
+
+	q, err := parseQuery(opts.Query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+
+	var shown []SidecarData
+	for _, data := range sidecars {
+		if opts.Host != "" && !strings.EqualFold(data.Host, opts.Host) {
+			continue
+		}
+		if !opts.Range.Contains(data.Time) {
+			continue
+		}
+		if opts.Filter && !q.Match(data) {
+			continue
+		}
+		shown = append(shown, data)
+	}
+
+	if len(opts.Columns) > 0 {
+		printColumns(shown, q, opts)
+		return
+	}
+	if opts.Group {
+		printGroups(shown, q, opts)
+		return
+	}
+
+	thisHost := hostname()
+	for _, data := range shown {
+		printBackup(data, q, opts, thisHost)
+	}
+	warnStale(shown)
+}
+
+// printGroups prints the backups by the path they're of, in the order the first
+// backup of each path is sorted in. with All the backups are listed under each
+// path, otherwise only their number and size
+func printGroups(sidecars []SidecarData, q backupQuery, opts listOptions) {
+	type group struct {
+		backups []SidecarData
+		size    int64
+		matches int
+		newest  SidecarData
+	}
+	var order []string
+	groups := make(map[string]*group)
+	for _, data := range sidecars {
+		g, ok := groups[data.Of()]
+		if !ok {
+			g = &group{newest: data}
+			groups[data.Of()] = g
+			order = append(order, data.Of())
+		}
+		g.backups = append(g.backups, data)
+		g.size += data.ParentSize
+		if q.Match(data) {
+			g.matches++
+		}
+		if data.Time.After(g.newest.Time) {
+			g.newest = data
+		}
+	}
+
+	thisHost := hostname()
+	for i, of := range order {
+		g := groups[of]
+		var matches string
+		if !q.Empty() && !opts.Filter {
+			matches = fmt.Sprintf(", %d matching", g.matches)
+		}
+		if opts.All && i > 0 {
+			fmt.Println()
+		}
+		var stale string
+		if age := (targetAge{Of: of, Last: lastBackedUp(g.newest), Backups: len(g.backups)}); age.Stale(time.Now()) {
+			stale = paint(os.Stdout, "stale", fmt.Sprintf(", STALE: %s", age.Describe()))
+		}
+		fmt.Printf("%s (%d backups, %s%s), newest %d at %s%s\n",
+			of, len(g.backups), humanize.IBytes(uint64(g.size)), matches,
+			g.newest.ID, formatTime(g.newest.Time), stale,
+		)
+		if opts.All {
+			for _, data := range g.backups {
+				printBackup(data, q, opts, thisHost)
+			}
+		}
+	}
+}
+
+// printBackup prints a backup in the default list layout, bold if it matches
+// the query and grey if it doesn't
+func printBackup(data SidecarData, q backupQuery, opts listOptions, thisHost string) {
+	role := ""
+	if !q.Empty() && !opts.Filter {
+		role = "other"
+		if q.Match(data) {
+			role = "match"
+		}
+	}
+
+	of := data.Of()
+	if len(data.Sources) > 1 {
+		of = fmt.Sprintf("%s (%d paths)", of, len(data.Sources))
+	}
+	if data.ParentID != nil {
+		of = fmt.Sprintf("%s (incremental on %d)", of, *data.ParentID)
+	}
+	if data.Host != "" && data.Host != thisHost {
+		of = fmt.Sprintf("%s (%s@%s)", of, data.User, data.Host)
+	}
+	if format := formatOf(data.ParentPath); format != defaultArchiveFormat {
+		of = fmt.Sprintf("%s [%s]", of, format)
+	}
+
+	when := formatTime(data.Time)
+	if !data.LastSeen.IsZero() {
+		when = fmt.Sprintf("%s (unchanged until %s)", when, formatTime(data.LastSeen))
+	}
+
+	var note string
+	if data.Note != "" {
+		note = fmt.Sprintf("\t%q\n", data.Note)
+	}
+
+	fmt.Print(paint(os.Stdout, role, fmt.Sprintf("%v (%s):\n\t%s\n\t%s | %s\n%s",
+		data.ID,
+		data.UUID()[:min(8, len(data.UUID()))],
+		of,
+		when,
+		humanize.IBytes(uint64(data.ParentSize)),
+		note,
+	)))
+}
+
+// printColumns prints one line per backup matching q, tab separated for scripts
+// or as an aligned table
+func printColumns(sidecars []SidecarData, q backupQuery, opts listOptions) {
+	var w *tabwriter.Writer
+	out := os.Stdout
+	if opts.Table {
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.ToUpper(strings.Join(opts.Columns, "\t")))
+	}
+
+	for _, data := range sidecars {
+		// colors would break the alignment and awk, so non matching backups are left out
+		if !q.Match(data) {
+			continue
+		}
+
+		values := make([]string, len(opts.Columns))
+		for i, column := range opts.Columns {
+			// keep one backup per line and the columns intact
+			values[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(listColumns[column](data))
+		}
+		if w != nil {
+			fmt.Fprintln(w, strings.Join(values, "\t"))
+		} else {
+			fmt.Fprintln(out, strings.Join(values, "\t"))
+		}
+	}
+
+	if w != nil {
+		w.Flush()
+	}
+}
@@ -2,247 +2,1341 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
-	"sort"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"github.com/lithammer/fuzzysearch/fuzzy"
 )
 
-func printUsage() {
-	fmt.Println("Usage:")
-	fmt.Println("	help => Show this menu")
-	fmt.Println("	info => Print config info and exit")
-	fmt.Println("	backup [dir] => Which directory to backup, defaults to `.`")
-	fmt.Println("	restore [id] => Restores from a backup, use `list` to get ID's")
-	fmt.Println("	list [query] => List backups with filter, omit query to list all")
-	fmt.Println("	delete [id] => Delete a backup with given ID")
-	fmt.Println("	purge [date] => Delete backups older than date. (go time format, eg '1d1h')")
-}
-
 func main() {
-	loadConfig()
+	// commands that finish with problems set exitCode instead of exiting right away
+	defer func() {
+		if exitCode != exitOK {
+			os.Exit(exitCode)
+		}
+	}()
 
-	if len(os.Args) < 2 || os.Args[1] == "help" {
+	os.Args = takeConfigFlag(os.Args)
+	// the config commands read the file themselves, so they work on broken configs
+	if len(os.Args) < 2 || os.Args[1] != "config" {
+		loadConfig()
+		os.Args = applyOverrides(os.Args)
+		if config.LowPriority {
+			lowerPriority()
+		}
+	}
+
+	if len(os.Args) < 2 || helpRequested(os.Args[1:2]) {
 		printUsage()
 		return
 	}
+	if helpRequested(os.Args[2:]) && printCommandHelp(os.Stdout, os.Args[1]) {
+		return
+	}
+	if catalogCommands[os.Args[1]] {
+		defer snapshotCatalog()
+	}
 
-	switch os.Args[1] {
-	case "info":
-		info := map[string]any{
-			"backup location": config.ArchiveDir,
-			"time format":     config.TimeFormat,
-		}
-		for k, v := range info {
-			fmt.Printf("%s: %v\n", k, v)
+	cmd, ok := commands[os.Args[1]]
+	if !ok || len(os.Args)-2 < cmd.MinArgs {
+		usageError(os.Args[1])
+	}
+	cmd.Run(os.Args[2:])
+}
+
+func infoCommand(args []string) {
+	if len(args) > 0 {
+		printBackupInfo(findSidecar(args[0]))
+		return
+	}
+	for _, field := range configFields() {
+		fmt.Printf("%s: %v\n", field.Key, field.Value.Interface())
+	}
+}
+
+func backupCommand(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	followSymlinks := fs.Bool("follow-symlinks", config.FollowSymlinks, "archive what symlinks point to")
+	separate := fs.Bool("separate", false, "make one backup per path")
+	stdin := fs.Bool("stdin", false, "back up data piped into backman")
+	name := fs.String("name", "", "name of the data backed up with --stdin")
+	xattrs := fs.Bool("xattrs", config.Xattrs, "store extended attributes and ACLs")
+	snapshot := fs.String("snapshot", config.Snapshot, "back up from a btrfs, zfs or lvm snapshot")
+	incremental := fs.Bool("incremental", false, "only store the changes since the last backup")
+	pause := fs.Bool("pause", config.DockerPause, "pause the containers using a docker volume while it's backed up")
+	format := fs.String("format", config.ArchiveFormat, "archive format: tar.zstd, tar.gz, tar or zip")
+	maxFileSize := fs.String("max-file-size", config.MaxFileSize, "leave out files bigger than this")
+	newerThan := fs.String("newer-than", config.NewerThan, "only store files modified within this long")
+	strict := fs.Bool("strict", config.Strict, "abort on the first file that can't be read")
+	retries := fs.Int("retries", config.Retries, "how often to read a file again that changed while it was read")
+	splitSize := fs.String("split-size", config.SplitSize, "split the archive into volumes of this size")
+	targets := parseFlags(fs, args)
+
+	if !isArchiveFormat(*format) {
+		fmt.Fprintf(os.Stderr, "unknown archive format %q, use one of: %s\n", *format, strings.Join(archiveFormats, ", "))
+		os.Exit(exitUsage)
+	}
+	split, err := parseSplitSize(*splitSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+
+	if *stdin {
+		if *name == "" || len(targets) > 0 {
+			fmt.Fprintln(os.Stderr, "--stdin needs a --name and no paths")
+			os.Exit(exitUsage)
 		}
+		backupStdin(*name, *format, split)
 		return
-	case "backup":
-		target := "."
-		if len(os.Args) > 2 {
-			target = os.Args[2]
+	}
+
+	if len(targets) == 0 {
+		targets = []string{"."}
+	}
+	if *xattrs && *format == "zip" {
+		fmt.Fprintln(os.Stderr, "WARNING: zip archives can't hold extended attributes, ignoring --xattrs")
+		*xattrs = false
+	}
+	if *xattrs && !xattrSupported {
+		fmt.Fprintln(os.Stderr, "WARNING: Extended attributes are only supported on linux, ignoring --xattrs")
+		*xattrs = false
+	}
+	filter, err := parseFileFilter(*maxFileSize, *newerThan)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+	opts := compressOptions{
+		Filter:         filter,
+		FollowSymlinks: *followSymlinks,
+		Xattrs:         *xattrs,
+		Snapshot:       *snapshot,
+		Incremental:    *incremental,
+		Format:         *format,
+		Strict:         *strict,
+		Retries:        *retries,
+		SplitSize:      split,
+		Index:          config.ContentIndex,
+		Pause:          *pause,
+	}
+
+	if *separate {
+		for _, target := range targets {
+			makeBackup([]string{target}, opts)
 		}
+	} else {
+		makeBackup(targets, opts)
+	}
+}
 
-		makeBackup(target)
-		return
-	case "restore":
-		if len(os.Args) < 3 {
-			break
+func restoreCommand(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	latest := fs.Bool("latest", false, "restore the newest backup of a directory")
+	xattrs := fs.Bool("xattrs", config.Xattrs, "restore extended attributes and ACLs")
+	stdout := fs.Bool("stdout", false, "write the backup to stdout instead")
+	dryRun := fs.Bool("dry-run", false, "only print what would be restored")
+	force := fs.Bool("force", false, "restore even if there doesn't seem to be enough free space")
+	delta := fs.String("delta", "", "only write the files that differ from the ones in this directory")
+	showDiff := fs.Bool("show-diff", false, "compare the backup to the destination and ask before restoring")
+	owners := fs.Bool("owners", false, "give restored files the owners stored in the backup")
+	var include, exclude, mapUsers, mapGroups stringList
+	fs.Var(&include, "include", "only restore files matching this glob, can be repeated")
+	fs.Var(&exclude, "exclude", "don't restore files matching this glob, can be repeated")
+	fs.Var(&mapUsers, "map-user", "restore the files of a user of the backup as another one, old=new, can be repeated")
+	fs.Var(&mapGroups, "map-group", "restore the files of a group of the backup as another one, old=new, can be repeated")
+	args = parseFlags(fs, args)
+
+	filter, err := newPathFilter(include, exclude)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
+
+	if !slices.Contains(conflictModes, config.OnConflict) {
+		fmt.Fprintf(os.Stderr, "unknown on_conflict %q, use one of: %s\n", config.OnConflict, strings.Join(conflictModes, ", "))
+		os.Exit(exitUsage)
+	}
+
+	opts := restoreOptions{
+		Xattrs:   *xattrs,
+		Stdout:   *stdout,
+		DryRun:   *dryRun,
+		Force:    *force,
+		Filter:   filter,
+		DeltaDir: *delta,
+		ShowDiff: *showDiff,
+	}
+
+	// mapping owners means restoring them
+	if *owners || len(mapUsers) > 0 || len(mapGroups) > 0 {
+		if runtime.GOOS == "windows" {
+			fmt.Fprintln(os.Stderr, "restoring owners isn't supported on windows")
+			os.Exit(exitUsage)
 		}
-		restoreFrom(readUint16Fatal(os.Args[2]))
-		return
-	case "list":
-		if len(os.Args) > 2 {
-			listBackups(os.Args[2])
-		} else {
-			listBackups("")
+		opts.Owners = newOwnerMap()
+		for _, mapping := range mapUsers {
+			if err := opts.Owners.Users.Add(mapping); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(exitUsage)
+			}
+		}
+		for _, mapping := range mapGroups {
+			if err := opts.Owners.Groups.Add(mapping); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(exitUsage)
+			}
 		}
+	}
+
+	// restore [id] ssh://host/path, or pg://otherdb and the like
+	if len(args) > 1 && isDBTarget(args[1]) {
+		opts.Database = args[1]
+	} else if len(args) > 1 {
+		if !isSSHTarget(args[1]) || *stdout || *delta != "" || *showDiff {
+			fmt.Fprintf(os.Stderr, "'%s' isn't an ssh://[user@]host[:port]/path destination\n", args[1])
+			os.Exit(exitUsage)
+		}
+		// the remote tar gives the files their owners
+		if opts.Owners != nil {
+			fmt.Fprintln(os.Stderr, "--owners, --map-user and --map-group only work when restoring on this machine")
+			os.Exit(exitUsage)
+		}
+		opts.Remote = args[1]
+	}
+
+	if *latest {
+		dir := "."
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		restoreFrom(findLatest(dir), opts)
 		return
-	case "delete":
-		if len(os.Args) < 3 {
-			break
+	}
+
+	if len(args) < 1 {
+		usageError("restore")
+	}
+	restoreFrom(findSidecar(args[0]), opts)
+}
+
+func listCommand(args []string) {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	host := fs.String("host", "", "only list backups made on this machine")
+	sortBy := fs.String("sort", "time", "sort by id, time, size or name")
+	reverse := fs.Bool("reverse", false, "reverse the order")
+	columns := fs.String("columns", "", "print these columns, one backup per line")
+	table := fs.Bool("table", false, "print an aligned table with a header")
+	filter := fs.Bool("filter", config.ListFilter, "hide backups that don't match the query")
+	since := fs.String("since", "", "only list backups made since this date or duration ago")
+	until := fs.String("until", "", "only list backups made before this date or duration ago")
+	group := fs.Bool("group", false, "print one line per backed up path")
+	all := fs.Bool("all", false, "with --group, list the backups under each path too")
+	utc := fs.Bool("utc", false, "show times in UTC, like --time-zone=UTC")
+	args = parseFlags(fs, args)
+	if *utc {
+		config.TimeZone = "UTC"
+	}
+
+	window, err := parseTimeRange(*since, *until)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid time range: ", err)
+		os.Exit(exitUsage)
+	}
+	if *group && (*columns != "" || *table) {
+		fmt.Fprintln(os.Stderr, "--group can't be combined with --columns or --table")
+		os.Exit(exitUsage)
+	}
+
+	opts := listOptions{
+		Query:   strings.Join(args, " "),
+		Host:    *host,
+		Filter:  *filter,
+		Range:   window,
+		Sort:    *sortBy,
+		Reverse: *reverse,
+		Table:   *table,
+		Group:   *group,
+		All:     *all,
+	}
+	if *columns != "" {
+		opts.Columns = strings.Split(*columns, ",")
+	} else if *table {
+		opts.Columns = defaultColumns
+	}
+	listBackups(opts)
+}
+
+func searchCommand(args []string) {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	regex := fs.Bool("regex", false, "match the pattern as a regular expression")
+	content := fs.String("content", "", "only find files containing all of these words")
+	of := fs.String("of", "", "only search the backups of this directory")
+	since := fs.String("since", "", "only search backups made since this date or duration ago")
+	until := fs.String("until", "", "only search backups made before this date or duration ago")
+	args = parseFlags(fs, args)
+	if len(args) > 1 || len(args) == 0 && *content == "" {
+		usageError("search")
+	}
+
+	window, err := parseTimeRange(*since, *until)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid time range: ", err)
+		os.Exit(exitUsage)
+	}
+	opts := searchOptions{Pattern: strings.Join(args, ""), Regex: *regex, Content: *content, Range: window}
+	if *of != "" {
+		opts.Of = targetPath(*of)
+	}
+	searchBackups(opts)
+}
+
+func historyCommand(args []string) {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	of := fs.String("of", "", "only list the backups of this directory")
+	args = parseFlags(fs, args)
+	if len(args) != 1 {
+		usageError("history")
+	}
+	var target string
+	if *of != "" {
+		target = targetPath(*of)
+	}
+	printHistory(args[0], target)
+}
+
+func catCommand(args []string) {
+	fs := flag.NewFlagSet("cat", flag.ContinueOnError)
+	raw := fs.Bool("raw", false, "print binary files to a terminal too")
+	args = parseFlags(fs, args)
+	if len(args) != 2 {
+		usageError("cat")
+	}
+	catFile(findSidecar(args[0]), args[1], *raw)
+}
+
+func deleteCommand(args []string) {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	cascade := fs.Bool("cascade", false, "also delete the incremental backups that depend on it")
+	of := fs.String("of", "", "delete backups of this directory instead of one by ID, needs --all")
+	all := fs.Bool("all", false, "delete every backup of the --of directory")
+	force := forceFlag(fs)
+	iKnow := iKnowFlag(fs)
+	args = parseFlags(fs, args)
+	checkAppendOnly("delete backups", *iKnow)
+	if *of != "" {
+		if !*all || len(args) > 0 {
+			fmt.Fprintln(os.Stderr, "--of deletes every backup of a directory, confirm that with --all")
+			os.Exit(exitUsage)
 		}
-		deleteBackup(readUint16Fatal(os.Args[2]))
+		deleteBackupsOf(targetPath(*of), *force)
 		return
-	case "purge":
-		if len(os.Args) < 3 {
+	}
+	if len(args) < 1 {
+		usageError("delete")
+	}
+	deleteBackup(args[0], *cascade, *force)
+}
+
+func purgeCommand(args []string) {
+	fs := flag.NewFlagSet("purge", flag.ContinueOnError)
+	between := fs.String("between", "", "delete the backups made between two dates or durations, as from..to")
+	of := fs.String("of", "", "only purge backups of this directory")
+	force := forceFlag(fs)
+	iKnow := iKnowFlag(fs)
+	args = parseFlags(fs, args)
+	checkAppendOnly("purge backups", *iKnow)
+
+	var window timeRange
+	var err error
+	switch {
+	case *between != "":
+		from, to, ok := strings.Cut(*between, "..")
+		if !ok || len(args) > 0 {
 			break
 		}
+		window, err = parseTimeRange(from, to)
+	case len(args) == 1:
+		// older than the threshold
+		window, err = parseTimeRange("", args[0])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid time range: ", err)
+		os.Exit(exitUsage)
+	}
+	if window == (timeRange{}) {
+		usageError("purge")
+	}
+	var target string
+	if *of != "" {
+		target = targetPath(*of)
+	}
+	purgeBackups(window, target, *force)
+}
 
-		// parse the threshold
-		age, err := parseDurationExt(os.Args[2])
+func makeBackup(targets []string, opts compressOptions) {
+	if len(targets) == 1 && isSSHTarget(targets[0]) {
+		backupSSH(targets[0], opts)
+		return
+	}
+	if len(targets) == 1 && isDockerTarget(targets[0]) {
+		backupDocker(targets[0], opts)
+		return
+	}
+	if len(targets) == 1 && isDBTarget(targets[0]) {
+		backupDatabase(targets[0], opts)
+		return
+	}
+	if len(targets) == 1 && isBackendTarget(targets[0]) {
+		backupBackend(targets[0], opts)
+		return
+	}
+
+	var targetsAbs []string
+	for _, target := range targets {
+		if isRemoteTarget(target) {
+			fmt.Fprintln(os.Stderr, "ssh, docker, database and backend targets can't be combined with other paths, use --separate")
+			os.Exit(exitUsage)
+		}
+		targetAbs, err := filepath.Abs(target)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "invalid duration %q: %v\n", os.Args[2], err)
-			os.Exit(1)
+			fmt.Fprintln(os.Stderr, "error getting absolute path of target: ", err)
+			os.Exit(exitFatal)
+		}
+		if _, err := os.Stat(targetAbs); err != nil {
+			fmt.Fprintln(os.Stderr, "error reading target: ", err)
+			os.Exit(exitFatal)
+		}
+		targetsAbs = append(targetsAbs, targetAbs)
+	}
+	roots := archiveRoots(targetsAbs)
+
+	// the archive dir is left out of targets containing it, but can't be a target itself.
+	// it's created first, the sidecar is written into it before compressing starts
+	if err := os.MkdirAll(config.ArchiveDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "error creating backup directory: ", err)
+		os.Exit(exitFatal)
+	}
+	if info, err := os.Stat(config.ArchiveDir); err == nil {
+		opts.ArchiveDir = info
+		for _, target := range targetsAbs {
+			if targetInfo, err := os.Stat(target); err == nil && os.SameFile(info, targetInfo) {
+				fmt.Fprintf(os.Stderr, "'%s' is the archive dir, backing it up into itself would never end\n", target)
+				fmt.Fprintln(os.Stderr, "Use export or a mirror to copy backups elsewhere")
+				os.Exit(exitUsage)
+			}
+		}
+	}
+
+	// a combined backup is "of" the directory containing all of its targets
+	sidecar := SidecarData{BackupOf: targetsAbs[0]}
+	if len(targetsAbs) > 1 {
+		sidecar.BackupOf = commonParent(targetsAbs)
+		sidecar.Sources = targetsAbs
+	}
+
+	// incremental backups only store what changed, which isn't known before compressing
+	if !opts.Incremental {
+		checkBackupSpace(targetsAbs, opts)
+	}
+
+	if opts.Incremental {
+		parent, manifest, ok := findParent(sidecar)
+		if ok {
+			fmt.Printf("Storing changes since backup %d...\n", parent.ID)
+			sidecar.ParentID = &parent.ID
+			opts.Parent = manifest
+		} else {
+			fmt.Printf("No earlier backup of '%s' to build on, making a full backup\n", sidecar.BackupOf)
+		}
+	}
+
+	useDict(&sidecar, &opts)
+	writeBackup(sidecar, opts.Format, func(backupName string) (*Manifest, error) {
+		// snapshots only need to exist while compressing
+		if opts.Snapshot != "" {
+			releaseSnapshots, err := snapshotRoots(roots, opts.Snapshot)
+			if err != nil {
+				return nil, fmt.Errorf("error creating snapshot: %w", err)
+			}
+			defer releaseSnapshots()
+		}
+
+		fmt.Println("Compressing directory...")
+		return compressDir(roots, backupName, opts)
+	})
+}
+
+// checkBackupSpace exits if the archive of targets likely won't fit into the archive dir,
+// instead of running out of space halfway through writing it
+func checkBackupSpace(targets []string, opts compressOptions) {
+	if config.SpaceCheckRatio == 0 {
+		return
+	}
+
+	free, err := freeSpace(config.ArchiveDir)
+	if err != nil {
+		if freeSpaceSupported {
+			fmt.Fprintln(os.Stderr, "WARNING: Could not check free space: ", err)
 		}
-		cutoff := time.Now().Add(-age)
-		purgeBackups(cutoff)
 		return
 	}
 
-	printUsage()
-	os.Exit(1)
+	var size int64
+	for _, target := range targets {
+		size += max(dirSize(target, opts.FollowSymlinks), 0)
+	}
+	needed := float64(size) * config.SpaceCheckRatio * (1 + float64(config.ParityPercent)/100)
+
+	if uint64(needed) > free {
+		fmt.Fprintf(os.Stderr, "Not enough free space in '%s': the backup needs about %s, %s is free\n",
+			config.ArchiveDir, humanize.IBytes(uint64(needed)), humanize.IBytes(free))
+		fmt.Fprintln(os.Stderr, "Free up some space, or lower space_check_ratio if your data compresses well")
+		os.Exit(exitFatal)
+	}
 }
 
-func makeBackup(target string) {
-	appDir := getAppDir()
+// writeBackup creates a new backup in the archive dir. sidecar holds what the
+// backup is of, write has to create the archive in format at the path it's given
+func writeBackup(sidecar SidecarData, format string, write func(backupName string) (*Manifest, error)) {
+	// failures are recorded for the metrics, so monitoring can alert on them
+	start := time.Now()
+	failWith := func(code int, msg string, err error) {
+		fmt.Fprintln(os.Stderr, msg, err)
+		recordRun(runRecord{Target: sidecar.BackupOf}, start, err)
+		os.Exit(code)
+	}
+	fail := func(msg string, err error) {
+		failWith(exitFatal, msg, err)
+	}
+
+	appDir := config.ArchiveDir
 	if _, err := os.Stat(appDir); errors.Is(err, os.ErrNotExist) {
 		fmt.Printf("Directory '%s' missing, creating...\n", appDir)
 		err := os.MkdirAll(appDir, 0755)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "error creating backup directory: ", err)
-			os.Exit(1)
+			fail("error creating backup directory: ", err)
 		}
 	}
 
-	uuid := generateUUID()
+	if config.Encrypt {
+		if _, err := loadMasterKey(true); err != nil {
+			failWith(exitUsage, "error unlocking the master key: ", err)
+		}
+		sidecar.Encrypted = true
+	}
 
-	targetAbs, err := filepath.Abs(target)
+	uuid := generateUUID()
+	name, err := archiveName(sidecar, uuid)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error getting absolute path of target: ", err)
-		os.Exit(1)
+		fail("error in archive_name_template: ", err)
+	}
+	if name != uuid {
+		sidecar.ArchiveUUID = uuid
 	}
 
 	backupName := filepath.Join(
-		config.ArchiveDir, fmt.Sprintf("%s.tar.zstd", uuid),
+		config.ArchiveDir, fmt.Sprintf("%s.%s", name, format),
 	)
 	sidecarName := backupName + ".json"
 
 	fmt.Println("Generating sidecar file...")
 
 	// generate sidecar file
-	deleteSidecar, err := generateSidecar(sidecarName, targetAbs)
+	saved, deleteSidecar, err := generateSidecar(sidecarName, sidecar)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error generating sidecar file: ", err)
-		os.Exit(1)
+		fail("error generating sidecar file: ", err)
 	}
 
-	fmt.Println("Compressing directory...")
-	// compress directory and copy into backupName
-	err = compressDir(target, backupName)
+	// write the archive into backupName
+	manifest, err := write(backupName)
+	if err == nil {
+		err = writeManifest(backupName+".manifest", manifest)
+	}
+	if err == nil && manifest.Index != nil {
+		err = writeIndex(backupName+".index", manifest.Index)
+	}
 
 	if err != nil {
 		// undo if compression failed
-		fmt.Fprintln(os.Stderr, "error compressing directory: ", err)
 		deleteSidecar()
-		os.Exit(1)
+		removeArchive(backupName)
+		os.Remove(backupName + ".manifest")
+		os.Remove(backupName + ".index")
+		fail("error compressing directory: ", err)
+	}
+
+	// an identical earlier backup only gets its LastSeen bumped
+	sidecar.ParentPath = backupName
+	if previous, ok := unchangedSince(sidecar, manifest); ok && shouldDedupe(previous) {
+		deleteSidecar()
+		removeArchive(backupName)
+		os.Remove(backupName + ".manifest")
+		os.Remove(backupName + ".index")
+
+		previous.LastSeen = time.Now().UTC()
+		if err := previous.Save(); err != nil {
+			fail("error updating sidecar file: ", err)
+		}
+		fmt.Printf(tr("\nNothing changed since backup %d, kept it instead of a new archive\n"), previous.ID)
+		recordRun(runRecord{Target: sidecar.BackupOf, ID: previous.ID, Unchanged: true}, start, nil)
+		return
+	}
+
+	if config.VerifyAfterBackup {
+		fmt.Println("Verifying archive...")
+		written := SidecarData{ParentPath: backupName, Stream: sidecar.Stream}
+		var mismatched []string
+		if sidecar.Stream != "" {
+			mismatched, err = checkStream(written, manifest)
+		} else {
+			mismatched, err = checkArchive(backupName, manifest)
+		}
+		if err == nil && len(mismatched) > 0 {
+			err = fmt.Errorf("%d files don't match what was read, eg. '%s'", len(mismatched), mismatched[0])
+		}
+		if err != nil {
+			deleteSidecar()
+			removeArchive(backupName)
+			os.Remove(backupName + ".manifest")
+			os.Remove(backupName + ".index")
+			failWith(exitVerifyFailed, "error verifying archive: ", err)
+		}
+	}
+
+	if config.SignWith != "" {
+		fmt.Println("Signing archive...")
+		if err := signArchive(backupName); err != nil {
+			deleteSidecar()
+			removeArchive(backupName)
+			os.Remove(backupName + ".manifest")
+			os.Remove(backupName + ".index")
+			os.Remove(backupName + ".sig")
+			fail("error signing archive: ", err)
+		}
+	}
+
+	if config.ParityPercent > 0 {
+		fmt.Println("Generating parity...")
+		if err := writeParity(backupName, config.ParityPercent); err != nil {
+			deleteSidecar()
+			removeArchive(backupName)
+			os.Remove(backupName + ".manifest")
+			os.Remove(backupName + ".index")
+			os.Remove(backupName + ".sig")
+			os.Remove(backupName + ".par")
+			fail("error generating parity: ", err)
+		}
+	}
+
+	// the sidecar only stops being partial once everything it points at is on disk.
+	// the archive and manifest are synced as they're written, gpg and ssh-keygen don't
+	for _, extra := range []string{backupName + ".sig", backupName + ".par"} {
+		if err := syncFile(extra); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fail("error syncing backup files: ", err)
+		}
 	}
+	syncDir(config.ArchiveDir)
+
+	// what was stored is only known now
+	saved.OriginalSize, saved.Files = manifest.Stored()
+	saved.Skipped = manifest.Skipped
+	saved.Partial = false
+	if err := saved.Save(); err != nil {
+		fail("error updating sidecar file: ", err)
+	}
+	originalSize := saved.OriginalSize
 
 	fmt.Printf(
-		"\nDone.\n Original size: %s\n Compressed size: %s\n",
-		humanize.IBytes(uint64(dirSize(target))),
-		humanize.IBytes(uint64(fileSize(backupName))),
+		tr("\nDone.\n Original size: %s\n Compressed size: %s\n"),
+		humanize.IBytes(uint64(originalSize)),
+		humanize.IBytes(uint64(archiveSize(backupName))),
 	)
+	recordRun(runRecord{
+		Target:   sidecar.BackupOf,
+		ID:       saved.ID,
+		Bytes:    archiveSize(backupName),
+		Original: saved.OriginalSize,
+		Files:    saved.Files,
+	}, start, nil)
+	if len(manifest.Skipped) > 0 {
+		printSkipped(manifest.Skipped)
+		exitCode = exitPartial
+	}
+	if changed := manifest.Changed(); len(changed) > 0 {
+		printChanged(changed)
+	}
+
+	if config.AutoPush {
+		fmt.Println("Uploading to remote...")
+		r, err := openRemote(config.Remote)
+		if err == nil {
+			err = pushBackup(r, SidecarData{ParentPath: backupName, Time: saved.Time, Encrypted: saved.Encrypted})
+		}
+		if err == nil {
+			// the remote is reachable again, catch up on what couldn't be uploaded before
+			var uploaded int
+			if uploaded, err = flushQueue(r); uploaded > 0 {
+				fmt.Printf("Uploaded %d queued backups\n", uploaded)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "WARNING: Could not upload queued backups, run flush later: ", err)
+			}
+		} else if queueErr := queueUpload(backupName); queueErr == nil {
+			// the local backup is still fine
+			fmt.Fprintln(os.Stderr, "error uploading backup, queued it for flush: ", err)
+			exitCode = exitPartial
+		} else {
+			fmt.Fprintln(os.Stderr, "error uploading backup: ", err)
+			fmt.Fprintln(os.Stderr, "error queueing the upload, push it later: ", queueErr)
+			exitCode = exitPartial
+		}
+	}
+
+	if config.Mirror != "" {
+		fmt.Println("Syncing mirror...")
+		r, err := openRemote(config.Mirror)
+		if err == nil {
+			_, _, err = syncMirror(r)
+		}
+		if err != nil {
+			// the local backup is still fine
+			fmt.Fprintln(os.Stderr, "error syncing mirror: ", err)
+			exitCode = exitPartial
+		}
+	}
+}
+
+// printSkipped lists the files a backup left out because they couldn't be read
+func printSkipped(skipped map[string]string) {
+	fmt.Fprintf(os.Stderr, "\nWARNING: %d files couldn't be read and aren't in the backup:\n", len(skipped))
+	for i, path := range slices.Sorted(maps.Keys(skipped)) {
+		if i == previewLimit {
+			fmt.Fprintf(os.Stderr, "\t...and %d more, see the sidecar\n", len(skipped)-i)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "\t%s: %s\n", escapeName(path), skipped[path])
+	}
+	fmt.Fprintln(os.Stderr, "Use --strict to fail the backup instead")
 }
-func restoreFrom(id uint16) {
+
+// printChanged lists the files that were modified while the backup read them
+func printChanged(changed []string) {
+	fmt.Fprintf(os.Stderr, "\nWARNING: %d files changed while they were backed up and may be inconsistent:\n", len(changed))
+	for i, path := range changed {
+		if i == previewLimit {
+			fmt.Fprintf(os.Stderr, "\t...and %d more, they're flagged in the manifest\n", len(changed)-i)
+			break
+		}
+		fmt.Fprintf(os.Stderr, "\t%s\n", escapeName(path))
+	}
+	fmt.Fprintln(os.Stderr, "The next incremental backup stores them again, or raise --retries")
+}
+
+// findSidecar returns the backup ref refers to, exiting if there is none. see matchSidecar
+func findSidecar(ref string) SidecarData {
 	sidecars, err := readSidecars()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error reading sidecar files: ", err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+
+	sidecar, err := matchSidecar(sidecars, ref)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFatal)
+	}
+	return sidecar
+}
+
+// shorter UUID prefixes are too likely to be mistyped IDs
+const minUUIDPrefix = 4
+
+// matchSidecar finds the sidecar ref refers to: an ID, or a unique prefix of
+// the UUID like git's short hashes. IDs win if ref could be both
+func matchSidecar(sidecars []SidecarData, ref string) (SidecarData, error) {
+	if id, err := strconv.ParseUint(ref, 10, 16); err == nil {
+		for _, sidecar := range sidecars {
+			if sidecar.ID == uint16(id) {
+				return sidecar, nil
+			}
+		}
 	}
 
-	var backupSidecar SidecarData
+	if len(ref) < minUUIDPrefix {
+		return SidecarData{}, fmt.Errorf("no backup with ID %q", ref)
+	}
+	var matches []SidecarData
 	for _, sidecar := range sidecars {
-		if sidecar.ID == id {
-			backupSidecar = sidecar
-			break
+		if strings.HasPrefix(sidecar.UUID(), strings.ToLower(ref)) {
+			matches = append(matches, sidecar)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return SidecarData{}, fmt.Errorf("no backup with ID or UUID %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return SidecarData{}, fmt.Errorf("%q matches %d backups, use more of the UUID", ref, len(matches))
+	}
+}
+
+// targetPath returns the BackupOf that backups of dir have
+func targetPath(dir string) string {
+	if isSSHTarget(dir) {
+		t, err := parseSSHTarget(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading directory: ", err)
+			os.Exit(exitFatal)
+		}
+		return t.String()
+	}
+	if isDockerTarget(dir) || isBackendTarget(dir) {
+		return dir
+	}
+	if isDBTarget(dir) {
+		_, t, err := parseDBTarget(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading database: ", err)
+			os.Exit(exitFatal)
+		}
+		return t.String()
+	}
+	dirAbs, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error getting absolute path of directory: ", err)
+		os.Exit(exitFatal)
+	}
+	return dirAbs
+}
+
+// findLatest returns the newest backup of dir, exiting if there is none
+func findLatest(dir string) SidecarData {
+	dirAbs := targetPath(dir)
+
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+
+	var latest *SidecarData
+	for i, sidecar := range sidecars {
+		if !sidecar.matchesTarget(dirAbs) {
+			continue
+		}
+		if latest == nil || sidecar.Time.After(latest.Time) {
+			latest = &sidecars[i]
 		}
 	}
 
+	if latest == nil {
+		fmt.Fprintf(os.Stderr, "No backups of '%s' found!\n", dirAbs)
+		os.Exit(exitFatal)
+	}
+	return *latest
+}
+func restoreFrom(backupSidecar SidecarData, opts restoreOptions) {
+	if opts.Stdout {
+		if !opts.Filter.Empty() {
+			fmt.Fprintln(os.Stderr, "WARNING: --stdout writes the whole backup, ignoring --include and --exclude")
+		}
+		restoreToStdout(backupSidecar)
+		return
+	}
+	if isDBTarget(backupSidecar.BackupOf) {
+		restoreDatabase(backupSidecar, opts)
+		return
+	}
+	if opts.Database != "" {
+		fmt.Fprintf(os.Stderr, "Backup %d isn't of a database, it can't be replayed into '%s'\n", backupSidecar.ID, opts.Database)
+		os.Exit(exitUsage)
+	}
+	if opts.Remote != "" {
+		restoreSSH(backupSidecar, opts)
+		return
+	}
+
 	// ./some_directory-restored
 	restoringTo := filepath.Base(backupSidecar.BackupOf) + "-restored"
+	if backupSidecar.Stream != "" {
+		restoringTo = filepath.Base(backupSidecar.Stream) + "-restored"
+	}
+	if opts.DeltaDir != "" {
+		if backupSidecar.Stream != "" {
+			fmt.Fprintln(os.Stderr, "--delta needs a backup of files, this one is a single stream")
+			os.Exit(exitUsage)
+		}
+		restoringTo = opts.DeltaDir
+	}
+
+	files, err := restoreFiles(backupSidecar)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading backup: ", err)
+		os.Exit(exitFatal)
+	}
+	if !opts.Filter.Empty() {
+		if backupSidecar.Stream != "" {
+			fmt.Fprintln(os.Stderr, "WARNING: The backup is a single stream, ignoring --include and --exclude")
+			opts.Filter = pathFilter{}
+		}
+		maps.DeleteFunc(files, func(path string, _ int64) bool { return !opts.Filter.Keep(path) })
+		if len(files) == 0 {
+			fmt.Fprintln(os.Stderr, "No files in the backup match --include and --exclude")
+			os.Exit(exitFatal)
+		}
+	}
+	if opts.ShowDiff {
+		if backupSidecar.Stream != "" {
+			fmt.Fprintln(os.Stderr, "--show-diff needs a backup of files, this one is a single stream")
+			os.Exit(exitUsage)
+		}
+		diff, err := diffRestore(restoringTo, backupSidecar, files, opts.Filter)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error comparing the backup to the destination: ", err)
+			os.Exit(exitFatal)
+		}
+		diff.Print(restoringTo)
+		if !opts.DryRun && !askYesNo(tr("Restore?")) {
+			fmt.Println(tr("Restore aborted"))
+			os.Exit(exitFatal)
+		}
+	}
+	if opts.DeltaDir != "" {
+		manifest, err := readManifest(backupSidecar.ManifestPath())
+		if err != nil || manifest == nil {
+			fmt.Fprintln(os.Stderr, "--delta needs the backup's manifest to compare against: ", err)
+			os.Exit(exitFatal)
+		}
+		total := len(files)
+		opts.Delta = deltaFiles(restoringTo, files, manifest)
+		maps.DeleteFunc(files, func(path string, _ int64) bool { return !opts.Delta[path] })
+		if len(files) == 0 {
+			fmt.Printf("All %d files in '%s' already match the backup\n", total, restoringTo)
+			return
+		}
+		fmt.Printf("%d of %d files differ from the backup\n", len(files), total)
+	}
+	if backupSidecar.Stream == "" && caseInsensitive(restoringTo) {
+		opts.CaseInsensitive = true
+		opts.CaseRenames = planCaseCollisions(slices.Collect(maps.Keys(files)), config.CaseCollisions)
+		printCaseCollisions(restoringTo, opts.CaseRenames)
+	}
+	inodes := restoreInodes(backupSidecar, files, opts.Filter)
+	if opts.DryRun {
+		printDryRun(restoringTo, files, opts.CaseRenames)
+		checkRestoreInodes(restoringTo, inodes)
+		return
+	}
+	if !opts.Force {
+		checkRestoreSpace(restoringTo, files)
+	}
+	checkRestoreInodes(restoringTo, inodes)
+
+	var chain []SidecarData
+	if backupSidecar.ParentID != nil {
+		// incremental backups need every backup they build on
+		chain, err = backupChain(backupSidecar)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error resolving backup chain: ", err)
+			os.Exit(exitFatal)
+		}
+	}
+
+	// --delta overwrites the files it found to differ, that's the point of it
+	if _, err := os.Stat(restoringTo); err == nil && backupSidecar.Stream == "" && opts.DeltaDir == "" {
+		paths := slices.Sorted(maps.Keys(files))
+		if chain != nil {
+			// earlier layers write files the last one deleted, they can conflict too
+			if paths, err = chainFiles(chain); err != nil {
+				fmt.Fprintln(os.Stderr, "error reading backup chain: ", err)
+				os.Exit(exitFatal)
+			}
+			paths = slices.DeleteFunc(paths, func(path string) bool { return !opts.Filter.Keep(path) })
+		}
+		opts.Conflicts = newConflictResolver(restoringTo, config.OnConflict, paths, opts.CaseRenames)
+		if !opts.Conflicts.Preview(restoringTo) {
+			fmt.Println(tr("Restore aborted"))
+			os.Exit(exitFatal)
+		}
+	}
 
-	err = decompressDir(backupSidecar.ParentPath, restoringTo)
+	var mismatched []string
+	if chain != nil {
+		mismatched, err = restoreChain(chain, restoringTo, opts)
+	} else {
+		checkSignature(backupSidecar.ParentPath)
+
+		manifest, manifestErr := readManifest(backupSidecar.ManifestPath())
+		if manifestErr != nil {
+			fmt.Fprintln(os.Stderr, "error reading manifest, restoring without verification: ", manifestErr)
+		}
+
+		opts.Manifest = manifest
+		if backupSidecar.Stream != "" {
+			mismatched, err = restoreStream(backupSidecar, restoringTo, manifest)
+		} else {
+			mismatched, err = decompressDir(backupSidecar.ParentPath, restoringTo, opts)
+		}
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error decompressing directory: ", err)
-		os.Exit(1)
+		os.Exit(exitFatal)
 	}
 
-	fmt.Printf("Restored backup into '%s'\n", restoringTo)
+	if len(mismatched) > 0 {
+		fmt.Fprintf(os.Stderr, tr("WARNING: %d files failed verification:\n"), len(mismatched))
+		for _, path := range mismatched {
+			fmt.Fprintf(os.Stderr, "\t%s\n", escapeName(path))
+		}
+		fmt.Printf(tr("Restored backup into '%s' with errors\n"), restoringTo)
+		os.Exit(exitVerifyFailed)
+	}
+
+	fmt.Printf(tr("Restored backup into '%s'\n"), restoringTo)
 }
-func listBackups(query string) {
-	sidecars, err := readSidecars()
+
+// printDryRun lists what restoring files into dir would do, with renames for
+// names that differ only in case
+func printDryRun(dir string, files map[string]int64, renames caseRenames) {
+	fmt.Printf("Would restore into '%s':\n", dir)
+
+	var total int64
+	for _, path := range slices.Sorted(maps.Keys(files)) {
+		total += files[path]
+		line := fmt.Sprintf("\t%s (%s)", escapeName(path), humanize.IBytes(uint64(files[path])))
+		name, ok := renames.Apply(path)
+		if !ok {
+			line += " [differs only in case, skipped]"
+		} else if name != path {
+			line += fmt.Sprintf(" [as %s]", escapeName(name))
+		}
+		if restored, ok := restoredPath(dir, name); !ok {
+			line += " [outside, skipped]"
+		} else if _, err := os.Lstat(restored); err == nil {
+			line += " [exists]"
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("%d files, %s\n", len(files), humanize.IBytes(uint64(total)))
+
+	if free, err := freeSpace(dir); err == nil {
+		fmt.Printf("Free space: %s\n", humanize.IBytes(free))
+		if uint64(total) > free {
+			fmt.Fprintln(os.Stderr, "Not enough free space, the restore would refuse to start")
+			os.Exit(exitFatal)
+		}
+	}
+}
+
+// checkRestoreSpace exits if files don't fit into dir's filesystem
+func checkRestoreSpace(dir string, files map[string]int64) {
+	var total int64
+	for _, size := range files {
+		total += size
+	}
+
+	free, err := freeSpace(dir)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error reading sidecar files: %v\n", err)
-		os.Exit(1)
+		if freeSpaceSupported {
+			fmt.Fprintln(os.Stderr, "WARNING: Could not check free space: ", err)
+		}
+		return
+	}
+	if uint64(total) > free {
+		fmt.Fprintf(os.Stderr, "Not enough free space to restore: %s needed, %s free\n", humanize.IBytes(uint64(total)), humanize.IBytes(free))
+		fmt.Fprintln(os.Stderr, "Use --force to restore anyway, eg. if it has sparse files")
+		os.Exit(exitFatal)
 	}
+}
 
-	sort.Slice(sidecars, func(i, j int) bool {
-		return sidecars[i].Time.Before(sidecars[j].Time)
-	})
+// restoreInodes returns how many inodes restoring files of the backup takes. the
+// directories and links are only known from manifests of newer backups, and are
+// left out when only some files are restored
+func restoreInodes(sidecar SidecarData, files map[string]int64, filter pathFilter) int {
+	inodes := len(files)
+	if !filter.Empty() {
+		return inodes
+	}
+	if manifest, err := readManifest(sidecar.ManifestPath()); err == nil && manifest != nil {
+		inodes += manifest.Dirs
+	}
+	return inodes
+}
+
+// checkRestoreInodes warns if restoring inodes files, directories and links would
+// use up most or all of the inodes left on dir's filesystem. running out shows
+// as "no space left on device" with space to spare
+func checkRestoreInodes(dir string, inodes int) {
+	free, limited, err := freeInodes(dir)
+	if err != nil || !limited {
+		return
+	}
+	switch {
+	case uint64(inodes) > free:
+		fmt.Fprintf(os.Stderr, "WARNING: Restoring takes %d inodes but only %d are free, it will fail partway with \"no space left on device\"\n", inodes, free)
+	case uint64(inodes) > free/10*9:
+		fmt.Fprintf(os.Stderr, "WARNING: Restoring takes %d of the %d free inodes, leaving almost none for anything else\n", inodes, free)
+	}
+}
+
+// verifyBackup checks a backup's signature and reads the whole archive to check it against the manifest
+func verifyBackup(sidecar SidecarData) {
+	if !checkBackup(sidecar) {
+		os.Exit(exitVerifyFailed)
+	}
+}
+
+// checkBackup does what verify does, printing how each part went, and records
+// when the backup last checked out in its sidecar. returns false if it didn't
+func checkBackup(sidecar SidecarData) bool {
+	ok := true
+
+	if err := verifySignature(sidecar.ParentPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Signature: %v\n", err)
+		ok = false
+	} else if _, err := os.Stat(sidecar.SignaturePath()); err == nil {
+		fmt.Println("Signature: OK")
+	} else {
+		fmt.Println("Signature: none")
+	}
 
-	var q string
-	if query != "" {
-		q = strings.ToLower(query)
+	manifest, err := readManifest(sidecar.ManifestPath())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Manifest: ", err)
+		return false
+	}
+	if manifest == nil {
+		fmt.Println("Contents: no manifest, only checking that the archive can be read")
+		manifest = newManifest()
+	}
+
+	var mismatched []string
+	if sidecar.Stream != "" {
+		mismatched, err = checkStream(sidecar, manifest)
+	} else {
+		mismatched, err = checkArchive(sidecar.ParentPath, manifest)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Contents: error reading archive: %v\n", err)
+		ok = false
+	} else if len(mismatched) > 0 {
+		fmt.Fprintf(os.Stderr, "Contents: %d files failed verification:\n", len(mismatched))
+		for _, path := range mismatched {
+			fmt.Fprintf(os.Stderr, "\t%s\n", escapeName(path))
+		}
+		ok = false
+	} else {
+		fmt.Printf("Contents: OK (%d files)\n", len(manifest.Files))
+	}
+
+	if !ok {
+		if _, err := os.Stat(sidecar.ParityPath()); err == nil {
+			fmt.Printf("Parity: available, try `backman repair %d`\n", sidecar.ID)
+		}
 	}
 
-	for _, data := range sidecars {
-		var prefix, suffix string
-		if query == "" {
-			// normal text
-			prefix = ""
-			suffix = ""
+	if sidecar.ParentID != nil {
+		if chain, err := backupChain(sidecar); err != nil {
+			fmt.Fprintf(os.Stderr, "Chain: %v\n", err)
+			ok = false
 		} else {
-			hay := data.FormatHay()
-			if fuzzy.Match(q, hay) {
-				// matching bold
-				prefix = "\033[1m"
-				suffix = "\033[0m"
-			} else {
-				// non matching grey
-				prefix = "\033[90m"
-				suffix = "\033[0m"
-			}
+			fmt.Printf("Chain: OK (%d backups)\n", len(chain))
+		}
+	}
+
+	if ok {
+		sidecar.Verified = time.Now()
+		if err := sidecar.Save(); err != nil {
+			fmt.Fprintln(os.Stderr, "WARNING: Could not record the verification in the sidecar: ", err)
 		}
+	}
+	return ok
+}
+
+// repairBackup fixes a damaged archive with its parity file
+func repairBackup(sidecar SidecarData) {
+	if _, err := os.Stat(sidecar.ParityPath()); err != nil {
+		fmt.Fprintln(os.Stderr, "This backup has no parity to repair it with, set parity_percent for new backups")
+		os.Exit(exitFatal)
+	}
+
+	rebuilt, err := repairArchive(sidecar.ParentPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error repairing archive: ", err)
+		os.Exit(exitFatal)
+	}
+	if rebuilt == 0 {
+		fmt.Println("Nothing to repair, the archive matches its parity")
+		return
+	}
+	fmt.Printf("Rebuilt %d damaged blocks\n", rebuilt)
+}
 
-		fmt.Printf("%s%v:\n\t%s\n\t%s | %s\n%s",
-			prefix,
-			data.ID,
-			data.BackupOf,
-			data.Time.Local().Format(config.TimeFormat),
-			humanize.IBytes(uint64(data.ParentSize)),
-			suffix,
-		)
+// annotateBackup sets the note of a backup, an empty note removes it
+func annotateBackup(sidecar SidecarData, note string) {
+	sidecar.Note = strings.TrimSpace(note)
+	if err := sidecar.Save(); err != nil {
+		fmt.Fprintln(os.Stderr, "error writing sidecar: ", err)
+		os.Exit(exitFatal)
 	}
+
+	if sidecar.Note == "" {
+		fmt.Println("Removed the note!")
+		return
+	}
+	fmt.Println("Saved the note!")
 }
-func deleteBackup(id uint16) {
+
+func deleteBackup(ref string, cascade, force bool) {
 	files, err := readSidecars()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error reading sidecar files: ", err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+	file, err := matchSidecar(files, ref)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFatal)
 	}
 
-	for _, file := range files {
-		if file.ID == id {
-			file.DeleteAll()
-			fmt.Println("Deleted successfully!")
-			return
+	deps := dependents(files, file.ID)
+	if len(deps) > 0 && !cascade {
+		fmt.Fprintf(os.Stderr, "%d incremental backups depend on this backup, use --cascade to delete them too:\n", len(deps))
+		for _, dep := range deps {
+			fmt.Fprintf(os.Stderr, "\t%d\n", dep.ID)
+		}
+		os.Exit(exitFatal)
+	}
+	doomed := append(deps, file)
+	if !confirmRemoval(doomed, len(files), force) {
+		fmt.Println("Nothing was deleted")
+		return
+	}
+	for _, sc := range doomed {
+		if err := trashBackup(sc); err != nil {
+			fmt.Fprintf(os.Stderr, "error deleting backup %d: %v\n", sc.ID, err)
+			os.Exit(exitFatal)
+		}
+	}
+	expireTrash()
+
+	if len(deps) > 0 {
+		fmt.Printf("Deleted successfully, along with %d dependent backups!\n", len(deps))
+	} else {
+		fmt.Println("Deleted successfully!")
+	}
+	if config.TrashDays > 0 {
+		fmt.Printf("It's in the trash for %d days, use `undelete %d` to bring it back\n", config.TrashDays, file.ID)
+	}
+}
+
+// deleteBackupsOf deletes every backup of target
+func deleteBackupsOf(target string, force bool) {
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+
+	var doomed []SidecarData
+	for _, sc := range sidecars {
+		if sc.matchesTarget(target) {
+			doomed = append(doomed, sc)
+		}
+	}
+	if len(doomed) == 0 {
+		fmt.Fprintf(os.Stderr, "No backups of '%s' found!\n", target)
+		os.Exit(exitFatal)
+	}
+
+	// incremental backups of other targets never build on these, but check anyway
+	for _, sc := range doomed {
+		for _, dep := range dependents(sidecars, sc.ID) {
+			if !dep.matchesTarget(target) {
+				fmt.Fprintf(os.Stderr, "Backup %d of '%s' depends on backup %d, delete it first\n", dep.ID, dep.BackupOf, sc.ID)
+				os.Exit(exitFatal)
+			}
 		}
 	}
 
-	fmt.Fprintln(os.Stderr, "ID not found!")
-	os.Exit(1)
+	if !confirmRemoval(doomed, len(sidecars), force) {
+		fmt.Println("Nothing was deleted")
+		return
+	}
+	for _, sc := range doomed {
+		if err := trashBackup(sc); err != nil {
+			fmt.Fprintf(os.Stderr, "error deleting backup %d: %v\n", sc.ID, err)
+			os.Exit(exitFatal)
+		}
+	}
+	expireTrash()
+	fmt.Printf("Deleted %d backups of '%s'!\n", len(doomed), target)
 }
-func purgeBackups(cutoff time.Time) {
+
+// purgeBackups deletes the backups made within window, only those of target if it isn't empty
+func purgeBackups(window timeRange, target string, force bool) {
 	sidecars, err := readSidecars()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error reading sidecar files: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitFatal)
+	}
+
+	// backups that newer ones build on are kept until those expire too
+	needed := make(map[uint16]bool)
+	byID := make(map[uint16]SidecarData)
+	for _, sc := range sidecars {
+		byID[sc.ID] = sc
+	}
+	for _, sc := range sidecars {
+		if window.Contains(sc.Time) {
+			continue
+		}
+		for current := sc; current.ParentID != nil && !needed[*current.ParentID]; {
+			needed[*current.ParentID] = true
+			current = byID[*current.ParentID]
+		}
 	}
 
-	// delete any older than cutoff
-	var deleted int
+	// delete any within the window
+	var expired []SidecarData
+	var kept int
 	for _, sc := range sidecars {
-		if sc.Time.Before(cutoff) {
-			sc.DeleteAll()
-			deleted++
+		if target != "" && !sc.matchesTarget(target) {
+			continue
+		}
+		if window.Contains(sc.Time) {
+			if needed[sc.ID] {
+				kept++
+				continue
+			}
+			expired = append(expired, sc)
 		}
 	}
 
-	fmt.Printf("Purged %d backups!\n", deleted)
+	if len(expired) > 0 && !confirmRemoval(expired, len(sidecars), force) {
+		fmt.Println("Nothing was purged")
+		return
+	}
+	for _, sc := range expired {
+		if err := trashBackup(sc); err != nil {
+			fmt.Fprintf(os.Stderr, "error deleting backup %d: %v\n", sc.ID, err)
+			os.Exit(exitFatal)
+		}
+	}
+	expireTrash()
+
+	fmt.Printf("Purged %d backups!\n", len(expired))
+	if kept > 0 {
+		fmt.Printf("Kept %d expired backups that newer incremental backups depend on\n", kept)
+	}
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Manifest records every regular file stored in an archive, keyed by its path inside the archive.
+// it is written next to the archive as <archive>.manifest
+type Manifest struct {
+	Files map[string]ManifestEntry `json:"files"`
+	// directories and symlinks in the archive. restoring takes an inode for each
+	// of them and each file, which small file systems can run out of before space
+	Dirs int `json:"dirs,omitempty"`
+	// files that couldn't be read and were left out, with why. stored in the sidecar
+	Skipped map[string]string `json:"-"`
+	// words of the stored text files, set while backing up if content_index is set. stored in <archive>.index
+	Index *contentIndex `json:"-"`
+}
+
+type ManifestEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// hex encoded sha256 of the contents
+	SHA256 string `json:"sha256"`
+	// set in incremental backups for files that didn't change since the parent backup,
+	// their contents are stored in an earlier archive of the chain
+	Unchanged bool `json:"unchanged,omitempty"`
+	// set if the file was being modified while it was backed up, so what's stored
+	// may be a mix of before and after. the next incremental backup stores it again
+	Changed bool `json:"changed,omitempty"`
+}
+
+// Stored returns the total size and number of the files stored in the archive
+// itself, leaving out the unchanged files of incremental backups
+func (m *Manifest) Stored() (int64, int) {
+	var size int64
+	var files int
+	for _, entry := range m.Files {
+		if !entry.Unchanged {
+			size += entry.Size
+			files++
+		}
+	}
+	return size, files
+}
+
+// Inodes returns how many inodes restoring the backup takes
+func (m *Manifest) Inodes() int {
+	return len(m.Files) + m.Dirs
+}
+
+// Changed returns the sorted paths of the files that changed while they were backed up
+func (m *Manifest) Changed() []string {
+	var changed []string
+	for _, path := range m.Paths() {
+		if m.Files[path].Changed {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+func newManifest() *Manifest {
+	return &Manifest{Files: make(map[string]ManifestEntry), Skipped: make(map[string]string)}
+}
+
+// skipFile records a file left out of the backup because of err
+func (m *Manifest) skipFile(path string, err error) {
+	fmt.Fprintf(os.Stderr, "WARNING: Skipping '%s': %v\n", escapeName(path), err)
+	m.Skipped[path] = err.Error()
+}
+
+func newFileHash() hash.Hash {
+	return sha256.New()
+}
+func hashString(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Paths returns the sorted paths of all files in the manifest
+func (m *Manifest) Paths() []string {
+	paths := make([]string, 0, len(m.Files))
+	for path := range m.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// writeManifest writes m to name, encrypted if encrypt is set
+func writeManifest(name string, m *Manifest) error {
+	stored := m
+	for path := range m.Files {
+		if encodeName(path) == path {
+			continue
+		}
+		// only copied for the rare names that need it
+		stored = &Manifest{Files: make(map[string]ManifestEntry, len(m.Files)), Dirs: m.Dirs}
+		for path, entry := range m.Files {
+			stored.Files[encodeName(path)] = entry
+		}
+		break
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if config.Encrypt {
+		if data, err = encryptBytes(data); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(name, data, 0600)
+}
+
+// readManifest returns nil without an error if the manifest doesn't exist,
+// which is the case for backups made before manifests were introduced
+func readManifest(name string) (*Manifest, error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data, err = decryptBytes(data); err != nil {
+		return nil, fmt.Errorf("error decrypting '%s': %w", filepath.Base(name), err)
+	}
+
+	m := newManifest()
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	for stored, entry := range m.Files {
+		path, err := decodeName(stored)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file name %q in '%s': %w", stored, filepath.Base(name), err)
+		}
+		if path != stored {
+			delete(m.Files, stored)
+			m.Files[path] = entry
+		}
+	}
+	return m, nil
+}
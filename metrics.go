@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runRecord is one line of the run log, written after every backup attempt.
+// it's kept after the backups are deleted, report reads it for trends
+type runRecord struct {
+	Target string    `json:"target"`
+	Time   time.Time `json:"time"`
+	// how long the backup took, in seconds
+	Duration float64 `json:"duration"`
+	// size of the written archive
+	Bytes int64  `json:"bytes"`
+	Error string `json:"error,omitempty"`
+	// the backup that was made, or kept if nothing changed
+	ID uint16 `json:"id,omitempty"`
+	// set if nothing changed and no archive was written
+	Unchanged bool `json:"unchanged,omitempty"`
+	// size and number of the files stored, before compression. zero in older logs
+	Original int64 `json:"original,omitempty"`
+	Files    int   `json:"files,omitempty"`
+}
+
+// runLogPath is where runRecords are appended. not .json, that would be read as a sidecar
+func runLogPath() string {
+	return filepath.Join(config.ArchiveDir, "runs.jsonl")
+}
+
+// recordRun logs a backup attempt that started at start and updates the metrics file.
+// record holds the target and what was written. failing to log only warns, it
+// shouldn't fail the backup
+func recordRun(record runRecord, start time.Time, runErr error) {
+	record.Time = start
+	record.Duration = time.Since(start).Seconds()
+	if runErr != nil {
+		record.Error = runErr.Error()
+	}
+
+	err := appendRun(record)
+	if err == nil && config.MetricsFile != "" {
+		err = writeMetricsFile(config.MetricsFile)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: Could not record backup metrics: ", err)
+	}
+}
+
+func appendRun(record runRecord) error {
+	if err := os.MkdirAll(config.ArchiveDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(runLogPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// readRuns reads the run log, oldest first
+func readRuns() ([]runRecord, error) {
+	f, err := os.Open(runLogPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []runRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record runRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// a line cut off by a crash shouldn't hide the rest
+			continue
+		}
+		runs = append(runs, record)
+	}
+	return runs, scanner.Err()
+}
+
+// writeMetricsFile writes the metrics to path through a temporary file, so
+// collectors never read a half written file
+func writeMetricsFile(path string) error {
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// targetMetrics are the metrics of a single backed up path
+type targetMetrics struct {
+	lastBackup   time.Time
+	archiveBytes int64
+	backups      int
+	lastDuration float64
+	lastSuccess  bool
+	hasRuns      bool
+	failures     int
+}
+
+// metricsCache holds the last metrics served, they are only built again when
+// the archive dir or the run log changed
+var metricsCache struct {
+	sync.Mutex
+	key  string
+	data []byte
+}
+
+// metricsKey changes whenever a backup is written, removed or annotated (sidecars
+// are replaced by a rename, which updates the dir) or a run is logged
+func metricsKey() string {
+	var key string
+	for _, path := range []string{config.ArchiveDir, runLogPath()} {
+		if info, err := os.Stat(path); err == nil {
+			key += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+		} else {
+			key += "-;"
+		}
+	}
+	return key
+}
+
+// writeCachedMetrics is writeMetrics for scrapes, it reuses the last result while
+// nothing changed so a scrape doesn't read every sidecar
+func writeCachedMetrics(w io.Writer) error {
+	metricsCache.Lock()
+	defer metricsCache.Unlock()
+
+	key := metricsKey()
+	if metricsCache.data == nil || metricsCache.key != key {
+		var buf bytes.Buffer
+		if err := writeMetrics(&buf); err != nil {
+			return err
+		}
+		metricsCache.key, metricsCache.data = key, buf.Bytes()
+	}
+	_, err := w.Write(metricsCache.data)
+	return err
+}
+
+// writeMetrics writes the metrics in the prometheus text format. it only reads,
+// see peekSidecars
+func writeMetrics(w io.Writer) error {
+	sidecars, err := peekSidecars()
+	if err != nil {
+		return err
+	}
+	runs, err := readRuns()
+	if err != nil {
+		return err
+	}
+
+	targets := map[string]*targetMetrics{}
+	get := func(target string) *targetMetrics {
+		if targets[target] == nil {
+			targets[target] = &targetMetrics{}
+		}
+		return targets[target]
+	}
+
+	// the backups that exist, including imported ones
+	for _, sidecar := range sidecars {
+		t := get(sidecar.Of())
+		t.archiveBytes += sidecar.ParentSize
+		t.backups++
+		if sidecar.Time.After(t.lastBackup) {
+			t.lastBackup = sidecar.Time
+		}
+		if sidecar.LastSeen.After(t.lastBackup) {
+			t.lastBackup = sidecar.LastSeen
+		}
+	}
+	// how the backups made on this machine went
+	for _, run := range runs {
+		t := get(run.Target)
+		t.hasRuns = true
+		t.lastDuration = run.Duration
+		t.lastSuccess = run.Error == ""
+		if run.Error != "" {
+			t.failures++
+		}
+	}
+
+	var names []string
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	type metric struct {
+		name, help, kind string
+		value            func(t *targetMetrics) (float64, bool)
+	}
+	metrics := []metric{
+		{"backman_last_backup_timestamp_seconds", "Time of the newest backup of the target.", "gauge",
+			func(t *targetMetrics) (float64, bool) {
+				return float64(t.lastBackup.Unix()), t.backups > 0
+			}},
+		{"backman_backups", "Number of stored backups of the target.", "gauge",
+			func(t *targetMetrics) (float64, bool) { return float64(t.backups), true }},
+		{"backman_archive_bytes", "Total size of the stored archives of the target.", "gauge",
+			func(t *targetMetrics) (float64, bool) { return float64(t.archiveBytes), true }},
+		{"backman_last_run_duration_seconds", "How long the last backup run of the target took.", "gauge",
+			func(t *targetMetrics) (float64, bool) { return t.lastDuration, t.hasRuns }},
+		{"backman_last_run_success", "Whether the last backup run of the target succeeded.", "gauge",
+			func(t *targetMetrics) (float64, bool) {
+				if t.lastSuccess {
+					return 1, t.hasRuns
+				}
+				return 0, t.hasRuns
+			}},
+		{"backman_failures_total", "Number of failed backup runs of the target.", "counter",
+			func(t *targetMetrics) (float64, bool) { return float64(t.failures), true }},
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, name := range names {
+			if value, ok := m.value(targets[name]); ok {
+				fmt.Fprintf(bw, "%s{target=\"%s\"} %s\n", m.name, escapeLabel(name), strconv.FormatFloat(value, 'f', -1, 64))
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// escapeLabel escapes a prometheus label value
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sidecarVersion is the version of the sidecar format this backman writes.
+// sidecars from before versions were recorded are version 1
+const sidecarVersion = 3
+
+// sidecarMigrations[i] upgrades a sidecar from version i+1 to i+2. they run
+// whenever a sidecar is read, `migrate` saves the result so they don't have to.
+// ParentPath is set, but the archive may be on a remote
+var sidecarMigrations = []func(s *SidecarData){
+	// 2: the backed up size and number of files, which were only in the manifest
+	func(s *SidecarData) {
+		if size, files, ok := s.Original(); ok {
+			s.OriginalSize, s.Files = size, files
+		}
+	},
+	// 3: times in UTC instead of the zone of the machine that made the backup
+	func(s *SidecarData) {
+		s.toUTC()
+	},
+}
+
+// toUTC converts the times of the sidecar to UTC, which they're stored in
+func (s *SidecarData) toUTC() {
+	for _, t := range []*time.Time{&s.Time, &s.LastSeen, &s.Verified, &s.TrashedAt} {
+		if !t.IsZero() {
+			*t = t.UTC()
+		}
+	}
+}
+
+// errNewerSidecar is returned when saving a sidecar written by a newer backman,
+// which would lose the fields this one doesn't know
+var errNewerSidecar = errors.New("the sidecar was written by a newer version of backman, update it first")
+
+// parseSidecar reads the sidecar of parent and upgrades it to sidecarVersion
+func parseSidecar(data []byte, parent string) (SidecarData, error) {
+	var sidecar SidecarData
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return sidecar, err
+	}
+	sidecar.ParentPath = parent
+
+	version := max(sidecar.Version, 1)
+	if version < sidecarVersion {
+		for _, migration := range sidecarMigrations[version-1:] {
+			migration(&sidecar)
+		}
+		sidecar.migratedFrom = version
+		sidecar.Version = sidecarVersion
+	}
+	return sidecar, nil
+}
+
+// migrateSidecars saves every sidecar that was upgraded when it was read
+func migrateSidecars(dryRun bool) {
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+	trashed, err := readTrash()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the trash: ", err)
+		os.Exit(exitFatal)
+	}
+
+	var migrated, newer, failed int
+	for _, sidecar := range append(sidecars, trashed...) {
+		if sidecar.Version > sidecarVersion {
+			fmt.Fprintf(os.Stderr, "WARNING: Backup %d has sidecar version %d, this backman only knows up to %d\n", sidecar.ID, sidecar.Version, sidecarVersion)
+			newer++
+			continue
+		}
+		if sidecar.migratedFrom == 0 {
+			continue
+		}
+
+		fmt.Printf("%d: version %d => %d (%s)\n", sidecar.ID, sidecar.migratedFrom, sidecarVersion, filepath.Base(sidecar.ParentPath)+".json")
+		if dryRun {
+			migrated++
+			continue
+		}
+		if err := sidecar.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "error saving sidecar of backup %d: %v\n", sidecar.ID, err)
+			failed++
+			continue
+		}
+		migrated++
+	}
+
+	switch {
+	case migrated == 0 && failed == 0:
+		if newer == 0 {
+			fmt.Printf("Every sidecar is already version %d\n", sidecarVersion)
+		}
+	case dryRun:
+		fmt.Printf("Would migrate %d sidecars\n", migrated)
+	default:
+		fmt.Printf("Migrated %d sidecars!\n", migrated)
+	}
+	if failed > 0 || newer > 0 {
+		exitCode = exitPartial
+	}
+}
+
+func migrateCommand(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only print which sidecars would be rewritten")
+	parseFlags(fs, args)
+	migrateSidecars(*dryRun)
+}
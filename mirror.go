@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// isBackupFile reports whether name is one of the files backups are made of,
+// sync leaves everything else on the mirror alone
+func isBackupFile(name string) bool {
+	name = strings.TrimSuffix(name, ".json")
+	for _, ext := range []string{".manifest", ".index", ".sig", ".par"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	name = trimVolume(name)
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(name, "."+format) {
+			return true
+		}
+	}
+	return false
+}
+
+// trimVolume strips the number of a volume of a split archive from name, see volumePath
+func trimVolume(name string) string {
+	i := strings.LastIndex(name, ".")
+	if i < 0 || len(name)-i-1 < 3 {
+		return name
+	}
+	for _, c := range name[i+1:] {
+		if c < '0' || c > '9' {
+			return name
+		}
+	}
+	return name[:i]
+}
+
+// syncMirror makes the mirror hold the same backups as the archive dir:
+// missing backups are copied over and ones deleted locally are deleted there too.
+// quarantined and partial backups aren't deleted, they're still here, and nothing
+// is deleted if the archive dir has no backups, eg. because it isn't mounted
+func syncMirror(r remote) (uploaded, deleted int, err error) {
+	// readSidecars takes a missing archive dir for one without backups
+	if _, err := os.Stat(config.ArchiveDir); err != nil {
+		return 0, 0, fmt.Errorf("archive dir '%s' is missing, is it mounted? %w", config.ArchiveDir, err)
+	}
+	sidecars, err := readSidecars()
+	if err != nil {
+		return 0, 0, err
+	}
+	names, err := r.List()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	local := make(map[string]bool)
+	partial, err := partialBackups()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, sidecar := range partial {
+		for _, file := range backupFiles(sidecar) {
+			local[filepath.Base(file)] = true
+		}
+	}
+	quarantine, err := readQuarantine()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, backup := range quarantine {
+		for _, file := range quarantineFiles(filepath.Join(quarantineDir(), backup.Name)) {
+			local[filepath.Base(file)] = true
+		}
+	}
+
+	for _, sidecar := range sidecars {
+		files := backupFiles(sidecar)
+		for _, file := range files {
+			local[filepath.Base(file)] = true
+		}
+
+		// the sidecar is uploaded last, so it's only there once the whole backup is
+		if slices.Contains(names, filepath.Base(sidecar.ParentPath)+".json") {
+			continue
+		}
+		fmt.Printf("Copying backup %d...\n", sidecar.ID)
+		if err := pushBackup(r, sidecar); err != nil {
+			return uploaded, deleted, err
+		}
+		uploaded++
+	}
+
+	// sidecars go first, so a mirror never has a sidecar without its archive
+	var stale []string
+	for _, name := range names {
+		if !local[name] && isBackupFile(name) {
+			stale = append(stale, name)
+		}
+	}
+	if len(sidecars) == 0 && len(stale) > 0 {
+		return uploaded, deleted, fmt.Errorf("there are no backups in '%s', refusing to delete the %d files of the mirror", config.ArchiveDir, len(stale))
+	}
+	if config.AppendOnly && len(stale) > 0 {
+		// deleting locally took --i-know, the mirror keeps them regardless
+		fmt.Fprintf(os.Stderr, "WARNING: keeping %d files deleted locally on the mirror, append_only is set\n", len(stale))
+		stale = nil
+	}
+	slices.SortFunc(stale, func(a, b string) int {
+		return boolCompare(filepath.Ext(b) == ".json", filepath.Ext(a) == ".json")
+	})
+	for _, name := range stale {
+		if err := r.Delete(name); err != nil {
+			return uploaded, deleted, fmt.Errorf("error deleting '%s': %w", name, err)
+		}
+		if filepath.Ext(name) == ".json" {
+			deleted++
+		}
+	}
+
+	return uploaded, deleted, nil
+}
+
+func boolCompare(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
+
+func syncCommand() {
+	if config.Mirror == "" {
+		fmt.Fprintln(os.Stderr, "no mirror configured, set the mirror config key")
+		os.Exit(exitFatal)
+	}
+	r, err := openRemote(config.Mirror)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error opening mirror: ", err)
+		os.Exit(exitFatal)
+	}
+
+	uploaded, deleted, err := syncMirror(r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error syncing mirror: ", err)
+		os.Exit(exitFatal)
+	}
+	fmt.Printf("Mirror synced, copied %d and deleted %d backups\n", uploaded, deleted)
+}
@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestIsBackupFile(t *testing.T) {
+	for name, want := range map[string]bool{
+		"x.tar.zstd":          true,
+		"x.tar.zstd.json":     true,
+		"x.tar.zstd.manifest": true,
+		"x.tar.zstd.001":      true,
+		"x.tar.zstd.042":      true,
+		"x.tar.zstd.1000":     true,
+		"x.zip.007":           true,
+		"x.tar.zstd.01":       false,
+		"notes.txt.001":       false,
+		"backman.key":         false,
+		"x.tar.zstd.00a":      false,
+		"001":                 false,
+	} {
+		if got := isBackupFile(name); got != want {
+			t.Errorf("isBackupFile(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// file names can hold anything but / and NUL on unix, including newlines and
+// bytes that aren't utf-8. archives store them as they are. printing them escapes
+// what a terminal would mangle, and restoring on windows percent-encodes what
+// windows doesn't allow in names, eg. "CON" becomes "%43ON" and "notes." "notes%2E"
+
+// escapeName returns name as is if it's printable, else quoted with Go escapes,
+// so newlines and invalid utf-8 can't garble the output
+func escapeName(name string) string {
+	for _, r := range name {
+		if r == utf8.RuneError || !unicode.IsPrint(r) && r != ' ' {
+			return strconv.Quote(name)
+		}
+	}
+	return name
+}
+
+// json replaces bytes that aren't utf-8, so names with them are stored as a NUL,
+// which no name can contain, and the name in base64
+const encodedNamePrefix = "\x00"
+
+// encodeName returns name as it's stored in json
+func encodeName(name string) string {
+	if utf8.ValidString(name) {
+		return name
+	}
+	return encodedNamePrefix + base64.RawStdEncoding.EncodeToString([]byte(name))
+}
+
+// decodeName reverses encodeName
+func decodeName(stored string) (string, error) {
+	encoded, ok := strings.CutPrefix(stored, encodedNamePrefix)
+	if !ok {
+		return stored, nil
+	}
+	name, err := base64.RawStdEncoding.DecodeString(encoded)
+	return string(name), err
+}
+
+// windows reserves these names, with any extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// windowsName percent-encodes what windows doesn't allow in the file name elem:
+// the characters <>:"/\|?* and control characters, bytes that aren't utf-8,
+// trailing dots and spaces, and the first letter of reserved names
+func windowsName(elem string) string {
+	if elem == "." || elem == ".." {
+		return elem
+	}
+	var b strings.Builder
+	for i := 0; i < len(elem); {
+		r, size := utf8.DecodeRuneInString(elem[i:])
+		if r == utf8.RuneError && size <= 1 || r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			fmt.Fprintf(&b, "%%%02X", elem[i])
+			i++
+			continue
+		}
+		b.WriteString(elem[i : i+size])
+		i += size
+	}
+	name := b.String()
+
+	trimmed := strings.TrimRight(name, ". ")
+	for _, c := range []byte(name[len(trimmed):]) {
+		trimmed += fmt.Sprintf("%%%02X", c)
+	}
+	name = trimmed
+
+	base, _, _ := strings.Cut(name, ".")
+	if windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))] {
+		name = fmt.Sprintf("%%%02X", name[0]) + name[1:]
+	}
+	return name
+}
+
+// localName turns an archive path into a relative path of this system
+func localName(name string) string {
+	if runtime.GOOS != "windows" {
+		return filepath.FromSlash(name)
+	}
+	elems := strings.Split(name, "/")
+	for i, elem := range elems {
+		elems[i] = windowsName(elem)
+	}
+	return strings.Join(elems, `\`)
+}
+
+// restoredPath returns where the archive path name is restored in dir, false if
+// it would end up outside of dir, eg. a "../" path in an archive made by another tool
+func restoredPath(dir, name string) (string, bool) {
+	name = path.Clean(name)
+	if name == "." {
+		return dir, true
+	}
+	local := localName(name)
+	if !filepath.IsLocal(local) {
+		return "", false
+	}
+	return filepath.Join(dir, local), true
+}
+
+// linkedParent returns the first directory between dir and target that is a
+// symlink, false if there's none. restoring through one, eg. "d" linking to
+// "/outside" followed by "d/x.txt", would write outside of dir
+func linkedParent(dir, target string) (string, bool) {
+	rel, err := filepath.Rel(dir, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return "", false
+	}
+	current := dir
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, elem)
+		info, err := os.Lstat(current)
+		if err != nil {
+			// not created yet, so neither is anything below it
+			return "", false
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return current, true
+		}
+	}
+	return "", false
+}
+
+// throughLink returns the symlink among links that the archive path name is
+// under, false if it isn't under any. links holds cleaned archive paths
+func throughLink(name string, links map[string]bool) (string, bool) {
+	name = path.Clean(name)
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if links[dir] {
+			return dir, true
+		}
+	}
+	return "", false
+}
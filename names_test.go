@@ -0,0 +1,91 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestWindowsName(t *testing.T) {
+	for elem, want := range map[string]string{
+		"notes.txt":   "notes.txt",
+		"CON":         "%43ON",
+		"nul.txt":     "%6Eul.txt",
+		"com1 .log":   "%63om1 .log",
+		"CONSOLE":     "CONSOLE",
+		"notes.":      "notes%2E",
+		"trailing  ":  "trailing%20%20",
+		"a:b?c*":      "a%3Ab%3Fc%2A",
+		"line\nbreak": "line%0Abreak",
+		"bad\xffutf8": "bad%FFutf8",
+		"grüße":       "grüße",
+		"..":          "..",
+	} {
+		if got := windowsName(elem); got != want {
+			t.Errorf("windowsName(%q) = %q, want %q", elem, got, want)
+		}
+	}
+}
+
+func TestEscapeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"plain name.txt": "plain name.txt",
+		"grüße":          "grüße",
+		"line\nbreak":    `"line\nbreak"`,
+		"tab\there":      `"tab\there"`,
+		"bad\xffutf8":    `"bad\xffutf8"`,
+		"\x1b[31mred":    `"\x1b[31mred"`,
+	} {
+		if got := escapeName(name); got != want {
+			t.Errorf("escapeName(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestEncodeName(t *testing.T) {
+	for _, name := range []string{"plain", "grüße", "bad\xffutf8", "\xc3"} {
+		stored := encodeName(name)
+		decoded, err := decodeName(stored)
+		if err != nil || decoded != name {
+			t.Errorf("decodeName(encodeName(%q)) = %q, %v", name, decoded, err)
+		}
+	}
+	if stored := encodeName("grüße"); stored != "grüße" {
+		t.Errorf("valid utf-8 is stored as %q, want it as is", stored)
+	}
+}
+
+func TestRestoredPath(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"a/b.txt":      true,
+		"./a/b.txt":    true,
+		"../escape":    false,
+		"a/../../up":   false,
+		"/etc/passwd":  false,
+		"a/./b/../c":   true,
+		"CON/file.txt": true,
+	} {
+		if _, got := restoredPath("dst", name); got != ok {
+			t.Errorf("restoredPath(%q) = %v, want %v", name, got, ok)
+		}
+	}
+}
+
+// names that are legal on unix but odd anywhere have to come back byte for byte
+func TestUnusualNames(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows can't create these names")
+	}
+	files := map[string]string{
+		"new\nline.txt":  "newline",
+		"trailing. ":     "trailing dot and space",
+		"CON":            "reserved on windows",
+		"nul.txt":        "reserved with extension",
+		"quote\"and|bar": "windows characters",
+		"tab\tname":      "tab",
+	}
+	if runtime.GOOS == "linux" {
+		// macOS only allows utf-8 names
+		files["bad\xffutf8"] = "invalid utf-8"
+	}
+	roundTrip(t, files)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// archive_name_template names new archives after what they hold, so the archive
+// dir can be browsed without reading sidecars. the format's extension is appended
+// and the UUID is kept in the sidecar, since it can't be told apart from the rest
+
+// archiveNameData is what archive_name_template is executed with
+type archiveNameData struct {
+	Host string
+	User string
+	// the backed up directory, or stdin:<name> for piped data
+	Target string
+	// when the backup was made, as 2006-01-02_150405
+	Time string
+	UUID string
+}
+
+var archiveNameFuncs = template.FuncMap{
+	"base": filepath.Base,
+}
+
+// uuidPattern matches the UUIDs made by generateUUID
+var uuidPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}`)
+
+func parseArchiveNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("archive_name_template").Funcs(archiveNameFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(text, ".UUID") {
+		return nil, errors.New("has to contain {{.UUID}}, which keeps the names unique")
+	}
+	// catches unknown fields, which only fail once it's executed
+	if err := tmpl.Execute(io.Discard, archiveNameData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// archiveName returns the name of a new archive of sidecar, without its extension
+func archiveName(sidecar SidecarData, uuid string) (string, error) {
+	if config.ArchiveNameTemplate == "" {
+		return uuid, nil
+	}
+	tmpl, err := parseArchiveNameTemplate(config.ArchiveNameTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	var name strings.Builder
+	err = tmpl.Execute(&name, archiveNameData{
+		Host:   hostname(),
+		User:   username(),
+		Target: sidecar.BackupOf,
+		Time:   time.Now().Local().Format("2006-01-02_150405"),
+		UUID:   uuid,
+	})
+	if err != nil {
+		return "", err
+	}
+	// leave out what isn't allowed in file names on any platform
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name.String()), nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// archives keep the uid, gid and names of the owners of every file. restore
+// --owners gives the files back to them: to the user of the same name if there's
+// one here, like tar does, else to the same id. --map-user and --map-group say
+// who gets the files of users that don't exist here, or are someone else here
+
+// idMap decides the local ids the files of an archive's users or groups get
+type idMap struct {
+	// "user" or "group"
+	kind string
+	// from --map-user or --map-group, by archive id or name
+	mapped map[string]int
+	// decided ids by archive id and name, so every user is looked up and asked about once
+	decided map[string]int
+	// the local id of a name, false if there's no such user or group
+	lookup func(name string) (int, bool)
+	// whether a local user or group has the id
+	exists func(id int) bool
+}
+
+func newUserMap() *idMap {
+	return &idMap{
+		kind:    "user",
+		mapped:  make(map[string]int),
+		decided: make(map[string]int),
+		lookup: func(name string) (int, bool) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return 0, false
+			}
+			id, err := strconv.Atoi(u.Uid)
+			return id, err == nil
+		},
+		exists: func(id int) bool {
+			_, err := user.LookupId(strconv.Itoa(id))
+			return err == nil
+		},
+	}
+}
+
+func newGroupMap() *idMap {
+	return &idMap{
+		kind:    "group",
+		mapped:  make(map[string]int),
+		decided: make(map[string]int),
+		lookup: func(name string) (int, bool) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return 0, false
+			}
+			id, err := strconv.Atoi(g.Gid)
+			return id, err == nil
+		},
+		exists: func(id int) bool {
+			_, err := user.LookupGroupId(strconv.Itoa(id))
+			return err == nil
+		},
+	}
+}
+
+// localID parses an id or looks up a name on this system
+func (m *idMap) localID(s string) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil && id >= 0 {
+		return id, nil
+	}
+	if id, ok := m.lookup(s); ok {
+		return id, nil
+	}
+	return 0, fmt.Errorf("no %s '%s' on this system", m.kind, s)
+}
+
+// Add parses an old=new mapping. old is an id or name in the archive, new an id
+// or name here
+func (m *idMap) Add(mapping string) error {
+	old, new, ok := strings.Cut(mapping, "=")
+	old, new = strings.TrimSpace(old), strings.TrimSpace(new)
+	if !ok || old == "" || new == "" {
+		return fmt.Errorf("invalid %s mapping '%s', use old=new", m.kind, mapping)
+	}
+	id, err := m.localID(new)
+	if err != nil {
+		return err
+	}
+	m.mapped[old] = id
+	return nil
+}
+
+// Resolve returns the local id for the archive's id and name. prompt is asked
+// about users and groups that aren't here, it returns "" to keep the archive's id
+func (m *idMap) Resolve(id int, name string, prompt func(m *idMap, id int, name string) string) int {
+	key := fmt.Sprintf("%d:%s", id, name)
+	if local, ok := m.decided[key]; ok {
+		return local
+	}
+	local, ok := m.mapped[strconv.Itoa(id)]
+	if !ok && name != "" {
+		if local, ok = m.mapped[name]; !ok {
+			local, ok = m.lookup(name)
+		}
+	}
+	if !ok {
+		local = id
+		// the id may belong to someone else here when the name doesn't
+		if (name != "" || !m.exists(id)) && prompt != nil {
+			if answer := prompt(m, id, name); answer != "" {
+				local, _ = m.localID(answer)
+			}
+		}
+	}
+	m.decided[key] = local
+	return local
+}
+
+// ownerMap gives restored files their owners, see restore --owners
+type ownerMap struct {
+	Users  *idMap
+	Groups *idMap
+	reader *bufio.Reader
+}
+
+func newOwnerMap() *ownerMap {
+	return &ownerMap{Users: newUserMap(), Groups: newGroupMap()}
+}
+
+// ask prompts for who gets the files of a user or group that doesn't exist here
+func (o *ownerMap) ask(m *idMap, id int, name string) string {
+	if !interactive() {
+		return ""
+	}
+	if o.reader == nil {
+		o.reader = bufio.NewReader(os.Stdin)
+	}
+	who := strconv.Itoa(id)
+	if name != "" {
+		who = fmt.Sprintf("'%s' (%d)", name, id)
+	}
+	for {
+		fmt.Printf("The %s %s of the backup doesn't exist here, restore its files as (name or id, empty keeps %d): ", m.kind, who, id)
+		input, err := o.reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+		if err != nil || input == "" {
+			return ""
+		}
+		if _, err := m.localID(input); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		return input
+	}
+}
+
+// Chown gives the file at path the owner of header, mapped to this system
+func (o *ownerMap) Chown(path string, header *tar.Header) error {
+	// archives made on windows have no owners
+	if header.Uid == 0 && header.Gid == 0 && header.Uname == "" && header.Gname == "" {
+		return nil
+	}
+	uid := o.Users.Resolve(header.Uid, header.Uname, o.ask)
+	gid := o.Groups.Resolve(header.Gid, header.Gname, o.ask)
+	return os.Lchown(path, uid, gid)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// parity files hold Reed-Solomon parity for an archive. the archive is split into
+// DataShards equal shards (the last one padded with zeros) and ParityShards more are
+// computed from them, any DataShards of the shards are enough to rebuild the archive.
+// the shard hashes tell which ones are damaged.
+//
+// layout: the parity shards, then the JSON encoded parityHeader, then its length as
+// a big endian uint64
+type parityHeader struct {
+	Size         int64 `json:"size"`
+	ShardSize    int64 `json:"shard_size"`
+	DataShards   int   `json:"data_shards"`
+	ParityShards int   `json:"parity_shards"`
+	// hex encoded sha256 of every shard, data shards first
+	Hashes []string `json:"hashes"`
+}
+
+const (
+	// more data shards make encoding slower, 64 keeps every shard count in GF(2^8)
+	maxDataShards  = 64
+	minShardSize   = 4096
+	parityChunkLen = 64 * 1024
+)
+
+// parityLayout splits an archive of size into shards, with percent parity
+func parityLayout(size int64, percent int) parityHeader {
+	k := int(min((size+minShardSize-1)/minShardSize, maxDataShards))
+	k = max(k, 1)
+	m := max((k*percent+99)/100, 1)
+	shardSize := max((size+int64(k)-1)/int64(k), 1)
+
+	return parityHeader{Size: size, ShardSize: shardSize, DataShards: k, ParityShards: m}
+}
+
+// writeParity creates the parity file of archive
+func writeParity(archive string, percent int) error {
+	f, err := openArchiveFile(archive, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := parityLayout(f.Size(), percent)
+	data := dataShards(f, header, 0, header.DataShards)
+
+	out, err := os.Create(archive + ".par")
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	parityHashes := hashes(header.ParityShards)
+	err = data.each(func(off int64, chunks [][]byte) error {
+		for i := range header.ParityShards {
+			parity := make([]byte, len(chunks[0]))
+			for j, chunk := range chunks {
+				mulAdd(parity, chunk, encodingCoef(header.DataShards, header.DataShards+i, j))
+			}
+			parityHashes[i].Write(parity)
+			if _, err := out.WriteAt(parity, int64(i)*header.ShardSize+off); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		os.Remove(archive + ".par")
+		return err
+	}
+
+	for _, h := range append(data.hashes, parityHashes...) {
+		header.Hashes = append(header.Hashes, hashString(h))
+	}
+	if err := writeParityHeader(out, header); err != nil {
+		os.Remove(archive + ".par")
+		return err
+	}
+	return nil
+}
+
+func writeParityHeader(out *os.File, header parityHeader) error {
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	encoded = binary.BigEndian.AppendUint64(encoded, uint64(len(encoded)))
+	_, err = out.WriteAt(encoded, int64(header.ParityShards)*header.ShardSize)
+	return err
+}
+
+func readParityHeader(f *os.File) (parityHeader, error) {
+	var header parityHeader
+
+	info, err := f.Stat()
+	if err != nil {
+		return header, err
+	}
+	var length [8]byte
+	if _, err := f.ReadAt(length[:], info.Size()-8); err != nil {
+		return header, fmt.Errorf("parity file is damaged: %w", err)
+	}
+	n := int64(binary.BigEndian.Uint64(length[:]))
+	if n <= 0 || n > info.Size()-8 {
+		return header, errors.New("parity file is damaged")
+	}
+
+	encoded := make([]byte, n)
+	if _, err := f.ReadAt(encoded, info.Size()-8-n); err != nil {
+		return header, err
+	}
+	if err := json.Unmarshal(encoded, &header); err != nil {
+		return header, fmt.Errorf("parity file is damaged: %w", err)
+	}
+	if header.DataShards < 1 || header.ParityShards < 1 || header.DataShards+header.ParityShards > 256 ||
+		len(header.Hashes) != header.DataShards+header.ParityShards {
+		return header, errors.New("parity file is damaged")
+	}
+	return header, nil
+}
+
+// repairArchive rebuilds the damaged parts of archive from its parity file.
+// returns how many shards were rebuilt
+func repairArchive(archive string) (int, error) {
+	par, err := os.OpenFile(archive+".par", os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer par.Close()
+	header, err := readParityHeader(par)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := openArchiveFile(archive, os.O_RDWR)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// find the damaged shards
+	k, m := header.DataShards, header.ParityShards
+	var good, damaged []int
+	for i := range k + m {
+		shard := dataShards(f, header, i, 1)
+		if i >= k {
+			shard = parityShards(par, header, i-k, 1)
+		}
+		if err := shard.each(func(int64, [][]byte) error { return nil }); err != nil {
+			return 0, err
+		}
+
+		if hashString(shard.hashes[0]) == header.Hashes[i] {
+			good = append(good, i)
+		} else {
+			damaged = append(damaged, i)
+		}
+	}
+
+	if len(damaged) == 0 {
+		return 0, f.Truncate(header.Size)
+	}
+	if len(good) < k {
+		return 0, fmt.Errorf("%d of %d blocks are damaged, parity can only rebuild %d", len(damaged), k+m, m)
+	}
+
+	// any k good shards determine the data
+	use := good[:k]
+	matrix := make([][]byte, k)
+	for row, shard := range use {
+		matrix[row] = make([]byte, k)
+		for j := range k {
+			matrix[row][j] = encodingCoef(k, shard, j)
+		}
+	}
+	inverse, err := invertMatrix(matrix)
+	if err != nil {
+		return 0, err
+	}
+
+	var rebuiltData []int
+	for _, shard := range damaged {
+		if shard < k {
+			rebuiltData = append(rebuiltData, shard)
+		}
+	}
+
+	sources := make([]*shardReader, len(use))
+	for t, shard := range use {
+		if shard < k {
+			sources[t] = dataShards(f, header, shard, 1)
+		} else {
+			sources[t] = parityShards(par, header, shard-k, 1)
+		}
+	}
+	rebuiltHashes := hashes(len(rebuiltData))
+	for off := int64(0); off < header.ShardSize; off += parityChunkLen {
+		n := min(parityChunkLen, header.ShardSize-off)
+		chunks := make([][]byte, len(sources))
+		for t, source := range sources {
+			chunks[t] = make([]byte, n)
+			if err := source.readChunk(0, off, chunks[t]); err != nil {
+				return 0, err
+			}
+		}
+		for r, shard := range rebuiltData {
+			out := make([]byte, n)
+			for t, chunk := range chunks {
+				mulAdd(out, chunk, inverse[shard][t])
+			}
+			rebuiltHashes[r].Write(out)
+
+			// the padding of the last shard isn't part of the archive
+			start := int64(shard)*header.ShardSize + off
+			out = out[:max(min(n, header.Size-start), 0)]
+			if _, err := f.WriteAt(out, start); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := f.Truncate(header.Size); err != nil {
+		return 0, err
+	}
+
+	for r, shard := range rebuiltData {
+		if hashString(rebuiltHashes[r]) != header.Hashes[shard] {
+			return 0, fmt.Errorf("block %d doesn't match its hash after rebuilding it", shard)
+		}
+	}
+
+	// damaged parity is simply generated again
+	if len(rebuiltData) < len(damaged) {
+		par.Close()
+		percent := header.ParityShards * 100 / header.DataShards
+		if err := writeParity(archive, max(percent, 1)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(damaged), nil
+}
+
+// shardReader reads count shards of an archive or parity file in chunks, hashing them
+type shardReader struct {
+	r      io.ReaderAt
+	header parityHeader
+	// offset of the first shard
+	first int64
+	count int
+	// only the data shards are limited to Size, past it they're padded with zeros
+	limit  int64
+	hashes []hash.Hash
+}
+
+func dataShards(f io.ReaderAt, header parityHeader, first, count int) *shardReader {
+	return &shardReader{
+		r: f, header: header, first: int64(first) * header.ShardSize,
+		count: count, limit: header.Size, hashes: hashes(count),
+	}
+}
+
+func parityShards(f *os.File, header parityHeader, first, count int) *shardReader {
+	return &shardReader{
+		r: f, header: header, first: int64(first) * header.ShardSize,
+		count: count, limit: int64(header.ParityShards) * header.ShardSize, hashes: hashes(count),
+	}
+}
+
+// readChunk reads len(buf) bytes at off of the shard'th shard
+func (s *shardReader) readChunk(shard int, off int64, buf []byte) error {
+	clear(buf)
+	start := s.first + int64(shard)*s.header.ShardSize + off
+	n := max(min(int64(len(buf)), s.limit-start), 0)
+	// a truncated archive reads as zeros, which fails the hash
+	if _, err := s.r.ReadAt(buf[:n], start); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// each calls fn with the same chunk of every shard, from the start to the end
+func (s *shardReader) each(fn func(off int64, chunks [][]byte) error) error {
+	chunks := make([][]byte, s.count)
+	for i := range chunks {
+		chunks[i] = make([]byte, parityChunkLen)
+	}
+	for off := int64(0); off < s.header.ShardSize; off += parityChunkLen {
+		n := min(parityChunkLen, s.header.ShardSize-off)
+		for i := range chunks {
+			chunks[i] = chunks[i][:n]
+			if err := s.readChunk(i, off, chunks[i]); err != nil {
+				return err
+			}
+			s.hashes[i].Write(chunks[i])
+		}
+		if err := fn(off, chunks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashes(n int) []hash.Hash {
+	hs := make([]hash.Hash, n)
+	for i := range hs {
+		hs[i] = newFileHash()
+	}
+	return hs
+}
+
+// GF(2^8) arithmetic with the polynomial 0x11d, as used by most Reed-Solomon codes
+var (
+	gfExp [510]byte
+	gfLog [256]int
+	// gfMulTable[a][b] = a*b
+	gfMulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := range 255 {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMulTable[a][b] = gfExp[gfLog[a]+gfLog[b]]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// encodingCoef returns the coefficient of data shard j in shard i. data shards are
+// themselves, parity shards are rows of a Cauchy matrix, which keeps every
+// choice of k shards invertible
+func encodingCoef(k, i, j int) byte {
+	if i < k {
+		if i == j {
+			return 1
+		}
+		return 0
+	}
+	return gfInv(byte(i) ^ byte(j))
+}
+
+// mulAdd adds c*src to dst
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	table := &gfMulTable[c]
+	for i, b := range src {
+		dst[i] ^= table[b]
+	}
+}
+
+// invertMatrix inverts a square matrix with Gauss-Jordan elimination
+func invertMatrix(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for i := range matrix {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], matrix[i])
+		work[i][n+i] = 1
+	}
+
+	for col := range n {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("parity matrix is singular")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMulTable[scale][work[col][j]]
+		}
+		for row := range n {
+			if row != col && work[row][col] != 0 {
+				mulAdd(work[row], work[col], work[row][col])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+	return inverse, nil
+}
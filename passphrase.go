@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// the passphrase of the master key never has to be in the config: it's typed in
+// when needed, and with keychain set remembered by the OS keychain after that
+
+var errNoPassphrase = errors.New("no passphrase to unlock the master key")
+
+// keychainService is what backman's keychain entries are stored under
+const keychainService = appName
+
+// keychainAccount tells apart the passphrases of different archive dirs
+func keychainAccount() string {
+	return config.ArchiveDir
+}
+
+// masterSecret returns what unlocks the master key and where it came from:
+// key_file, key_command or BACKMAN_PASSPHRASE, else the passphrase stored in the
+// keychain ("keychain"), else one typed in ("prompt"), twice with confirm
+func masterSecret(confirm bool) ([]byte, string, error) {
+	secret, err := readSecret(config.KeyFile, config.KeyCommand, "BACKMAN_PASSPHRASE")
+	if !errors.Is(err, errNoPassphrase) {
+		return secret, "", err
+	}
+	if config.Keychain {
+		stored, keychainErr := keychainGet(keychainAccount())
+		if keychainErr != nil {
+			fmt.Fprintln(os.Stderr, "WARNING: error reading the keychain: ", keychainErr)
+		} else if stored != nil {
+			return stored, "keychain", nil
+		}
+	}
+	if !interactive() {
+		return nil, "", err
+	}
+	secret, err = promptPassphrase("Passphrase of the master key", confirm)
+	return secret, "prompt", err
+}
+
+// promptPassphrase asks for a passphrase without echoing it, twice with confirm.
+// the prompts go to stderr, restore --stdout may be writing to stdout
+func promptPassphrase(label string, confirm bool) ([]byte, error) {
+	fmt.Fprintf(os.Stderr, "%s: ", label)
+	passphrase, err := readPassword()
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("the passphrase is empty")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat it: ")
+		again, err := readPassword()
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, errors.New("the passphrases don't match")
+		}
+	}
+	return passphrase, nil
+}
+
+// readLine reads a line from stdin without its line ending
+func readLine() ([]byte, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// rememberPassphrase stores a typed in passphrase in the keychain, if keychain is set
+func rememberPassphrase(passphrase []byte) {
+	if !config.Keychain {
+		return
+	}
+	if err := keychainSet(keychainAccount(), passphrase); err != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: error storing the passphrase in the keychain: ", err)
+	}
+}
+
+func keychainCommand(args []string) {
+	if len(args) != 1 {
+		usageError("keychain")
+	}
+
+	switch args[0] {
+	case "store":
+		if !interactive() {
+			fmt.Fprintln(os.Stderr, "storing the passphrase needs someone to type it in, run `keychain store` in a terminal")
+			os.Exit(exitUsage)
+		}
+		passphrase, err := promptPassphrase("Passphrase of the master key", false)
+		if err == nil {
+			// only a passphrase that works is stored
+			_, err = unlockMasterKey(passphrase)
+		}
+		if err == nil {
+			err = keychainSet(keychainAccount(), passphrase)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error storing the passphrase: ", err)
+			os.Exit(exitFatal)
+		}
+		fmt.Println("Stored the passphrase in the keychain")
+		if !config.Keychain {
+			fmt.Println("Set keychain to true to use it")
+		}
+	case "forget":
+		if err := keychainDelete(keychainAccount()); err != nil {
+			fmt.Fprintln(os.Stderr, "error removing the passphrase from the keychain: ", err)
+			os.Exit(exitFatal)
+		}
+		fmt.Println("Removed the passphrase from the keychain")
+	default:
+		usageError("keychain")
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+)
+
+// readPassword reads a line from the terminal with echo turned off
+func readPassword() ([]byte, error) {
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	if err := stty("-echo"); err != nil {
+		return nil, fmt.Errorf("error turning off echo: %w", err)
+	}
+	defer stty("echo")
+
+	// ctrl+c would leave the terminal without echo
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer func() {
+		signal.Stop(interrupt)
+		close(interrupt)
+	}()
+	go func() {
+		if _, ok := <-interrupt; ok {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+			os.Exit(exitFatal)
+		}
+	}()
+
+	return readLine()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var setConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+const enableEchoInput = 0x4
+
+// readPassword reads a line from the console with echo turned off
+func readPassword() ([]byte, error) {
+	console := syscall.Handle(os.Stdin.Fd())
+	var mode uint32
+	if err := syscall.GetConsoleMode(console, &mode); err != nil {
+		return nil, fmt.Errorf("error turning off echo: %w", err)
+	}
+	if ok, _, err := setConsoleMode.Call(uintptr(console), uintptr(mode&^enableEchoInput)); ok == 0 {
+		return nil, fmt.Errorf("error turning off echo: %w", err)
+	}
+	defer setConsoleMode.Call(uintptr(console), uintptr(mode))
+
+	return readLine()
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// lowerPriority makes backman get out of the way of everything else: it runs at
+// the lowest CPU and IO priority the OS allows and uses a quarter of the cores
+func lowerPriority() {
+	runtime.GOMAXPROCS(max(runtime.NumCPU()/4, 1))
+	if err := setLowPriority(); err != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: Couldn't lower the process priority: ", err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build darwin || freebsd
+
+package main
+
+import "syscall"
+
+// setLowPriority sets nice 19, there's no portable way to lower the IO priority
+func setLowPriority() error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, 19)
+}
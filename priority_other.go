@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || windows)
+
+package main
+
+import "errors"
+
+func setLowPriority() error {
+	return errors.New("not supported on this platform")
+}
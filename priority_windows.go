@@ -0,0 +1,19 @@
+package main
+
+import "syscall"
+
+// lowers CPU, IO and memory priority until the process exits
+const processModeBackgroundBegin = 0x00100000
+
+var setPriorityClass = syscall.NewLazyDLL("kernel32.dll").NewProc("SetPriorityClass")
+
+func setLowPriority() error {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	if ok, _, err := setPriorityClass.Call(uintptr(process), processModeBackgroundBegin); ok == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// backups whose sidecar can't be parsed are moved into ArchiveDir/quarantine
+// with a <archive>.report saying why. the archive itself is often fine, so once
+// the sidecar is fixed by hand it can be brought back with `quarantine restore`
+
+func quarantineDir() string {
+	return filepath.Join(config.ArchiveDir, "quarantine")
+}
+
+// quarantined is a backup in the quarantine, named by its archive
+type quarantined struct {
+	Name   string
+	Report string
+	Size   int64
+	Time   time.Time
+}
+
+// quarantineFiles returns the files of the backup with the given archive, the sidecar last
+func quarantineFiles(parent string) []string {
+	return backupFiles(SidecarData{ParentPath: parent})
+}
+
+// quarantineBackup moves the backup of an unparsable sidecar into the quarantine
+func quarantineBackup(parent string, reason error) error {
+	if err := os.MkdirAll(quarantineDir(), 0700); err != nil {
+		return err
+	}
+	name := filepath.Base(parent)
+	report := fmt.Sprintf("quarantined %s\nsidecar %s.json could not be parsed: %v\n", formatTime(time.Now()), name, reason)
+	if err := os.WriteFile(filepath.Join(quarantineDir(), name+".report"), []byte(report), 0600); err != nil {
+		return err
+	}
+
+	// the sidecar goes first, readSidecars deletes sidecars without an archive
+	files := quarantineFiles(parent)
+	slices.Reverse(files)
+	for _, file := range files {
+		if err := os.Rename(file, filepath.Join(quarantineDir(), filepath.Base(file))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readQuarantine returns the backups in the quarantine, the oldest first
+func readQuarantine() ([]quarantined, error) {
+	entries, err := os.ReadDir(quarantineDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []quarantined
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".report" || entry.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".report")
+		report, err := os.ReadFile(filepath.Join(quarantineDir(), entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var modified time.Time
+		if info, err := entry.Info(); err == nil {
+			modified = info.ModTime()
+		}
+		backups = append(backups, quarantined{
+			Name:   name,
+			Report: strings.TrimSpace(string(report)),
+			Size:   archiveSize(filepath.Join(quarantineDir(), name)),
+			Time:   modified,
+		})
+	}
+	slices.SortFunc(backups, func(a, b quarantined) int { return a.Time.Compare(b.Time) })
+	return backups, nil
+}
+
+// matchQuarantined finds a quarantined backup by its archive name or a prefix of it
+func matchQuarantined(backups []quarantined, ref string) (quarantined, error) {
+	var found []quarantined
+	for _, backup := range backups {
+		if backup.Name == ref {
+			return backup, nil
+		}
+		if strings.HasPrefix(backup.Name, ref) {
+			found = append(found, backup)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return quarantined{}, fmt.Errorf("no backup matching '%s' in the quarantine", ref)
+	case 1:
+		return found[0], nil
+	}
+	return quarantined{}, fmt.Errorf("'%s' matches %d backups in the quarantine, give more of the name", ref, len(found))
+}
+
+func listQuarantine() {
+	backups, err := readQuarantine()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the quarantine: ", err)
+		os.Exit(exitFatal)
+	}
+	if len(backups) == 0 {
+		fmt.Println("The quarantine is empty")
+		return
+	}
+
+	for _, backup := range backups {
+		fmt.Printf("%s:\n\t%s | %s\n", backup.Name, filepath.Join(quarantineDir(), backup.Name+".json"), humanize.IBytes(uint64(backup.Size)))
+		for _, line := range strings.Split(backup.Report, "\n") {
+			fmt.Printf("\t%s\n", line)
+		}
+	}
+	fmt.Println("Fix a sidecar and bring its backup back with `quarantine restore [name]`")
+}
+
+// restoreQuarantined moves a backup with a fixed sidecar back into the archive dir
+func restoreQuarantined(ref string) {
+	backups, err := readQuarantine()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the quarantine: ", err)
+		os.Exit(exitFatal)
+	}
+	backup, err := matchQuarantined(backups, ref)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFatal)
+	}
+
+	parent := filepath.Join(quarantineDir(), backup.Name)
+	data, err := os.ReadFile(parent + ".json")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading sidecar: ", err)
+		os.Exit(exitFatal)
+	}
+	sidecar, err := parseSidecar(data, parent)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "The sidecar still can't be parsed, fix '%s' first: %v\n", parent+".json", err)
+		os.Exit(exitFatal)
+	}
+
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+	trashed, err := trashedIDs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the trash: ", err)
+		os.Exit(exitFatal)
+	}
+	if slices.ContainsFunc(sidecars, func(s SidecarData) bool { return s.ID == sidecar.ID }) || slices.Contains(trashed, sidecar.ID) {
+		fmt.Fprintf(os.Stderr, "ID %d is already used by another backup, change \"id\" in '%s'\n", sidecar.ID, parent+".json")
+		os.Exit(exitFatal)
+	}
+
+	// the sidecar goes last, so it always has its archive
+	for _, file := range quarantineFiles(parent) {
+		if err := os.Rename(file, filepath.Join(config.ArchiveDir, filepath.Base(file))); err != nil {
+			fmt.Fprintln(os.Stderr, "error moving backup out of the quarantine: ", err)
+			os.Exit(exitFatal)
+		}
+	}
+	os.Remove(parent + ".report")
+	fmt.Printf("Restored backup %d successfully!\n", sidecar.ID)
+}
+
+// purgeQuarantine deletes one quarantined backup, or all of them
+func purgeQuarantine(ref string, force bool) {
+	backups, err := readQuarantine()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the quarantine: ", err)
+		os.Exit(exitFatal)
+	}
+	if ref != "" {
+		backup, err := matchQuarantined(backups, ref)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitFatal)
+		}
+		backups = []quarantined{backup}
+	}
+	if len(backups) == 0 {
+		fmt.Println("The quarantine is empty")
+		return
+	}
+
+	var size int64
+	for _, backup := range backups {
+		size += backup.Size
+	}
+	fmt.Printf("Deleting %d quarantined backups (%s) for good\n", len(backups), humanize.IBytes(uint64(size)))
+	if !force && !askYesNo(tr("Continue?")) {
+		fmt.Println("Nothing was deleted")
+		return
+	}
+
+	for _, backup := range backups {
+		parent := filepath.Join(quarantineDir(), backup.Name)
+		(&SidecarData{ParentPath: parent}).DeleteAll()
+		os.Remove(parent + ".report")
+	}
+	fmt.Printf("Deleted %d backups for good!\n", len(backups))
+}
+
+func quarantineCommand(args []string) {
+	if len(args) == 0 {
+		usageError("quarantine")
+	}
+
+	switch args[0] {
+	case "list":
+		listQuarantine()
+	case "restore":
+		if len(args) < 2 {
+			usageError("quarantine")
+		}
+		restoreQuarantined(args[1])
+	case "purge":
+		fs := flag.NewFlagSet("quarantine purge", flag.ContinueOnError)
+		force := forceFlag(fs)
+		iKnow := iKnowFlag(fs)
+		rest := parseFlags(fs, args[1:])
+		checkAppendOnly("purge quarantined backups", *iKnow)
+		ref := ""
+		if len(rest) > 0 {
+			ref = rest[0]
+		}
+		purgeQuarantine(ref, *force)
+	default:
+		usageError("quarantine")
+	}
+}
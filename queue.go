@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// backups auto_push couldn't upload, eg. while offline, are queued instead of
+// failing the backup. the archive stays in the archive dir as always, the queue
+// is an empty file named like it in ArchiveDir/.queue. flush uploads them, as do
+// the next successful auto_push and serve every flush_interval
+
+func queueDir() string {
+	return filepath.Join(config.ArchiveDir, ".queue")
+}
+
+// queueUpload adds the backup with the archive at archive to the queue
+func queueUpload(archive string) error {
+	if err := os.MkdirAll(queueDir(), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(queueDir(), filepath.Base(archive)), nil, 0600)
+}
+
+// queuedUploads returns the archive names in the queue, the oldest first
+func queuedUploads() ([]string, error) {
+	entries, err := os.ReadDir(queueDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	type queued struct {
+		name string
+		at   time.Time
+	}
+	var all []queued
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		all = append(all, queued{entry.Name(), info.ModTime()})
+	}
+	slices.SortFunc(all, func(a, b queued) int { return a.at.Compare(b.at) })
+
+	names := make([]string, len(all))
+	for i, q := range all {
+		names[i] = q.name
+	}
+	return names, nil
+}
+
+// flushQueue uploads the queued backups to r, stopping at the first that fails
+// so an unreachable remote isn't tried for every one of them
+func flushQueue(r remote) (uploaded int, err error) {
+	names, err := queuedUploads()
+	if err != nil || len(names) == 0 {
+		return 0, err
+	}
+	sidecars, err := readSidecars()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range names {
+		i := slices.IndexFunc(sidecars, func(s SidecarData) bool { return filepath.Base(s.ParentPath) == name })
+		if i < 0 {
+			fmt.Printf("'%s' was deleted, dropping it from the queue\n", name)
+		} else {
+			fmt.Printf("Uploading queued backup %d...\n", sidecars[i].ID)
+			if err := pushBackup(r, sidecars[i]); err != nil {
+				return uploaded, err
+			}
+			uploaded++
+		}
+		if err := os.Remove(filepath.Join(queueDir(), name)); err != nil {
+			return uploaded, err
+		}
+	}
+	return uploaded, nil
+}
+
+func flushCommand() {
+	names, err := queuedUploads()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the upload queue: ", err)
+		os.Exit(exitFatal)
+	}
+	if len(names) == 0 {
+		fmt.Println("No backups are waiting to be uploaded")
+		return
+	}
+
+	r := openRemoteFatal()
+	uploaded, err := flushQueue(r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error uploading queued backups, %d are still queued: %v\n", len(names)-uploaded, err)
+		os.Exit(exitFatal)
+	}
+	fmt.Printf("Uploaded %d queued backups\n", uploaded)
+}
+
+// flushPeriodically runs flush every flush_interval while the queue isn't empty,
+// for serve. run is how serve runs commands
+func flushPeriodically(run func(args ...string) commandResult) {
+	if !config.AutoPush || config.FlushInterval == "" {
+		return
+	}
+	interval, err := time.ParseDuration(config.FlushInterval)
+	if err != nil || interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		if names, err := queuedUploads(); err != nil || len(names) == 0 {
+			continue
+		}
+		result := run("flush")
+		if !result.OK {
+			fmt.Fprintf(os.Stderr, "WARNING: Uploading queued backups failed, trying again in %s:\n%s\n", interval, result.Output)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// rcloneRemote stores backups anywhere rclone can, by running the rclone binary.
+// it's a remote and not an archive dir: listing, restoring, verifying and the
+// rest read sidecars and seek in archives as local files, which rclone would
+// have to download each time. set archive_dir to a local directory, remote to the
+// rclone path and auto_push to have every backup uploaded
+type rcloneRemote struct {
+	// rclone path, eg. "gdrive:backups"
+	dir string
+}
+
+func newRclone(dir string) (*rcloneRemote, error) {
+	if !strings.Contains(dir, ":") {
+		return nil, fmt.Errorf("rclone path %q is missing the remote name, eg. rclone:gdrive:backups", dir)
+	}
+	if _, err := exec.LookPath("rclone"); err != nil {
+		return nil, err
+	}
+	return &rcloneRemote{dir: dir}, nil
+}
+
+func (r *rcloneRemote) path(name string) string {
+	if strings.HasSuffix(r.dir, ":") || strings.HasSuffix(r.dir, "/") {
+		return r.dir + name
+	}
+	return r.dir + "/" + name
+}
+
+func (r *rcloneRemote) Put(name, localPath string) error {
+	return runQuiet(nil, "rclone", "copyto", localPath, r.path(name))
+}
+
+func (r *rcloneRemote) Get(name, localPath string) error {
+	return runQuiet(nil, "rclone", "copyto", r.path(name), localPath)
+}
+
+func (r *rcloneRemote) List() ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	// one path per line, names can have spaces
+	cmd := exec.Command("rclone", "lsf", "--files-only", "--format", "p", r.dir)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "directory not found") {
+			// nothing was uploaded yet
+			return nil, nil
+		}
+		return nil, fmt.Errorf("rclone: %w\n%s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var names []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if name := strings.TrimRight(line, "\r"); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (r *rcloneRemote) Delete(name string) error {
+	return runQuiet(nil, "rclone", "deletefile", r.path(name))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// backups keep the path they're of, so after a directory is moved or a disk is
+// mounted elsewhere, restore --latest, purge --of and incremental backups can't
+// find them anymore. path_aliases maps the old paths to the new ones whenever
+// backups are matched or shown, see Of, rebind rewrites the sidecars for good
+
+// movePath returns p moved from under old to under new, false if p isn't old or inside it
+func movePath(p, old, new string) (string, bool) {
+	if p == old {
+		return new, true
+	}
+	rest, ok := strings.CutPrefix(p, strings.TrimSuffix(old, string(filepath.Separator))+string(filepath.Separator))
+	if !ok {
+		return p, false
+	}
+	return filepath.Join(new, rest), true
+}
+
+// aliasPath maps p with path_aliases, the longest old path that p is in wins
+func aliasPath(p string) string {
+	var longest string
+	for old := range config.PathAliases {
+		if _, ok := movePath(p, filepath.Clean(old), ""); ok && len(old) > len(longest) {
+			longest = old
+		}
+	}
+	if longest == "" {
+		return p
+	}
+	moved, _ := movePath(p, filepath.Clean(longest), filepath.Clean(config.PathAliases[longest]))
+	return moved
+}
+
+// move moves what the backup is of from under old to under new, false if it isn't in old
+func (s *SidecarData) move(old, new string) bool {
+	of, ok := movePath(s.BackupOf, old, new)
+	if !ok {
+		return false
+	}
+	s.BackupOf = of
+	for i, source := range s.Sources {
+		s.Sources[i], _ = movePath(source, old, new)
+	}
+	return true
+}
+
+// Of returns the path the backup is of, mapped with path_aliases. BackupOf stays
+// as stored, so saving the sidecar for anything else doesn't rebind it
+func (s *SidecarData) Of() string {
+	return aliasPath(s.BackupOf)
+}
+
+// OfSources returns Sources mapped with path_aliases, see Of
+func (s *SidecarData) OfSources() []string {
+	if len(config.PathAliases) == 0 {
+		return s.Sources
+	}
+	sources := make([]string, len(s.Sources))
+	for i, source := range s.Sources {
+		sources[i] = aliasPath(source)
+	}
+	return sources
+}
+
+// matchesTarget reports whether the backup is of target, going by path_aliases
+func (s *SidecarData) matchesTarget(target string) bool {
+	return s.Of() == target
+}
+
+func rebindCommand(args []string) {
+	fs := flag.NewFlagSet("rebind", flag.ContinueOnError)
+	of := fs.String("of", "", "rebind every backup of this path, or of a path inside it")
+	args = parseFlags(fs, args)
+
+	if *of == "" && len(args) != 2 || *of != "" && len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: rebind [id] [new path], or rebind --of [old path] [new path]")
+		os.Exit(exitUsage)
+	}
+	newPath := targetPath(args[len(args)-1])
+	if _, err := os.Stat(newPath); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: '%s' doesn't exist (yet): %v\n", newPath, err)
+	}
+
+	var sidecars []SidecarData
+	var oldPath string
+	if *of == "" {
+		sidecar := findSidecar(args[0])
+		oldPath = sidecar.BackupOf
+		sidecars = []SidecarData{sidecar}
+	} else {
+		oldPath = targetPath(*of)
+		var err error
+		if sidecars, err = readSidecars(); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading sidecar files: %v\n", err)
+			os.Exit(exitFatal)
+		}
+	}
+
+	var moved int
+	for _, sidecar := range sidecars {
+		if !sidecar.move(oldPath, newPath) {
+			continue
+		}
+		if err := sidecar.Save(); err != nil {
+			fmt.Fprintf(os.Stderr, "error updating the sidecar of backup %d: %v\n", sidecar.ID, err)
+			os.Exit(exitFatal)
+		}
+		fmt.Printf("%d: %s\n", sidecar.ID, sidecar.BackupOf)
+		moved++
+	}
+	if moved == 0 {
+		fmt.Printf("No backups of '%s'\n", oldPath)
+		return
+	}
+
+	// new backups of the new path keep using the dictionaries trained on the old one
+	if *of != "" {
+		dicts, err := readDicts()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "WARNING: Could not read zstd dictionaries: ", err)
+		}
+		for _, info := range dicts {
+			var ok bool
+			if info.Of, ok = movePath(info.Of, oldPath, newPath); !ok {
+				continue
+			}
+			meta, err := json.Marshal(info)
+			if err == nil {
+				err = writeFileAtomic(strings.TrimSuffix(dictPath(info.ID), ".dict")+".json", meta, 0600)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: Could not update zstd dictionary %d: %v\n", info.ID, err)
+			}
+		}
+	}
+	fmt.Printf("Rebound %d backups from '%s' to '%s'\n", moved, oldPath, newPath)
+}
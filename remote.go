@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// remote is offsite storage holding copies of backups.
+// the archive dir stays the local catalog, remotes store the same files under the same names
+type remote interface {
+	// Put uploads the local file at path as name
+	Put(name, path string) error
+	// Get downloads name into a new local file at path
+	Get(name, path string) error
+	// List returns the names of every file on the remote
+	List() ([]string, error)
+	Delete(name string) error
+}
+
+// remotes that need interactive authentication before use
+type loginRemote interface {
+	Login() error
+}
+
+// remotes that can keep files from being deleted or overwritten until a time
+type lockRemote interface {
+	Lock(name string, until time.Time) error
+}
+
+// openRemote parses a remote spec, eg. "dropbox:/backups", "rclone:gdrive:backups",
+// "s3:mybucket/backups", an absolute path of a local directory or "<kind>:..." for
+// an external backend, see backend.go
+func openRemote(spec string) (remote, error) {
+	if filepath.IsAbs(spec) {
+		return newDirRemote(spec)
+	}
+
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "":
+		return nil, errors.New("no remote configured, set the remote config key")
+	case "dropbox":
+		return newDropbox(arg)
+	case "rclone":
+		return newRclone(arg)
+	case "s3":
+		return newS3(arg)
+	default:
+		return openBackendRemote(kind, arg)
+	}
+}
+
+func openRemoteFatal() remote {
+	r, err := openRemote(config.Remote)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error opening remote: ", err)
+		os.Exit(exitFatal)
+	}
+	return r
+}
+
+// backupFiles returns the local files that make up a backup, sidecar last
+func backupFiles(sidecar SidecarData) []string {
+	files := archiveVolumes(sidecar.ParentPath)
+	for _, extra := range []string{sidecar.ManifestPath(), sidecar.IndexPath(), sidecar.SignaturePath(), sidecar.ParityPath()} {
+		if _, err := os.Stat(extra); err == nil {
+			files = append(files, extra)
+		}
+	}
+	return append(files, sidecar.ParentPath+".json")
+}
+
+// pushBackup uploads a backup's files to r, and locks them if object_lock is set
+// and r supports it
+func pushBackup(r remote, sidecar SidecarData) error {
+	locker, _ := r.(lockRemote)
+	var until time.Time
+	if config.ObjectLock != "" && locker != nil {
+		var err error
+		if until, err = lockUntil(sidecar.Time); err != nil {
+			return err
+		}
+	}
+
+	// restoring from the remote alone needs the master key too
+	if sidecar.Encrypted {
+		if err := r.Put(keyFileName, keyFilePath()); err != nil {
+			return fmt.Errorf("error uploading %s: %w", keyFileName, err)
+		}
+	}
+
+	// the sidecar goes last, so a remote sidecar always has its archive
+	for _, file := range backupFiles(sidecar) {
+		if err := r.Put(filepath.Base(file), file); err != nil {
+			return fmt.Errorf("error uploading '%s': %w", filepath.Base(file), err)
+		}
+		// backups older than object_lock aren't locked anymore
+		if until.After(time.Now()) {
+			if err := locker.Lock(filepath.Base(file), until); err != nil {
+				return fmt.Errorf("error locking '%s': %w", filepath.Base(file), err)
+			}
+		}
+	}
+	return nil
+}
+
+// lockUntil is when the object lock of a backup made at made expires, object_lock
+// after it was made
+func lockUntil(made time.Time) (time.Time, error) {
+	if made.IsZero() {
+		made = time.Now()
+	}
+	ago, err := timeAgo(config.ObjectLock, made)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return made.Add(made.Sub(ago)), nil
+}
+
+func pushCommand(ref string) {
+	sidecar := findSidecar(ref)
+	r := openRemoteFatal()
+
+	fmt.Printf("Uploading backup %d (%s)...\n", sidecar.ID, humanize.IBytes(uint64(sidecar.ParentSize)))
+	if err := pushBackup(r, sidecar); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFatal)
+	}
+	fmt.Println("Uploaded successfully!")
+}
+
+// remoteSidecars downloads and parses every sidecar on the remote
+func remoteSidecars(r remote) ([]SidecarData, error) {
+	names, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.MkdirTemp("", "backman-remote-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	var sidecars []SidecarData
+	for _, name := range names {
+		if filepath.Ext(name) != ".json" {
+			continue
+		}
+
+		local := filepath.Join(tmp, name)
+		if err := r.Get(name, local); err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(local)
+		if err != nil {
+			return nil, err
+		}
+
+		// remote sidecars have no local archive, ParentPath is the remote name instead
+		sidecar, err := parseSidecar(data, strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Error parsing remote sidecar file. (%s)\n", name)
+			continue
+		}
+		sidecars = append(sidecars, sidecar)
+	}
+
+	sort.Slice(sidecars, func(i, j int) bool {
+		return sidecars[i].Time.Before(sidecars[j].Time)
+	})
+	return sidecars, nil
+}
+
+func listRemote() {
+	r := openRemoteFatal()
+	sidecars, err := remoteSidecars(r)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error listing remote: ", err)
+		os.Exit(exitFatal)
+	}
+
+	for _, sidecar := range sidecars {
+		fmt.Printf("%s:\n\t%s\n\t%s\n",
+			sidecar.ParentPath,
+			sidecar.BackupOf,
+			formatTime(sidecar.Time),
+		)
+	}
+}
+
+// pullBackup downloads the remote backup with the given archive name and imports it
+func pullBackup(name string) {
+	r := openRemoteFatal()
+
+	names, err := r.List()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error listing remote: ", err)
+		os.Exit(exitFatal)
+	}
+
+	tmp, err := os.MkdirTemp("", "backman-pull-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error creating temporary directory: ", err)
+		os.Exit(exitFatal)
+	}
+	defer os.RemoveAll(tmp)
+
+	var found bool
+	for _, remoteName := range names {
+		if remoteName != name && !strings.HasPrefix(remoteName, name+".") {
+			continue
+		}
+		found = found || remoteName == name || remoteName == volumePath(name, 1)
+
+		fmt.Printf("Downloading '%s'...\n", remoteName)
+		if err := r.Get(remoteName, filepath.Join(tmp, remoteName)); err != nil {
+			fmt.Fprintf(os.Stderr, "error downloading '%s': %v\n", remoteName, err)
+			os.RemoveAll(tmp)
+			os.Exit(exitFatal)
+		}
+	}
+
+	if !found {
+		fmt.Fprintf(os.Stderr, "'%s' not found on the remote, use `remote list` to get names\n", name)
+		os.RemoveAll(tmp)
+		os.Exit(exitFatal)
+	}
+
+	if err := os.MkdirAll(config.ArchiveDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "error creating backup directory: ", err)
+		os.RemoveAll(tmp)
+		os.Exit(exitFatal)
+	}
+
+	if _, err := os.Stat(keyFilePath()); errors.Is(err, os.ErrNotExist) && slices.Contains(names, keyFileName) {
+		fmt.Printf("Downloading '%s'...\n", keyFileName)
+		if err := r.Get(keyFileName, keyFilePath()); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: error downloading %s, encrypted backups can't be restored without it: %v\n", keyFileName, err)
+		}
+	}
+
+	sidecar, err := importBackup(filepath.Join(tmp, name), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error importing backup: ", err)
+		os.RemoveAll(tmp)
+		os.Exit(exitFatal)
+	}
+	fmt.Printf("Pulled '%s' as %d\n", name, sidecar.ID)
+}
+
+func remoteCommand(args []string) {
+	if len(args) == 0 {
+		usageError("remote")
+	}
+
+	switch args[0] {
+	case "list":
+		listRemote()
+	case "login":
+		r := openRemoteFatal()
+		if l, ok := r.(loginRemote); ok {
+			if err := l.Login(); err != nil {
+				fmt.Fprintln(os.Stderr, "error logging in: ", err)
+				os.Exit(exitFatal)
+			}
+			fmt.Println("Logged in successfully!")
+		} else {
+			fmt.Println("This remote doesn't need a login")
+		}
+	default:
+		usageError("remote")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// report summarizes the run log per target: how big the archives and the backed
+// up data were over time and how long backups took, to spot runaway growth
+
+// growthWarning is how much bigger the newest backup of a target can be than the
+// median of its earlier ones before report points it out
+const growthWarning = 2.0
+
+// reportOptions select the runs report looks at
+type reportOptions struct {
+	// only runs of this target, empty for all
+	Target string
+	Range  timeRange
+	CSV    bool
+}
+
+// reportRuns returns the selected runs grouped by target, oldest first
+func reportRuns(opts reportOptions) (map[string][]runRecord, error) {
+	runs, err := readRuns()
+	if err != nil {
+		return nil, err
+	}
+	byTarget := make(map[string][]runRecord)
+	for _, run := range runs {
+		if opts.Target != "" && run.Target != opts.Target {
+			continue
+		}
+		if !opts.Range.Contains(run.Time) {
+			continue
+		}
+		byTarget[run.Target] = append(byTarget[run.Target], run)
+	}
+	for _, runs := range byTarget {
+		slices.SortFunc(runs, func(a, b runRecord) int { return a.Time.Compare(b.Time) })
+	}
+	return byTarget, nil
+}
+
+// writeReportCSV writes one line per run
+func writeReportCSV(byTarget map[string][]runRecord) error {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"target", "time", "id", "duration_seconds", "archive_bytes", "original_bytes", "files", "unchanged", "error"})
+	for _, target := range slices.Sorted(maps.Keys(byTarget)) {
+		for _, run := range byTarget[target] {
+			// failed runs and older logs have no ID
+			id := ""
+			if run.ID != 0 {
+				id = strconv.Itoa(int(run.ID))
+			}
+			w.Write([]string{
+				run.Target,
+				run.Time.Format(time.RFC3339),
+				id,
+				strconv.FormatFloat(run.Duration, 'f', 3, 64),
+				strconv.FormatInt(run.Bytes, 10),
+				strconv.FormatInt(run.Original, 10),
+				strconv.Itoa(run.Files),
+				strconv.FormatBool(run.Unchanged),
+				run.Error,
+			})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// printReport prints a table of the runs of every target and how its backups grew
+func printReport(byTarget map[string][]runRecord) {
+	for i, target := range slices.Sorted(maps.Keys(byTarget)) {
+		runs := byTarget[target]
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s:\n", target)
+		fmt.Printf("\t%-19s %10s %10s %10s %8s  %s\n", "time", "duration", "archive", "original", "files", "result")
+
+		var written []runRecord
+		var failures int
+		var total time.Duration
+		for _, run := range runs {
+			duration := time.Duration(run.Duration * float64(time.Second))
+			total += duration
+
+			result := "ok"
+			switch {
+			case run.Error != "":
+				result = "failed: " + run.Error
+				failures++
+			case run.Unchanged:
+				result = fmt.Sprintf("unchanged, kept %d", run.ID)
+			default:
+				written = append(written, run)
+				if run.ID != 0 {
+					result = fmt.Sprintf("backup %d", run.ID)
+				}
+			}
+			original, files := "-", "-"
+			if run.Files > 0 {
+				original = humanize.IBytes(uint64(run.Original))
+				files = strconv.Itoa(run.Files)
+			}
+			fmt.Printf("\t%-19s %10s %10s %10s %8s  %s\n",
+				inZone(run.Time).Format("2006-01-02 15:04:05"),
+				duration.Round(time.Millisecond),
+				humanize.IBytes(uint64(run.Bytes)),
+				original,
+				files,
+				result,
+			)
+		}
+
+		fmt.Printf("\t%d runs, %d failed, %s on average\n", len(runs), failures, (total / time.Duration(len(runs))).Round(time.Millisecond))
+		if len(written) < 2 {
+			continue
+		}
+		first, last := written[0], written[len(written)-1]
+		fmt.Printf("\tarchives went from %s to %s", humanize.IBytes(uint64(first.Bytes)), humanize.IBytes(uint64(last.Bytes)))
+		if days := last.Time.Sub(first.Time).Hours() / 24; days >= 1 {
+			fmt.Printf(", %s per day", signedBytes(float64(last.Bytes-first.Bytes)/days))
+		}
+		fmt.Println()
+		if first.Files > 0 && last.Files > 0 {
+			fmt.Printf("\tbacked up data went from %s in %d files to %s in %d files\n",
+				humanize.IBytes(uint64(first.Original)), first.Files, humanize.IBytes(uint64(last.Original)), last.Files)
+		}
+
+		// the median isn't thrown off by a few small incremental backups
+		var sizes []int64
+		for _, run := range written[:len(written)-1] {
+			sizes = append(sizes, run.Bytes)
+		}
+		slices.Sort(sizes)
+		if median := sizes[len(sizes)/2]; median > 0 && float64(last.Bytes) > growthWarning*float64(median) {
+			fmt.Fprintf(os.Stderr, "WARNING: The newest backup of '%s' is %.1fx the usual size (%s), check what's new in it\n",
+				target, float64(last.Bytes)/float64(median), humanize.IBytes(uint64(median)))
+		}
+	}
+}
+
+// signedBytes formats a size difference with its sign
+func signedBytes(n float64) string {
+	if n < 0 {
+		return "-" + humanize.IBytes(uint64(-n))
+	}
+	return "+" + humanize.IBytes(uint64(n))
+}
+
+func reportCommand(args []string) {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	of := fs.String("of", "", "only report on backups of this directory")
+	since := fs.String("since", "", "only runs since this date or duration ago")
+	until := fs.String("until", "", "only runs before this date or duration ago")
+	asCSV := fs.Bool("csv", false, "print every run as CSV instead")
+	parseFlags(fs, args)
+
+	window, err := parseTimeRange(*since, *until)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid time range: ", err)
+		os.Exit(exitUsage)
+	}
+	opts := reportOptions{Range: window, CSV: *asCSV}
+	if *of != "" {
+		opts.Target = targetPath(*of)
+	}
+
+	byTarget, err := reportRuns(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the run log: ", err)
+		os.Exit(exitFatal)
+	}
+	if opts.CSV {
+		if err := writeReportCSV(byTarget); err != nil {
+			fmt.Fprintln(os.Stderr, "error writing report: ", err)
+			os.Exit(exitFatal)
+		}
+		return
+	}
+	if len(byTarget) == 0 {
+		fmt.Println("No backup runs recorded yet")
+		return
+	}
+	printReport(byTarget)
+}
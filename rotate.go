@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// rekey --rotate replaces the master key itself, for when what unlocked it leaked
+// along with a copy of backman.key. the new key is saved first with the old one
+// sealed inside it (keyFile.Retired), so archives open with either while the data
+// key in the header of every encrypted file is rewrapped. then the backups on the
+// remote and the mirror are uploaded again, and only once all of that worked is
+// the old key forgotten. an interrupted rotation continues where it stopped
+
+// encryptedFiles returns the files under dir whose data key is wrapped by the
+// master key with id: archives or their first volume, manifests and indexes,
+// also the ones in the trash and the quarantine
+func encryptedFiles(dir string, id []byte) ([]string, error) {
+	var paths []string
+	want := append([]byte(encryptMagic), id...)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		prefix := make([]byte, len(want))
+		if _, err := f.ReadAt(prefix, 0); err == nil && bytes.Equal(prefix, want) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// rewrapHeader rewraps the data key in the header of the encrypted file at path
+// from the master key from to to. the rest of the file stays as it is
+func rewrapHeader(path string, from, to *masterKey) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, encryptHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return errors.New("the encrypted data is truncated")
+	}
+	prefix := header[:len(encryptMagic)+keyIDSize]
+	if !bytes.Equal(prefix[len(encryptMagic):], from.id) {
+		return fmt.Errorf("encrypted with the master key %x, not %x", prefix[len(encryptMagic):], from.id)
+	}
+	dataKey, err := unseal(from.key, header[len(prefix):], prefix)
+	if err != nil {
+		return errors.New("the header of the encrypted data is damaged")
+	}
+
+	newPrefix := append([]byte(encryptMagic), to.id...)
+	wrapped, err := seal(to.key, dataKey, newPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(append(newPrefix, wrapped...), 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// repushBackups uploads the encrypted backups the remote and the mirror have
+// again, so their copies get the rewrapped headers too. false if one failed
+func repushBackups() bool {
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		return false
+	}
+
+	ok := true
+	for _, spec := range []string{config.Remote, config.Mirror} {
+		if spec == "" {
+			continue
+		}
+		r, err := openRemote(spec)
+		var names []string
+		if err == nil {
+			names, err = r.List()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error listing %s: %v\n", spec, err)
+			ok = false
+			continue
+		}
+
+		for _, sidecar := range sidecars {
+			if !sidecar.Encrypted || !slices.Contains(names, filepath.Base(sidecar.ParentPath)+".json") {
+				continue
+			}
+			fmt.Printf("Uploading backup %d to %s again...\n", sidecar.ID, spec)
+			if err := pushBackup(r, sidecar); err != nil {
+				fmt.Fprintf(os.Stderr, "error uploading backup %d to %s: %v\n", sidecar.ID, spec, err)
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// rotateMasterKey rewraps every encrypted file from master.retired to master,
+// uploads the backups again and then drops the retired key from k. false if
+// something is left, running it again continues
+func rotateMasterKey(k *keyFile, master *masterKey) bool {
+	paths, err := encryptedFiles(config.ArchiveDir, master.retired.id)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error looking for encrypted files: ", err)
+		return false
+	}
+
+	fmt.Printf("Rewrapping the data keys of %d files...\n", len(paths))
+	var failed int
+	for i, path := range paths {
+		name, _ := filepath.Rel(config.ArchiveDir, path)
+		if err := rewrapHeader(path, master.retired, master); err != nil {
+			fmt.Fprintf(os.Stderr, "error rewrapping '%s': %v\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("[%d/%d] %s\n", i+1, len(paths), name)
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d files still need the old master key, run `rekey --rotate` again to finish\n", failed)
+		return false
+	}
+
+	if !repushBackups() {
+		fmt.Fprintln(os.Stderr, "The copies on the remote or the mirror still open with the old master key, run `rekey --rotate` again to finish")
+		return false
+	}
+
+	master.retired = nil
+	k.Retired = nil
+	if err := k.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing %s: %v\n", keyFileName, err)
+		return false
+	}
+	return true
+}
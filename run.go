@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// run --profile <name> runs what a profile in the profiles config key describes
+// as one unit: the before hook, the backup, verifying it, pruning older backups,
+// syncing the mirror, the after hook and notify, then prints how each step went.
+// a step that fails skips the rest, except the after hook once the before hook
+// ran and notify. prune only runs once there's a new backup that checked out,
+// so a broken run never deletes the backups that are still good
+
+// profile is one entry of the profiles config key
+type profile struct {
+	// what's backed up, as with backup
+	Paths       []string `json:"paths"`
+	Incremental bool     `json:"incremental,omitempty"`
+	// commands, split on spaces, run before the backup and after the rest, eg. to
+	// stop and start a service
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+	// read the new backup back and check it against its manifest
+	Verify bool `json:"verify,omitempty"`
+	// purge backups of the same paths older than this, eg. "90d", empty to keep them
+	Prune string `json:"prune,omitempty"`
+	// sync the mirror config key
+	Mirror bool `json:"mirror,omitempty"`
+	// command, split on spaces, that gets the summary on stdin and
+	// BACKMAN_RUN_STATUS set to "ok", "partial" or "failed"
+	Notify string `json:"notify,omitempty"`
+}
+
+// step results, as printed in the summary
+const (
+	stepOK      = "ok"
+	stepPartial = "partial"
+	stepFailed  = "failed"
+	stepSkipped = "skipped"
+)
+
+type stepResult struct {
+	Name     string
+	Status   string
+	Detail   string
+	Duration time.Duration
+}
+
+// pipeline runs the steps of a profile and keeps track of how they went
+type pipeline struct {
+	exe     string
+	results []stepResult
+	failed  bool
+}
+
+// step runs fn as the step name unless an earlier one failed. fn returns what to
+// show next to the result and an error if the step failed
+func (p *pipeline) step(name string, fn func() (string, error)) bool {
+	if p.failed {
+		p.results = append(p.results, stepResult{Name: name, Status: stepSkipped})
+		return false
+	}
+	return p.always(name, fn)
+}
+
+// always runs fn as the step name even if an earlier one failed
+func (p *pipeline) always(name string, fn func() (string, error)) bool {
+	fmt.Printf("\n==> %s\n", name)
+	start := time.Now()
+	detail, err := fn()
+	result := stepResult{Name: name, Status: stepOK, Detail: detail, Duration: time.Since(start)}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == exitPartial:
+		result.Status = stepPartial
+	default:
+		result.Status = stepFailed
+		if result.Detail == "" {
+			result.Detail = err.Error()
+		}
+		p.failed = true
+	}
+	p.results = append(p.results, result)
+	return result.Status != stepFailed
+}
+
+// backman runs a backman command with the config as loaded, showing its output
+func (p *pipeline) backman(args ...string) error {
+	cmd := exec.Command(p.exe, args...)
+	cmd.Env = append(os.Environ(), configEnv()...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// Status returns "ok", "partial" or "failed" for the whole run
+func (p *pipeline) Status() string {
+	if p.failed {
+		return stepFailed
+	}
+	for _, result := range p.results {
+		if result.Status == stepPartial {
+			return stepPartial
+		}
+	}
+	return stepOK
+}
+
+// Summary returns a line per step
+func (p *pipeline) Summary(name string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Profile '%s': %s\n", name, p.Status())
+	for _, result := range p.results {
+		line := fmt.Sprintf("\t%-8s %-8s", result.Name, result.Status)
+		if result.Status != stepSkipped {
+			line += fmt.Sprintf(" %6s", result.Duration.Round(time.Second))
+		}
+		if result.Detail != "" {
+			line += "  " + result.Detail
+		}
+		b.WriteString(strings.TrimRight(line, " ") + "\n")
+	}
+	return b.String()
+}
+
+// hookCommand splits a hook or notify command on spaces
+func hookCommand(command string) (*exec.Cmd, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("command %q is empty", command)
+	}
+	cmd := exec.Command(fields[0], fields[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd, nil
+}
+
+// runHook runs a hook command, split on spaces
+func runHook(command string) error {
+	cmd, err := hookCommand(command)
+	if err != nil {
+		return err
+	}
+	return cmd.Run()
+}
+
+// newBackups returns the backups in after that aren't in before
+func newBackups(before, after []SidecarData) []SidecarData {
+	var added []SidecarData
+	for _, sidecar := range after {
+		if !slices.ContainsFunc(before, func(s SidecarData) bool { return s.ParentPath == sidecar.ParentPath }) {
+			added = append(added, sidecar)
+		}
+	}
+	return added
+}
+
+func runCommand(args []string) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	name := fs.String("profile", "", "the profile to run")
+	parseFlags(fs, args)
+
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "run needs a --profile, one of the profiles config key")
+		os.Exit(exitUsage)
+	}
+	prof, ok := config.Profiles[*name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "No profile named '%s' in the config\n", *name)
+		os.Exit(exitUsage)
+	}
+	if prof.Mirror && config.Mirror == "" {
+		fmt.Fprintf(os.Stderr, "Profile '%s' syncs the mirror, but no mirror is configured\n", *name)
+		os.Exit(exitUsage)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error finding the backman executable: ", err)
+		os.Exit(exitFatal)
+	}
+	p := &pipeline{exe: exe}
+
+	// the after hook undoes what the before hook did, so it runs if that did
+	runAfter := true
+	if prof.Before != "" {
+		runAfter = p.step("before", func() (string, error) { return "", runHook(prof.Before) })
+	}
+
+	var added []SidecarData
+	p.step("backup", func() (string, error) {
+		before, err := readSidecars()
+		if err != nil {
+			return "", err
+		}
+		args := []string{"backup"}
+		if prof.Incremental {
+			args = append(args, "--incremental")
+		}
+		runErr := p.backman(append(args, prof.Paths...)...)
+
+		after, err := readSidecars()
+		if err != nil {
+			return "", err
+		}
+		added = newBackups(before, after)
+		var ids []string
+		for _, sidecar := range added {
+			ids = append(ids, fmt.Sprint(sidecar.ID))
+		}
+		if len(ids) == 0 {
+			return "no new backup", runErr
+		}
+		return "backup " + strings.Join(ids, ", "), runErr
+	})
+
+	if prof.Verify {
+		p.step("verify", func() (string, error) {
+			for _, sidecar := range added {
+				if err := p.backman("verify", fmt.Sprint(sidecar.ID)); err != nil {
+					return fmt.Sprintf("backup %d didn't check out", sidecar.ID), err
+				}
+			}
+			return "", nil
+		})
+	}
+
+	if prof.Prune != "" {
+		p.step("prune", func() (string, error) {
+			if len(added) == 0 {
+				return "nothing new, kept the older backups", nil
+			}
+			var targets []string
+			for _, sidecar := range added {
+				if !slices.Contains(targets, sidecar.Of()) {
+					targets = append(targets, sidecar.Of())
+				}
+			}
+			for _, target := range targets {
+				if err := p.backman("purge", prof.Prune, "--of", target, "--force"); err != nil {
+					return "", err
+				}
+			}
+			return "older than " + prof.Prune, nil
+		})
+	}
+
+	if prof.Mirror {
+		p.step("mirror", func() (string, error) { return "", p.backman("sync") })
+	}
+
+	if runAfter && prof.After != "" {
+		p.always("after", func() (string, error) { return "", runHook(prof.After) })
+	}
+
+	summary := p.Summary(*name)
+	if prof.Notify != "" {
+		// notify isn't part of the summary it's sent
+		cmd, err := hookCommand(prof.Notify)
+		if err == nil {
+			cmd.Env = append(os.Environ(), "BACKMAN_RUN_STATUS="+p.Status(), "BACKMAN_PROFILE="+*name)
+			cmd.Stdin = strings.NewReader(summary)
+			err = cmd.Run()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "WARNING: Could not notify: ", err)
+		}
+	}
+
+	fmt.Print("\n" + summary)
+	switch p.Status() {
+	case stepFailed:
+		exitCode = exitFatal
+	case stepPartial:
+		exitCode = exitPartial
+	}
+}
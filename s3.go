@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// s3Remote stores backups in an S3 bucket by running the aws cli, which is
+// configured the usual way, eg. with AWS_PROFILE or AWS_ENDPOINT_URL for
+// other providers
+type s3Remote struct {
+	bucket string
+	// key prefix, empty or ending in a slash
+	prefix string
+}
+
+func newS3(spec string) (*s3Remote, error) {
+	bucket, prefix, _ := strings.Cut(strings.Trim(spec, "/"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 path %q is missing the bucket, eg. s3:mybucket/backups", spec)
+	}
+	if _, err := exec.LookPath("aws"); err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Remote{bucket: bucket, prefix: prefix}, nil
+}
+
+func (r *s3Remote) url(name string) string {
+	return "s3://" + r.bucket + "/" + r.prefix + name
+}
+
+func (r *s3Remote) Put(name, localPath string) error {
+	return runQuiet(nil, "aws", "s3", "cp", "--only-show-errors", localPath, r.url(name))
+}
+
+func (r *s3Remote) Get(name, localPath string) error {
+	return runQuiet(nil, "aws", "s3", "cp", "--only-show-errors", r.url(name), localPath)
+}
+
+func (r *s3Remote) List() ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("aws", "s3api", "list-objects-v2",
+		"--bucket", r.bucket,
+		"--prefix", r.prefix,
+		"--query", "Contents[].Key",
+		"--output", "text",
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("aws: %w\n%s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var names []string
+	for _, key := range strings.Fields(stdout.String()) {
+		name := strings.TrimPrefix(key, r.prefix)
+		// "None" is how an empty prefix is printed
+		if key == "None" || name == "" || strings.Contains(name, "/") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (r *s3Remote) Delete(name string) error {
+	return runQuiet(nil, "aws", "s3", "rm", "--only-show-errors", r.url(name))
+}
+
+// Lock sets the object lock retention of name, which needs a bucket created with
+// object lock enabled
+func (r *s3Remote) Lock(name string, until time.Time) error {
+	retention := fmt.Sprintf("Mode=%s,RetainUntilDate=%s", strings.ToUpper(config.ObjectLockMode), until.UTC().Format(time.RFC3339))
+	return runQuiet(nil, "aws", "s3api", "put-object-retention",
+		"--bucket", r.bucket,
+		"--key", r.prefix+name,
+		"--retention", retention,
+	)
+}
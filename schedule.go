@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// install-schedule hands scheduling to the OS instead of a daemon: a user
+// systemd timer on linux, a launchd agent on macos and a scheduled task on windows.
+// each schedule runs `backman backup` with the paths it was installed with
+
+type schedule struct {
+	// used in the unit, agent or task name
+	Name string
+	// time of day, "15:04"
+	At time.Time
+	// the command to run, the executable first
+	Command []string
+}
+
+// scheduleName makes a name usable in file and task names out of a path
+func scheduleName(path string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, filepath.Base(path))
+	return strings.Trim(name, "-")
+}
+
+// systemdQuote quotes an ExecStart argument, where % and $ are expanded too
+func systemdQuote(arg string) string {
+	arg = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$").Replace(arg)
+	return `"` + arg + `"`
+}
+
+func systemdUnitDir() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "systemd", "user"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".config", "systemd", "user"), nil
+}
+
+// systemdUnits returns the service and timer unit files of s
+func (s schedule) systemdUnits() (service, timer string) {
+	var args []string
+	for _, arg := range s.Command {
+		args = append(args, systemdQuote(arg))
+	}
+	service = fmt.Sprintf(`[Unit]
+Description=backman backup (%s)
+
+[Service]
+Type=oneshot
+ExecStart=%s
+Nice=10
+`, s.Name, strings.Join(args, " "))
+
+	timer = fmt.Sprintf(`[Unit]
+Description=Daily backman backup (%s)
+
+[Timer]
+OnCalendar=*-*-* %s:00
+# runs at the next boot if the machine was off at that time
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`, s.Name, s.At.Format("15:04"))
+	return service, timer
+}
+
+func launchdAgentPath(label string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", label+".plist"), nil
+}
+
+// launchdPlist returns the agent running s
+func (s schedule) launchdPlist(label string) string {
+	escape := func(text string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(text))
+		return b.String()
+	}
+
+	var args strings.Builder
+	for _, arg := range s.Command {
+		fmt.Fprintf(&args, "\t\t<string>%s</string>\n", escape(arg))
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+%s	</array>
+	<key>StartCalendarInterval</key>
+	<dict>
+		<key>Hour</key>
+		<integer>%d</integer>
+		<key>Minute</key>
+		<integer>%d</integer>
+	</dict>
+	<key>LowPriorityIO</key>
+	<true/>
+</dict>
+</plist>
+`, escape(label), args.String(), s.At.Hour(), s.At.Minute())
+}
+
+// windowsCommand joins the command for schtasks /TR
+func (s schedule) windowsCommand() string {
+	var args []string
+	for _, arg := range s.Command {
+		if strings.ContainsAny(arg, " \t") {
+			arg = `"` + arg + `"`
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// runTool runs an OS tool, showing its output
+func runTool(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// install writes and enables the OS schedule. with dryRun the files are only printed
+func (s schedule) install(dryRun bool) error {
+	switch runtime.GOOS {
+	case "linux":
+		dir, err := systemdUnitDir()
+		if err != nil {
+			return err
+		}
+		service, timer := s.systemdUnits()
+		unit := "backman-" + s.Name
+		if dryRun {
+			fmt.Printf("# %s\n%s\n# %s\n%s", filepath.Join(dir, unit+".service"), service, filepath.Join(dir, unit+".timer"), timer)
+			return nil
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, unit+".service"), []byte(service), 0644); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, unit+".timer"), []byte(timer), 0644); err != nil {
+			return err
+		}
+		if err := runTool("systemctl", "--user", "daemon-reload"); err != nil {
+			return err
+		}
+		return runTool("systemctl", "--user", "enable", "--now", unit+".timer")
+
+	case "darwin":
+		label := "com.backman." + s.Name
+		path, err := launchdAgentPath(label)
+		if err != nil {
+			return err
+		}
+		plist := s.launchdPlist(label)
+		if dryRun {
+			fmt.Printf("# %s\n%s", path, plist)
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(plist), 0644); err != nil {
+			return err
+		}
+		// replace an agent that's already loaded
+		exec.Command("launchctl", "unload", path).Run()
+		return runTool("launchctl", "load", "-w", path)
+
+	case "windows":
+		args := []string{"/Create", "/F", "/TN", "backman-" + s.Name, "/SC", "DAILY", "/ST", s.At.Format("15:04"), "/TR", s.windowsCommand()}
+		if dryRun {
+			fmt.Println("schtasks " + strings.Join(args, " "))
+			return nil
+		}
+		return runTool("schtasks", args...)
+	}
+	return fmt.Errorf("scheduling isn't supported on %s, use cron or similar to run `%s`", runtime.GOOS, strings.Join(s.Command, " "))
+}
+
+// uninstallSchedule disables and removes the OS schedule called name
+func uninstallSchedule(name string) error {
+	switch runtime.GOOS {
+	case "linux":
+		dir, err := systemdUnitDir()
+		if err != nil {
+			return err
+		}
+		unit := "backman-" + name
+		if _, err := os.Stat(filepath.Join(dir, unit+".timer")); err != nil {
+			return err
+		}
+		if err := runTool("systemctl", "--user", "disable", "--now", unit+".timer"); err != nil {
+			return err
+		}
+		os.Remove(filepath.Join(dir, unit+".timer"))
+		os.Remove(filepath.Join(dir, unit+".service"))
+		return runTool("systemctl", "--user", "daemon-reload")
+
+	case "darwin":
+		path, err := launchdAgentPath("com.backman." + name)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+		exec.Command("launchctl", "unload", "-w", path).Run()
+		return os.Remove(path)
+
+	case "windows":
+		return runTool("schtasks", "/Delete", "/F", "/TN", "backman-"+name)
+	}
+	return fmt.Errorf("scheduling isn't supported on %s", runtime.GOOS)
+}
+
+func installScheduleCommand(args []string) {
+	fs := flag.NewFlagSet("install-schedule", flag.ContinueOnError)
+	daily := fs.String("daily", "03:00", "time of day to back up at, as HH:MM")
+	name := fs.String("name", "", "name of the schedule, defaults to the first path's directory name")
+	remove := fs.Bool("remove", false, "remove the schedule called --name instead")
+	dryRun := fs.Bool("dry-run", false, "only print what would be installed")
+	incremental := fs.Bool("incremental", false, "make incremental backups")
+	profileName := fs.String("profile", "", "run this profile instead of backing up paths")
+	scrub := fs.Bool("scrub", false, "run scrub instead of backing up paths")
+	paths := parseFlags(fs, args)
+
+	if *remove {
+		if *name == "" {
+			fmt.Fprintln(os.Stderr, "--remove needs the --name of the schedule")
+			os.Exit(exitUsage)
+		}
+		if err := uninstallSchedule(*name); err != nil {
+			fmt.Fprintln(os.Stderr, "error removing schedule: ", err)
+			os.Exit(exitFatal)
+		}
+		fmt.Println(tr("Removed successfully!"))
+		return
+	}
+
+	at, err := time.Parse("15:04", *daily)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --daily %q, use HH:MM\n", *daily)
+		os.Exit(exitUsage)
+	}
+	if *scrub && (len(paths) > 0 || *incremental || *profileName != "") {
+		fmt.Fprintln(os.Stderr, "--scrub doesn't back anything up, it takes no paths, --incremental or --profile")
+		os.Exit(exitUsage)
+	}
+	if *profileName != "" {
+		if len(paths) > 0 || *incremental {
+			fmt.Fprintln(os.Stderr, "--profile takes its paths and --incremental from the profile")
+			os.Exit(exitUsage)
+		}
+		if _, ok := config.Profiles[*profileName]; !ok {
+			fmt.Fprintf(os.Stderr, "No profile named '%s' in the config\n", *profileName)
+			os.Exit(exitUsage)
+		}
+	}
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error finding the backman executable: ", err)
+		os.Exit(exitFatal)
+	}
+	// nobody is there to answer the dedupe prompt
+	command := []string{exe, "backup", "--dedupe=auto", "--low-priority"}
+	if *profileName != "" {
+		command = []string{exe, "run", "--profile", *profileName, "--dedupe=auto", "--low-priority"}
+		paths = nil
+	}
+	if *scrub {
+		command = []string{exe, "scrub", "--low-priority"}
+		paths = nil
+	}
+	if *incremental {
+		command = append(command, "--incremental")
+	}
+	for _, path := range paths {
+		if !isRemoteTarget(path) {
+			if path, err = filepath.Abs(path); err != nil {
+				fmt.Fprintln(os.Stderr, "error getting absolute path of target: ", err)
+				os.Exit(exitFatal)
+			}
+		}
+		command = append(command, path)
+	}
+
+	s := schedule{Name: *name, At: at, Command: command}
+	if s.Name == "" && *scrub {
+		s.Name = "scrub"
+	} else if s.Name == "" && *profileName != "" {
+		s.Name = scheduleName(*profileName)
+	} else if s.Name == "" {
+		s.Name = scheduleName(targetPath(paths[0]))
+	}
+	if s.Name == "" {
+		fmt.Fprintln(os.Stderr, "can't name the schedule after the path, pass --name")
+		os.Exit(exitUsage)
+	}
+
+	if err := s.install(*dryRun); err != nil {
+		fmt.Fprintln(os.Stderr, "error installing schedule: ", err)
+		os.Exit(exitFatal)
+	}
+	if !*dryRun {
+		what := "backup"
+		if *scrub {
+			what = "scrub"
+		}
+		fmt.Printf("Scheduled a daily %s at %s as '%s', remove it with `install-schedule --remove --name %s`\n", what, at.Format("15:04"), s.Name, s.Name)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// scrub verifies a share of the backups per run, the ones checked longest ago
+// first, so running it regularly (see install-schedule --scrub) reads every
+// archive back every so often without reading all of them at once. what verify
+// finds intact is recorded in the sidecar as verified
+
+func scrubCommand(args []string) {
+	fs := flag.NewFlagSet("scrub", flag.ContinueOnError)
+	percent := fs.Int("percent", config.ScrubPercent, "percentage of the backups to verify")
+	parseFlags(fs, args)
+	if *percent < 1 || *percent > 100 {
+		fmt.Fprintln(os.Stderr, "--percent must be between 1 and 100")
+		os.Exit(exitUsage)
+	}
+
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+	if len(sidecars) == 0 {
+		fmt.Println(tr("No backups yet!"))
+		return
+	}
+
+	// never verified ones come first, then the ones verified longest ago
+	slices.SortStableFunc(sidecars, func(a, b SidecarData) int {
+		if c := a.Verified.Compare(b.Verified); c != 0 {
+			return c
+		}
+		return a.Time.Compare(b.Time)
+	})
+	count := max(1, (len(sidecars)**percent+99)/100)
+
+	var failed []string
+	for _, sidecar := range sidecars[:count] {
+		fmt.Printf("\nBackup %d of '%s':\n", sidecar.ID, sidecar.BackupOf)
+		if !checkBackup(sidecar) {
+			failed = append(failed, fmt.Sprint(sidecar.ID))
+		}
+	}
+
+	fmt.Printf("\nScrubbed %d of %d backups\n", count, len(sidecars))
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %d backups failed verification: %s\n", len(failed), strings.Join(failed, ", "))
+		exitCode = exitVerifyFailed
+	}
+}
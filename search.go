@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/dustin/go-humanize"
+)
+
+type searchOptions struct {
+	// a glob like the ones of restore --include, or a regular expression if Regex is set.
+	// empty matches every file
+	Pattern string
+	Regex   bool
+	// only find files containing all of these words, see index.go
+	Content string
+	// only search backups of this directory
+	Of string
+	// only search backups made in this window
+	Range timeRange
+}
+
+// searchHit is one version of a matching file, in one backup
+type searchHit struct {
+	Sidecar SidecarData
+	Entry   ManifestEntry
+}
+
+// archiveFiles returns the regular files of a backup by archive path, read from
+// the manifest, or the archive itself for backups made before manifests
+func archiveFiles(sidecar SidecarData) (map[string]ManifestEntry, error) {
+	manifest, err := readManifest(sidecar.ManifestPath())
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		return manifest.Files, nil
+	}
+
+	files := make(map[string]ManifestEntry)
+	err = readEntries(sidecar.ParentPath, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag == tar.TypeReg {
+			files[header.Name] = ManifestEntry{Size: header.Size, ModTime: header.ModTime}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// versionKey tells versions of a file apart. archives listed without a manifest
+// have no hash, their size and mtime have to do
+func (e ManifestEntry) versionKey() string {
+	if e.SHA256 != "" {
+		return e.SHA256
+	}
+	return fmt.Sprintf("%d %d", e.Size, e.ModTime.UnixNano())
+}
+
+// contentMatches returns the hashes of the files whose words match query, in the
+// content indexes of all backups. by hash, so the unchanged files of incremental
+// backups and copies in other backups match as well
+func contentMatches(sidecars []SidecarData, query string) (map[string]bool, int) {
+	hashes := make(map[string]bool)
+	var indexed int
+	for _, sidecar := range sidecars {
+		index, err := readIndex(sidecar.IndexPath())
+		if err == nil && index != nil {
+			var manifest *Manifest
+			if manifest, err = readManifest(sidecar.ManifestPath()); err == nil && manifest != nil {
+				indexed++
+				for _, path := range index.Find(query) {
+					hashes[manifest.Files[path].SHA256] = true
+				}
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Not searching the contents of backup %d: %v\n", sidecar.ID, err)
+			exitCode = exitPartial
+		}
+	}
+	return hashes, indexed
+}
+
+// searchBackups prints which backups contain files matching the pattern, and
+// which version of them, so eg. the last backup still holding a deleted file can be found
+func searchBackups(opts searchOptions) {
+	var match func(name string) bool
+	if opts.Pattern == "" {
+		match = func(string) bool { return true }
+	} else if opts.Regex {
+		re, err := regexp.Compile(opts.Pattern)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid regular expression: ", err)
+			os.Exit(exitUsage)
+		}
+		match = re.MatchString
+	} else {
+		filter, err := newPathFilter([]string{opts.Pattern}, nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: ", err)
+			os.Exit(exitUsage)
+		}
+		match = filter.Keep
+	}
+
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading sidecar files: %v\n", err)
+		os.Exit(exitFatal)
+	}
+	sort.Slice(sidecars, func(i, j int) bool {
+		return sidecars[i].Time.Before(sidecars[j].Time)
+	})
+
+	var containing map[string]bool
+	if opts.Content != "" {
+		if len(indexTerms(opts.Content)) == 0 {
+			fmt.Fprintf(os.Stderr, "'%s' has no words to search for\n", opts.Content)
+			os.Exit(exitUsage)
+		}
+		var indexed int
+		containing, indexed = contentMatches(sidecars, opts.Content)
+		if indexed == 0 {
+			fmt.Println("No backup has a content index, set content_index to index new backups")
+			return
+		}
+	}
+
+	hits := make(map[string][]searchHit)
+	for _, sidecar := range sidecars {
+		if opts.Of != "" && !sidecar.matchesTarget(opts.Of) {
+			continue
+		}
+		if !opts.Range.Contains(sidecar.Time) {
+			continue
+		}
+		// files listed from an archive have no hash to match the contents by
+		if _, err := os.Stat(sidecar.ManifestPath()); err != nil && containing != nil {
+			continue
+		}
+		files, err := archiveFiles(sidecar)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Not searching backup %d: %v\n", sidecar.ID, err)
+			exitCode = exitPartial
+			continue
+		}
+		for name, entry := range files {
+			if containing != nil && (entry.SHA256 == "" || !containing[entry.SHA256]) {
+				continue
+			}
+			if match(name) {
+				hits[name] = append(hits[name], searchHit{Sidecar: sidecar, Entry: entry})
+			}
+		}
+	}
+
+	if len(hits) == 0 {
+		if opts.Content != "" {
+			fmt.Printf("No backups contain a file with '%s'\n", opts.Content)
+		} else {
+			fmt.Printf("No backups contain a file matching '%s'\n", opts.Pattern)
+		}
+		return
+	}
+
+	names := make([]string, 0, len(hits))
+	for name := range hits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		printHits(name, hits[name])
+	}
+}
+
+// printHits lists the backups a file is in, oldest first, with which version of it each has
+func printHits(name string, hits []searchHit) {
+	// the same contents in several backups are one version, numbered from the oldest
+	versions := make(map[string]int)
+	for _, hit := range hits {
+		key := hit.Entry.versionKey()
+		if _, ok := versions[key]; !ok {
+			versions[key] = len(versions) + 1
+		}
+	}
+
+	fmt.Printf("%s (backups: %d, versions: %d)\n", escapeName(name), len(hits), len(versions))
+	for _, hit := range hits {
+		// older backups have no manifest to take the hash from
+		sum := "-"
+		if hit.Entry.SHA256 != "" {
+			sum = hit.Entry.SHA256[:12]
+		}
+		line := fmt.Sprintf("	v%d  #%d  %s  %s  %s  %s, modified %s",
+			versions[hit.Entry.versionKey()], hit.Sidecar.ID, formatTime(hit.Sidecar.Time),
+			hit.Sidecar.BackupOf, humanize.IBytes(uint64(hit.Entry.Size)), sum,
+			formatTime(hit.Entry.ModTime),
+		)
+		if hit.Entry.Unchanged {
+			line += " (stored in an earlier backup of the chain)"
+		}
+		fmt.Println(line)
+	}
+}
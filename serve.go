@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// backupJSON is how the web UI sees a backup
+type backupJSON struct {
+	ID      uint16    `json:"id"`
+	Of      string    `json:"of"`
+	Sources []string  `json:"sources,omitempty"`
+	Time    time.Time `json:"time"`
+	Size    int64     `json:"size"`
+}
+
+// commandResult is the output of a backman command run for the web UI
+type commandResult struct {
+	OK     bool   `json:"ok"`
+	Output string `json:"output"`
+}
+
+// tokenHeader carries the token of a server run on the requests that change
+// anything. other sites can make a browser post to the web UI, but can't read
+// the page the token is in
+const tokenHeader = "X-Backman-Token"
+
+// newToken returns a random token for a server run
+func newToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// allowedHost reports whether a request for host, from its Host header, is one
+// for the server on addr. a site can point its own name at 127.0.0.1 (DNS
+// rebinding), so other names than the one served on and localhost are refused
+func allowedHost(host, addr string) bool {
+	if host == addr {
+		return true
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+	_, servedPort, _ := net.SplitHostPort(addr)
+	return port == servedPort && (name == "localhost" || net.ParseIP(name) != nil)
+}
+
+// guard refuses requests for other hosts, without password if one is set, and posts
+// from other sites or without token
+func guard(addr, token, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowedHost(r.Host, addr) {
+			http.Error(w, "unknown host", http.StatusForbidden)
+			return
+		}
+		if password != "" {
+			_, given, ok := r.BasicAuth()
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(password)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="backman", charset="UTF-8"`)
+				http.Error(w, "wrong password", http.StatusUnauthorized)
+				return
+			}
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+				http.Error(w, "cross-origin request", http.StatusForbidden)
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get(tokenHeader)), []byte(token)) != 1 {
+				http.Error(w, "missing or wrong token, reload the page", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve runs the web UI on addr until killed
+func serve(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid address: ", err)
+		os.Exit(exitUsage)
+	}
+	// anyone who can load the page gets the token, and with it restore and delete
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) && config.ServePassword == "" {
+		fmt.Fprintf(os.Stderr, "Refusing to serve on %s without serve_password, anyone on the network could restore and delete backups\n", addr)
+		os.Exit(exitUsage)
+	}
+
+	static, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+
+	token := newToken()
+	page, err := fs.ReadFile(static, "index.html")
+	if err != nil {
+		panic(err)
+	}
+	page = bytes.ReplaceAll(page, []byte("{{token}}"), []byte(token))
+
+	// commands are run one at a time, like they would be from a shell
+	var running sync.Mutex
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(static))
+	servePage := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	}
+	mux.HandleFunc("GET /{$}", servePage)
+	mux.HandleFunc("GET /index.html", servePage)
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := writeCachedMetrics(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("GET /api/backups", func(w http.ResponseWriter, r *http.Request) {
+		sidecars, err := readSidecars()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sort.Slice(sidecars, func(i, j int) bool {
+			return sidecars[i].Time.After(sidecars[j].Time)
+		})
+
+		backups := []backupJSON{}
+		for _, sidecar := range sidecars {
+			backups = append(backups, backupJSON{
+				ID:      sidecar.ID,
+				Of:      sidecar.Of(),
+				Sources: sidecar.OfSources(),
+				Time:    sidecar.Time,
+				Size:    sidecar.ParentSize,
+			})
+		}
+		writeJSON(w, backups)
+	})
+	mux.HandleFunc("POST /api/backup", func(w http.ResponseWriter, r *http.Request) {
+		path := r.FormValue("path")
+		if path == "" {
+			http.Error(w, "missing path", http.StatusBadRequest)
+			return
+		}
+		running.Lock()
+		defer running.Unlock()
+		writeJSON(w, runSelf("backup", "--", path))
+	})
+	mux.HandleFunc("POST /api/restore/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 16)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		running.Lock()
+		defer running.Unlock()
+		writeJSON(w, runSelf("restore", "--on-conflict=overwrite", strconv.FormatUint(id, 10)))
+	})
+	mux.HandleFunc("POST /api/delete/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 16)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		running.Lock()
+		defer running.Unlock()
+		writeJSON(w, runSelf("delete", "--force", strconv.FormatUint(id, 10)))
+	})
+
+	go flushPeriodically(func(args ...string) commandResult {
+		running.Lock()
+		defer running.Unlock()
+		return runSelf(args...)
+	})
+
+	fmt.Printf("Serving on http://%s\n", addr)
+	if err := http.ListenAndServe(addr, guard(addr, token, config.ServePassword, mux)); err != nil {
+		fmt.Fprintln(os.Stderr, "error serving: ", err)
+		os.Exit(exitFatal)
+	}
+}
+
+// runSelf runs backman with args and returns its output. the commands exit the
+// process on errors, so they can't be called from the server directly
+func runSelf(args ...string) commandResult {
+	exe, err := os.Executable()
+	if err != nil {
+		return commandResult{Output: err.Error()}
+	}
+
+	cmd := exec.Command(exe, args...)
+	// pass on the config as loaded, including command line overrides
+	cmd.Env = append(os.Environ(), configEnv()...)
+	out, err := cmd.CombinedOutput()
+
+	result := commandResult{OK: err == nil, Output: string(out)}
+	if err != nil {
+		result.Output += err.Error()
+	}
+	return result
+}
+
+// configEnv returns the current config as BACKMAN_<KEY> variables, see applyOverrides
+func configEnv() []string {
+	var env []string
+	for _, field := range configFields() {
+		value := fmt.Sprint(field.Value.Interface())
+		if field.Value.Kind() != reflect.String {
+			data, err := json.Marshal(field.Value.Interface())
+			if err != nil {
+				continue
+			}
+			value = string(data)
+		}
+		env = append(env, "BACKMAN_"+strings.ToUpper(field.Key)+"="+value)
+	}
+	return env
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
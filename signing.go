@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// signature files are written next to the archive as <archive>.sig
+
+// ssh signatures are bound to a namespace so they can't be reused for anything else
+const sshNamespace = "backman"
+
+var errNoSignature = errors.New("signature missing")
+
+// the archive is given to gpg and ssh-keygen on stdin, so split archives are
+// signed as a whole
+func signArchive(archive string) error {
+	if config.SignWith == "" {
+		return nil
+	}
+	data, err := openArchiveFile(archive, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	switch config.SignWith {
+	case "gpg":
+		args := []string{"--batch", "--yes", "--detach-sign", "--output", archive + ".sig"}
+		if config.SigningKey != "" {
+			args = append(args, "--local-user", config.SigningKey)
+		}
+		return runQuiet(data, "gpg", args...)
+	case "ssh":
+		// prints the signature when signing stdin
+		sig, err := os.Create(archive + ".sig")
+		if err != nil {
+			return err
+		}
+		defer sig.Close()
+		var out bytes.Buffer
+		cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", config.SigningKey, "-n", sshNamespace)
+		cmd.Stdin = data
+		cmd.Stdout = sig
+		cmd.Stderr = &out
+		if err := cmd.Run(); err != nil {
+			os.Remove(archive + ".sig")
+			return fmt.Errorf("ssh-keygen: %w\n%s", err, strings.TrimSpace(out.String()))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown signing method %q", config.SignWith)
+	}
+}
+
+// verifySignature checks the archive's signature. archives without one are fine
+// unless signing is configured, then errNoSignature is returned
+func verifySignature(archive string) error {
+	sig := archive + ".sig"
+	if _, err := os.Stat(sig); errors.Is(err, os.ErrNotExist) {
+		if config.SignWith != "" {
+			return errNoSignature
+		}
+		return nil
+	}
+
+	data, err := openArchiveFile(archive, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	switch config.SignWith {
+	case "", "gpg":
+		return runQuiet(data, "gpg", "--batch", "--verify", sig, "-")
+	case "ssh":
+		pub, err := os.ReadFile(config.SigningKey + ".pub")
+		if err != nil {
+			return fmt.Errorf("error reading public key: %w", err)
+		}
+
+		allowed, err := os.CreateTemp("", "backman-allowed-signers-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(allowed.Name())
+		fmt.Fprintf(allowed, "%s %s", sshNamespace, pub)
+		allowed.Close()
+
+		return runQuiet(data, "ssh-keygen", "-Y", "verify",
+			"-f", allowed.Name(), "-I", sshNamespace, "-n", sshNamespace, "-s", sig,
+		)
+	default:
+		return fmt.Errorf("unknown signing method %q", config.SignWith)
+	}
+}
+
+// checkSignature verifies the archive before it's used, exiting if require_signature is set
+func checkSignature(archive string) {
+	err := verifySignature(archive)
+	if err == nil {
+		return
+	}
+
+	if config.RequireSignature {
+		fmt.Fprintln(os.Stderr, "error verifying archive signature: ", err)
+		fmt.Fprintln(os.Stderr, "Refusing to use the archive, it may have been tampered with")
+		os.Exit(exitVerifyFailed)
+	}
+	fmt.Fprintln(os.Stderr, "WARNING: Could not verify archive signature: ", err)
+}
+
+// runQuiet runs a command, only showing its output if it fails
+func runQuiet(stdin io.Reader, name string, args ...string) error {
+	var out bytes.Buffer
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w\n%s", name, err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
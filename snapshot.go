@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// snapshot is a read-only, point in time copy of a backup target
+type snapshot struct {
+	// where the target's contents can be read from while the snapshot exists
+	Path    string
+	release func() error
+}
+
+// takeSnapshot snapshots the filesystem containing target using kind ("btrfs", "zfs" or "lvm")
+func takeSnapshot(kind, target string) (*snapshot, error) {
+	name := "backman-" + generateUUID()[:8]
+
+	switch kind {
+	case "btrfs":
+		return btrfsSnapshot(target, name)
+	case "zfs":
+		return zfsSnapshot(target, name)
+	case "lvm":
+		return lvmSnapshot(target, name)
+	default:
+		return nil, fmt.Errorf("unknown snapshot type %q, use btrfs, zfs or lvm", kind)
+	}
+}
+
+// snapshotRoots replaces the paths of roots with snapshots of them.
+// the returned function deletes the snapshots again and must always be called
+func snapshotRoots(roots []archiveRoot, kind string) (func(), error) {
+	var snapshots []*snapshot
+	release := func() {
+		for _, snap := range snapshots {
+			if err := snap.release(); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: Could not remove snapshot, remove it manually: %v\n", err)
+			}
+		}
+	}
+
+	for i := range roots {
+		fmt.Printf("Creating %s snapshot of '%s'...\n", kind, roots[i].Path)
+		snap, err := takeSnapshot(kind, roots[i].Path)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		snapshots = append(snapshots, snap)
+		roots[i].Path = snap.Path
+	}
+
+	return release, nil
+}
+
+// btrfs can only snapshot whole subvolumes, so target has to be one
+func btrfsSnapshot(target, name string) (*snapshot, error) {
+	// snapshots must be on the same filesystem, so it's placed next to the subvolume
+	path := filepath.Join(filepath.Dir(target), "."+name)
+	if err := runQuiet(nil, "btrfs", "subvolume", "snapshot", "-r", target, path); err != nil {
+		return nil, err
+	}
+
+	return &snapshot{
+		Path: path,
+		release: func() error {
+			return runQuiet(nil, "btrfs", "subvolume", "delete", path)
+		},
+	}, nil
+}
+
+func zfsSnapshot(target, name string) (*snapshot, error) {
+	out, err := commandOutput("zfs", "list", "-H", "-o", "name,mountpoint", "-t", "filesystem")
+	if err != nil {
+		return nil, err
+	}
+
+	// the dataset mounted closest to the target contains it
+	var dataset, mountpoint string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 || !filepath.IsAbs(fields[1]) {
+			continue
+		}
+		if isWithin(target, fields[1]) && len(fields[1]) > len(mountpoint) {
+			dataset, mountpoint = fields[0], fields[1]
+		}
+	}
+	if dataset == "" {
+		return nil, fmt.Errorf("'%s' is not on a mounted zfs dataset", target)
+	}
+
+	rel, err := filepath.Rel(mountpoint, target)
+	if err != nil {
+		return nil, err
+	}
+	full := dataset + "@" + name
+	if err := runQuiet(nil, "zfs", "snapshot", full); err != nil {
+		return nil, err
+	}
+
+	return &snapshot{
+		// zfs exposes snapshots in the hidden .zfs directory of the dataset
+		Path: filepath.Join(mountpoint, ".zfs", "snapshot", name, rel),
+		release: func() error {
+			return runQuiet(nil, "zfs", "destroy", full)
+		},
+	}, nil
+}
+
+// lvmSnapshot snapshots the logical volume holding target and mounts it read-only
+func lvmSnapshot(target, name string) (*snapshot, error) {
+	out, err := commandOutput("findmnt", "-n", "-o", "SOURCE,TARGET", "--target", target)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("unexpected findmnt output %q", out)
+	}
+	device, mountpoint := fields[0], fields[1]
+
+	out, err = commandOutput("lvs", "--noheadings", "-o", "vg_name", device)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not on a logical volume: %w", target, err)
+	}
+	vg := strings.TrimSpace(out)
+
+	rel, err := filepath.Rel(mountpoint, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := runQuiet(nil, "lvcreate", "-s", "-n", name, "-L", config.SnapshotSize, device); err != nil {
+		return nil, err
+	}
+	snapDevice := filepath.Join("/dev", vg, name)
+	removeLV := func() error {
+		return runQuiet(nil, "lvremove", "-f", snapDevice)
+	}
+
+	mountDir, err := os.MkdirTemp("", name+"-")
+	if err != nil {
+		removeLV()
+		return nil, err
+	}
+
+	// xfs refuses to mount a second filesystem with the same uuid
+	options := "ro"
+	if fsType, _ := commandOutput("findmnt", "-n", "-o", "FSTYPE", "--target", target); strings.TrimSpace(fsType) == "xfs" {
+		options += ",nouuid"
+	}
+	if err := runQuiet(nil, "mount", "-o", options, snapDevice, mountDir); err != nil {
+		os.Remove(mountDir)
+		removeLV()
+		return nil, err
+	}
+
+	return &snapshot{
+		Path: filepath.Join(mountDir, rel),
+		release: func() error {
+			err := runQuiet(nil, "umount", mountDir)
+			if err == nil {
+				os.Remove(mountDir)
+				err = removeLV()
+			}
+			return err
+		},
+	}, nil
+}
+
+// commandOutput runs a command and returns its stdout
+func commandOutput(name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("%s: %w\n%s", name, err, strings.TrimSpace(stderr.String()))
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
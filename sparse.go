@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+)
+
+// sparseRegion is a part of a sparse file that holds data
+type sparseRegion struct {
+	Offset int64
+	Length int64
+}
+
+// readers refuse sparse maps over 1MiB, files with more regions are stored whole
+const maxSparseRegions = 30000
+
+// the size of the blocks checked for zeros when restoring sparse files
+const sparseBlockSize = 4096
+
+// writeSparse stores file as a GNU sparse entry (the PAX 1.0 format GNU tar uses),
+// which only contains regions and a map of where they go. hasher gets the contents
+// of the whole file, holes included, so the hash matches a regular entry's.
+// archive/tar can't write these, so the entry is encoded by hand into w, the
+// stream under tw
+func writeSparse(w io.Writer, tw *tar.Writer, header *tar.Header, file *os.File, regions []sparseRegion, hasher hash.Hash) error {
+	// GNU tar expects a trailing hole to be marked by an empty region at the end
+	if last := regions[len(regions)-1]; last.Offset+last.Length < header.Size {
+		regions = append(regions, sparseRegion{Offset: header.Size})
+	}
+
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(regions))
+	var dataSize int64
+	for _, region := range regions {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", region.Offset, region.Length)
+		dataSize += region.Length
+	}
+	// the map is padded to a whole block
+	sparseMap.Write(make([]byte, blockPadding(int64(sparseMap.Len()))))
+	storedSize := int64(sparseMap.Len()) + dataSize
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     header.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(header.Size, 10),
+		"mtime":               strconv.FormatInt(header.ModTime.Unix(), 10),
+	}
+	for key, value := range header.PAXRecords {
+		records[key] = value
+	}
+	if storedSize > maxOctalSize {
+		records["size"] = strconv.FormatInt(storedSize, 10)
+	}
+	var pax bytes.Buffer
+	keys := slices.Sorted(maps.Keys(records))
+	for _, key := range keys {
+		pax.WriteString(paxRecord(key, records[key]))
+	}
+
+	// the rest of the current entry's padding
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	placeholder := path.Join(path.Dir(header.Name), "GNUSparseFile.0", path.Base(header.Name))
+	paxHeader := ustarBlock(header, path.Join(path.Dir(header.Name), "PaxHeaders.0", path.Base(header.Name)), tar.TypeXHeader, int64(pax.Len()))
+	fileHeader := ustarBlock(header, placeholder, tar.TypeReg, min(storedSize, maxOctalSize))
+
+	pax.Write(make([]byte, blockPadding(int64(pax.Len()))))
+	for _, data := range [][]byte{paxHeader, pax.Bytes(), fileHeader, sparseMap.Bytes()} {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	var pos int64
+	for _, region := range regions {
+		if err := hashZeros(hasher, region.Offset-pos); err != nil {
+			return err
+		}
+		section := io.NewSectionReader(file, region.Offset, region.Length)
+		n, err := copyBuffered(io.MultiWriter(w, hasher), section)
+		if err != nil {
+			return err
+		}
+		if n != region.Length {
+			return fmt.Errorf("'%s' shrank while being read", header.Name)
+		}
+		pos = region.Offset + region.Length
+	}
+	if err := hashZeros(hasher, header.Size-pos); err != nil {
+		return err
+	}
+
+	_, err := w.Write(make([]byte, blockPadding(dataSize)))
+	return err
+}
+
+// the largest size the 11 octal digits of a ustar header hold
+const maxOctalSize = 1<<33 - 1
+
+func blockPadding(n int64) int64 {
+	return -n & 511
+}
+
+// paxRecord formats a PAX record, "<length> <key>=<value>\n" where length includes itself
+func paxRecord(key, value string) string {
+	record := " " + key + "=" + value + "\n"
+	size := len(record)
+	for size < len(strconv.Itoa(size))+len(record) {
+		size++
+	}
+	return strconv.Itoa(size) + record
+}
+
+// ustarBlock encodes a ustar header block with the metadata of header
+func ustarBlock(header *tar.Header, name string, typeflag byte, size int64) []byte {
+	block := make([]byte, 512)
+	if len(name) > 100 {
+		// the real name is in the PAX records, this one is only informational
+		name = name[len(name)-100:]
+	}
+	copy(block[0:100], name)
+	putOctal(block[100:108], header.Mode&0o7777)
+	putOctal(block[108:116], int64(header.Uid)&0o7777777)
+	putOctal(block[116:124], int64(header.Gid)&0o7777777)
+	putOctal(block[124:136], size)
+	putOctal(block[136:148], max(header.ModTime.Unix(), 0))
+	block[156] = typeflag
+	copy(block[257:265], "ustar\x0000")
+	copy(block[265:297], header.Uname)
+	copy(block[297:329], header.Gname)
+
+	// the checksum is calculated with its own field set to spaces
+	copy(block[148:156], "        ")
+	var sum int64
+	for _, b := range block {
+		sum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return block
+}
+
+func putOctal(field []byte, value int64) {
+	copy(field, fmt.Sprintf("%0*o\x00", len(field)-1, value))
+}
+
+var zeroBlock = make([]byte, 64*1024)
+
+// hashZeros writes n zero bytes into h, for the holes of sparse files
+func hashZeros(h hash.Hash, n int64) error {
+	for n > 0 {
+		chunk := min(n, int64(len(zeroBlock)))
+		if _, err := h.Write(zeroBlock[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// isSparse reports whether header was stored with writeSparse or GNU tar --sparse
+func isSparse(header *tar.Header) bool {
+	return header.PAXRecords["GNU.sparse.major"] != "" || header.PAXRecords["GNU.sparse.map"] != ""
+}
+
+// sparseWriter writes to a file, skipping over blocks of zeros instead of
+// writing them so they become holes. Finish has to be called once done
+type sparseWriter struct {
+	file *os.File
+	pos  int64
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), sparseBlockSize)
+		block := p[:n]
+		if bytes.Equal(block, zeroBlock[:n]) {
+			if _, err := w.file.Seek(int64(n), io.SeekCurrent); err != nil {
+				return written, err
+			}
+		} else if _, err := w.file.Write(block); err != nil {
+			return written, err
+		}
+		w.pos += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Finish sets the size of the file, a trailing hole is never written otherwise
+func (w *sparseWriter) Finish() error {
+	return w.file.Truncate(w.pos)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// not in package syscall
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataRegions returns the parts of file that hold data, nil if it has no holes
+func dataRegions(file *os.File, info os.FileInfo) ([]sparseRegion, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Blocks*512 >= info.Size() {
+		// every byte is allocated
+		return nil, nil
+	}
+
+	var regions []sparseRegion
+	size := info.Size()
+	for pos := int64(0); pos < size; {
+		start, err := file.Seek(pos, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// only a hole is left
+			break
+		}
+		if err != nil {
+			// eg. the filesystem doesn't support SEEK_DATA
+			return nil, nil
+		}
+		end, err := file.Seek(start, seekHole)
+		if err != nil {
+			return nil, nil
+		}
+		if end > size {
+			end = size
+		}
+		regions = append(regions, sparseRegion{Offset: start, Length: end - start})
+		pos = end
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if len(regions) == 1 && regions[0].Length == size {
+		return nil, nil
+	}
+	return regions, nil
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// backups of other machines are made by running tar on them over ssh and
+// writing its stream into a local archive, so the host only needs ssh and tar.
+// restoring onto them works the other way around
+
+// sshTarget is a path on another machine, written as ssh://[user@]host[:port]/path
+type sshTarget struct {
+	User string
+	Host string
+	Port string
+	Path string
+}
+
+func isSSHTarget(target string) bool {
+	return strings.HasPrefix(target, "ssh://")
+}
+
+func parseSSHTarget(target string) (sshTarget, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return sshTarget{}, err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return sshTarget{}, fmt.Errorf("%q isn't an ssh://[user@]host[:port]/path url", target)
+	}
+
+	t := sshTarget{Host: u.Hostname(), Port: u.Port(), Path: path.Clean("/" + u.Path)}
+	if u.User != nil {
+		t.User = u.User.Username()
+	}
+	return t, nil
+}
+
+// String returns the target in the canonical form used as BackupOf
+func (t sshTarget) String() string {
+	host := t.Host
+	if t.Port != "" {
+		host += ":" + t.Port
+	}
+	if t.User != "" {
+		host = t.User + "@" + host
+	}
+	return "ssh://" + host + t.Path
+}
+
+// command returns an ssh command running remoteCmd on the target's host
+func (t sshTarget) command(remoteCmd string) *exec.Cmd {
+	var args []string
+	if t.Port != "" {
+		args = append(args, "-p", t.Port)
+	}
+	if t.User != "" {
+		args = append(args, "-l", t.User)
+	}
+	args = append(args, "--", t.Host, remoteCmd)
+	return exec.Command("ssh", args...)
+}
+
+// shellQuote quotes s for the remote shell ssh runs commands with
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func backupSSH(target string, opts compressOptions) {
+	t, err := parseSSHTarget(target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading target: ", err)
+		os.Exit(exitFatal)
+	}
+	if opts.Snapshot != "" {
+		fmt.Fprintln(os.Stderr, "WARNING: Snapshots can't be taken on other machines, ignoring --snapshot")
+	}
+
+	sidecar := SidecarData{BackupOf: t.String()}
+	if opts.Incremental {
+		parent, manifest, ok := findParent(sidecar)
+		if ok {
+			fmt.Printf("Storing changes since backup %d...\n", parent.ID)
+			sidecar.ParentID = &parent.ID
+			opts.Parent = manifest
+		} else {
+			fmt.Printf("No earlier backup of '%s' to build on, making a full backup\n", sidecar.BackupOf)
+		}
+	}
+
+	useDict(&sidecar, &opts)
+	writeBackup(sidecar, opts.Format, func(backupName string) (*Manifest, error) {
+		fmt.Printf("Compressing '%s' from %s...\n", t.Path, t.Host)
+		return compressSSH(t, backupName, opts)
+	})
+}
+
+// compressSSH streams the target directory from its host with tar and writes it into dst
+func compressSSH(t sshTarget, dst string, opts compressOptions) (*Manifest, error) {
+	remoteCmd := "tar -cf - "
+	if opts.FollowSymlinks {
+		remoteCmd += "-h "
+	}
+	if opts.Xattrs {
+		// only gnu tar has these
+		remoteCmd += "--xattrs --acls "
+	}
+	remoteCmd += "-C " + shellQuote(t.Path) + " ."
+	return compressCommand(t.command(remoteCmd), dst, opts)
+}
+
+// compressCommand runs cmd, which writes a tar stream to stdout, and writes the stream into dst
+func compressCommand(cmd *exec.Cmd, dst string, opts compressOptions) (*Manifest, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	manifest, copyErr := copyTarStream(out, dst, opts)
+	if copyErr != nil {
+		cmd.Process.Kill()
+	}
+	err = cmd.Wait()
+	// tar goes on past files it can't read, and only complains about them at the end
+	if err != nil && copyErr == nil && !opts.Strict && skipTarErrors(manifest, stderr.String()) {
+		err = nil
+	}
+	// a failing ssh or tar explains a broken stream better than the stream does
+	if err != nil && (copyErr == nil || stderr.Len() > 0) {
+		return nil, fmt.Errorf("%s: %w\n%s", cmd.Args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return manifest, copyErr
+}
+
+// skipTarErrors records the files tar couldn't read, from its "tar: ./path: reason"
+// messages. false if there are other errors
+func skipTarErrors(manifest *Manifest, stderr string) bool {
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		rest, ok := strings.CutPrefix(line, "tar: ./")
+		if !ok {
+			if strings.HasPrefix(line, "tar: Exiting with failure status") {
+				continue
+			}
+			return false
+		}
+		name, reason, ok := strings.Cut(rest, ": ")
+		if !ok {
+			return false
+		}
+		manifest.skipFile(path.Clean(name), errors.New(reason))
+	}
+	return true
+}
+
+// copyTarStream writes the entries of the tar stream r into a new archive at dst
+func copyTarStream(r io.Reader, dst string, opts compressOptions) (*Manifest, error) {
+	f, err := createArchive(dst, opts.SplitSize)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	aw, err := newArchiveWriter(f, opts.Format, opts.Dict)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := newManifest()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			err = copyTarEntry(aw, tr, header, manifest, opts)
+		}
+		if err != nil {
+			aw.Close()
+			return nil, err
+		}
+	}
+
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func copyTarEntry(aw archiveWriter, tr *tar.Reader, header *tar.Header, manifest *Manifest, opts compressOptions) error {
+	// the stream is of "./...", the archive of paths relative to the directory
+	name := path.Clean(header.Name)
+	if opts.Rename != nil {
+		var ok bool
+		if name, ok = opts.Rename(name); !ok {
+			return nil
+		}
+	}
+	if name == "." {
+		return nil
+	}
+	header.Name = name
+	header.Format = tar.FormatPAX
+	if !opts.Xattrs {
+		for key := range header.PAXRecords {
+			if strings.HasPrefix(key, paxXattrPrefix) {
+				delete(header.PAXRecords, key)
+			}
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir, tar.TypeSymlink:
+		manifest.Dirs++
+		return aw.WriteHeader(header)
+
+	case tar.TypeReg:
+		if opts.Filter.Skip(header.FileInfo()) {
+			return nil
+		}
+		if opts.Parent != nil {
+			entry, ok := opts.Parent.Files[name]
+			if ok && !entry.Changed && entry.Size == header.Size && entry.ModTime.Equal(header.ModTime) {
+				entry.Unchanged = true
+				manifest.Files[name] = entry
+				return nil
+			}
+		}
+
+		hasher := newFileHash()
+		if err := aw.WriteReader(header, tr, hasher); err != nil {
+			return err
+		}
+		manifest.Files[name] = ManifestEntry{
+			Size:    header.Size,
+			ModTime: header.ModTime,
+			SHA256:  hashString(hasher),
+		}
+		return nil
+
+	case tar.TypeLink:
+		fmt.Fprintf(os.Stderr, "WARNING: Skipping hard link '%s', its contents are stored as '%s'\n", name, path.Clean(header.Linkname))
+		return nil
+
+	default:
+		// devices, fifos and the like aren't backed up locally either
+		return nil
+	}
+}
+
+// restoreSSH restores a backup onto another machine, streaming a tar of the files
+// into tar on its host. incremental chains are merged into one stream, each file
+// coming from the last backup that stored it
+func restoreSSH(sidecar SidecarData, opts restoreOptions) {
+	t, err := parseSSHTarget(opts.Remote)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading destination: ", err)
+		os.Exit(exitFatal)
+	}
+
+	chain := []SidecarData{sidecar}
+	if sidecar.ParentID != nil {
+		if chain, err = backupChain(sidecar); err != nil {
+			fmt.Fprintln(os.Stderr, "error resolving backup chain: ", err)
+			os.Exit(exitFatal)
+		}
+	}
+	manifests := make([]*Manifest, len(chain))
+	for i, link := range chain {
+		manifests[i], err = readManifest(link.ManifestPath())
+		if err == nil && manifests[i] == nil && len(chain) > 1 {
+			err = fmt.Errorf("backup %d has no manifest, which incremental restores need", link.ID)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading manifest: ", err)
+			os.Exit(exitFatal)
+		}
+	}
+	if sidecar.Stream != "" && !opts.Filter.Empty() {
+		fmt.Fprintln(os.Stderr, "WARNING: The backup is a single stream, ignoring --include and --exclude")
+		opts.Filter = pathFilter{}
+	}
+
+	if opts.DryRun {
+		files, err := restoreFiles(sidecar)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading backup: ", err)
+			os.Exit(exitFatal)
+		}
+		var total int64
+		fmt.Printf("Would restore onto '%s':\n", t)
+		for _, name := range slices.Sorted(maps.Keys(files)) {
+			if opts.Filter.Keep(name) {
+				fmt.Printf("\t%s (%s)\n", escapeName(name), humanize.IBytes(uint64(files[name])))
+				total += files[name]
+			}
+		}
+		fmt.Printf("Total: %s\n", humanize.IBytes(uint64(total)))
+		return
+	}
+
+	// existing files are handled by the remote tar
+	extract := "tar -xf - "
+	if opts.Xattrs {
+		extract += "--xattrs --acls "
+	}
+	if t.command("test -e "+shellQuote(t.Path)).Run() == nil {
+		switch config.OnConflict {
+		case "skip":
+			extract += "--skip-old-files "
+		case "newer":
+			extract += "--keep-newer-files "
+		case "rename":
+			fmt.Fprintln(os.Stderr, "on_conflict \"rename\" isn't supported restoring over ssh, use overwrite, skip or newer")
+			os.Exit(exitUsage)
+		case "ask":
+			fmt.Printf("'%s' already exists, files in it will be overwritten\n", t)
+			if !askYesNo(tr("Continue?")) {
+				fmt.Println(tr("Restore aborted"))
+				os.Exit(exitFatal)
+			}
+		}
+	}
+	remoteCmd := "mkdir -p " + shellQuote(t.Path) + " && " + extract + "-C " + shellQuote(t.Path)
+
+	cmd := t.command(remoteCmd)
+	var stderr bytes.Buffer
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = &stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error starting ssh: ", err)
+		os.Exit(exitFatal)
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, "error starting ssh: ", err)
+		os.Exit(exitFatal)
+	}
+
+	fmt.Printf("Restoring backup %d onto %s...\n", sidecar.ID, t)
+	out := bufio.NewWriterSize(in, copyBufferSize)
+	tw := tar.NewWriter(out)
+	var mismatched []string
+	if sidecar.Stream != "" {
+		mismatched, err = writeStreamTar(tw, sidecar, manifests[0])
+	} else {
+		mismatched, err = writeChainTar(tw, chain, manifests, opts.Filter)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	in.Close()
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		fmt.Fprintf(os.Stderr, "error restoring over ssh: %v\n%s\n", waitErr, strings.TrimSpace(stderr.String()))
+		os.Exit(exitFatal)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error decompressing directory: ", err)
+		os.Exit(exitFatal)
+	}
+
+	if len(mismatched) > 0 {
+		fmt.Fprintf(os.Stderr, tr("WARNING: %d files failed verification:\n"), len(mismatched))
+		for _, name := range mismatched {
+			fmt.Fprintf(os.Stderr, "\t%s\n", escapeName(name))
+		}
+		fmt.Printf("Restored backup onto '%s' with errors\n", t)
+		os.Exit(exitVerifyFailed)
+	}
+	fmt.Printf("Restored backup onto '%s'\n", t)
+}
+
+// writeChainTar writes the files of a backup chain, oldest first, into tw. each
+// file is only written from the last backup that stored it, and is checked against its manifest
+func writeChainTar(tw *tar.Writer, chain []SidecarData, manifests []*Manifest, filter pathFilter) ([]string, error) {
+	// which backup of the chain a file's contents come from
+	storedIn := make(map[string]int)
+	last := manifests[len(manifests)-1]
+	for i, manifest := range manifests {
+		if manifest == nil {
+			continue
+		}
+		for name, entry := range manifest.Files {
+			if !entry.Unchanged {
+				storedIn[name] = i
+			}
+		}
+	}
+
+	var mismatched []string
+	hasher := newFileHash()
+	for i, link := range chain {
+		checkSignature(link.ParentPath)
+		manifest := manifests[i]
+		err := readEntries(link.ParentPath, func(header *tar.Header, r io.Reader) error {
+			if !filter.Keep(header.Name) {
+				return nil
+			}
+			if header.Typeflag == tar.TypeReg && manifest != nil {
+				if from, ok := storedIn[header.Name]; !ok || from != i {
+					return nil
+				}
+				// files deleted later in the chain aren't restored
+				if _, ok := last.Files[header.Name]; !ok {
+					return nil
+				}
+			}
+
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if header.Typeflag != tar.TypeReg {
+				return nil
+			}
+			hasher.Reset()
+			if _, err := copyBuffered(io.MultiWriter(tw, hasher), r); err != nil {
+				return err
+			}
+			if manifest != nil && manifest.Files[header.Name].SHA256 != hashString(hasher) {
+				mismatched = append(mismatched, header.Name)
+			}
+			return nil
+		})
+		if err != nil {
+			return mismatched, fmt.Errorf("error reading backup %d: %w", link.ID, err)
+		}
+	}
+	return mismatched, nil
+}
+
+// writeStreamTar writes the data of a stream backup into tw as a single file
+func writeStreamTar(tw *tar.Writer, sidecar SidecarData, manifest *Manifest) ([]string, error) {
+	checkSignature(sidecar.ParentPath)
+
+	// tar needs the size up front
+	size := int64(-1)
+	if manifest != nil {
+		if entry, ok := manifest.Files[sidecar.Stream]; ok {
+			size = entry.Size
+		}
+	}
+	if size < 0 {
+		r, err := openArchive(sidecar.ParentPath)
+		if err != nil {
+			return nil, err
+		}
+		size, err = copyBuffered(io.Discard, r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := openArchive(sidecar.ParentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	header := &tar.Header{
+		Name:     filepath.Base(sidecar.Stream),
+		Mode:     0644,
+		Size:     size,
+		ModTime:  sidecar.Time,
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	hasher := newFileHash()
+	if _, err := copyBuffered(io.MultiWriter(tw, hasher), r); err != nil {
+		return nil, err
+	}
+	if manifest != nil && manifest.Files[sidecar.Stream].SHA256 != hashString(hasher) {
+		return []string{sidecar.Stream}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/dustin/go-humanize"
+)
+
+type targetStats struct {
+	Of           string
+	Count        int
+	ArchiveSize  int64
+	OriginalSize int64
+	// files stored in the archives, see SidecarData.Files
+	Files int
+	// archive size of the backups that OriginalSize is known for
+	MeasuredSize int64
+	Last         SidecarData
+}
+
+func (t *targetStats) Ratio() string {
+	if t.MeasuredSize <= 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%.2fx", float64(t.OriginalSize)/float64(t.MeasuredSize))
+}
+
+// printStats summarizes the whole catalog, per target and per month
+func printStats() {
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading sidecar files: %v\n", err)
+		os.Exit(exitFatal)
+	}
+	if len(sidecars) == 0 {
+		fmt.Println(tr("No backups yet!"))
+		return
+	}
+
+	sort.Slice(sidecars, func(i, j int) bool {
+		return sidecars[i].Time.Before(sidecars[j].Time)
+	})
+
+	total := targetStats{}
+	perTarget := make(map[string]*targetStats)
+	var targets []string
+
+	type month struct {
+		Name  string
+		Count int
+		Size  int64
+	}
+	var months []month
+
+	for _, sidecar := range sidecars {
+		target, ok := perTarget[sidecar.Of()]
+		if !ok {
+			target = &targetStats{Of: sidecar.Of()}
+			perTarget[sidecar.Of()] = target
+			targets = append(targets, sidecar.Of())
+		}
+
+		originalSize, files, known := sidecar.Original()
+
+		for _, t := range []*targetStats{target, &total} {
+			t.Count++
+			t.ArchiveSize += sidecar.ParentSize
+			if known {
+				t.OriginalSize += originalSize
+				t.Files += files
+				t.MeasuredSize += sidecar.ParentSize
+			}
+			t.Last = sidecar
+		}
+
+		name := inZone(sidecar.Time).Format("2006-01")
+		if len(months) == 0 || months[len(months)-1].Name != name {
+			months = append(months, month{Name: name})
+		}
+		months[len(months)-1].Count++
+		months[len(months)-1].Size += sidecar.ParentSize
+	}
+
+	oldest := sidecars[0]
+	newest := sidecars[len(sidecars)-1]
+
+	fmt.Printf("Backups: %d (%s)\n", total.Count, humanize.IBytes(uint64(total.ArchiveSize)))
+	fmt.Printf("Compression ratio: %s\n", total.Ratio())
+	fmt.Printf("Files stored: %d\n", total.Files)
+	fmt.Printf("Oldest: %s (%v)\n", formatTime(oldest.Time), oldest.ID)
+	fmt.Printf("Newest: %s (%v)\n", formatTime(newest.Time), newest.ID)
+
+	fmt.Println("\nPer target:")
+	sort.Strings(targets)
+	for _, of := range targets {
+		t := perTarget[of]
+		fmt.Printf("\t%s\n\t\t%d backups | %s | %d files | ratio %s | last %s\n",
+			t.Of,
+			t.Count,
+			humanize.IBytes(uint64(t.ArchiveSize)),
+			t.Files,
+			t.Ratio(),
+			formatTime(t.Last.Time),
+		)
+	}
+
+	fmt.Println("\nGrowth:")
+	var running int64
+	for _, m := range months {
+		running += m.Size
+		fmt.Printf("\t%s: +%d backups, +%s (%s total)\n",
+			m.Name,
+			m.Count,
+			humanize.IBytes(uint64(m.Size)),
+			humanize.IBytes(uint64(running)),
+		)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// status shows when each path was last backed up and flags the ones that went
+// longer than stale_after without one, exiting with exitStale for monitoring
+
+// targetAge is when a path was last backed up
+type targetAge struct {
+	Of string
+	// zero if it never was, eg. a path of a profile that hasn't run yet
+	Last    time.Time
+	Backups int
+	// the machine that made the newest backup
+	Host string
+}
+
+// lastBackedUp returns the time sidecar counts as a backup at, which is when a
+// backup last found nothing changed since it
+func lastBackedUp(sidecar SidecarData) time.Time {
+	if sidecar.LastSeen.After(sidecar.Time) {
+		return sidecar.LastSeen
+	}
+	return sidecar.Time
+}
+
+// targetAges returns every path there are backups of, and the single paths of
+// profiles, sorted by path
+func targetAges(sidecars []SidecarData) []targetAge {
+	byTarget := make(map[string]*targetAge)
+	for _, sidecar := range sidecars {
+		age, ok := byTarget[sidecar.Of()]
+		if !ok {
+			age = &targetAge{Of: sidecar.Of()}
+			byTarget[sidecar.Of()] = age
+		}
+		age.Backups++
+		if last := lastBackedUp(sidecar); last.After(age.Last) {
+			age.Last = last
+			age.Host = sidecar.Host
+		}
+	}
+	for _, prof := range config.Profiles {
+		if len(prof.Paths) != 1 {
+			// combined backups are of a path that depends on what's in them
+			continue
+		}
+		of := targetPath(prof.Paths[0])
+		if _, ok := byTarget[of]; !ok {
+			byTarget[of] = &targetAge{Of: of}
+		}
+	}
+
+	ages := make([]targetAge, 0, len(byTarget))
+	for _, age := range byTarget {
+		ages = append(ages, *age)
+	}
+	slices.SortFunc(ages, func(a, b targetAge) int { return strings.Compare(a.Of, b.Of) })
+	return ages
+}
+
+// staleBefore returns the time backups have to be newer than not to be stale,
+// false if stale_after is empty
+func staleBefore(now time.Time) (time.Time, bool) {
+	if config.StaleAfter == "" {
+		return time.Time{}, false
+	}
+	cutoff, err := timeAgo(config.StaleAfter, now)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return cutoff, true
+}
+
+// Stale reports whether the path went without a backup for longer than stale_after
+func (a targetAge) Stale(now time.Time) bool {
+	cutoff, ok := staleBefore(now)
+	return ok && a.Last.Before(cutoff)
+}
+
+// Describe returns how long ago the path was last backed up
+func (a targetAge) Describe() string {
+	if a.Last.IsZero() {
+		return "never backed up"
+	}
+	return fmt.Sprintf("last backed up %s (%s)", formatTime(a.Last), humanize.Time(a.Last))
+}
+
+func statusCommand() {
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+	ages := targetAges(sidecars)
+	if len(ages) == 0 {
+		fmt.Println(tr("No backups yet!"))
+		return
+	}
+
+	now := time.Now()
+	thisHost := hostname()
+	stale := 0
+	for _, age := range ages {
+		of := age.Of
+		if age.Host != "" && age.Host != thisHost {
+			of = fmt.Sprintf("%s (%s)", of, age.Host)
+		}
+		// padded by hand, the escape codes would throw off %-5s
+		mark := paint(os.Stdout, "ok", "ok") + "   "
+		if age.Stale(now) {
+			mark = paint(os.Stdout, "stale", "STALE")
+			stale++
+		}
+		fmt.Printf("%s %s\n\t%s, %d backups\n", mark, of, age.Describe(), age.Backups)
+	}
+
+	if stale > 0 {
+		fmt.Fprint(os.Stderr, "\n"+paint(os.Stderr, "stale", fmt.Sprintf("%d of %d paths weren't backed up within %s", stale, len(ages), config.StaleAfter))+"\n")
+		exitCode = exitStale
+	}
+}
+
+// warnStale warns about the paths among sidecars that are stale, for list
+func warnStale(sidecars []SidecarData) {
+	now := time.Now()
+	for _, age := range targetAges(sidecars) {
+		if age.Backups > 0 && age.Stale(now) {
+			fmt.Fprintln(os.Stderr, paint(os.Stderr, "warning", fmt.Sprintf("WARNING: '%s' was %s", age.Of, age.Describe())))
+		}
+	}
+}
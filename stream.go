@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// backupStdin stores whatever is piped into backman, eg. `pg_dump db | backman backup --stdin --name db`
+func backupStdin(name, format string, split int64) {
+	if format == "zip" {
+		fmt.Fprintln(os.Stderr, "zip archives can't hold piped data, use another --format")
+		os.Exit(exitUsage)
+	}
+
+	sidecar := SidecarData{
+		BackupOf: "stdin:" + name,
+		Stream:   name,
+	}
+
+	writeBackup(sidecar, format, func(backupName string) (*Manifest, error) {
+		fmt.Println("Compressing stdin...")
+		return compressStream(os.Stdin, name, backupName, format, split)
+	})
+}
+
+// compressStream compresses r into dst, returning a manifest with name as its only file
+func compressStream(r io.Reader, name, dst, format string, split int64) (*Manifest, error) {
+	f, err := createArchive(dst, split)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	enc, err := compressWriter(f, format, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := newFileHash()
+	size, err := io.Copy(io.MultiWriter(enc, hasher), r)
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	manifest := newManifest()
+	manifest.Files[name] = ManifestEntry{
+		Size:    size,
+		ModTime: time.Now(),
+		SHA256:  hashString(hasher),
+	}
+	return manifest, nil
+}
+
+// restoreToStdout writes the backed up data, or a tar of the backed up files, to stdout.
+// zip archives are written as they are
+func restoreToStdout(sidecar SidecarData) {
+	checkSignature(sidecar.ParentPath)
+
+	var r io.ReadCloser
+	var err error
+	if formatOf(sidecar.ParentPath) == "zip" {
+		r, err = openArchiveData(sidecar.ParentPath)
+	} else {
+		r, err = openArchive(sidecar.ParentPath)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error opening archive: ", err)
+		os.Exit(exitFatal)
+	}
+	defer r.Close()
+
+	out := bufio.NewWriterSize(os.Stdout, copyBufferSize)
+	if _, err := io.Copy(out, r); err != nil {
+		fmt.Fprintln(os.Stderr, "error decompressing archive: ", err)
+		os.Exit(exitFatal)
+	}
+	if err := out.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, "error writing to stdout: ", err)
+		os.Exit(exitFatal)
+	}
+}
+
+// restoreStream writes the data of a stream backup into dir/<name>
+func restoreStream(sidecar SidecarData, dir string, manifest *Manifest) ([]string, error) {
+	r, err := openArchive(sidecar.ParentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	out, err := os.OpenFile(filepath.Join(dir, filepath.Base(sidecar.Stream)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	hasher := newFileHash()
+	if _, err := io.Copy(io.MultiWriter(out, hasher), r); err != nil {
+		return nil, err
+	}
+
+	if manifest != nil && manifest.Files[sidecar.Stream].SHA256 != hashString(hasher) {
+		return []string{sidecar.Stream}, nil
+	}
+	return nil, nil
+}
+
+// checkStream compares the data of a stream backup against its manifest
+func checkStream(sidecar SidecarData, manifest *Manifest) ([]string, error) {
+	r, err := openArchive(sidecar.ParentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	hasher := newFileHash()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return nil, err
+	}
+
+	entry, ok := manifest.Files[sidecar.Stream]
+	if ok && entry.SHA256 != hashString(hasher) {
+		return []string{sidecar.Stream}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// exportBackup copies a backup's archive, sidecar and manifest into dir
+func exportBackup(ref string, dir string) {
+	sidecar := findSidecar(ref)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "error creating export directory: ", err)
+		os.Exit(exitFatal)
+	}
+
+	dst := filepath.Join(dir, filepath.Base(sidecar.ParentPath))
+	if _, err := os.Stat(dst + ".json"); err == nil {
+		fmt.Fprintf(os.Stderr, "'%s' already exists\n", dst)
+		os.Exit(exitFatal)
+	}
+
+	// older or unsigned backups have no manifest, signature or parity, backupFiles leaves them out
+	for _, file := range backupFiles(sidecar) {
+		if err := copyFile(file, filepath.Join(dir, filepath.Base(file))); err != nil {
+			fmt.Fprintln(os.Stderr, "error exporting backup: ", err)
+			removeArchive(dst)
+			os.Remove(dst + ".json")
+			os.Exit(exitFatal)
+		}
+	}
+
+	fmt.Printf("Exported backup %d to '%s'\n", sidecar.ID, dst)
+	if sidecar.Dict != 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: The archive needs zstd dictionary %d to be read, copy '%s' along with it\n", sidecar.Dict, dictPath(sidecar.Dict))
+	}
+}
+
+// importBackups registers exported backups into the archive dir.
+// path can be an archive, its sidecar, or a directory containing exported backups
+func importBackups(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading import path: ", err)
+		os.Exit(exitFatal)
+	}
+
+	var archives []string
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error reading import directory: ", err)
+			os.Exit(exitFatal)
+		}
+		for _, entry := range entries {
+			if filepath.Ext(entry.Name()) == ".json" && !entry.IsDir() {
+				archives = append(archives, filepath.Join(path, strings.TrimSuffix(entry.Name(), ".json")))
+			}
+		}
+	} else {
+		archives = append(archives, strings.TrimSuffix(path, ".json"))
+	}
+
+	if err := os.MkdirAll(config.ArchiveDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "error creating backup directory: ", err)
+		os.Exit(exitFatal)
+	}
+
+	// parents are older than their incremental backups, so they're imported first
+	// and ids knows what they were renumbered to by the time their children are
+	slices.SortStableFunc(archives, func(a, b string) int {
+		return sidecarTime(a).Compare(sidecarTime(b))
+	})
+	ids := make(map[uint16]uint16)
+
+	var imported int
+	for _, archive := range archives {
+		sidecar, err := importBackup(archive, ids)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error importing '%s': %v\n", archive, err)
+			continue
+		}
+		fmt.Printf("Imported '%s' as %d\n", filepath.Base(archive), sidecar.ID)
+		imported++
+	}
+
+	fmt.Printf("Imported %d backups!\n", imported)
+	if imported == 0 && len(archives) > 0 {
+		os.Exit(exitFatal)
+	}
+	if imported < len(archives) {
+		exitCode = exitPartial
+	}
+}
+
+// sidecarTime returns when the exported backup archive was made, zero if its
+// sidecar can't be read
+func sidecarTime(archive string) time.Time {
+	data, err := os.ReadFile(archive + ".json")
+	if err != nil {
+		return time.Time{}
+	}
+	sidecar, _ := parseSidecar(data, archive)
+	return sidecar.Time
+}
+
+// importBackup copies an exported backup into the archive dir, giving it a new ID
+// if its own is taken. ids maps the IDs of backups imported along with it to the
+// ones they got, so an incremental backup stays on its own parent. it's updated
+// with archive's, nil when importing a single backup
+func importBackup(archive string, ids map[uint16]uint16) (SidecarData, error) {
+	data, err := os.ReadFile(archive + ".json")
+	if err != nil {
+		return SidecarData{}, err
+	}
+	sidecar, err := parseSidecar(data, archive)
+	if err != nil {
+		return sidecar, fmt.Errorf("error parsing sidecar: %w", err)
+	}
+	volumes := archiveVolumes(archive)
+	if len(volumes) == 0 {
+		_, err := os.Stat(archive)
+		return sidecar, err
+	}
+
+	existing, err := readSidecars()
+	if err != nil {
+		return sidecar, err
+	}
+
+	var usedIDs []uint16
+	idTaken := false
+	for _, other := range existing {
+		usedIDs = append(usedIDs, other.ID)
+		idTaken = idTaken || other.ID == sidecar.ID
+	}
+	trashed, err := trashedIDs()
+	if err != nil {
+		return sidecar, err
+	}
+	usedIDs = append(usedIDs, trashed...)
+	idTaken = idTaken || slices.Contains(trashed, sidecar.ID)
+	exportedID := sidecar.ID
+	if idTaken {
+		if sidecar.ID, err = allocateID(usedIDs); err != nil {
+			return sidecar, err
+		}
+	}
+	if sidecar.ParentID != nil {
+		if parentID, ok := ids[*sidecar.ParentID]; ok {
+			sidecar.ParentID = &parentID
+		} else if parent := slices.IndexFunc(existing, func(s SidecarData) bool { return s.ID == *sidecar.ParentID }); parent < 0 {
+			fmt.Fprintf(os.Stderr, "WARNING: '%s' is incremental on backup %d, which isn't here. Import it too before restoring\n", filepath.Base(archive), *sidecar.ParentID)
+		} else if existing[parent].Of() != sidecar.Of() {
+			// IDs are reused, the backup here with it is of something else
+			return sidecar, fmt.Errorf("it's incremental on backup %d, but backup %d here is of '%s'. Import its parent along with it", *sidecar.ParentID, *sidecar.ParentID, existing[parent].BackupOf)
+		}
+	}
+
+	name := filepath.Base(archive)
+	if len(archiveVolumes(filepath.Join(config.ArchiveDir, name))) > 0 {
+		// the same archive was already imported, or is the one it was exported from
+		return sidecar, errors.New("archive already exists in the backup directory")
+	}
+	sidecar.ParentPath = filepath.Join(config.ArchiveDir, name)
+
+	for _, volume := range volumes {
+		if err := copyFile(volume, filepath.Join(config.ArchiveDir, filepath.Base(volume))); err != nil {
+			sidecar.DeleteAll()
+			return sidecar, err
+		}
+	}
+	for _, ext := range []string{".manifest", ".index", ".sig", ".par"} {
+		err = copyFile(archive+ext, sidecar.ParentPath+ext)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			sidecar.DeleteAll()
+			return sidecar, err
+		}
+	}
+
+	// written last, so an interrupted import doesn't leave a sidecar without an archive
+	if err := sidecar.Save(); err != nil {
+		sidecar.DeleteAll()
+		return sidecar, err
+	}
+
+	if ids != nil {
+		ids[exportedID] = sidecar.ID
+	}
+	return sidecar, nil
+}
+
+// foreignFormats maps the extensions of archives made by other tools to archiveFormats
+var foreignFormats = []struct{ Ext, Format string }{
+	{".tar.zstd", "tar.zstd"}, {".tar.zst", "tar.zstd"}, {".tzst", "tar.zstd"},
+	{".tar.gz", "tar.gz"}, {".tgz", "tar.gz"},
+	{".tar", "tar"},
+	{".zip", "zip"},
+}
+
+// foreignManifest reads every file in an archive made by another tool into a
+// manifest, so it can be verified and restored like any backup
+func foreignManifest(archive string) (*Manifest, error) {
+	manifest := newManifest()
+	links := make(map[string]bool)
+	var names []string
+	err := readEntries(archive, func(header *tar.Header, r io.Reader) error {
+		// plain tar keeps ../ paths, restoring them would write outside the destination
+		name := path.Clean(header.Name)
+		if name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("'%s' points outside of the archive", header.Name)
+		}
+		names = append(names, name)
+		if header.Typeflag == tar.TypeSymlink {
+			links[name] = true
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		hasher := newFileHash()
+		if _, err := copyBuffered(hasher, r); err != nil {
+			return err
+		}
+		manifest.Files[header.Name] = ManifestEntry{
+			Size:    header.Size,
+			ModTime: header.ModTime,
+			SHA256:  hashString(hasher),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the same goes for entries under a link, whichever comes first in the archive
+	for _, name := range names {
+		if link, ok := throughLink(name, links); ok {
+			return nil, fmt.Errorf("'%s' is under the symlink '%s', restoring it would write outside the destination", name, link)
+		}
+	}
+	if len(manifest.Files) == 0 {
+		return nil, errors.New("there are no files in it")
+	}
+	return manifest, nil
+}
+
+// importArchive registers an archive made by another tool, eg. plain tar, as a
+// backup of of. the archive is copied into the archive dir, or moved with move
+func importArchive(archive, of string, move bool) {
+	format := ""
+	for _, foreign := range foreignFormats {
+		if strings.HasSuffix(strings.ToLower(archive), foreign.Ext) {
+			format = foreign.Format
+			break
+		}
+	}
+	if format == "" {
+		fmt.Fprintf(os.Stderr, "Can't tell the format of '%s', it has to be a .tar, .tar.gz, .tgz, .tar.zst or .zip\n", archive)
+		os.Exit(exitUsage)
+	}
+	info, err := os.Stat(archive)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading archive: ", err)
+		os.Exit(exitFatal)
+	}
+
+	sidecar := SidecarData{
+		BackupOf: of,
+		Time:     info.ModTime().UTC(),
+		Note:     "imported from " + filepath.Base(archive),
+	}
+	if !isRemoteTarget(of) {
+		if sidecar.BackupOf, err = filepath.Abs(of); err != nil {
+			fmt.Fprintln(os.Stderr, "error getting absolute path of target: ", err)
+			os.Exit(exitFatal)
+		}
+	}
+
+	if err := os.MkdirAll(config.ArchiveDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "error creating backup directory: ", err)
+		os.Exit(exitFatal)
+	}
+	sidecar.ParentPath = filepath.Join(config.ArchiveDir, generateUUID()+"."+format)
+	if move {
+		err = os.Rename(archive, sidecar.ParentPath)
+	}
+	if !move || err != nil {
+		err = copyFile(archive, sidecar.ParentPath)
+	}
+	if err != nil {
+		os.Remove(sidecar.ParentPath)
+		fmt.Fprintln(os.Stderr, "error copying archive: ", err)
+		os.Exit(exitFatal)
+	}
+	undo := func(msg string, err error) {
+		if move {
+			os.Rename(sidecar.ParentPath, archive)
+		}
+		sidecar.DeleteAll()
+		fmt.Fprintln(os.Stderr, msg, err)
+		os.Exit(exitFatal)
+	}
+
+	// the copy is read instead of the original, so it's what the manifest vouches for
+	fmt.Println("Reading archive...")
+	manifest, err := foreignManifest(sidecar.ParentPath)
+	if err != nil {
+		undo("error reading archive: ", err)
+	}
+	if err := writeManifest(sidecar.ManifestPath(), manifest); err != nil {
+		undo("error writing manifest: ", err)
+	}
+	sidecar.OriginalSize, sidecar.Files = manifest.Stored()
+	sidecar.Dict = archiveDict(sidecar.ParentPath)
+
+	if config.SignWith != "" {
+		fmt.Println("Signing archive...")
+		if err := signArchive(sidecar.ParentPath); err != nil {
+			undo("error signing archive: ", err)
+		}
+	}
+	if config.ParityPercent > 0 {
+		fmt.Println("Generating parity...")
+		if err := writeParity(sidecar.ParentPath, config.ParityPercent); err != nil {
+			undo("error generating parity: ", err)
+		}
+	}
+
+	sidecars, err := readSidecars()
+	if err != nil {
+		undo(tr("error reading sidecar files: "), err)
+	}
+	trashed, err := trashedIDs()
+	if err != nil {
+		undo("error reading the trash: ", err)
+	}
+	usedIDs := trashed
+	for _, other := range sidecars {
+		usedIDs = append(usedIDs, other.ID)
+	}
+	if sidecar.ID, err = allocateID(usedIDs); err != nil {
+		undo("error allocating ID: ", err)
+	}
+	// written last, so an interrupted import doesn't leave a sidecar without an archive
+	if err := sidecar.Save(); err != nil {
+		undo("error writing sidecar: ", err)
+	}
+
+	fmt.Printf("Imported '%s' as %d, %d files (%s)\n", filepath.Base(archive), sidecar.ID, sidecar.Files, humanize.IBytes(uint64(sidecar.OriginalSize)))
+}
+
+func importArchiveCommand(args []string) {
+	fs := flag.NewFlagSet("import-archive", flag.ContinueOnError)
+	of := fs.String("of", "", "the directory the archive is a backup of")
+	move := fs.Bool("move", false, "move the archive into the archive dir instead of copying it")
+	args = parseFlags(fs, args)
+	if len(args) != 1 || *of == "" {
+		usageError("import-archive")
+	}
+	importArchive(args[0], *of, *move)
+}
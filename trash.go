@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// deleted backups are moved into ArchiveDir/.trash, with the time in their
+// sidecar, and removed for good once they're older than trash_days
+
+func trashDir() string {
+	return filepath.Join(config.ArchiveDir, ".trash")
+}
+
+// trashBackup moves a backup's files into the trash, or deletes them if the trash is disabled
+func trashBackup(sidecar SidecarData) error {
+	if config.TrashDays == 0 {
+		sidecar.DeleteAll()
+		return nil
+	}
+
+	if err := os.MkdirAll(trashDir(), 0700); err != nil {
+		return err
+	}
+	sidecar.TrashedAt = time.Now().UTC()
+	if err := sidecar.Save(); err != nil {
+		return err
+	}
+
+	// the sidecar goes first, readSidecars deletes sidecars without an archive
+	files := backupFiles(sidecar)
+	slices.Reverse(files)
+	for _, file := range files {
+		if err := os.Rename(file, filepath.Join(trashDir(), filepath.Base(file))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readTrash reads the sidecars of the backups in the trash, their ParentPath is in the trash
+func readTrash() ([]SidecarData, error) {
+	entries, err := os.ReadDir(trashDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var trashed []SidecarData
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" || entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(trashDir(), entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sidecar, err := parseSidecar(data, strings.TrimSuffix(path, ".json"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Error parsing sidecar file in the trash. (%s)\n", entry.Name())
+			continue
+		}
+		sidecar.ParentSize = archiveSize(sidecar.ParentPath)
+		trashed = append(trashed, sidecar)
+	}
+	return trashed, nil
+}
+
+// trashedIDs returns the IDs of the backups in the trash, which aren't given to
+// new backups so they can still be undeleted
+func trashedIDs() ([]uint16, error) {
+	trashed, err := readTrash()
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint16
+	for _, sidecar := range trashed {
+		ids = append(ids, sidecar.ID)
+	}
+	return ids, nil
+}
+
+// trashExpiry returns when a trashed backup is removed for good
+func trashExpiry(sidecar SidecarData) time.Time {
+	return sidecar.TrashedAt.AddDate(0, 0, config.TrashDays)
+}
+
+// emptyTrash deletes the expired backups in the trash, or all of them
+func emptyTrash(all bool) (int, error) {
+	trashed, err := readTrash()
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, sidecar := range trashed {
+		if all || time.Now().After(trashExpiry(sidecar)) {
+			sidecar.DeleteAll()
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// expireTrash is run after deleting backups, so the trash doesn't grow forever
+func expireTrash() {
+	if _, err := emptyTrash(false); err != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: Could not clean up the trash: ", err)
+	}
+}
+
+// undeleteBackup moves a backup out of the trash
+func undeleteBackup(ref string) {
+	trashed, err := readTrash()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the trash: ", err)
+		os.Exit(exitFatal)
+	}
+	sidecars, err := readSidecars()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, tr("error reading sidecar files: "), err)
+		os.Exit(exitFatal)
+	}
+
+	sidecar, err := matchSidecar(trashed, ref)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err, "in the trash")
+		os.Exit(exitFatal)
+	}
+	if slices.ContainsFunc(sidecars, func(s SidecarData) bool { return s.ID == sidecar.ID }) {
+		fmt.Fprintf(os.Stderr, "ID %d is already used by another backup\n", sidecar.ID)
+		os.Exit(exitFatal)
+	}
+
+	// the sidecar goes last, so it always has its archive
+	for _, file := range backupFiles(sidecar) {
+		if err := os.Rename(file, filepath.Join(config.ArchiveDir, filepath.Base(file))); err != nil {
+			fmt.Fprintln(os.Stderr, "error moving backup out of the trash: ", err)
+			os.Exit(exitFatal)
+		}
+	}
+	sidecar.ParentPath = filepath.Join(config.ArchiveDir, filepath.Base(sidecar.ParentPath))
+	sidecar.TrashedAt = time.Time{}
+	if err := sidecar.Save(); err != nil {
+		fmt.Fprintln(os.Stderr, "error writing sidecar: ", err)
+		os.Exit(exitFatal)
+	}
+
+	if sidecar.ParentID != nil && !slices.ContainsFunc(sidecars, func(s SidecarData) bool { return s.ID == *sidecar.ParentID }) {
+		fmt.Fprintf(os.Stderr, "WARNING: This backup is incremental on backup %d, which is still deleted. Undelete it too before restoring\n", *sidecar.ParentID)
+	}
+	fmt.Println("Undeleted successfully!")
+}
+
+func listTrash() {
+	trashed, err := readTrash()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error reading the trash: ", err)
+		os.Exit(exitFatal)
+	}
+	if len(trashed) == 0 {
+		fmt.Println("The trash is empty")
+		return
+	}
+
+	for _, sidecar := range trashed {
+		fmt.Printf("%d:\n\t%s\n\tdeleted %s, gone after %s | %s\n",
+			sidecar.ID,
+			sidecar.BackupOf,
+			formatTime(sidecar.TrashedAt),
+			formatTime(trashExpiry(sidecar)),
+			humanize.IBytes(uint64(sidecar.ParentSize)),
+		)
+	}
+}
+
+func trashCommand(args []string) {
+	if len(args) == 0 {
+		usageError("trash")
+	}
+
+	switch args[0] {
+	case "list":
+		listTrash()
+	case "empty":
+		fs := flag.NewFlagSet("trash empty", flag.ContinueOnError)
+		iKnow := iKnowFlag(fs)
+		parseFlags(fs, args[1:])
+		checkAppendOnly("empty the trash", *iKnow)
+		deleted, err := emptyTrash(true)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error emptying the trash: ", err)
+			os.Exit(exitFatal)
+		}
+		fmt.Printf("Deleted %d backups for good!\n", deleted)
+	default:
+		usageError("trash")
+	}
+}
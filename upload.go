@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// uploads that fail because of the network are retried with exponential backoff,
+// and chunked uploads remember how far they got in a state file next to the
+// config, so running push or sync again picks up where an interrupted one stopped
+
+// temporaryError marks a failure worth retrying, eg. a 503 or rate limit response
+type temporaryError struct {
+	err error
+}
+
+func (e temporaryError) Error() string { return e.err.Error() }
+func (e temporaryError) Unwrap() error { return e.err }
+
+// isTemporary tells whether err is a temporaryError or a network error
+func isTemporary(err error) bool {
+	var temporary temporaryError
+	// http.Client wraps every error it returns, none of them come from the server
+	var network *url.Error
+	return errors.As(err, &temporary) || errors.As(err, &network)
+}
+
+// withRetry calls fn until it succeeds, fails for good or upload_retries runs
+// out, waiting twice as long after each try up to a minute
+func withRetry(what string, fn func() error) error {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isTemporary(err) || attempt >= config.UploadRetries {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: %s failed, retrying in %s: %v\n", what, delay, err)
+		time.Sleep(delay)
+		delay = min(delay*2, time.Minute)
+	}
+}
+
+// uploadState is how far a chunked upload got
+type uploadState struct {
+	SessionID string    `json:"session_id"`
+	Offset    int64     `json:"offset"`
+	Started   time.Time `json:"started"`
+	// size and modification time of the local file, it's uploaded again from the
+	// start if they change
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func uploadStatePath() string {
+	return filepath.Join(filepath.Dir(getConfigPath()), "uploads.json")
+}
+
+// readUploadStates returns the unfinished uploads by remote path
+func readUploadStates() map[string]uploadState {
+	states := make(map[string]uploadState)
+	data, err := os.ReadFile(uploadStatePath())
+	if err == nil {
+		err = json.Unmarshal(data, &states)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		// losing the state only means starting the uploads over
+		fmt.Fprintln(os.Stderr, "WARNING: ignoring unreadable upload state: ", err)
+	}
+	return states
+}
+
+// resumableUpload returns the state of the upload of info to key, if it can be resumed
+func resumableUpload(key string, info os.FileInfo, maxAge time.Duration) (uploadState, bool) {
+	state, ok := readUploadStates()[key]
+	if !ok || state.Size != info.Size() || !state.ModTime.Equal(info.ModTime()) || time.Since(state.Started) > maxAge {
+		return uploadState{}, false
+	}
+	return state, true
+}
+
+// saveUploadState records the state of the upload to key, nil forgets it
+func saveUploadState(key string, state *uploadState) error {
+	states := readUploadStates()
+	if state == nil {
+		if _, ok := states[key]; !ok {
+			return nil
+		}
+		delete(states, key)
+	} else {
+		states[key] = *state
+	}
+
+	if len(states) == 0 {
+		if err := os.Remove(uploadStatePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(uploadStatePath()), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(uploadStatePath(), data, 0600)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// usageLines is the help menu. a line with " => " starts the entry of the
+// command named by its first word, the more indented lines after it belong to
+// it, so `backman help [command]` and `backman [command] --help` can print just
+// the entries of one command
+var usageLines = []string{
+	"Usage:",
+	"	Any config key can be overridden with --key=value (eg. --archive-dir=/mnt/backups)",
+	"	or a BACKMAN_KEY environment variable (eg. BACKMAN_ARCHIVE_DIR)",
+	"	--config [path] or BACKMAN_CONFIG uses another config file, eg. to keep work and personal backups apart",
+	"		the dropbox token and upload state are kept next to it",
+	"	--no-color or NO_COLOR prints without colors, which are only used on terminals anyway",
+	"	--low-priority runs any command at the lowest CPU and IO priority on fewer cores",
+	"	Exit codes: 0 success, 1 invalid usage or config, 2 finished but left files out, 3 failed, 4 verification failed, 5 stale backups (status)",
+	"	Prompts take default_answer with --non-interactive or when stdin isn't a terminal",
+	"	Messages are shown in language, or going by LC_ALL, LC_MESSAGES or LANG, where there's a translation",
+	"	[id] is a backup's ID or a unique prefix of its UUID, both shown by list",
+	"	help [command] => Show this menu, or only the part about command, like [command] --help",
+	"	info [id] => Print everything about a backup, or the config without an [id]",
+	"	backup [paths...] => Which directories/files to backup, defaults to `.`",
+	"		ssh://[user@]host[:port]/path backs up a directory of another machine, which needs tar",
+	"		docker:[volume|container] backs up a docker volume, or every volume and bind mount of a container",
+	"		pg://[user@][host[:port]/]dbname, mysql://... or sqlite:///path/to/file.db dumps a database with pg_dump, mysqldump or sqlite3",
+	"		[kind]:[arg] backs up what a backman-backend-[kind] on the PATH dumps, see `backends`",
+	"		--pause => Pause the containers using a docker volume while it's backed up",
+	"		--follow-symlinks => Archive what symlinks point to instead of the links",
+	"		--separate => Make one backup per path instead of a combined one",
+	"		--xattrs => Store extended attributes and ACLs (linux only)",
+	"		--snapshot [btrfs|zfs|lvm] => Back up from a temporary filesystem snapshot",
+	"		--stdin --name [name] => Back up data piped into backman, eg. a database dump",
+	"		--incremental => Only store the changes since the last backup of the same paths",
+	"		--format [tar.zstd|tar.gz|tar|zip] => Archive format, zip for windows or tar for already compressed media",
+	"		--max-file-size [size] => Leave out files bigger than size, eg. 500M",
+	"		--newer-than [duration] => Only store files modified within duration, eg. 7d or 2w, or since a date",
+	"		--strict => Abort on the first file that can't be read, instead of leaving it out with a warning",
+	"		--retries [n] => How often a file that changes while it's read is read again, before it's flagged",
+	"		--split-size [size] => Write the archive as numbered volumes of size, eg. 4G (SI, 4GiB for IEC)",
+	"	restore [id] => Restores from a backup, use `list` to get ID's",
+	"		backups of databases are replayed into the database with psql, mysql or sqlite3, after asking",
+	"	restore [id] ssh://[user@]host[:port]/path => Restore onto another machine with ssh and tar",
+	"	restore [id] pg://...|mysql://...|sqlite://... => Replay a database backup into another database of the same kind",
+	"		--latest [dir] => Restore the newest backup of dir instead, defaults to `.`",
+	"		--xattrs => Reapply stored extended attributes and ACLs",
+	"		--stdout => Write the data (or a tar of the files) to stdout instead",
+	"		--on-conflict [ask|overwrite|skip|rename|newer] => What to do with files that already exist",
+	"		--dry-run => Only list the files that would be restored and check the free space",
+	"		--force => Restore even if there doesn't seem to be enough free space",
+	"		--show-diff => List the files only in the backup, only on disk and modified, then ask before restoring",
+	"		--delta [dir] => Bring dir back to the backup's state, only writing the files that differ or are missing",
+	"		--include [glob] --exclude [glob] => Only restore matching files, eg. '*.sql' or 'cache/**', both can be repeated",
+	"		--owners => Give the files the owners stored in the backup, by name if they exist here, else by id",
+	"		--map-user [old=new] --map-group [old=new] => Restore the files of a user or group as another one, by name or id, implies --owners",
+	"	verify [id] => Check a backup's signature and contents",
+	"	scrub => Verify the backups checked longest ago, scrub_percent of them, to catch bit rot early",
+	"		--percent [n] => Verify this percentage of the backups instead",
+	"		schedule it with `install-schedule --scrub`",
+	"	repair [id] => Rebuild a damaged archive from its parity, see parity_percent",
+	"	annotate [id] [text] => Attach a note to a backup, omit text to remove it",
+	"	list [query] => List backups with filter, omit query to list all",
+	"		the query is fuzzy matched, or scoped to a field with eg. of:projects time:2024-05 host:laptop",
+	"		--filter => Hide the backups that don't match instead of greying them out",
+	"		--host [name] => Only list backups made on that machine",
+	"		--sort [id|time|size|name] => Sort order, defaults to time",
+	"		--reverse => Reverse the order",
+	"		--columns [id,uuid,of,time,size,...] => Print these columns tab separated, one backup per line",
+	"		--table => Print an aligned table with a header, of --columns or the default ones",
+	"		--since [when] --until [when] => Only list backups made in that window, a date like 2024-05-01 or a duration ago like 7d",
+	"		--utc => Show times in UTC instead of time_zone or the system's zone",
+	"		--group => One line per backed up path with the number and size of its backups",
+	"		--all => With --group, list the backups under each path too",
+	"	search [pattern] => Find the backups that contain matching files, and which version of them",
+	"		the pattern is a glob like restore --include takes, eg. 'invoices/2023.xlsx' or '*.sql'",
+	"		--regex => Match the pattern as a regular expression against the whole path instead",
+	"		--content [words] => Only find text files containing all of the words, the pattern can be left out then. needs content_index",
+	"		--of [dir] => Only search the backups of dir",
+	"		--since [when] --until [when] => Only search backups made in that window",
+	"	history [path] => List every backup that has the file, with its size, hash and mtime in each",
+	"		the path is one on disk, or the path inside the archives as search prints it",
+	"		--of [dir] => Only list the backups of dir",
+	"	cat [id] [path] => Print a single file of a backup to stdout, without restoring anything",
+	"		--raw => Print binary files to the terminal too, instead of refusing",
+	"	delete [id] => Delete a backup with given ID",
+	"		--cascade => Also delete the incremental backups that depend on it",
+	"		--of [dir] --all => Delete every backup of dir instead, without an [id]",
+	"		--force, --yes => Don't ask for confirmation",
+	"		--i-know => Delete even though append_only is set, also for purge, trash empty, quarantine purge and fsck --remove-partial",
+	"		deleted backups stay in the trash for trash_days, see undelete",
+	"	purge [when] => Delete backups older than a date like 2024-05-01 or a duration like 30d, 1d12h or 1y6mo",
+	"		--between [from]..[to] => Delete the backups made in that window instead, either end may be left out",
+	"		--of [dir] => Only purge backups of dir, leaving the other directories' backups alone",
+	"		--force, --yes => Don't ask for confirmation",
+	"	undelete [id] => Bring a deleted backup back from the trash",
+	"	trash list => List deleted backups",
+	"	trash empty => Delete the backups in the trash for good",
+	"	fsck [names] => List interrupted backups and archives that lost their sidecar",
+	"		--remove-partial => Delete the interrupted backups",
+	"		--rebuild => Write new sidecars for them, guessing what they're backups of",
+	"		--of [path] => What they're backups of, instead of guessing",
+	"	quarantine list => List backups moved aside because their sidecar couldn't be parsed",
+	"	quarantine restore [name] => Bring a quarantined backup back once its sidecar is fixed",
+	"	quarantine purge [name] => Delete quarantined backups for good",
+	"		--force, --yes => Don't ask for confirmation",
+	"	dict train [dir] => Train a zstd dictionary on the small files in dir's backups, defaults to `.`",
+	"		new tar.zstd backups of dir are compressed with it, which helps with many small similar files",
+	"	dict list => List the trained dictionaries",
+	"	dict remove [dict id] => Remove a dictionary that no backup uses",
+	"	run --profile [name] => Run a profile of the config: before hook, backup, verify, prune, mirror, after hook and notify",
+	"		stops at the first step that fails, prunes only after a new backup checked out, and prints a summary",
+	"	install-schedule [paths...] => Back up paths daily with systemd (user timer), launchd or the windows task scheduler",
+	"		--daily [HH:MM] => Time of day, defaults to 03:00",
+	"		--name [name] => Name of the schedule, defaults to the first path's directory name",
+	"		--incremental => Make incremental backups",
+	"		--profile [name] => Run a profile of the config instead of backing up paths",
+	"		--scrub => Run scrub instead of backing up paths",
+	"		--dry-run => Only print the units, agent or task that would be installed",
+	"		--remove --name [name] => Remove a schedule instead",
+	"	status => When each path was last backed up, flagging the ones not backed up within stale_after",
+	"	stats => Summarize backup sizes, compression ratios and growth",
+	"	rebind [id] [new path] => Make a backup one of new path, after what it's of was moved or mounted elsewhere",
+	"		--of [old path] => Rebind every backup of old path or a path inside it instead, without an [id]",
+	"		see path_aliases to map paths without changing the backups",
+	"	catalog list => List the bundles of the config, sidecars, master key and dictionaries",
+	"		they're saved in the archive dir after every command that changes them, see catalog_versions",
+	"	catalog save => Save a bundle now, if anything changed since the newest one",
+	"	catalog restore [bundle] => Bring back the files of a bundle that were lost, from the newest one by default",
+	"		--force => Overwrite the files that exist too",
+	"	migrate => Rewrite sidecars of older backups in the current format",
+	"		--dry-run => Only list the sidecars that would be rewritten",
+	"	rekey => Unlock the master key of encrypted backups with a new passphrase from now on, typed in or from BACKMAN_NEW_PASSPHRASE",
+	"		only backman.key and its copies in the catalog, on the remote and the mirror change. the master key stays, so copies of the old backman.key kept elsewhere still open the backups with the old passphrase",
+	"		--rotate => Replace the master key too, rewrap the key in every encrypted file and upload the backups on the remote and the mirror again. run it again to continue if it's interrupted",
+	"		--new-key-file [path] => With this file instead",
+	"		--new-key-command [command] => With what this command prints, eg. to decrypt a secret with a PIV token",
+	"		--new-fido2 => By touching the plugged in FIDO2 security key, eg. a YubiKey, needs libfido2's tools",
+	"	keychain store => Type in the passphrase of the master key and remember it in the OS keychain",
+	"	keychain forget => Remove the passphrase from the OS keychain",
+	"	report => Sizes and durations of every backup run over time, per directory",
+	"		--of [dir] => Only report on backups of dir",
+	"		--since [when] --until [when] => Only runs in this time range",
+	"		--csv => Print every run as CSV instead",
+	"	export [id] [dir] => Copy a backup into another directory, eg. a USB drive",
+	"	import [path] => Add exported backups from an archive, sidecar or directory",
+	"	import-archive [archive] --of [dir] => Add a .tar, .tar.gz, .tar.zst or .zip made by another tool as a backup of dir",
+	"		--move => Move the archive into the archive dir instead of copying it",
+	"	import-restic [repo] [snapshots...] => Turn the snapshots of a restic repository into backups, all of them by default",
+	"	import-borg [repo] [archives...] => Turn the archives of a borg repository into backups, all of them by default",
+	"		snapshots that were imported before are skipped, the tools may ask for the repository password",
+	"		--incremental => Store each snapshot as the changes since the one before",
+	"		--path [path] => The absolute path the snapshots are of, if the tool doesn't know, can be repeated",
+	"	push [id] => Upload a backup to the configured remote",
+	"	flush => Upload the backups auto_push queued because the remote was unreachable",
+	"	pull [name] => Download a backup from the remote, use `remote list` to get names",
+	"	remote list => List backups on the remote",
+	"	remote login => Authenticate with the remote, if it needs it",
+	"	sync => Copy new backups to the mirror and delete the ones deleted here",
+	"	backends => List the backman-backend-[kind] executables on the PATH, usable as remote [kind]:[arg] or backup targets",
+	"	config init [--force] => Write a commented default config file",
+	"	config validate => Check the config file for problems",
+	"	config set [key] [value] => Change a single config value",
+	"	config edit => Open the config file in $EDITOR, then validate it",
+	"	completion [shell] => Print a completion script for bash, zsh or fish",
+	"	serve [addr] => Run the web UI, defaults to 127.0.0.1:8080",
+	"		prometheus metrics are served on /metrics",
+	"		other addresses than localhost need serve_password to be set",
+}
+
+func printUsage() {
+	for _, line := range usageLines {
+		fmt.Println(tr(line))
+	}
+}
+
+// commandUsage returns the lines of the help menu about command, none if it
+// isn't one
+func commandUsage(command string) []string {
+	var lines []string
+	in := false
+	for _, line := range usageLines {
+		if entry, ok := strings.CutPrefix(line, "\t"); ok && !strings.HasPrefix(entry, "\t") {
+			in = false
+			if name, _, _ := strings.Cut(entry, " "); strings.Contains(entry, " => ") && name == command {
+				in = true
+			}
+		}
+		if in {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// printCommandHelp prints the entries of command in the help menu to w, false
+// if it isn't a command
+func printCommandHelp(w io.Writer, command string) bool {
+	lines := commandUsage(command)
+	if len(lines) == 0 {
+		return false
+	}
+	fmt.Fprintln(w, tr("Usage:"))
+	for _, line := range lines {
+		fmt.Fprintln(w, tr(line))
+	}
+	fmt.Fprintln(w, tr("\tconfig keys can be overridden too, see `backman help`"))
+	return true
+}
+
+// helpRequested reports whether args ask for help with -h, -help or --help
+// before a "--"
+func helpRequested(args []string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			return false
+		}
+		if slices.Contains([]string{"-h", "-help", "--help"}, arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// helpCommand prints the help menu, or with a command only its entries
+func helpCommand(args []string) {
+	if len(args) == 0 {
+		printUsage()
+		return
+	}
+	if !printCommandHelp(os.Stdout, args[0]) {
+		fmt.Fprintf(os.Stderr, tr("Unknown command '%s', see `backman help`\n"), args[0])
+		os.Exit(exitUsage)
+	}
+}
+
+// usageError is where commands given the wrong arguments end up. it prints the
+// entries of command, or points at the help menu if there's no such command
+func usageError(command string) {
+	if !printCommandHelp(os.Stderr, command) {
+		fmt.Fprintf(os.Stderr, tr("Unknown command '%s', see `backman help`\n"), command)
+	}
+	os.Exit(exitUsage)
+}
+
+// parseFlags parses fs from args, allowing flags to appear after positional arguments.
+// returns the positional arguments. errors name the flag and point at the
+// command's help, --help prints it. fs is made with flag.ContinueOnError, the
+// flag package would exit with 2 on errors, which is exitPartial here
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	fs.SetOutput(io.Discard)
+	command, _, _ := strings.Cut(fs.Name(), " ")
+	var positional []string
+	for {
+		if err := fs.Parse(args); errors.Is(err, flag.ErrHelp) {
+			// commands left out of the help menu only have their flags
+			if !printCommandHelp(os.Stdout, command) {
+				fs.SetOutput(os.Stdout)
+				fs.PrintDefaults()
+			}
+			os.Exit(exitOK)
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v, see `backman %s --help`\n", fs.Name(), err, command)
+			os.Exit(exitUsage)
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
@@ -3,50 +3,132 @@ package main
 import (
 	"bufio"
 	"crypto/rand"
+	"flag"
 	"fmt"
 	"io"
 	"math"
 	"os"
+	"os/user"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/dustin/go-humanize"
 )
 
+// how many entries previews of what a command is about to do list before summarizing
+const previewLimit = 20
+
+// interactive reports whether prompts can be answered: non_interactive isn't set
+// and stdin is a terminal
+func interactive() bool {
+	if config.NonInteractive {
+		return false
+	}
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// /dev/null is a character device too, eg. for systemd services
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+// stdoutIsTerminal reports whether output goes to a terminal rather than a file or pipe
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 func askYesNo(prompt string) bool {
+	if !interactive() {
+		fmt.Printf(tr("%s [y/n]: %s (non-interactive, see default_answer)\n"), prompt, tr(config.DefaultAnswer))
+		return config.DefaultAnswer == "yes"
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 	for {
-		fmt.Printf("%s [y/n]: ", prompt)
+		fmt.Printf(tr("%s [y/n]: "), prompt)
 
 		input, err := reader.ReadString('\n')
 		if err != nil {
 			return false
 		}
 
-		input = strings.TrimSpace(strings.ToLower(input))
+		return isYes(input)
+	}
+}
 
-		switch input {
-		case "y", "yes":
-			return true
-		default:
-			return false
-		}
+// forceFlag adds --force and its alias --yes to fs, for commands that ask before removing things
+func forceFlag(fs *flag.FlagSet) *bool {
+	force := fs.Bool("force", false, "don't ask for confirmation")
+	fs.BoolVar(force, "yes", false, "same as --force")
+	return force
+}
+
+// iKnowFlag adds --i-know to fs, for commands that append_only refuses to run
+func iKnowFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("i-know", false, "delete backups even though append_only is set")
+}
+
+// checkAppendOnly exits when append_only is set, unless iKnow. what is what would
+// have been done, eg. "delete backups"
+func checkAppendOnly(what string, iKnow bool) {
+	if config.AppendOnly && !iKnow {
+		fmt.Fprintf(os.Stderr, "The archive dir is append only, refusing to %s. Pass --i-know to do it anyway\n", what)
+		os.Exit(exitFatal)
 	}
 }
 
-func readUint16Fatal(str string) uint16 {
-	rawID, err := strconv.Atoi(str)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "error parsing ID: ", err)
-		os.Exit(1)
+// confirmRemoval lists the backups about to be deleted and asks whether to go
+// ahead, unless force is set. total is how many backups there are
+func confirmRemoval(sidecars []SidecarData, total int, force bool) bool {
+	sort.Slice(sidecars, func(i, j int) bool {
+		return sidecars[i].Time.Before(sidecars[j].Time)
+	})
+
+	var size int64
+	for _, sc := range sidecars {
+		size += sc.ParentSize
+	}
+	fmt.Printf("Deleting %d backups (%s, from %s to %s):\n",
+		len(sidecars),
+		humanize.IBytes(uint64(size)),
+		humanize.Time(sidecars[0].Time),
+		humanize.Time(sidecars[len(sidecars)-1].Time),
+	)
+	for i, sc := range sidecars {
+		if i == previewLimit {
+			fmt.Printf("\t...and %d more\n", len(sidecars)-i)
+			break
+		}
+		fmt.Printf("\t%d: %s, %s | %s\n", sc.ID, sc.BackupOf, formatTime(sc.Time), humanize.IBytes(uint64(sc.ParentSize)))
+	}
+	if len(sidecars) == total {
+		fmt.Fprintln(os.Stderr, "WARNING: This is every backup there is!")
 	}
-	if rawID < 0 || rawID > math.MaxUint16 {
-		fmt.Fprintln(os.Stderr, "Please enter a valid ID. (0-65535)")
-		os.Exit(1)
+
+	if force {
+		return true
 	}
+	return askYesNo(tr("Continue?"))
+}
 
-	return uint16(rawID)
+// hostname returns the name of this machine, empty if it can't be found
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+// username returns the name of the user running backman
+func username() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
 }
 
 func closestMissing(nums []uint16) uint16 {
@@ -98,7 +180,7 @@ func generateUUID() string {
 	if _, err := io.ReadFull(rand.Reader, b); err != nil {
 		// realistically this is never gonna happen anyways
 		fmt.Fprintln(os.Stderr, "error reading from rand: ", err)
-		os.Exit(1)
+		os.Exit(exitFatal)
 	}
 
 	b[6] = (b[6] & 0x0f) | 0x40
@@ -114,21 +196,162 @@ func generateUUID() string {
 	return uuid
 }
 
-func parseDurationExt(s string) (time.Duration, error) {
-	if strings.HasSuffix(s, "d") {
-		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+// durationPart is one number and unit of a duration like 1y6mo or 2w3d12h.
+// mo and ms come before m, which is minutes
+var (
+	durationPart    = regexp.MustCompile(`(\d+)(y|mo|w|d|h|ms|m|s)`)
+	durationPattern = regexp.MustCompile(`^(?:\d+(?:y|mo|w|d|h|ms|m|s))+$`)
+)
+
+// the zone loaded for time_zone, kept since list formats many times
+var loadedZone struct {
+	name string
+	zone *time.Location
+}
+
+// displayZone returns where times are shown and dates typed in are, time_zone
+// or the system's zone. an invalid time_zone is caught by checkConfig
+func displayZone() *time.Location {
+	if config.TimeZone == "" {
+		return time.Local
+	}
+	if loadedZone.zone == nil || loadedZone.name != config.TimeZone {
+		zone, err := time.LoadLocation(config.TimeZone)
+		if err != nil {
+			return time.Local
+		}
+		loadedZone.name, loadedZone.zone = config.TimeZone, zone
+	}
+	return loadedZone.zone
+}
+
+// inZone returns t in the zone times are shown in. they're stored in UTC
+func inZone(t time.Time) time.Time {
+	return t.In(displayZone())
+}
+
+// formatTime formats t with time_format in the zone times are shown in
+func formatTime(t time.Time) string {
+	return inZone(t).Format(config.TimeFormat)
+}
+
+// timeAgo returns the time s before now. on top of what time.ParseDuration takes,
+// s can use y (years), mo (months), w (weeks) and d (days) combined like 1y6mo.
+// those follow the calendar: 1mo before March 31st is the last day of February,
+// and a day is a day even if it's 23 hours long because of daylight saving time
+func timeAgo(s string, now time.Time) (time.Time, error) {
+	if !durationPattern.MatchString(s) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid duration %q, use eg. 36h, 7d, 2w or 1y6mo", s)
+		}
+		return now.Add(-d), nil
+	}
+
+	var months, days int
+	var clock time.Duration
+	for _, part := range durationPart.FindAllStringSubmatch(s, -1) {
+		n, err := strconv.Atoi(part[1])
 		if err != nil {
-			return 0, err
+			return time.Time{}, fmt.Errorf("invalid duration %q: %w", s, err)
+		}
+		switch part[2] {
+		case "y":
+			months += 12 * n
+		case "mo":
+			months += n
+		case "w":
+			days += 7 * n
+		case "d":
+			days += n
+		default:
+			d, _ := time.ParseDuration(part[0])
+			clock += d
+		}
+	}
+	return subtractMonths(now, months).AddDate(0, 0, -days).Add(-clock), nil
+}
+
+// subtractMonths goes back n months from t, to the last day of the month if
+// it's shorter than t's day of the month
+func subtractMonths(t time.Time, n int) time.Time {
+	year, month, day := t.Date()
+	first := time.Date(year, month-time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(day, lastDay)-1)
+}
+
+// timeLayouts are the absolute times parseTimeArg accepts, in local time
+var timeLayouts = []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02 15:04:05", "2006-01-02T15:04"}
+
+// parseTimeArg reads a point in time, either a date like 2024-05-01 or a
+// duration like 7d or 1y6mo meaning that long ago, see timeAgo
+func parseTimeArg(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, displayZone()); err == nil {
+			return t, nil
 		}
-		return time.Duration(n) * 24 * time.Hour, nil
 	}
-	return time.ParseDuration(s)
+	t, err := timeAgo(s, time.Now())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a date (2006-01-02 [15:04]) nor a duration (eg. 7d or 1y6mo)", s)
+	}
+	return t, nil
+}
+
+// timeRange is a window of backup times, a zero end is open
+type timeRange struct {
+	Since time.Time
+	Until time.Time
 }
 
-func dirSize(root string) int64 {
+// parseTimeRange reads the two ends with parseTimeArg, empty ends stay open
+func parseTimeRange(since, until string) (timeRange, error) {
+	var r timeRange
+	var err error
+	if since != "" {
+		if r.Since, err = parseTimeArg(since); err != nil {
+			return r, err
+		}
+	}
+	if until != "" {
+		if r.Until, err = parseTimeArg(until); err != nil {
+			return r, err
+		}
+	}
+	if !r.Since.IsZero() && !r.Until.IsZero() && r.Until.Before(r.Since) {
+		return r, fmt.Errorf("the range ends (%s) before it starts (%s)", formatTime(r.Until), formatTime(r.Since))
+	}
+	return r, nil
+}
+
+// Contains reports whether t is in the range, the start is inclusive and the end isn't
+func (r timeRange) Contains(t time.Time) bool {
+	if !r.Since.IsZero() && t.Before(r.Since) {
+		return false
+	}
+	return r.Until.IsZero() || t.Before(r.Until)
+}
+
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func dirSize(root string, followSymlinks bool) int64 {
 	var totalSize int64
 
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+	err := walkTree(root, followSymlinks, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -144,6 +367,36 @@ func dirSize(root string) int64 {
 
 	return totalSize
 }
+
+// copyFile copies src to a new file at dst, failing if dst exists
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	// archives are big, a clone on the same filesystem saves copying them
+	if cloneFile(out, in) != nil {
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			os.Remove(dst)
+			return err
+		}
+	}
+	return syncedFile{out}.Close()
+}
+
 func fileSize(file string) int64 {
 	info, err := os.Stat(file)
 	if err != nil {
@@ -152,3 +405,111 @@ func fileSize(file string) int64 {
 
 	return info.Size()
 }
+
+// commonParent returns the deepest directory containing all of the given absolute paths
+func commonParent(paths []string) string {
+	parent := filepath.Dir(paths[0])
+	for _, path := range paths[1:] {
+		for !isWithin(path, parent) {
+			next := filepath.Dir(parent)
+			if next == parent {
+				break
+			}
+			parent = next
+		}
+	}
+	return parent
+}
+
+// isWithin reports whether path is dir or somewhere inside of it
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// writeFileAtomic replaces path with data durably: it's written to path.tmp, synced
+// and renamed over path, then the directory is synced so the rename survives a power
+// cut too. some sftp, nfs and smb mounts can't rename over an existing file, there
+// path is moved to path.old first and put back if the rename still fails, and as
+// a last resort path is written in place
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		// path may be the only good copy, eg. backman.key, so it's only moved aside
+		old := path + ".old"
+		if err := os.Rename(path, old); err == nil {
+			if err := os.Rename(tmp, path); err == nil {
+				os.Remove(old)
+				syncDir(filepath.Dir(path))
+				return nil
+			}
+			if err := os.Rename(old, path); err != nil {
+				os.Remove(tmp)
+				return fmt.Errorf("could not replace '%s', the old contents are in '%s': %w", path, old, err)
+			}
+		}
+		os.Remove(tmp)
+		return writeFileSynced(path, data, perm)
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// writeFileSynced writes path in place and syncs it
+func writeFileSynced(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncFile flushes a file written by someone else, eg. gpg, to disk
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncDir makes renames and new files in dir durable. windows and some network
+// filesystems can't sync directories, which is ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/dustin/go-humanize"
+)
+
+// with split_size set archives are written as numbered volumes, <archive>.001,
+// <archive>.002 and so on, each split_size big except the last. ParentPath stays
+// the archive's name without a number, readers go through openArchiveFile which
+// reads the volumes as one file
+
+// volumePath returns the path of the n'th volume of archive, counting from 1
+func volumePath(archive string, n int) string {
+	return fmt.Sprintf("%s.%03d", archive, n)
+}
+
+// archiveVolumes returns the files an archive is stored in: the archive itself, or
+// its volumes. empty if there are neither
+func archiveVolumes(archive string) []string {
+	if _, err := os.Stat(archive); err == nil {
+		return []string{archive}
+	}
+	var volumes []string
+	for n := 1; ; n++ {
+		if _, err := os.Stat(volumePath(archive, n)); err != nil {
+			return volumes
+		}
+		volumes = append(volumes, volumePath(archive, n))
+	}
+}
+
+// archiveSize returns the size of an archive summed over its volumes, -1 if it's missing
+func archiveSize(archive string) int64 {
+	volumes := archiveVolumes(archive)
+	if len(volumes) == 0 {
+		return -1
+	}
+	var size int64
+	for _, volume := range volumes {
+		size += max(fileSize(volume), 0)
+	}
+	return size
+}
+
+// removeArchive deletes an archive or its volumes
+func removeArchive(archive string) {
+	for _, volume := range archiveVolumes(archive) {
+		os.Remove(volume)
+	}
+}
+
+// minSplitSize is the smallest volume size, 1M. sizes are SI like everywhere
+// else ("4G" has to fit FAT32), "1MiB" and the other IEC units work too
+const minSplitSize = 1000 * 1000
+
+// parseSplitSize parses split_size, 0 for archives that aren't split
+func parseSplitSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	size, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid split size %q: %w", s, err)
+	}
+	if size < minSplitSize {
+		return 0, fmt.Errorf("split size %q is %d bytes, volumes need to be at least %d bytes (1M)", s, size, minSplitSize)
+	}
+	return int64(size), nil
+}
+
+// createArchive creates the file an archive is written into, split into volumes of
+// split bytes unless split is 0, and encrypted if encrypt is set
+func createArchive(archive string, split int64) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	if split == 0 {
+		f, err := os.Create(archive)
+		if err != nil {
+			return nil, err
+		}
+		w = syncedFile{f}
+	} else {
+		volumes := &volumeWriter{archive: archive, split: split}
+		if err := volumes.next(); err != nil {
+			return nil, err
+		}
+		w = volumes
+	}
+
+	if !config.Encrypt {
+		return w, nil
+	}
+	enc, err := newEncryptWriter(w)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return enc, nil
+}
+
+// volumeWriter writes into the volumes of an archive, starting the next once one is full
+type volumeWriter struct {
+	archive string
+	split   int64
+	n       int
+	current *os.File
+	written int64
+}
+
+func (w *volumeWriter) next() error {
+	if w.current != nil {
+		if err := (syncedFile{w.current}).Close(); err != nil {
+			return err
+		}
+	}
+	w.n++
+	f, err := os.Create(volumePath(w.archive, w.n))
+	if err != nil {
+		return err
+	}
+	w.current = f
+	w.written = 0
+	return nil
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if w.written == w.split {
+			if err := w.next(); err != nil {
+				return total, err
+			}
+		}
+		chunk := p[:min(int64(len(p)), w.split-w.written)]
+		n, err := w.current.Write(chunk)
+		total += n
+		w.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (w *volumeWriter) Close() error {
+	return syncedFile{w.current}.Close()
+}
+
+// syncedFile is flushed to disk when it's closed, so a finished archive survives a power cut
+type syncedFile struct{ *os.File }
+
+func (f syncedFile) Close() error {
+	err := f.File.Sync()
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// archiveFile reads (and with os.O_RDWR writes) the volumes of an archive as one file
+type archiveFile struct {
+	files []*os.File
+	// how much every volume holds, the biggest volume's size. a damaged volume may be shorter
+	stride int64
+	size   int64
+	reader io.Reader
+}
+
+// openArchiveFile opens the file or volumes of an archive with flag, eg. os.O_RDONLY
+func openArchiveFile(archive string, flag int) (*archiveFile, error) {
+	volumes := archiveVolumes(archive)
+	if len(volumes) == 0 {
+		_, err := os.Stat(archive)
+		return nil, err
+	}
+
+	a := &archiveFile{}
+	var readers []io.Reader
+	for _, volume := range volumes {
+		f, err := os.OpenFile(volume, flag, 0)
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			a.Close()
+			return nil, err
+		}
+		a.files = append(a.files, f)
+		a.size += info.Size()
+		a.stride = max(a.stride, info.Size())
+		readers = append(readers, f)
+	}
+	if len(a.files) == 1 {
+		a.stride = math.MaxInt64
+	}
+	a.reader = io.MultiReader(readers...)
+	return a, nil
+}
+
+// Split reports whether the archive is stored in volumes
+func (a *archiveFile) Split() bool {
+	return len(a.files) > 1
+}
+
+func (a *archiveFile) Size() int64 {
+	return a.size
+}
+
+func (a *archiveFile) Read(p []byte) (int, error) {
+	return a.reader.Read(p)
+}
+
+// ReadAt reads at off of the whole archive. a short volume ends the read with io.EOF
+func (a *archiveFile) ReadAt(p []byte, off int64) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		volume := int(off / a.stride)
+		if volume >= len(a.files) {
+			return total, io.EOF
+		}
+		within := off % a.stride
+		chunk := p[:min(int64(len(p)), a.stride-within)]
+		n, err := a.files[volume].ReadAt(chunk, within)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		p, off = p[n:], off+int64(n)
+	}
+	return total, nil
+}
+
+// WriteAt writes at off of the whole archive, used to repair it
+func (a *archiveFile) WriteAt(p []byte, off int64) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		volume := int(off / a.stride)
+		if volume >= len(a.files) {
+			return total, errors.New("write past the last volume")
+		}
+		within := off % a.stride
+		chunk := p[:min(int64(len(p)), a.stride-within)]
+		n, err := a.files[volume].WriteAt(chunk, within)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		p, off = p[n:], off+int64(n)
+	}
+	return total, nil
+}
+
+// Truncate cuts or pads every volume to the size it has in an archive of size bytes
+func (a *archiveFile) Truncate(size int64) error {
+	for i, f := range a.files {
+		start := int64(i) * a.stride
+		if err := f.Truncate(max(min(a.stride, size-start), 0)); err != nil {
+			return err
+		}
+	}
+	a.size = size
+	return nil
+}
+
+func (a *archiveFile) Close() error {
+	var err error
+	for _, f := range a.files {
+		err = errors.Join(err, f.Close())
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+
+function formatSize(bytes) {
+	let i = 0;
+	while (bytes >= 1024 && i < units.length - 1) {
+		bytes /= 1024;
+		i++;
+	}
+	return `${bytes.toFixed(i ? 1 : 0)} ${units[i]}`;
+}
+
+function showOutput(result) {
+	const output = document.getElementById("output");
+	output.textContent = result.output;
+	output.className = result.ok ? "" : "failed";
+	output.hidden = false;
+}
+
+// the server only runs commands for requests that carry the token of the page it served
+const token = document.querySelector('meta[name="backman-token"]').content;
+
+// run posts to a backman command and shows its output
+async function run(url, body) {
+	document.body.style.cursor = "wait";
+	try {
+		const res = await fetch(url, { method: "POST", body, headers: { "X-Backman-Token": token } });
+		if (!res.ok) {
+			showOutput({ ok: false, output: await res.text() });
+			return;
+		}
+		showOutput(await res.json());
+	} finally {
+		document.body.style.cursor = "";
+		load();
+	}
+}
+
+function button(label, onclick) {
+	const b = document.createElement("button");
+	b.textContent = label;
+	b.onclick = onclick;
+	return b;
+}
+
+async function load() {
+	const res = await fetch("api/backups");
+	const backups = await res.json();
+
+	const total = backups.reduce((sum, b) => sum + b.size, 0);
+	document.getElementById("summary").textContent =
+		`${backups.length} backups, ${formatSize(total)}`;
+
+	const rows = backups.map((b) => {
+		const tr = document.createElement("tr");
+		let of = b.of;
+		if (b.sources && b.sources.length > 1) {
+			of += ` (${b.sources.length} paths)`;
+		}
+		for (const text of [b.id, of, new Date(b.time).toLocaleString(), formatSize(b.size)]) {
+			const td = document.createElement("td");
+			td.textContent = text;
+			tr.append(td);
+		}
+
+		const actions = document.createElement("td");
+		actions.className = "actions";
+		actions.append(
+			button("Restore", () => run(`api/restore/${b.id}`)),
+			button("Delete", () => {
+				if (confirm(`Delete backup ${b.id} of ${b.of}?`)) {
+					run(`api/delete/${b.id}`);
+				}
+			}),
+		);
+		tr.append(actions);
+		return tr;
+	});
+	document.getElementById("backups").replaceChildren(...rows);
+}
+
+document.getElementById("backup").onsubmit = (e) => {
+	e.preventDefault();
+	run("api/backup", new FormData(e.target));
+};
+
+load();
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+)
+
+const xattrSupported = true
+
+// readXattrs returns every extended attribute of path, including POSIX ACLs
+// (system.posix_acl_*). filesystems without xattr support just have none
+func readXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if errors.Is(err, syscall.ENOTSUP) || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]byte, size)
+	size, err = syscall.Listxattr(path, names)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		valueSize, err := syscall.Getxattr(path, string(name), nil)
+		if errors.Is(err, syscall.ENODATA) {
+			// removed in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, valueSize)
+		valueSize, err = syscall.Getxattr(path, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = string(value[:valueSize])
+	}
+	return xattrs, nil
+}
+
+func writeXattr(path, name, value string) error {
+	return syscall.Setxattr(path, name, []byte(value), 0)
+}
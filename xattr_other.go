@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+const xattrSupported = false
+
+var errXattrUnsupported = errors.New("extended attributes are only supported on linux")
+
+func readXattrs(path string) (map[string]string, error) {
+	return nil, errXattrUnsupported
+}
+
+func writeXattr(path, name, value string) error {
+	return errXattrUnsupported
+}